@@ -0,0 +1,84 @@
+package goproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AbortKind is a simulated network error, used to abort an exchange
+// instead of answering the client.
+type AbortKind int
+
+const (
+	// AbortReset resets the client connection (TCP RST).
+	AbortReset AbortKind = iota + 1
+	// AbortClose closes the client connection without sending a response.
+	AbortClose
+	// AbortTimeout never answers, the connection is kept open until the
+	// client gives up.
+	AbortTimeout
+)
+
+// abortTimeoutLimit bounds how long a connection is kept by AbortTimeout.
+const abortTimeoutLimit = 10 * time.Minute
+
+// Abort makes the proxy abort the current exchange with a simulated network
+// error, so that the error handling of clients can be exercised. The
+// returned response must be returned by the handler, to stop the processing
+// of the request; it's never sent to the client.
+//
+//	proxy.OnRequest(goproxy.DstHostIs("flaky.example")).DoFunc(
+//		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//			return req, ctx.Abort(goproxy.AbortReset)
+//		})
+func (ctx *ProxyCtx) Abort(kind AbortKind) *http.Response {
+	ctx.abort = kind
+	return NewResponse(ctx.Req, ContentTypeText, http.StatusBadGateway, "Exchange aborted")
+}
+
+// abortConn applies the simulated error of the exchange to the client
+// connection, that is closed. It reports false when the exchange wasn't
+// aborted.
+func (ctx *ProxyCtx) abortConn(conn net.Conn) bool {
+	raw := conn
+	if peeked, ok := raw.(*peekedConn); ok {
+		raw = peeked.Conn
+	}
+	switch ctx.abort {
+	case AbortReset:
+		ctx.Logf("Resetting client connection")
+		if tcpConn, ok := raw.(*net.TCPConn); ok {
+			// Closing with a zero linger sends RST instead of FIN
+			_ = tcpConn.SetLinger(0)
+		}
+	case AbortTimeout:
+		ctx.Logf("Holding client connection until it gives up")
+		_ = conn.SetReadDeadline(time.Now().Add(abortTimeoutLimit))
+		_, _ = io.Copy(io.Discard, conn)
+	case AbortClose:
+		ctx.Logf("Closing client connection")
+	default:
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// abortHTTP aborts the exchange of a request received by the proxy
+// http.Handler. It reports false when the exchange wasn't aborted.
+func (proxy *ProxyHttpServer) abortHTTP(ctx *ProxyCtx, w http.ResponseWriter) bool {
+	if ctx.abort == 0 {
+		return false
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		// HTTP/2 connections can't be hijacked, the stream is reset instead
+		panic(http.ErrAbortHandler)
+	}
+	conn, err := proxy.hijackConnection(ctx, w)
+	if err != nil {
+		return true
+	}
+	return ctx.abortConn(conn)
+}
@@ -0,0 +1,53 @@
+package goproxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbortExchange(t *testing.T) {
+	testCases := []struct {
+		name string
+		kind goproxy.AbortKind
+		url  string
+	}{
+		{"reset", goproxy.AbortReset, srv.URL},
+		{"close", goproxy.AbortClose, srv.URL},
+		{"timeout", goproxy.AbortTimeout, srv.URL},
+		{"mitm reset", goproxy.AbortReset, https.URL},
+		{"mitm close", goproxy.AbortClose, https.URL},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				return req, ctx.Abort(tc.kind)
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+			client.Timeout = 300 * time.Millisecond
+			client.Transport.(*http.Transport).DisableKeepAlives = true
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, tc.url+"/bobo", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			require.Error(t, err)
+
+			var timeout interface{ Timeout() bool }
+			isTimeout := errors.As(err, &timeout) && timeout.Timeout()
+			assert.Equal(t, tc.kind == goproxy.AbortTimeout, isTimeout, err.Error())
+		})
+	}
+}
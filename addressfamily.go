@@ -0,0 +1,198 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// AddressFamily selects the IP versions of the addresses dialed for the
+// destinations, see ProxyHttpServer.AddressFamily.
+type AddressFamily int
+
+const (
+	// AnyAddressFamily dials the addresses in the order of the resolver,
+	// racing the addresses of the other IP version after FallbackDelay.
+	AnyAddressFamily AddressFamily = iota
+	// PreferIPv6 dials the IPv6 addresses first.
+	PreferIPv6
+	// PreferIPv4 dials the IPv4 addresses first.
+	PreferIPv4
+	// IPv4Only only dials the IPv4 addresses.
+	IPv4Only
+	// IPv6Only only dials the IPv6 addresses.
+	IPv6Only
+)
+
+// defaultFallbackDelay is the Happy Eyeballs delay recommended by RFC 6555,
+// as used by net.Dialer.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// DialPreference overrides the AddressFamily and FallbackDelay of the proxy
+// for some hosts.
+type DialPreference struct {
+	// Hosts are the matched host names, as in UpstreamRoute.Hosts.
+	Hosts         []string
+	AddressFamily AddressFamily
+	FallbackDelay time.Duration
+}
+
+// dialPreference returns the address family and Happy Eyeballs delay of
+// the dials to host, and whether any is configured.
+func (proxy *ProxyHttpServer) dialPreference(host string) (AddressFamily, time.Duration, bool) {
+	family, delay := proxy.AddressFamily, proxy.FallbackDelay
+	configured := family != AnyAddressFamily || delay != 0
+	for i := range proxy.DialPreferences {
+		if matchHosts(proxy.DialPreferences[i].Hosts, host) {
+			family, delay = proxy.DialPreferences[i].AddressFamily, proxy.DialPreferences[i].FallbackDelay
+			configured = true
+			break
+		}
+	}
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+	return family, delay, configured
+}
+
+// resolvesDials tells whether the dials of the transports go through
+// dialResolved, for the proxy to resolve or check their addresses itself.
+func (proxy *ProxyHttpServer) resolvesDials() bool {
+	return proxy.Resolver != nil || proxy.Hosts != nil || proxy.DestinationGuard != nil ||
+		proxy.AddressFamily != AnyAddressFamily || proxy.FallbackDelay != 0 || len(proxy.DialPreferences) > 0
+}
+
+// sortAddressFamilies returns the addresses of ips to dial first, and the
+// ones to race after the fallback delay, as selected by family.
+func sortAddressFamilies(ips []net.IP, family AddressFamily) (primaries, fallbacks []net.IP) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	isPrimary := func(ip net.IP) bool { return (ip.To4() != nil) == (ips[0].To4() != nil) }
+	switch family {
+	case PreferIPv4, IPv4Only:
+		isPrimary = func(ip net.IP) bool { return ip.To4() != nil }
+	case PreferIPv6, IPv6Only:
+		isPrimary = func(ip net.IP) bool { return ip.To4() == nil }
+	}
+	for _, ip := range ips {
+		if isPrimary(ip) {
+			primaries = append(primaries, ip)
+		} else if family != IPv4Only && family != IPv6Only {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial dials the addresses ips on port in order, until one of them
+// answers.
+func dialSerial(
+	c context.Context,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, port string,
+	ips []net.IP,
+) (net.Conn, error) {
+	err := errors.New("no address to dial")
+	for _, ip := range ips {
+		if c.Err() != nil {
+			return nil, c.Err()
+		}
+		var conn net.Conn
+		if conn, err = dial(c, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dialHappyEyeballs dials the primaries, racing the fallbacks once delay
+// elapsed or the primaries failed, as net.Dialer does (RFC 6555). The
+// connection answering first is returned, the other one is closed.
+func dialHappyEyeballs(
+	c context.Context,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, port string,
+	primaries, fallbacks []net.IP,
+	delay time.Duration,
+) (net.Conn, error) {
+	if len(fallbacks) == 0 || delay < 0 {
+		return dialSerial(c, dial, network, port, append(primaries, fallbacks...))
+	}
+	c, cancel := context.WithCancel(c)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	race := func(ips []net.IP, primary bool) {
+		go func() {
+			conn, err := dialSerial(c, dial, network, port, ips)
+			results <- result{conn, err, primary}
+		}()
+	}
+	race(primaries, true)
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var primaryErr error
+	fallbackStarted := false
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				race(fallbacks, false)
+				fallbackStarted, pending = true, pending+1
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// The dialers may ignore the cancellation of their context
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if r.primary {
+				primaryErr = r.err
+			}
+			if !fallbackStarted {
+				race(fallbacks, false)
+				fallbackStarted, pending = true, pending+1
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, r.err
+			}
+		}
+	}
+}
+
+// filterAddressFamily returns the addresses of ips matching the IP version
+// of network, "tcp4" or "tcp6".
+func filterAddressFamily(ips []net.IP, network string) []net.IP {
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
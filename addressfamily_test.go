@@ -0,0 +1,86 @@
+package goproxy_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dualStackResolver resolves every host name to ::1 and 127.0.0.1.
+type dualStackResolver struct{}
+
+func (dualStackResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	return []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+// blackholeIPv6 returns a dialer timing out after 100ms for the IPv6
+// addresses, and sending the dialed addresses to the returned channel.
+func blackholeIPv6() (func(ctx context.Context, network, addr string) (net.Conn, error), chan string) {
+	addrs := make(chan string, 10)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs <- addr
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host).To4() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			return nil, errors.New("blackholed")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}, addrs
+}
+
+func TestAddressFamily(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		family      goproxy.AddressFamily
+		preferences []goproxy.DialPreference
+		status      int
+		dialed      []string
+	}{
+		{"prefer-ipv6", goproxy.PreferIPv6, nil, http.StatusOK, []string{"::1", "127.0.0.1"}},
+		{"ipv4-only", goproxy.IPv4Only, nil, http.StatusOK, []string{"127.0.0.1"}},
+		{"ipv6-only", goproxy.IPv6Only, nil, http.StatusInternalServerError, []string{"::1"}},
+		{
+			"per-host", goproxy.IPv6Only,
+			[]goproxy.DialPreference{{Hosts: []string{"*.test"}, AddressFamily: goproxy.PreferIPv4}},
+			http.StatusOK, []string{"127.0.0.1"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dial, addrs := blackholeIPv6()
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.DialContext = dial
+			proxy.Resolver = dualStackResolver{}
+			proxy.AddressFamily = test.family
+			proxy.FallbackDelay = 20 * time.Millisecond
+			proxy.DialPreferences = test.preferences
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+			u.Host = net.JoinHostPort("backend.test", u.Port())
+			resp, err := client.Get(u.String() + "/bobo")
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode)
+
+			for _, ip := range test.dialed {
+				host, _, err := net.SplitHostPort(<-addrs)
+				require.NoError(t, err)
+				assert.Equal(t, ip, host)
+			}
+		})
+	}
+}
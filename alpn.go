@@ -0,0 +1,81 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// MitmALPN chooses, during the handshake with a MITM'd client, whether
+// http/1.1 is negotiated with it ("" to negotiate no protocol), and the
+// protocols offered to the remote server for the requests of the
+// connection (nil to keep the defaults of Tr). The MITM'd connections only
+// speak HTTP/1.1, another selected protocol is replaced by http/1.1. It
+// allows to test the interoperability of HTTP/1.1 clients with HTTP/2
+// servers:
+//
+//	proxy.MitmALPN = func(ctx *goproxy.ProxyCtx, offered []string) (string, []string) {
+//		return "http/1.1", []string{"h2"}
+//	}
+//
+// ctx is the context of the CONNECT request.
+type MitmALPN func(ctx *ProxyCtx, offered []string) (selected string, upstream []string)
+
+// mitmALPNConfig returns config negotiating the protocol chosen by MitmALPN,
+// storing the protocols to offer upstream in upstream.
+func (proxy *ProxyHttpServer) mitmALPNConfig(ctx *ProxyCtx, config *tls.Config, upstream *[]string) *tls.Config {
+	if proxy.MitmALPN == nil {
+		return config
+	}
+	base := config
+	config = config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		selected, protos := proxy.MitmALPN(ctx, hello.SupportedProtos)
+		*upstream = protos
+
+		negotiated := base
+		if base.GetConfigForClient != nil {
+			c, err := base.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				negotiated = c
+			}
+		}
+		negotiated = negotiated.Clone()
+		negotiated.NextProtos = nil
+		if selected != "" {
+			if selected != "http/1.1" {
+				ctx.Warnf("MitmALPN selected %q, negotiating http/1.1 instead", selected)
+			}
+			negotiated.NextProtos = []string{"http/1.1"}
+		}
+		return negotiated, nil
+	}
+	return config
+}
+
+// withUpstreamALPN makes tr offer the given protocols to the servers.
+func withUpstreamALPN(tr *http.Transport, protos []string) {
+	config := tr.TLSClientConfig
+	if config == nil {
+		config = tlsClientSkipVerify
+	}
+	config = config.Clone()
+	config.NextProtos = protos
+	tr.TLSClientConfig = config
+
+	for _, proto := range protos {
+		if proto == http2.NextProtoTLS {
+			if _, configured := tr.TLSNextProto[http2.NextProtoTLS]; !configured {
+				_, _ = http2.ConfigureTransports(tr)
+			}
+			return
+		}
+	}
+	// Don't speak HTTP/2 on connections that can't negotiate it
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+}
@@ -0,0 +1,70 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmALPN(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	var offered []string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmALPN = func(ctx *goproxy.ProxyCtx, protos []string) (string, []string) {
+		offered = protos
+		return "http/1.1", []string{"h2"}
+	}
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, offered, "h2")
+	// HTTP/1.1 with the client, HTTP/2 with the server
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, "HTTP/2.0", string(body))
+}
+
+func TestMitmALPNOnlyHTTP1(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmALPN = func(ctx *goproxy.ProxyCtx, protos []string) (string, []string) {
+		return "h2", nil
+	}
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, "bobo", string(body))
+}
@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditKind is the kind of an AuditEvent.
+type AuditKind string
+
+const (
+	// AuditChallenge is a client challenged for its credentials.
+	AuditChallenge AuditKind = "challenge"
+	// AuditSuccess is a client authenticated.
+	AuditSuccess AuditKind = "success"
+	// AuditFailure is a client whose credentials were rejected.
+	AuditFailure AuditKind = "failure"
+	// AuditDenied is a request denied by a policy, e.g. a Policy or the
+	// ClientACL of the proxy.
+	AuditDenied AuditKind = "denied"
+)
+
+// AuditEvent is an authentication or authorization decision, see
+// ProxyHttpServer.AuditSink.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Kind AuditKind `json:"kind"`
+	// User is the authenticated user, or the one the credentials claim.
+	User string `json:"user,omitempty"`
+	// Client is the IP address of the client.
+	Client string `json:"client,omitempty"`
+	// Destination is the host, and port, of the request.
+	Destination string `json:"destination,omitempty"`
+	// Scheme is the authentication scheme, e.g. "Basic".
+	Scheme string `json:"scheme,omitempty"`
+	// Rule is the policy rule denying the request, if any.
+	Rule string `json:"rule,omitempty"`
+	// Reason describes the decision.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditSink receives the AuditEvents, see ProxyHttpServer.AuditSink. It's
+// called concurrently.
+type AuditSink interface {
+	Audit(e *AuditEvent)
+}
+
+// AuditSinkFunc is a function implementing AuditSink.
+type AuditSinkFunc func(e *AuditEvent)
+
+func (f AuditSinkFunc) Audit(e *AuditEvent) {
+	f(e)
+}
+
+// JSONAuditSink is an AuditSink writing the events to W, one JSON object
+// per line.
+type JSONAuditSink struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (s *JSONAuditSink) Audit(e *AuditEvent) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.W.Write(append(line, '\n'))
+}
+
+// Audit sends e to the AuditSink of the proxy, if any, completing its
+// time, user, client and destination with the ones of the exchange of
+// ctx.
+func (ctx *ProxyCtx) Audit(e AuditEvent) {
+	if ctx.Proxy == nil || ctx.Proxy.AuditSink == nil {
+		return
+	}
+	if e.User == "" && ctx.User != nil {
+		e.User = ctx.User.Name
+	}
+	ctx.Proxy.audit(&e, ctx.Req)
+}
+
+// audit sends e, about the request req, to the AuditSink of the proxy.
+func (proxy *ProxyHttpServer) audit(e *AuditEvent, req *http.Request) {
+	if proxy.AuditSink == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if req != nil {
+		if e.Client == "" {
+			e.Client = req.RemoteAddr
+			if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				e.Client = host
+			}
+		}
+		if e.Destination == "" {
+			e.Destination = req.URL.Host
+			if e.Destination == "" {
+				e.Destination = req.Host
+			}
+		}
+	}
+	proxy.AuditSink.Audit(e)
+}
@@ -0,0 +1,57 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditSink(t *testing.T) {
+	var log bytes.Buffer
+	acl, err := goproxy.NewClientACL(nil, []string{"192.0.2.0/24"})
+	require.NoError(t, err)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.AuditSink = &goproxy.JSONAuditSink{W: &log}
+	proxy.ClientACL = acl
+	policy := &goproxy.Policy{Rules: []goproxy.PolicyRule{{Name: "bobo", PathPrefix: "/bobo", Action: goproxy.PolicyDeny}}}
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.User = &goproxy.User{Name: "alice"}
+		return req, nil
+	})
+	proxy.OnRequest().Do(policy)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Denied client
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = "192.0.2.1:1234"
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	require.Len(t, lines, 2)
+	var events [2]goproxy.AuditEvent
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &events[i]))
+		assert.False(t, events[i].Time.IsZero())
+		assert.Equal(t, goproxy.AuditDenied, events[i].Kind)
+	}
+	assert.Equal(t, "alice", events[0].User)
+	assert.Equal(t, "127.0.0.1", events[0].Client)
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), events[0].Destination)
+	assert.Equal(t, "bobo", events[0].Rule)
+	assert.Equal(t, "192.0.2.1", events[1].Client)
+	assert.Equal(t, "192.0.2.0/24", events[1].Rule)
+}
@@ -0,0 +1,174 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// MitmBypass is an HttpsHandler deciding which CONNECT requests are
+// intercepted, and which ones are tunneled as is, from a list of rules:
+//
+//	bypass, err := goproxy.NewMitmBypass("bank.example", "*.apple.com", "10.0.0.0/8")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	proxy.OnRequest().HandleConnect(bypass)
+//
+// When the CONNECT request gives an IP address, as in transparent mode,
+// the server name (SNI) sent by the client is checked too, once its
+// ClientHello has been received.
+type MitmBypass struct {
+	// Action is applied to the hosts that aren't bypassed, MitmConnect if
+	// nil.
+	Action *ConnectAction
+	// Func, if set, is called for the hosts not matched by the rules and
+	// reports whether they are bypassed.
+	Func func(host string, ctx *ProxyCtx) bool
+
+	mu        sync.RWMutex
+	hosts     map[string]bool
+	wildcards []string
+	networks  []*net.IPNet
+}
+
+// NewMitmBypass returns a MitmBypass with the given rules, see Add.
+func NewMitmBypass(rules ...string) (*MitmBypass, error) {
+	b := &MitmBypass{}
+	for _, rule := range rules {
+		if err := b.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add adds a bypass rule, either a host name ("example.com"), a wildcard
+// matching all the subdomains of a domain ("*.example.com"), an IP address
+// or a CIDR block ("10.0.0.0/8"). It can be called while the proxy is
+// running.
+func (b *MitmBypass) Add(rule string) error {
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case strings.Contains(rule, "/"):
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			return err
+		}
+		b.networks = append(b.networks, network)
+	case strings.HasPrefix(rule, "*."):
+		b.wildcards = append(b.wildcards, rule[1:])
+	case rule == "" || strings.Contains(rule, "*"):
+		return fmt.Errorf("invalid bypass rule %q", rule)
+	default:
+		if b.hosts == nil {
+			b.hosts = make(map[string]bool)
+		}
+		b.hosts[strings.Trim(rule, "[]")] = true
+	}
+	return nil
+}
+
+// Match reports whether host, with or without port, is bypassed.
+func (b *MitmBypass) Match(host string, ctx *ProxyCtx) bool {
+	host = strings.ToLower(stripPort(host))
+	b.mu.RLock()
+	matched := b.hosts[host]
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range b.networks {
+			matched = matched || network.Contains(ip)
+		}
+	} else {
+		for _, suffix := range b.wildcards {
+			matched = matched || strings.HasSuffix(host, suffix)
+		}
+	}
+	b.mu.RUnlock()
+
+	if !matched && b.Func != nil {
+		matched = b.Func(host, ctx)
+	}
+	return matched
+}
+
+// HandleConnect tunnels the bypassed hosts, and applies Action to the
+// other ones.
+func (b *MitmBypass) HandleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	if b.Match(host, ctx) {
+		return OkConnect, host
+	}
+	action := b.Action
+	if action == nil {
+		action = MitmConnect
+	}
+	if net.ParseIP(stripPort(host)) != nil && action.Bypass == nil {
+		withSNI := *action
+		withSNI.Bypass = func(serverName string, ctx *ProxyCtx) bool {
+			return serverName != "" && b.Match(serverName, ctx)
+		}
+		action = &withSNI
+	}
+	return action, host
+}
+
+// bypassMitm peeks the ClientHello of client, and tunnels the connection
+// to host if todo.Bypass excludes its server name from MITM, or closes it
+// if its ECH policy says so. Otherwise, it returns a connection replaying
+// the peeked data.
+func (proxy *ProxyHttpServer) bypassMitm(ctx *ProxyCtx, todo *ConnectAction, client net.Conn, host string) (net.Conn, bool) {
+	hello, replay, err := peekClientHello(client)
+	if err != nil || hello == nil {
+		return replay, false
+	}
+	switch proxy.echAction(hello, ctx) {
+	case ECHTunnel:
+		ctx.Logf("Tunneling ECH connection to %s (%s)", hello.ServerName, host)
+		proxy.tunnel(ctx, replay, host)
+		return replay, true
+	case ECHReject:
+		ctx.Logf("Rejecting ECH connection to %s (%s)", hello.ServerName, host)
+		_ = replay.Close()
+		return replay, true
+	}
+	if todo.Bypass == nil || !todo.Bypass(hello.ServerName, ctx) {
+		return replay, false
+	}
+	ctx.Logf("Bypassing MITM for %s (%s)", hello.ServerName, host)
+	proxy.tunnel(ctx, replay, host)
+	return replay, true
+}
+
+// tunnel copies the data between client and host until both of them
+// close the connection, propagating half-closes.
+func (proxy *ProxyHttpServer) tunnel(ctx *ProxyCtx, client net.Conn, host string) {
+	target, err := proxy.connectDial(ctx, "tcp", host)
+	if err != nil {
+		ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+		_ = client.Close()
+		return
+	}
+	tracker := proxy.openTunnel(ctx, host)
+	watch := ctx.watchTunnel(host, client, target)
+	done := make(chan struct{})
+	go func() {
+		n, err := copyTunnelOrWarn(ctx, target, client)
+		if err != nil || !closeWrite(target) {
+			_ = target.Close()
+		}
+		tracker.done(n, true)
+		watch.done()
+		close(done)
+	}()
+	n, err := copyTunnelOrWarn(ctx, client, target)
+	if err != nil || !closeWrite(client) {
+		_ = client.Close()
+	}
+	tracker.done(n, false)
+	watch.done()
+	<-done
+	_ = client.Close()
+	_ = target.Close()
+}
@@ -0,0 +1,76 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmBypassMatch(t *testing.T) {
+	bypass, err := goproxy.NewMitmBypass("bank.example", "*.apple.com", "10.0.0.0/8", "::1")
+	require.NoError(t, err)
+	bypass.Func = func(host string, ctx *goproxy.ProxyCtx) bool {
+		return host == "callback.example"
+	}
+
+	for host, want := range map[string]bool{
+		"bank.example:443":     true,
+		"BANK.example":         true,
+		"www.bank.example":     false,
+		"apple.com":            false,
+		"store.apple.com:443":  true,
+		"a.b.apple.com":        true,
+		"10.1.2.3:443":         true,
+		"11.1.2.3:443":         false,
+		"[::1]:443":            true,
+		"callback.example:443": true,
+		"other.example":        false,
+	} {
+		assert.Equal(t, want, bypass.Match(host, nil), host)
+	}
+
+	_, err = goproxy.NewMitmBypass("a*.example")
+	assert.Error(t, err)
+	_, err = goproxy.NewMitmBypass("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestMitmBypassSNI(t *testing.T) {
+	bypass, err := goproxy.NewMitmBypass("bank.example")
+	require.NoError(t, err)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(bypass)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	backendURL, _ := url.Parse(https.URL)
+
+	// issuer returns the issuer of the certificate received when connecting
+	// to the backend IP address with the given SNI
+	issuer := func(serverName string) string {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT "+backendURL.Host+" HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		require.NoError(t, tlsConn.Handshake())
+		return tlsConn.ConnectionState().PeerCertificates[0].Issuer.CommonName
+	}
+
+	assert.Equal(t, goproxy.GoproxyCa.Leaf.Subject.CommonName, issuer("other.example"))
+	assert.NotEqual(t, goproxy.GoproxyCa.Leaf.Subject.CommonName, issuer("bank.example"))
+}
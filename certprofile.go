@@ -0,0 +1,155 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/elazarl/goproxy/internal/signer"
+)
+
+// CAProfile describes a CA generated by GenerateCA.
+type CAProfile struct {
+	// CommonName and Organization are the subject of the CA.
+	CommonName   string
+	Organization []string
+	// KeyType is the key algorithm of the CA, ECDSA P-256 if CertKeyAuto.
+	KeyType CertKeyType
+	// Validity is how long the CA is valid, one year if zero.
+	Validity time.Duration
+	// MaxPathLen is the number of intermediate CAs allowed below the CA,
+	// -1 for no limit.
+	MaxPathLen int
+	// PermittedDNSDomains, ExcludedDNSDomains and PermittedIPRanges are
+	// the name constraints of the CA, limiting the hosts it can sign
+	// certificates for, which makes it less dangerous to trust.
+	PermittedDNSDomains []string
+	ExcludedDNSDomains  []string
+	PermittedIPRanges   []*net.IPNet
+}
+
+// GenerateCA returns a new self-signed CA described by profile, to be
+// used as the MITM CA, e.g. with TLSConfigFromCA.
+func GenerateCA(profile CAProfile) (*tls.Certificate, error) {
+	var key crypto.Signer
+	var err error
+	switch profile.KeyType {
+	case CertKeyAuto, CertKeyECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case CertKeyRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case CertKeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %d", profile.KeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyID := sha1.Sum(publicKey)
+	validity := profile.Validity
+	if validity == 0 {
+		validity = 365 * 24 * time.Hour
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   profile.CommonName,
+			Organization: profile.Organization,
+		},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		SubjectKeyId: subjectKeyID[:],
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            profile.MaxPathLen,
+		MaxPathLenZero:        profile.MaxPathLen == 0,
+
+		PermittedDNSDomains: profile.PermittedDNSDomains,
+		ExcludedDNSDomains:  profile.ExcludedDNSDomains,
+		PermittedIPRanges:   profile.PermittedIPRanges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// EncodeCA returns the PEM encoding of the certificate and of the private
+// key of ca, e.g. to save a CA made by GenerateCA for tls.X509KeyPair.
+func EncodeCA(ca *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	key, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return certPEM, keyPEM, nil
+}
+
+// LeafProfile customizes the certificates generated by TLSConfigFromCA.
+// The zero values keep the defaults.
+type LeafProfile struct {
+	// Backdate is how long before now the certificates become valid, 30
+	// days by default, to tolerate the clients with a late clock.
+	Backdate time.Duration
+	// Validity is how long after now the certificates stay valid, 365
+	// days by default. Certificates cached in the proxy CertStore may
+	// outlive a short validity.
+	Validity time.Duration
+	// Organization is the organization of the certificate subjects.
+	Organization []string
+	// KeyUsage and ExtKeyUsage replace the default key usages (digital
+	// signature, plus key encipherment for RSA keys, and server auth).
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	// IPAddressesAsDNSNames also lists the IP addresses as DNS names, for
+	// the clients that don't match the IP address SANs.
+	IPAddressesAsDNSNames bool
+	// OmitCommonName leaves the common name of the subjects empty, the
+	// host names (and wildcards) being only listed in the SANs.
+	OmitCommonName bool
+}
+
+// apply sets the options of the signer from the profile.
+func (p *LeafProfile) apply(opts *signer.Options) {
+	if p == nil {
+		return
+	}
+	opts.Backdate = p.Backdate
+	opts.Validity = p.Validity
+	opts.Organization = p.Organization
+	opts.KeyUsage = p.KeyUsage
+	opts.ExtKeyUsage = p.ExtKeyUsage
+	opts.IPAddressesAsDNSNames = p.IPAddressesAsDNSNames
+	opts.OmitCommonName = p.OmitCommonName
+}
@@ -0,0 +1,95 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func leafFor(t *testing.T, proxy *goproxy.ProxyHttpServer, ca *tls.Certificate, host string) *x509.Certificate {
+	t.Helper()
+	config, err := goproxy.TLSConfigFromCA(ca)(host, &goproxy.ProxyCtx{Proxy: proxy})
+	require.NoError(t, err)
+	require.Len(t, config.Certificates, 1)
+	return config.Certificates[0].Leaf
+}
+
+func TestGenerateCA(t *testing.T) {
+	ca, err := goproxy.GenerateCA(goproxy.CAProfile{
+		CommonName:          "test CA",
+		Validity:            time.Hour,
+		PermittedDNSDomains: []string{"example.com"},
+	})
+	require.NoError(t, err)
+	assert.True(t, ca.Leaf.IsCA)
+	assert.True(t, ca.Leaf.MaxPathLenZero)
+	assert.Equal(t, "test CA", ca.Leaf.Subject.CommonName)
+
+	certPEM, keyPEM, err := goproxy.EncodeCA(ca)
+	require.NoError(t, err)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	proxy := goproxy.NewProxyHttpServer()
+	_, err = leafFor(t, proxy, ca, "www.example.com:443").Verify(x509.VerifyOptions{Roots: roots, DNSName: "www.example.com"})
+	assert.NoError(t, err)
+	// The name constraints prevent the CA from being used for other hosts
+	_, err = leafFor(t, proxy, ca, "www.example.org:443").Verify(x509.VerifyOptions{Roots: roots, DNSName: "www.example.org"})
+	assert.Error(t, err)
+}
+
+func TestLeafProfile(t *testing.T) {
+	ca, err := goproxy.GenerateCA(goproxy.CAProfile{CommonName: "test CA", KeyType: goproxy.CertKeyRSA})
+	require.NoError(t, err)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.LeafProfile = &goproxy.LeafProfile{
+		Backdate:              time.Hour,
+		Validity:              24 * time.Hour,
+		IPAddressesAsDNSNames: true,
+		OmitCommonName:        true,
+	}
+	leaf := leafFor(t, proxy, ca, "10.0.0.1:443")
+	assert.Empty(t, leaf.Subject.CommonName)
+	assert.Equal(t, []string{"10.0.0.1"}, leaf.DNSNames)
+	require.Len(t, leaf.IPAddresses, 1)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), leaf.NotAfter, time.Minute)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), leaf.NotBefore, time.Minute)
+	assert.Equal(t, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, leaf.KeyUsage)
+}
+
+func TestSetCA(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = goproxy.NewCertStorage(goproxy.NewLRUCertCache(10))
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	var issuers []string
+	client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		issuers = append(issuers, state.PeerCertificates[0].Issuer.CommonName)
+		return nil
+	}
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	rotated, err := goproxy.GenerateCA(goproxy.CAProfile{CommonName: "rotated CA"})
+	require.NoError(t, err)
+	getOrFail(t, https.URL+"/bobo", client)
+	proxy.SetCA(rotated)
+	getOrFail(t, https.URL+"/bobo", client)
+	proxy.SetCA(nil)
+	getOrFail(t, https.URL+"/bobo", client)
+
+	require.Len(t, issuers, 3)
+	assert.Equal(t, goproxy.GoproxyCa.Leaf.Subject.CommonName, issuers[0])
+	assert.Equal(t, "rotated CA", issuers[1])
+	assert.Equal(t, issuers[0], issuers[2])
+}
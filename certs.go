@@ -23,6 +23,40 @@ func init() {
 	}
 }
 
+// CertKeyType is the key algorithm of the certificates generated for MITM.
+type CertKeyType int
+
+const (
+	// CertKeyAuto uses the algorithm of the CA key. This is the default.
+	CertKeyAuto CertKeyType = iota
+	// CertKeyRSA generates 2048 bits RSA keys.
+	CertKeyRSA
+	// CertKeyECDSA generates ECDSA P-256 keys, which are much faster to
+	// generate and to handshake with than RSA keys.
+	CertKeyECDSA
+	// CertKeyEd25519 generates Ed25519 keys. Most browsers don't accept
+	// them yet.
+	CertKeyEd25519
+)
+
+// CASelector returns the CA used to sign the MITM certificate of host.
+type CASelector func(host string, ctx *ProxyCtx) (*tls.Certificate, error)
+
+// SetCA replaces the CA signing the certificates generated by
+// TLSConfigFromCA, while the proxy is running, e.g. to rotate short-lived
+// CAs. The connections already established keep their certificates, and
+// the certificates of the previous CA kept in CertStore aren't used
+// anymore. A nil ca restores the CA given to TLSConfigFromCA. The CA
+// returned by CASelector still takes precedence.
+func (proxy *ProxyHttpServer) SetCA(ca *tls.Certificate) {
+	proxy.ca.Store(ca)
+}
+
+// CA returns the CA set by SetCA, nil if none.
+func (proxy *ProxyHttpServer) CA() *tls.Certificate {
+	return proxy.ca.Load()
+}
+
 var tlsClientSkipVerify = &tls.Config{InsecureSkipVerify: true}
 
 var defaultTLSConfig = &tls.Config{
@@ -0,0 +1,228 @@
+package goproxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertCache is a storage of generated MITM certificates, indexed by host.
+// Implementations must be safe for concurrent use.
+type CertCache interface {
+	// Get returns the certificate stored for host, if any.
+	Get(host string) (*tls.Certificate, bool)
+	// Put stores the certificate of host.
+	Put(host string, cert *tls.Certificate) error
+}
+
+// NewCertStorage returns a CertStorage looking up certificates in caches,
+// in order. A certificate found in a cache is copied to the previous ones,
+// so that a fast in-memory cache can be placed in front of a persistent one:
+//
+//	disk, err := goproxy.NewDiskCertCache("/var/cache/goproxy")
+//	...
+//	proxy.CertStore = goproxy.NewCertStorage(goproxy.NewLRUCertCache(1000), disk)
+//
+// Expired certificates are ignored, and concurrent requests for the same
+// missing host wait for a single certificate generation.
+func NewCertStorage(caches ...CertCache) CertStorage {
+	return &tieredCertStorage{caches: caches, calls: make(map[string]*certCall)}
+}
+
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+type tieredCertStorage struct {
+	caches []CertCache
+
+	mu    sync.Mutex
+	calls map[string]*certCall
+}
+
+func (s *tieredCertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert, ok := s.lookup(hostname); ok {
+		return cert, nil
+	}
+
+	s.mu.Lock()
+	if call, ok := s.calls[hostname]; ok {
+		s.mu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	s.calls[hostname] = call
+	s.mu.Unlock()
+
+	call.cert, call.err = gen()
+	if call.err == nil {
+		for _, cache := range s.caches {
+			// A failure to persist the certificate isn't fatal
+			_ = cache.Put(hostname, call.cert)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.calls, hostname)
+	s.mu.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
+
+func (s *tieredCertStorage) lookup(hostname string) (*tls.Certificate, bool) {
+	for i, cache := range s.caches {
+		cert, ok := cache.Get(hostname)
+		if !ok || !certValid(cert) {
+			continue
+		}
+		for _, previous := range s.caches[:i] {
+			_ = previous.Put(hostname, cert)
+		}
+		return cert, true
+	}
+	return nil, false
+}
+
+func certValid(cert *tls.Certificate) bool {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return false
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false
+		}
+	}
+	return time.Now().Before(leaf.NotAfter)
+}
+
+// LRUCertCache is an in-memory CertCache keeping the most recently used
+// certificates.
+type LRUCertCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruCertEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// NewLRUCertCache returns a cache holding at most size certificates.
+func NewLRUCertCache(size int) *LRUCertCache {
+	return &LRUCertCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *LRUCertCache) Get(host string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruCertEntry).cert, true
+}
+
+func (c *LRUCertCache) Put(host string, cert *tls.Certificate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[host]; ok {
+		elem.Value.(*lruCertEntry).cert = cert
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.entries[host] = c.order.PushFront(&lruCertEntry{host: host, cert: cert})
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCertEntry).host)
+	}
+	return nil
+}
+
+// DiskCertCache is a CertCache storing each certificate and its private key
+// in a PEM file, so that they survive restarts of the proxy.
+// Since certificates are stored by host only, a directory must not be shared
+// between proxies using different CAs.
+type DiskCertCache struct {
+	dir string
+}
+
+// NewDiskCertCache returns a cache storing the certificates in dir,
+// which is created if needed.
+func NewDiskCertCache(dir string) (*DiskCertCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskCertCache{dir: dir}, nil
+}
+
+func (c *DiskCertCache) path(host string) string {
+	name := strings.ToLower(host)
+	if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789.-") != "" || strings.HasPrefix(name, ".") {
+		name = "x-" + hex.EncodeToString([]byte(host))
+	}
+	return filepath.Join(c.dir, name+".pem")
+}
+
+func (c *DiskCertCache) Get(host string) (*tls.Certificate, bool) {
+	data, err := os.ReadFile(c.path(host))
+	if err != nil {
+		return nil, false
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, false
+	}
+	return &cert, true
+}
+
+func (c *DiskCertCache) Put(host string, cert *tls.Certificate) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+	var data []byte
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+
+	// Write to a temporary file first, so that readers never see a partial file
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(host))
+}
@@ -0,0 +1,88 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCertCache(t *testing.T) {
+	cache := goproxy.NewLRUCertCache(2)
+	a, b, c := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	require.NoError(t, cache.Put("a", a))
+	require.NoError(t, cache.Put("b", b))
+	// Use a, so that b is the least recently used
+	got, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Same(t, a, got)
+	require.NoError(t, cache.Put("c", c))
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	_, ok = cache.Get("a")
+	assert.True(t, ok)
+	_, ok = cache.Get("c")
+	assert.True(t, ok)
+}
+
+func TestDiskCertCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := goproxy.NewDiskCertCache(dir)
+	require.NoError(t, err)
+
+	_, ok := cache.Get("example.com")
+	assert.False(t, ok)
+	require.NoError(t, cache.Put("example.com", &goproxy.GoproxyCa))
+	require.NoError(t, cache.Put("[::1]", &goproxy.GoproxyCa))
+
+	// A new cache on the same directory finds the certificates
+	cache, err = goproxy.NewDiskCertCache(dir)
+	require.NoError(t, err)
+	for _, host := range []string{"example.com", "[::1]"} {
+		cert, ok := cache.Get(host)
+		require.True(t, ok, host)
+		assert.Equal(t, goproxy.GoproxyCa.Certificate, cert.Certificate)
+	}
+}
+
+func TestCertStorageSingleGeneration(t *testing.T) {
+	memory := goproxy.NewLRUCertCache(10)
+	disk, err := goproxy.NewDiskCertCache(t.TempDir())
+	require.NoError(t, err)
+	store := goproxy.NewCertStorage(memory, disk)
+
+	var generated int32
+	gen := func() (*tls.Certificate, error) {
+		atomic.AddInt32(&generated, 1)
+		time.Sleep(50 * time.Millisecond)
+		return &goproxy.GoproxyCa, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := store.Fetch("example.com", gen)
+			assert.NoError(t, err)
+			assert.NotNil(t, cert)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&generated))
+
+	// After a restart, the certificate is loaded from the disk
+	memory = goproxy.NewLRUCertCache(10)
+	store = goproxy.NewCertStorage(memory, disk)
+	_, err = store.Fetch("example.com", gen)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&generated))
+	_, ok := memory.Get("example.com")
+	assert.True(t, ok, "certificate wasn't copied to the memory cache")
+}
@@ -0,0 +1,218 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the error of the exchanges refused by a CircuitBreaker.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState is the state of the circuit of a host, see
+// CircuitBreaker.State.
+type CircuitState int
+
+const (
+	// CircuitClosed lets the exchanges through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen refuses the exchanges.
+	CircuitOpen
+	// CircuitHalfOpen lets a single exchange through, probing the
+	// recovery of the host.
+	CircuitHalfOpen
+)
+
+// CircuitBreaker stops sending the exchanges to the destinations failing
+// repeatedly, so that a dead backend doesn't tie up the proxy. After
+// Failures consecutive failures, the circuit of a host opens: its
+// requests are answered by the proxy and its tunnels refused, for
+// OpenFor. A single exchange then probes the host, closing the circuit if
+// it succeeds, opening it again otherwise.
+//
+//	proxy.CircuitBreaker = goproxy.NewCircuitBreaker(5, 30*time.Second)
+//
+// It applies to the plain and MITM'd requests, and to the dials of the
+// accepted CONNECT tunnels. The circuits left alone for OpenFor after
+// closing or expiring are forgotten.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures opening the circuit
+	// of a host, 5 if zero.
+	Failures int
+	// OpenFor is how long the circuit of a host stays open before being
+	// probed, 30 seconds if zero.
+	OpenFor time.Duration
+	// IsFailure tells whether an exchange failed, given its response or
+	// error. If nil, the errors and the 502, 503 and 504 responses are
+	// failures.
+	IsFailure func(resp *http.Response, err error) bool
+	// Response, if set, returns the response to the requests refused by
+	// the breaker, instead of a 503 response.
+	Response func(req *http.Request, ctx *ProxyCtx) *http.Response
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	swept    time.Time
+}
+
+type circuit struct {
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+	probing     bool
+}
+
+// NewCircuitBreaker returns a CircuitBreaker opening the circuit of a host
+// for openFor after failures consecutive failures.
+func NewCircuitBreaker(failures int, openFor time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Failures: failures, OpenFor: openFor}
+}
+
+func circuitKey(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// State returns the state of the circuit of host.
+func (b *CircuitBreaker) State(host string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[circuitKey(host)]
+	switch {
+	case c == nil || c.openUntil.IsZero():
+		return CircuitClosed
+	case c.probing || time.Now().After(c.openUntil):
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
+
+// allow tells whether an exchange with host is let through.
+func (b *CircuitBreaker) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[circuitKey(host)]
+	switch {
+	case c == nil || c.openUntil.IsZero():
+		return true
+	case c.probing || time.Now().Before(c.openUntil):
+		return false
+	default:
+		c.probing = true
+		return true
+	}
+}
+
+// record records the outcome of an exchange let through by allow: a
+// success, a failure, or neither when the client gave up.
+func (b *CircuitBreaker) record(host string, success, failure bool) {
+	key := circuitKey(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuits[key]
+	switch {
+	case success:
+		delete(b.circuits, key)
+	case failure:
+		if c == nil {
+			if b.circuits == nil {
+				b.circuits = make(map[string]*circuit)
+			}
+			c = &circuit{}
+			b.circuits[key] = c
+		}
+		now := time.Now()
+		c.failures++
+		c.lastFailure = now
+		threshold := b.Failures
+		if threshold <= 0 {
+			threshold = 5
+		}
+		if c.probing || c.failures >= threshold {
+			c.openUntil = now.Add(b.openFor())
+		}
+		c.probing = false
+		b.sweep(now)
+	case c != nil:
+		c.probing = false
+	}
+}
+
+func (b *CircuitBreaker) openFor() time.Duration {
+	if b.OpenFor <= 0 {
+		return 30 * time.Second
+	}
+	return b.OpenFor
+}
+
+// sweep forgets the circuits without a failure for OpenFor that are closed
+// or expired for as long, at most once per OpenFor.
+func (b *CircuitBreaker) sweep(now time.Time) {
+	idle := now.Add(-b.openFor())
+	if b.swept.After(idle) {
+		return
+	}
+	b.swept = now
+	for key, c := range b.circuits {
+		if c.probing || c.lastFailure.After(idle) || c.openUntil.After(idle) {
+			continue
+		}
+		delete(b.circuits, key)
+	}
+}
+
+func (b *CircuitBreaker) isFailure(resp *http.Response, err error) bool {
+	if b.IsFailure != nil {
+		return b.IsFailure(resp, err)
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// roundTrip sends req with send, unless the circuit of its host is open.
+func (b *CircuitBreaker) roundTrip(
+	ctx *ProxyCtx,
+	req *http.Request,
+	send func(req *http.Request) (*http.Response, error),
+) (*http.Response, error) {
+	host := req.URL.Host
+	if !b.allow(host) {
+		ctx.Logf("Circuit of %s open, refusing %s %v", host, req.Method, req.URL)
+		if b.Response != nil {
+			if resp := b.Response(req, ctx); resp != nil {
+				return resp, nil
+			}
+		}
+		return NewResponse(req, ContentTypeText, http.StatusServiceUnavailable,
+			fmt.Sprintf("%s: %s", ErrCircuitOpen, circuitKey(host))), nil
+	}
+	resp, err := send(req)
+	gaveUp := err != nil && req.Context().Err() != nil
+	failure := !gaveUp && b.isFailure(resp, err)
+	b.record(host, !gaveUp && !failure, failure)
+	return resp, err
+}
+
+// dial dials host with dial, unless its circuit is open.
+func (b *CircuitBreaker) dial(host string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if !b.allow(host) {
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, circuitKey(host))
+	}
+	conn, err := dial()
+	failure := err != nil && (b.IsFailure == nil || b.IsFailure(nil, err))
+	b.record(host, err == nil, failure)
+	return conn, err
+}
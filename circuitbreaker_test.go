@@ -0,0 +1,101 @@
+package goproxy_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	var healthy atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("bobo"))
+	}))
+	defer backend.Close()
+	breaker := goproxy.NewCircuitBreaker(2, 50*time.Millisecond)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CircuitBreaker = breaker
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	get := func() (int, string) {
+		resp, err := client.Get(backend.URL + "/bobo")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	for i := 0; i < 4; i++ {
+		status, _ := get()
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	}
+	assert.Equal(t, int32(2), hits.Load(), "the requests are refused once the circuit is open")
+	assert.Equal(t, goproxy.CircuitOpen, breaker.State(backend.Listener.Addr().String()))
+	_, body := get()
+	assert.Contains(t, body, goproxy.ErrCircuitOpen.Error())
+
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, goproxy.CircuitHalfOpen, breaker.State(backend.Listener.Addr().String()))
+	status, body := get()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "bobo", body)
+	assert.Equal(t, goproxy.CircuitClosed, breaker.State(backend.Listener.Addr().String()))
+}
+
+func TestCircuitBreakerTunnel(t *testing.T) {
+	var dials atomic.Int32
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CircuitBreaker = goproxy.NewCircuitBreaker(1, time.Minute)
+	proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New("connection refused")
+	}
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(https.URL + "/bobo")
+		require.Error(t, err)
+	}
+	assert.Equal(t, int32(1), dials.Load())
+}
+
+func TestCircuitBreakerForgetsIdleCircuits(t *testing.T) {
+	breaker := goproxy.NewCircuitBreaker(1, 20*time.Millisecond)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CircuitBreaker = breaker
+	proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	_, err := client.Get("https://a.test/bobo")
+	require.Error(t, err)
+	assert.Equal(t, goproxy.CircuitOpen, breaker.State("a.test:443"))
+
+	// The failures of another host sweep the circuit left alone
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, goproxy.CircuitHalfOpen, breaker.State("a.test:443"))
+	_, err = client.Get("https://b.test/bobo")
+	require.Error(t, err)
+	assert.Equal(t, goproxy.CircuitClosed, breaker.State("a.test:443"))
+	assert.Equal(t, goproxy.CircuitOpen, breaker.State("b.test:443"))
+}
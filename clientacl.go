@@ -0,0 +1,161 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ClientACL accepts or rejects the clients of the proxy by their IP
+// address, before any processing of their requests, see
+// ProxyHttpServer.ClientACL:
+//
+//	acl, err := goproxy.NewClientACL([]string{"10.0.0.0/8"}, []string{"10.66.0.0/16"})
+//
+// The denied networks take precedence over the allowed ones, and all the
+// clients which aren't denied are allowed when no network is allowed. The
+// lists can be replaced by Update while the proxy is serving, e.g. when
+// its configuration file changes.
+type ClientACL struct {
+	// Response, if set, returns the response to the requests of the
+	// rejected clients, instead of a 403 Forbidden response.
+	Response func(req *http.Request) *http.Response
+	// Audit, if set, is called with the decision taken for every request.
+	Audit func(e ClientACLEvent)
+
+	rules atomic.Pointer[clientACLRules]
+}
+
+type clientACLRules struct {
+	allow, deny []*net.IPNet
+}
+
+// ClientACLEvent is the decision of a ClientACL for a request.
+type ClientACLEvent struct {
+	Time     time.Time
+	Request  *http.Request
+	ClientIP net.IP
+	Allowed  bool
+	// Rule is the allowed or denied network matching the client, if any.
+	Rule string
+}
+
+// NewClientACL returns a ClientACL allowing the clients of the allow
+// networks, but the ones of the deny networks: CIDRs, or IP addresses.
+func NewClientACL(allow, deny []string) (*ClientACL, error) {
+	acl := &ClientACL{}
+	if err := acl.Update(allow, deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Update replaces the networks of the ACL, which are left unchanged if
+// one of them is invalid.
+func (a *ClientACL) Update(allow, deny []string) error {
+	var rules clientACLRules
+	var err error
+	if rules.allow, err = parseNetworks(allow); err != nil {
+		return err
+	}
+	if rules.deny, err = parseNetworks(deny); err != nil {
+		return err
+	}
+	a.rules.Store(&rules)
+	return nil
+}
+
+// parseNetworks parses the CIDRs or IP addresses of networks.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network %q: %w", network, err)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// Allowed tells whether the client at ip is allowed, and returns the
+// network of the ACL that matched it, if any.
+func (a *ClientACL) Allowed(ip net.IP) (bool, string) {
+	rules := a.rules.Load()
+	if rules == nil {
+		return true, ""
+	}
+	if ip == nil {
+		return len(rules.allow) == 0, ""
+	}
+	for _, n := range rules.deny {
+		if n.Contains(ip) {
+			return false, n.String()
+		}
+	}
+	for _, n := range rules.allow {
+		if n.Contains(ip) {
+			return true, n.String()
+		}
+	}
+	return len(rules.allow) == 0, ""
+}
+
+// admit tells whether the client of r is allowed, answering its request
+// otherwise.
+func (a *ClientACL) admit(proxy *ProxyHttpServer, w http.ResponseWriter, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	allowed, rule := a.Allowed(ip)
+	if a.Audit != nil {
+		a.Audit(ClientACLEvent{Time: time.Now(), Request: r, ClientIP: ip, Allowed: allowed, Rule: rule})
+	}
+	if allowed {
+		return true
+	}
+	proxy.audit(&AuditEvent{Kind: AuditDenied, Rule: rule, Reason: "client address not allowed"}, r)
+	var resp *http.Response
+	if a.Response != nil {
+		resp = a.Response(r)
+	}
+	if resp == nil {
+		resp = NewResponse(r, ContentTypeText, http.StatusForbidden, "Forbidden client address")
+		resp = proxy.applyErrorPage(resp, r, "", "client address not allowed")
+	}
+	if cw, ok := w.(*connectResponseWriter); ok {
+		// The SOCKS and transparent clients have no HTTP response writer,
+		// the response is written to their connection and replied as in
+		// ConnectReject.
+		if err := resp.Write(cw); err != nil {
+			proxy.Logger.Printf("WARN: Cannot write response to denied client %s: %v", r.RemoteAddr, err)
+		}
+		_ = cw.Close()
+		return false
+	}
+	copyHeaders(w.Header(), resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		_, _ = io.Copy(w, resp.Body)
+		_ = resp.Body.Close()
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientACL(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed bool
+		rule    string
+	}{
+		{"no-rule", nil, nil, true, ""},
+		{"allowed", []string{"10.0.0.0/8", "127.0.0.0/8"}, nil, true, "127.0.0.0/8"},
+		{"not-allowed", []string{"10.0.0.0/8"}, nil, false, ""},
+		{"denied", nil, []string{"127.0.0.1"}, false, "127.0.0.1/32"},
+		{"denied-first", []string{"127.0.0.0/8"}, []string{"127.0.0.1/32"}, false, "127.0.0.1/32"},
+	} {
+		for _, tunnel := range []bool{false, true} {
+			name := test.name + "-http"
+			if tunnel {
+				name = test.name + "-tunnel"
+			}
+			t.Run(name, func(t *testing.T) {
+				acl, err := goproxy.NewClientACL(test.allow, test.deny)
+				require.NoError(t, err)
+				var mu sync.Mutex
+				var events []goproxy.ClientACLEvent
+				acl.Audit = func(e goproxy.ClientACLEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, e)
+				}
+				proxy := goproxy.NewProxyHttpServer()
+				proxy.ClientACL = acl
+				handled := false
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					handled = true
+					return goproxy.OkConnect, host
+				})
+				proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+					handled = true
+					return req, nil
+				})
+				client, s := oneShotProxy(proxy)
+				defer s.Close()
+
+				backend := srv.URL
+				if tunnel {
+					backend = https.URL
+				}
+				resp, err := client.Get(backend + "/bobo")
+				if test.allowed {
+					require.NoError(t, err)
+					resp.Body.Close()
+					assert.Equal(t, http.StatusOK, resp.StatusCode)
+				} else if tunnel {
+					assert.Error(t, err)
+				} else {
+					require.NoError(t, err)
+					resp.Body.Close()
+					assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+				}
+				assert.Equal(t, test.allowed, handled)
+
+				mu.Lock()
+				defer mu.Unlock()
+				require.NotEmpty(t, events)
+				assert.Equal(t, test.allowed, events[0].Allowed)
+				assert.Equal(t, test.rule, events[0].Rule)
+				assert.Equal(t, "127.0.0.1", events[0].ClientIP.String())
+			})
+		}
+	}
+}
+
+func TestClientACLUpdate(t *testing.T) {
+	acl, err := goproxy.NewClientACL(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	acl.Response = func(req *http.Request) *http.Response {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusUnauthorized, "go away")
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientACL = acl
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "go away", string(getOrFail(t, srv.URL+"/bobo", client)))
+
+	assert.Error(t, acl.Update([]string{"127.0.0.0/33"}, nil))
+	assert.Equal(t, "go away", string(getOrFail(t, srv.URL+"/bobo", client)))
+
+	require.NoError(t, acl.Update([]string{"::1", "127.0.0.1"}, nil))
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+}
+
+func TestClientACLSOCKS(t *testing.T) {
+	acl, err := goproxy.NewClientACL(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientACL = acl
+	proxy.ConnectDial = nil
+	client := socksClient(t, socksProxy(t, proxy), nil)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/bobo", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+
+	require.NoError(t, acl.Update(nil, nil))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", string(body))
+}
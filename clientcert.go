@@ -0,0 +1,30 @@
+package goproxy
+
+import (
+	"crypto/tls"
+)
+
+// upstreamClientCertificate returns the client certificate presented to
+// the remote server hostname, nil if none.
+func (ctx *ProxyCtx) upstreamClientCertificate(hostname string) *tls.Certificate {
+	if ctx.ClientCertificate != nil {
+		return ctx.ClientCertificate
+	}
+	if ctx.Proxy != nil {
+		return ctx.Proxy.ClientCertificates[hostname]
+	}
+	return nil
+}
+
+// withClientCertificate returns config presenting cert to the server.
+func withClientCertificate(config *tls.Config, cert *tls.Certificate) *tls.Config {
+	if cert == nil {
+		return config
+	}
+	config = config.Clone()
+	config.Certificates = nil
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}
+	return config
+}
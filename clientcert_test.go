@@ -0,0 +1,80 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	hostCert := newTestCA(t)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientCertificates = map[string]*tls.Certificate{backendURL.Hostname(): hostCert}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.Header.Get("X-No-Cert") != "" {
+			ctx.ClientCertificate = &tls.Certificate{}
+		}
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "goproxy test CA", string(getOrFail(t, backend.URL, client)))
+
+	// An empty certificate set by a handler overrides the one of the host
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-No-Cert", "1")
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestMitmClientAuth(t *testing.T) {
+	clientCert := newTestCA(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmClientAuth = tls.RequireAnyClientCert
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if len(ctx.PeerCertificates) == 0 {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "no certificate")
+		}
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, ctx.PeerCertificates[0].Subject.CommonName)
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	// The handshake fails without a certificate
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+
+	tr := client.Transport.(*http.Transport)
+	tr.TLSClientConfig.Certificates = []tls.Certificate{*clientCert}
+	tr.CloseIdleConnections()
+	assert.Equal(t, "goproxy test CA", string(getOrFail(t, https.URL, client)))
+}
@@ -0,0 +1,420 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	handshakeTypeClientHello = 1
+
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionECPointFormats      = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+	extensionECH                 = 0xfe0d
+
+	// maxClientHelloSize bounds the bytes recorded while waiting for the
+	// ClientHello.
+	maxClientHelloSize = 64 << 10
+)
+
+var errInvalidClientHello = errors.New("invalid ClientHello")
+
+// ClientHello is the TLS ClientHello sent by a MITM'd client, with its
+// JA3 and JA4 fingerprints, so that the TLS stack of clients can be
+// identified (e.g. to tell browsers from automation tools).
+type ClientHello struct {
+	// Raw is the ClientHello handshake message, as reassembled from the
+	// TLS records (without the record headers).
+	Raw []byte
+	// JA3 is the JA3 string of the ClientHello, and JA3Hash its MD5 hash,
+	// the usual form of JA3 fingerprints.
+	JA3     string
+	JA3Hash string
+	// JA4 is the JA4 fingerprint of the ClientHello, e.g.
+	// "t13d1516h2_8daaf6152771_02713d6af862".
+	JA4 string
+	// ServerName is the server name (SNI) requested by the client, empty
+	// if none.
+	ServerName string
+	// ECH reports whether the client offered Encrypted Client Hello,
+	// ServerName is then the public name of the client-facing server
+	// rather than the host the client is connecting to. Clients send
+	// GREASE ECH extensions too, which can't be told from real ones.
+	ECH bool
+}
+
+// ParseClientHello parses a ClientHello handshake message and computes its
+// fingerprints.
+func ParseClientHello(raw []byte) (*ClientHello, error) {
+	h, err := parseHelloFields(raw)
+	if err != nil {
+		return nil, err
+	}
+	ja3 := h.ja3()
+	sum := md5.Sum([]byte(ja3))
+	return &ClientHello{
+		Raw:     raw,
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(sum[:]),
+		JA4:     h.ja4(),
+
+		ServerName: h.serverName,
+		ECH:        h.ech,
+	}, nil
+}
+
+// helloFields holds the ClientHello fields used by the fingerprints, GREASE
+// values excluded.
+type helloFields struct {
+	version       uint16
+	ciphers       []uint16
+	extensions    []uint16
+	curves        []uint16
+	pointFormats  []uint8
+	sigAlgs       []uint16
+	versions      []uint16
+	alpn          string
+	hasServerName bool
+	serverName    string
+	ech           bool
+}
+
+// isGREASE reports whether v is one of the values reserved by RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloReader reads the big-endian fields of a ClientHello.
+type helloReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *helloReader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *helloReader) uint24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// uint16s reads a list of uint16 of n bytes, without the GREASE values.
+func (r *helloReader) uint16s(n int) []uint16 {
+	b := r.bytes(n)
+	var values []uint16
+	for ; len(b) >= 2; b = b[2:] {
+		if v := binary.BigEndian.Uint16(b); !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func parseHelloFields(raw []byte) (*helloFields, error) {
+	r := &helloReader{b: raw}
+	if r.uint8() != handshakeTypeClientHello {
+		return nil, errInvalidClientHello
+	}
+	r = &helloReader{b: r.bytes(r.uint24())}
+
+	h := &helloFields{version: uint16(r.uint16())}
+	r.bytes(32)        // random
+	r.bytes(r.uint8()) // session ID
+	h.ciphers = r.uint16s(r.uint16())
+	r.bytes(r.uint8()) // compression methods
+	if r.err {
+		return nil, errInvalidClientHello
+	}
+	if len(r.b) == 0 {
+		// No extensions
+		return h, nil
+	}
+
+	exts := &helloReader{b: r.bytes(r.uint16())}
+	for len(exts.b) > 0 && !exts.err {
+		typ := uint16(exts.uint16())
+		data := &helloReader{b: exts.bytes(exts.uint16())}
+		if isGREASE(typ) {
+			continue
+		}
+		h.extensions = append(h.extensions, typ)
+		switch typ {
+		case extensionServerName:
+			h.hasServerName = true
+			names := &helloReader{b: data.bytes(data.uint16())}
+			for len(names.b) > 0 && !names.err {
+				nameType := names.uint8()
+				name := names.bytes(names.uint16())
+				if nameType == 0 {
+					h.serverName = string(name)
+				}
+			}
+		case extensionSupportedGroups:
+			h.curves = data.uint16s(data.uint16())
+		case extensionECPointFormats:
+			h.pointFormats = data.bytes(data.uint8())
+		case extensionSignatureAlgorithms:
+			h.sigAlgs = data.uint16s(data.uint16())
+		case extensionSupportedVersions:
+			h.versions = data.uint16s(data.uint8())
+		case extensionALPN:
+			protocols := &helloReader{b: data.bytes(data.uint16())}
+			h.alpn = string(protocols.bytes(protocols.uint8()))
+		case extensionECH:
+			h.ech = true
+		}
+	}
+	if r.err || exts.err {
+		return nil, errInvalidClientHello
+	}
+	return h, nil
+}
+
+func joinUint16s(values []uint16, sep string, format func(uint16) string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = format(v)
+	}
+	return strings.Join(s, sep)
+}
+
+func decimal(v uint16) string {
+	return strconv.Itoa(int(v))
+}
+
+func hex4(v uint16) string {
+	return fmt.Sprintf("%04x", v)
+}
+
+// ja3 returns the JA3 string: version, ciphers, extensions, curves and
+// point formats, as decimal values.
+func (h *helloFields) ja3() string {
+	formats := make([]uint16, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		decimal(h.version),
+		joinUint16s(h.ciphers, "-", decimal),
+		joinUint16s(h.extensions, "-", decimal),
+		joinUint16s(h.curves, "-", decimal),
+		joinUint16s(formats, "-", decimal),
+	}, ",")
+}
+
+// ja4 returns the JA4 fingerprint, see
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (h *helloFields) ja4() string {
+	version := h.version
+	for _, v := range h.versions {
+		if v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if h.hasServerName {
+		sni = "d"
+	}
+	a := fmt.Sprintf("t%s%s%s%s%s", ja4Version(version), sni,
+		ja4Count(len(h.ciphers)), ja4Count(len(h.extensions)), ja4ALPN(h.alpn))
+
+	ciphers := append([]uint16(nil), h.ciphers...)
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b := ja4Hash(joinUint16s(ciphers, ",", hex4))
+
+	var extensions []uint16
+	for _, e := range h.extensions {
+		if e != extensionServerName && e != extensionALPN {
+			extensions = append(extensions, e)
+		}
+	}
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+	c := joinUint16s(extensions, ",", hex4)
+	if len(h.sigAlgs) > 0 {
+		c += "_" + joinUint16s(h.sigAlgs, ",", hex4)
+	}
+	if len(extensions) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4Count formats a number of ciphers or extensions.
+func ja4Count(n int) string {
+	if n > 99 {
+		n = 99
+	}
+	return fmt.Sprintf("%02d", n)
+}
+
+func ja4ALPN(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte{first, last})
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4Hash returns the truncated SHA-256 of s, zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// clientHelloConn records the ClientHello read from the client, before it's
+// handed to crypto/tls.
+type clientHelloConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	records []byte
+	hello   []byte
+	done    bool
+}
+
+func (c *clientHelloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done && n > 0 {
+		c.records = append(c.records, b[:n]...)
+		c.reassemble()
+	}
+	return n, err
+}
+
+// reassemble extracts the ClientHello message from the recorded handshake
+// records, that may be fragmented.
+func (c *clientHelloConn) reassemble() {
+	var msg []byte
+	for rest := c.records; ; {
+		if len(rest) < recordHeaderLen {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(rest[3:5]))
+		if rest[0] != recordTypeHandshake {
+			c.done = true
+			return
+		}
+		if len(rest) < recordHeaderLen+length {
+			break
+		}
+		msg = append(msg, rest[recordHeaderLen:recordHeaderLen+length]...)
+		rest = rest[recordHeaderLen+length:]
+	}
+	if len(msg) >= 4 {
+		length := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if len(msg) >= length {
+			c.hello = msg[:length]
+			c.done = true
+		}
+	}
+	if len(c.records) > maxClientHelloSize {
+		c.done = true
+	}
+	if c.done {
+		c.records = nil
+	}
+}
+
+// clientHello returns the recorded ClientHello, nil if it couldn't be
+// parsed.
+func (c *clientHelloConn) clientHello() *ClientHello {
+	c.mu.Lock()
+	raw := c.hello
+	c.mu.Unlock()
+	if raw == nil {
+		return nil
+	}
+	hello, err := ParseClientHello(raw)
+	if err != nil {
+		return nil
+	}
+	return hello
+}
+
+// peekClientHello reads the ClientHello sent on conn, and returns it with
+// a connection replaying the read data. The returned ClientHello is nil if
+// the client didn't send a valid one.
+func peekClientHello(conn net.Conn) (*ClientHello, net.Conn, error) {
+	recorder := &clientHelloConn{Conn: conn}
+	var peeked []byte
+	buf := make([]byte, 4096)
+	var err error
+	for !recorder.done && err == nil {
+		var n int
+		n, err = recorder.Read(buf)
+		peeked = append(peeked, buf[:n]...)
+	}
+	replay := &peekedConn{Reader: io.MultiReader(bytes.NewReader(peeked), conn), Conn: conn}
+	return recorder.clientHello(), replay, err
+}
@@ -0,0 +1,68 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientHello(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer serverRaw.Close()
+	go func() {
+		client := tls.Client(clientRaw, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+		_ = client.Handshake()
+		_ = client.Close()
+	}()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(serverRaw, header)
+	require.NoError(t, err)
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	_, err = io.ReadFull(serverRaw, record)
+	require.NoError(t, err)
+
+	hello, err := goproxy.ParseClientHello(record)
+	require.NoError(t, err)
+	assert.Equal(t, record, hello.Raw)
+	assert.True(t, strings.HasPrefix(hello.JA3, "771,"), hello.JA3)
+	assert.Len(t, hello.JA3Hash, 32)
+	parts := strings.Split(hello.JA4, "_")
+	require.Len(t, parts, 3, hello.JA4)
+	assert.True(t, strings.HasPrefix(parts[0], "t13d"), hello.JA4)
+	assert.True(t, strings.HasSuffix(parts[0], "h2"), hello.JA4)
+	assert.Len(t, parts[1], 12)
+	assert.Len(t, parts[2], 12)
+
+	_, err = goproxy.ParseClientHello(record[:40])
+	assert.Error(t, err)
+}
+
+func TestMitmClientHello(t *testing.T) {
+	for _, handler := range []goproxy.FuncHttpsHandler{goproxy.AlwaysMitm, goproxy.AlwaysAutoMitm} {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.OnRequest().HandleConnect(handler)
+		hellos := make(chan *goproxy.ClientHello, 1)
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			hellos <- ctx.ClientHello
+			return req, nil
+		})
+
+		client, s := oneShotProxy(proxy)
+		assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+		s.Close()
+
+		hello := <-hellos
+		require.NotNil(t, hello)
+		// The test server is addressed by IP, without SNI
+		assert.True(t, strings.HasPrefix(hello.JA4, "t13i"), hello.JA4)
+		assert.NotEmpty(t, hello.JA3Hash)
+	}
+}
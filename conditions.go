@@ -0,0 +1,233 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// And returns a ReqCondition testing whether all the given conditions are
+// met, e.g. to combine the conditions given to Or or Not:
+//
+//	proxy.OnRequest(goproxy.Or(
+//		goproxy.And(goproxy.MethodIs(http.MethodPost), goproxy.ReqHostIs("api.example.com")),
+//		goproxy.Not(goproxy.SchemeIs("https")),
+//	)).DoFunc(handler)
+func And(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if !cond.HandleReq(req, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a ReqCondition testing whether one of the given conditions is
+// met.
+func Or(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if cond.HandleReq(req, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RespAnd returns a RespCondition testing whether all the given conditions
+// are met. The ReqConditions among them test the request of the response.
+func RespAnd(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if !cond.HandleResp(resp, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RespOr returns a RespCondition testing whether one of the given
+// conditions is met.
+func RespOr(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, cond := range conds {
+			if cond.HandleResp(resp, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RespNot returns a RespCondition negating the given RespCondition.
+func RespNot(cond RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return !cond.HandleResp(resp, ctx)
+	}
+}
+
+// ReqHeaderExists returns a ReqCondition testing whether the request has
+// the given header.
+func ReqHeaderExists(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		_, ok := req.Header[http.CanonicalHeaderKey(name)]
+		return ok
+	}
+}
+
+// ReqHeaderMatches returns a ReqCondition testing whether one of the
+// values of the given header of the request matches re.
+func ReqHeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return headerMatches(req.Header, name, re)
+	}
+}
+
+// RespHeaderExists returns a RespCondition testing whether the response
+// has the given header.
+func RespHeaderExists(name string) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		_, ok := resp.Header[http.CanonicalHeaderKey(name)]
+		return ok
+	}
+}
+
+// RespHeaderMatches returns a RespCondition testing whether one of the
+// values of the given header of the response matches re.
+func RespHeaderMatches(name string, re *regexp.Regexp) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && headerMatches(resp.Header, name, re)
+	}
+}
+
+func headerMatches(header http.Header, name string, re *regexp.Regexp) bool {
+	for _, value := range header.Values(name) {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryParamIs returns a ReqCondition testing whether the URL of the
+// request has the given query parameter, with one of the given values if
+// any.
+func QueryParamIs(name string, values ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		actual, ok := req.URL.Query()[name]
+		if !ok {
+			return false
+		}
+		if len(values) == 0 {
+			return true
+		}
+		for _, value := range actual {
+			for _, expected := range values {
+				if value == expected {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// QueryParamMatches returns a ReqCondition testing whether one of the
+// values of the given query parameter of the request matches re.
+func QueryParamMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, value := range req.URL.Query()[name] {
+			if re.MatchString(value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SrcIpIn returns a ReqCondition testing whether the source IP of the
+// request belongs to one of the given networks, in CIDR notation, or is one
+// of the given IP addresses. It panics if one of them is invalid.
+func SrcIpIn(networks ...string) ReqConditionFunc {
+	nets, err := parseNetworks(networks)
+	if err != nil {
+		panic("goproxy: SrcIpIn: " + err.Error())
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MethodIs returns a ReqCondition testing whether the method of the
+// request is one of the given ones.
+func MethodIs(methods ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, method := range methods {
+			if strings.EqualFold(req.Method, method) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstPortIs returns a ReqCondition testing whether the destination port of
+// the request is one of the given ones. Without an explicit port, it's the
+// default one of the scheme of the URL.
+func DstPortIs(ports ...int) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		port, err := strconv.Atoi(req.URL.Port())
+		if err != nil {
+			switch strings.ToLower(req.URL.Scheme) {
+			case "http", "ws":
+				port = 80
+			case "https", "wss":
+				port = 443
+			default:
+				return false
+			}
+		}
+		for _, p := range ports {
+			if p == port {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SchemeIs returns a ReqCondition testing whether the scheme of the URL of
+// the request is one of the given ones, e.g. "https" for the MITM'd
+// requests. The CONNECT requests don't have a scheme.
+func SchemeIs(schemes ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, scheme := range schemes {
+			if strings.EqualFold(req.URL.Scheme, scheme) {
+				return true
+			}
+		}
+		return false
+	}
+}
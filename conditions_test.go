@@ -0,0 +1,113 @@
+package goproxy_test
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func newConditionRequest(method, target, remoteAddr string) *http.Request {
+	req, _ := http.NewRequest(method, target, nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestConditionCombinators(t *testing.T) {
+	yes := goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool { return true })
+	no := goproxy.Not(yes)
+	req := newConditionRequest(http.MethodGet, "http://example.com/", "127.0.0.1:1234")
+	ctx := &goproxy.ProxyCtx{Req: req}
+
+	assert.True(t, goproxy.And().HandleReq(req, ctx))
+	assert.True(t, goproxy.And(yes, yes).HandleReq(req, ctx))
+	assert.False(t, goproxy.And(yes, no).HandleReq(req, ctx))
+	assert.False(t, goproxy.Or().HandleReq(req, ctx))
+	assert.True(t, goproxy.Or(no, yes).HandleReq(req, ctx))
+	assert.False(t, goproxy.Or(no, no).HandleReq(req, ctx))
+	assert.True(t, goproxy.Or(goproxy.And(yes, no), goproxy.Not(no)).HandleReq(req, ctx))
+
+	resp := &http.Response{Header: http.Header{"X-Cache": {"HIT"}}, Request: req}
+	hit := goproxy.RespHeaderExists("x-cache")
+	assert.True(t, goproxy.RespAnd(hit, yes).HandleResp(resp, ctx))
+	assert.False(t, goproxy.RespAnd(hit, no).HandleResp(resp, ctx))
+	assert.True(t, goproxy.RespOr(goproxy.RespNot(hit), yes).HandleResp(resp, ctx))
+	assert.False(t, goproxy.RespOr(goproxy.RespNot(hit), no).HandleResp(resp, ctx))
+}
+
+func TestHeaderConditions(t *testing.T) {
+	req := newConditionRequest(http.MethodGet, "http://example.com/", "127.0.0.1:1234")
+	req.Header.Add("User-Agent", "curl/8.0")
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+	ctx := &goproxy.ProxyCtx{Req: req}
+
+	assert.True(t, goproxy.ReqHeaderExists("user-agent").HandleReq(req, ctx))
+	assert.False(t, goproxy.ReqHeaderExists("Authorization").HandleReq(req, ctx))
+	assert.True(t, goproxy.ReqHeaderMatches("User-Agent", regexp.MustCompile(`^curl/`)).HandleReq(req, ctx))
+	assert.True(t, goproxy.ReqHeaderMatches("Accept", regexp.MustCompile(`json`)).HandleReq(req, ctx))
+	assert.False(t, goproxy.ReqHeaderMatches("Accept", regexp.MustCompile(`xml`)).HandleReq(req, ctx))
+
+	resp := &http.Response{Header: http.Header{"Content-Security-Policy": {"default-src 'self'"}}}
+	assert.True(t, goproxy.RespHeaderExists("Content-Security-Policy").HandleResp(resp, ctx))
+	assert.False(t, goproxy.RespHeaderExists("Set-Cookie").HandleResp(resp, ctx))
+	assert.True(t, goproxy.RespHeaderMatches("Content-Security-Policy", regexp.MustCompile(`self`)).HandleResp(resp, ctx))
+	assert.False(t, goproxy.RespHeaderMatches("Content-Security-Policy", regexp.MustCompile(`none`)).HandleResp(resp, ctx))
+	assert.False(t, goproxy.RespHeaderExists("Content-Security-Policy").HandleResp(nil, ctx))
+}
+
+func TestQueryParamConditions(t *testing.T) {
+	req := newConditionRequest(http.MethodGet, "http://example.com/search?q=golang&debug&page=2", "127.0.0.1:1234")
+	ctx := &goproxy.ProxyCtx{Req: req}
+
+	assert.True(t, goproxy.QueryParamIs("debug").HandleReq(req, ctx))
+	assert.True(t, goproxy.QueryParamIs("q", "rust", "golang").HandleReq(req, ctx))
+	assert.False(t, goproxy.QueryParamIs("q", "rust").HandleReq(req, ctx))
+	assert.False(t, goproxy.QueryParamIs("token").HandleReq(req, ctx))
+	assert.True(t, goproxy.QueryParamMatches("page", regexp.MustCompile(`^\d+$`)).HandleReq(req, ctx))
+	assert.False(t, goproxy.QueryParamMatches("q", regexp.MustCompile(`^\d+$`)).HandleReq(req, ctx))
+}
+
+func TestSrcIpIn(t *testing.T) {
+	cond := goproxy.SrcIpIn("10.0.0.0/8", "192.168.1.10", "::1")
+	for _, test := range []struct {
+		remoteAddr string
+		expected   bool
+	}{
+		{"10.1.2.3:5555", true},
+		{"192.168.1.10:5555", true},
+		{"192.168.1.11:5555", false},
+		{"[::1]:5555", true},
+		{"10.0.0.1", true},
+		{"not-an-ip", false},
+	} {
+		req := newConditionRequest(http.MethodGet, "http://example.com/", test.remoteAddr)
+		assert.Equal(t, test.expected, cond.HandleReq(req, &goproxy.ProxyCtx{Req: req}), test.remoteAddr)
+	}
+
+	assert.Panics(t, func() { goproxy.SrcIpIn("10.0.0.0/33") })
+}
+
+func TestMethodPortSchemeConditions(t *testing.T) {
+	for _, test := range []struct {
+		method, target string
+		post, port443  bool
+		https          bool
+	}{
+		{http.MethodPost, "http://example.com/", true, false, false},
+		{"post", "https://example.com/", true, true, true},
+		{http.MethodGet, "http://example.com:443/", false, true, false},
+		{http.MethodGet, "https://example.com:8443/", false, false, true},
+	} {
+		req := newConditionRequest(test.method, test.target, "127.0.0.1:1234")
+		ctx := &goproxy.ProxyCtx{Req: req}
+		assert.Equal(t, test.post, goproxy.MethodIs(http.MethodPut, http.MethodPost).HandleReq(req, ctx), test.target)
+		assert.Equal(t, test.port443, goproxy.DstPortIs(443).HandleReq(req, ctx), test.target)
+		assert.Equal(t, test.https, goproxy.SchemeIs("https").HandleReq(req, ctx), test.target)
+	}
+
+	req := newConditionRequest(http.MethodGet, "http://example.com/", "127.0.0.1:1234")
+	assert.True(t, goproxy.DstPortIs(80, 8080).HandleReq(req, &goproxy.ProxyCtx{Req: req}))
+}
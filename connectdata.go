@@ -0,0 +1,114 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// connectDataSniffSize bounds the bytes peeked to tell whether a tunnel
+// carries TLS or HTTP.
+const connectDataSniffSize = 64
+
+// ConnectDataHandler handles the CONNECT tunnels whose traffic is neither
+// TLS nor HTTP, e.g. SSH over port 443, to inspect custom protocols. It's
+// given the raw connections with the remote server and with the client,
+// and returns once it's done with them, they are closed afterwards.
+//
+//	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+//		ctx.ConnectDataHandler = goproxy.FuncConnectDataHandler(func(remote, client net.Conn, ctx *goproxy.ProxyCtx) {
+//			...
+//		})
+//		return goproxy.OkConnect, host
+//	})
+//
+// It applies to the tunnels accepted with OkConnect, and to the plain ones
+// of AutoMitmConnect.
+type ConnectDataHandler interface {
+	HandleConnectData(remote net.Conn, client net.Conn, ctx *ProxyCtx)
+}
+
+// A wrapper that would convert a function to a ConnectDataHandler interface type.
+type FuncConnectDataHandler func(remote net.Conn, client net.Conn, ctx *ProxyCtx)
+
+// FuncConnectDataHandler.HandleConnectData(remote, client, ctx) <=> FuncConnectDataHandler(remote, client, ctx).
+func (f FuncConnectDataHandler) HandleConnectData(remote net.Conn, client net.Conn, ctx *ProxyCtx) {
+	f(remote, client, ctx)
+}
+
+// handleConnectData hands the accepted tunnel to the ConnectDataHandler of
+// ctx if its traffic is neither TLS nor HTTP, and relays it otherwise.
+func (proxy *ProxyHttpServer) handleConnectData(ctx *ProxyCtx, proxyClient, targetSiteCon net.Conn, host string) {
+	reader := bufio.NewReader(proxyClient)
+	if isConnectData(proxyClient, reader) {
+		ctx.Logf("Handling non TLS nor HTTP tunnel to %s", ctx.Req.URL.Host)
+		ctx.ConnectDataHandler.HandleConnectData(targetSiteCon, &peekedConn{Reader: reader, Conn: proxyClient}, ctx)
+		_ = targetSiteCon.Close()
+		_ = proxyClient.Close()
+		return
+	}
+	// Send the sniffed bytes, so that the tunnel can relay the connections
+	// themselves
+	buffered, _ := reader.Peek(reader.Buffered())
+	if _, err := targetSiteCon.Write(buffered); err != nil {
+		ctx.Warnf("Error copying to %s: %s", ctx.Req.URL.Host, err)
+		_ = targetSiteCon.Close()
+		_ = proxyClient.Close()
+		return
+	}
+	proxy.relayTunnel(ctx, proxyClient, targetSiteCon, host)
+}
+
+// autoMitmConnectData hands the plain connection of an AutoMitmConnect
+// tunnel to host to the ConnectDataHandler of ctx, if its traffic isn't
+// HTTP, and reports whether it did. Otherwise, it returns a connection
+// replaying the peeked data.
+func (proxy *ProxyHttpServer) autoMitmConnectData(ctx *ProxyCtx, client net.Conn, host string) (net.Conn, bool) {
+	reader := bufio.NewReader(client)
+	replay := &peekedConn{Reader: reader, Conn: client}
+	if !isConnectData(client, reader) {
+		return replay, false
+	}
+	ctx.Logf("Handling non HTTP tunnel to %s", host)
+	if !hasPort.MatchString(host) {
+		host += ":80"
+	}
+	target, err := proxy.connectDial(ctx, "tcp", host)
+	if err != nil {
+		ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+		_ = replay.Close()
+		return replay, true
+	}
+	go func() {
+		ctx.ConnectDataHandler.HandleConnectData(target, replay, ctx)
+		_ = target.Close()
+		_ = replay.Close()
+	}()
+	return replay, true
+}
+
+// isConnectData peeks the first bytes of client through reader, reporting
+// whether they are neither a TLS handshake nor an HTTP request. A client
+// that doesn't send anything is assumed to wait for the server to speak
+// first.
+func isConnectData(client net.Conn, reader *bufio.Reader) bool {
+	_ = client.SetReadDeadline(time.Now().Add(rawConnectionSniffTimeout))
+	defer func() { _ = client.SetReadDeadline(time.Time{}) }()
+	var peeked []byte
+	for len(peeked) < connectDataSniffSize && bytes.IndexByte(peeked, '\n') < 0 {
+		if _, err := reader.Peek(len(peeked) + 1); err != nil {
+			var netErr net.Error
+			if len(peeked) == 0 {
+				return errors.As(err, &netErr) && netErr.Timeout()
+			}
+			break
+		}
+		peeked, _ = reader.Peek(reader.Buffered())
+		if peeked[0] == recordTypeHandshake {
+			return false
+		}
+	}
+	return !looksLikeHTTP(peeked)
+}
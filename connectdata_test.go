@@ -0,0 +1,99 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer echoes the lines it receives.
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+// connectTunnel opens a CONNECT tunnel to host through the proxy at
+// proxyURL.
+func connectTunnel(t *testing.T, proxyURL, host string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	u, _ := url.Parse(proxyURL)
+	c, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	_, err = io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return c, br
+}
+
+func TestConnectDataHandler(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	for _, action := range []*goproxy.ConnectAction{goproxy.OkConnect, goproxy.AutoMitmConnect} {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.ConnectDial = nil
+		var handled atomic.Int32
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			ctx.ConnectDataHandler = goproxy.FuncConnectDataHandler(func(remote, client net.Conn, ctx *goproxy.ProxyCtx) {
+				handled.Add(1)
+				line, err := bufio.NewReader(client).ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(remote, strings.ToUpper(line))
+				_, _ = io.CopyN(client, remote, int64(len(line)))
+			})
+			return action, host
+		})
+		s := httptest.NewServer(proxy)
+
+		c, br := connectTunnel(t, s.URL, backend.Addr().String())
+		_, err := io.WriteString(c, "SSH-2.0-test client\r\n")
+		require.NoError(t, err)
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "SSH-2.0-TEST CLIENT\r\n", line)
+		assert.Equal(t, int32(1), handled.Load())
+		c.Close()
+
+		// HTTP traffic isn't handed to the handler
+		u, _ := url.Parse(srv.URL)
+		c, br = connectTunnel(t, s.URL, u.Host)
+		_, err = io.WriteString(c, "GET /bobo HTTP/1.1\r\nHost: "+u.Host+"\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4))
+		assert.Equal(t, "bobo", string(body))
+		assert.Equal(t, int32(1), handled.Load())
+		c.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,85 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectResponse(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.ConnectResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 Tunnel ready",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"X-Policy": {"allowed"}},
+		}
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, br := connectTunnelResponse(t, s.URL, backend.Addr().String(), func(resp *http.Response) {
+		assert.Equal(t, "200 Tunnel ready", resp.Status)
+		assert.Equal(t, "HTTP/1.1", resp.Proto)
+		assert.Equal(t, "allowed", resp.Header.Get("X-Policy"))
+	})
+	defer c.Close()
+
+	_, err := io.WriteString(c, "ping\n")
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestConnectRejectResponse(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusUnavailableForLegalReasons, "Blocked by policy")
+		return goproxy.RejectConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "CONNECT blocked.example:443 HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, resp.StatusCode)
+	assert.Equal(t, "Blocked by policy", string(body))
+}
+
+// connectTunnelResponse opens a CONNECT tunnel to host through the proxy
+// at proxyURL, passing the response to check.
+func connectTunnelResponse(t *testing.T, proxyURL, host string, check func(resp *http.Response)) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", proxyURL[len("http://"):])
+	require.NoError(t, err)
+	_, err = io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	check(resp)
+	return c, br
+}
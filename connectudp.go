@@ -0,0 +1,271 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// connectUDPPrefix is the path prefix of the default URI template of the
+// CONNECT-UDP requests, /.well-known/masque/udp/{target_host}/{target_port}/.
+const connectUDPPrefix = "/.well-known/masque/udp/"
+
+// capsuleDatagram is the type of the DATAGRAM capsules (RFC 9297).
+const capsuleDatagram = 0
+
+// maxUDPPayload is the largest UDP payload relayed.
+const maxUDPPayload = 65527
+
+// DatagramHandler is called with every UDP payload relayed for a
+// CONNECT-UDP request, fromClient telling its direction. It returns the
+// payload to relay, or nil to drop it.
+type DatagramHandler func(payload []byte, fromClient bool, ctx *ProxyCtx) []byte
+
+// IsConnectUDP reports whether req is a CONNECT-UDP request (RFC 9298),
+// either an HTTP/2 extended CONNECT or an HTTP/1.1 upgrade. Note that the
+// HTTP/2 servers of the standard library and of golang.org/x/net only
+// accept extended CONNECT requests with GODEBUG=http2xconnect=1.
+func IsConnectUDP(req *http.Request) bool {
+	if req.Method == http.MethodConnect {
+		return req.Header.Get(":protocol") == "connect-udp"
+	}
+	return req.Method == http.MethodGet && req.ProtoMajor == 1 &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "connect-udp")
+}
+
+// connectUDPTarget returns the host and port of the target of a
+// CONNECT-UDP request.
+func connectUDPTarget(r *http.Request) (string, error) {
+	path, ok := strings.CutPrefix(r.URL.EscapedPath(), connectUDPPrefix)
+	if !ok {
+		return "", fmt.Errorf("unexpected CONNECT-UDP path %q", r.URL.Path)
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[2] != "" {
+		return "", fmt.Errorf("unexpected CONNECT-UDP path %q", r.URL.Path)
+	}
+	// IPv6 addresses have their colons percent-encoded
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" {
+		return "", fmt.Errorf("invalid CONNECT-UDP target host %q", parts[0])
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("invalid CONNECT-UDP target port %q", parts[1])
+	}
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// handleConnectUDP proxies the UDP payloads of a CONNECT-UDP request,
+// carried in DATAGRAM capsules on the request stream. The request is
+// filtered by the CONNECT handlers, like a CONNECT request for its target:
+// ConnectReject rejects it, every other action relays it.
+func (proxy *ProxyHttpServer) handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
+	ctx.ProxyProtocol = proxyProtocolHeader(r)
+
+	target, err := connectUDPTarget(r)
+	if err != nil {
+		ctx.Warnf("Invalid CONNECT-UDP request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	todo, host := proxy.filterConnect(target, ctx)
+	if ctx.TunnelCloseHandler != nil {
+		// The client connection or stream is closed when the handler returns
+		defer ctx.TunnelCloseHandler(ctx)
+	}
+	if todo.Action == ConnectReject {
+		if ctx.Resp != nil {
+			defer ctx.Resp.Body.Close()
+			copyHeaders(w.Header(), ctx.Resp.Header, proxy.KeepDestinationHeaders)
+			w.WriteHeader(ctx.Resp.StatusCode)
+			_, _ = io.Copy(w, ctx.Resp.Body)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if todo.Action != ConnectAccept {
+		ctx.Logf("Action %v not supported on CONNECT-UDP requests, relaying it", todo.Action)
+	}
+
+	remote, err := proxy.dial(ctx, "udp", host)
+	if err != nil {
+		ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var client io.Reader
+	var clientWriter io.Writer
+	var clientCloser io.Closer
+	if r.ProtoMajor == 1 {
+		hij, ok := w.(http.Hijacker)
+		if !ok {
+			panic("httpserver does not support hijacking")
+		}
+		conn, rw, err := hij.Hijack()
+		if err != nil {
+			panic("Cannot hijack connection " + err.Error())
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+		if err != nil {
+			_ = conn.Close()
+			_ = remote.Close()
+			return
+		}
+		client, clientWriter, clientCloser = rw.Reader, conn, conn
+	} else {
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		client, clientWriter, clientCloser = r.Body, flushWriter{w: w}, r.Body
+	}
+	ctx.Logf("Accepting CONNECT-UDP to %s", host)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		if err := relayClientDatagrams(ctx, bufio.NewReader(client), remote); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			ctx.Warnf("Error relaying datagrams to %s: %v", host, err)
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_ = relayServerDatagrams(ctx, remote, clientWriter)
+		done <- struct{}{}
+	}()
+	<-done
+	// Either side is done, unblock the other one
+	_ = remote.Close()
+	_ = clientCloser.Close()
+	<-done
+}
+
+// relayClientDatagrams sends to remote the UDP payloads of the DATAGRAM
+// capsules read from the client. The other capsules are ignored.
+func relayClientDatagrams(ctx *ProxyCtx, client *bufio.Reader, remote net.Conn) error {
+	for {
+		capsuleType, err := readVarint(client)
+		if err != nil {
+			return err
+		}
+		length, err := readVarint(client)
+		if err != nil {
+			return err
+		}
+		if capsuleType != capsuleDatagram || length > maxUDPPayload+8 {
+			if _, err := io.CopyN(io.Discard, client, int64(length)); err != nil {
+				return err
+			}
+			continue
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(client, value); err != nil {
+			return err
+		}
+		contextID, n := parseVarint(value)
+		if n == 0 || contextID != 0 {
+			// Only the context 0, UDP payloads, is defined by RFC 9298
+			continue
+		}
+		payload := value[n:]
+		if ctx.DatagramHandler != nil {
+			if payload = ctx.DatagramHandler(payload, true, ctx); payload == nil {
+				continue
+			}
+		}
+		if _, err := remote.Write(payload); err != nil {
+			return err
+		}
+	}
+}
+
+// relayServerDatagrams sends to the client the UDP payloads received from
+// remote, in DATAGRAM capsules.
+func relayServerDatagrams(ctx *ProxyCtx, remote net.Conn, client io.Writer) error {
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, err := remote.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// An ICMP error for a previous datagram
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		payload := buf[:n]
+		if ctx.DatagramHandler != nil {
+			if payload = ctx.DatagramHandler(payload, false, ctx); payload == nil {
+				continue
+			}
+		}
+		capsule := appendVarint(nil, capsuleDatagram)
+		capsule = appendVarint(capsule, uint64(len(payload)+1))
+		capsule = append(capsule, 0) // context ID
+		capsule = append(capsule, payload...)
+		if _, err := client.Write(capsule); err != nil {
+			return err
+		}
+	}
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, section 16).
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// parseVarint parses the QUIC variable-length integer at the start of b,
+// and returns it with its length, 0 if b is too short.
+func parseVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:length] {
+		v = v<<8 | uint64(c)
+	}
+	return v, length
+}
+
+// appendVarint appends v to b as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
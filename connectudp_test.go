@@ -0,0 +1,128 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// datagramCapsule returns a DATAGRAM capsule carrying payload, short
+// enough for single-byte lengths.
+func datagramCapsule(payload string) []byte {
+	return append([]byte{0, byte(len(payload) + 1), 0}, payload...)
+}
+
+func readDatagramCapsule(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var header [3]byte
+	_, err := io.ReadFull(r, header[:])
+	require.NoError(t, err)
+	require.Equal(t, byte(0), header[0])
+	payload := make([]byte, header[1]-1)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return string(payload)
+}
+
+func TestIsConnectUDP(t *testing.T) {
+	req := &http.Request{Method: http.MethodGet, ProtoMajor: 1, Header: http.Header{"Upgrade": {"connect-udp"}}}
+	assert.True(t, goproxy.IsConnectUDP(req))
+	req = &http.Request{Method: http.MethodConnect, ProtoMajor: 2, Header: http.Header{":protocol": {"connect-udp"}}}
+	assert.True(t, goproxy.IsConnectUDP(req))
+	req.Header.Set(":protocol", "webtransport")
+	assert.False(t, goproxy.IsConnectUDP(req))
+}
+
+func TestConnectUDPUpgrade(t *testing.T) {
+	echo := udpEchoServer(t)
+	proxy := goproxy.NewProxyHttpServer()
+	datagrams := make(chan bool, 2)
+	closed := make(chan struct{})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.TunnelCloseHandler = func(ctx *goproxy.ProxyCtx) {
+			close(closed)
+		}
+		ctx.DatagramHandler = func(payload []byte, fromClient bool, ctx *goproxy.ProxyCtx) []byte {
+			datagrams <- fromClient
+			return append([]byte("<"), payload...)
+		}
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, port, err := net.SplitHostPort(echo.LocalAddr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(c, "GET /.well-known/masque/udp/127.0.0.1/"+port+"/ HTTP/1.1\r\n"+
+		"Host: proxy\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(c)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "?1", resp.Header.Get("Capsule-Protocol"))
+
+	_, err = c.Write(datagramCapsule("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "<<ping", readDatagramCapsule(t, reader))
+	assert.True(t, <-datagrams)
+	assert.False(t, <-datagrams)
+
+	require.NoError(t, c.Close())
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TunnelCloseHandler not called")
+	}
+}
+
+func TestConnectUDPReject(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for path, status := range map[string]int{
+		"/.well-known/masque/udp/127.0.0.1/53/": http.StatusForbidden,
+		"/.well-known/masque/udp/127.0.0.1/":    http.StatusBadRequest,
+	} {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, s.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "connect-udp")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, path)
+	}
+}
@@ -0,0 +1,43 @@
+package goproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// ConnPool overrides the connection pool settings of the proxy Tr for some
+// hosts, e.g. to keep more idle connections to a busy API. The zero
+// settings keep the ones of Tr.
+//
+//	proxy.ConnPools = []goproxy.ConnPool{{Hosts: []string{"*.example.com"}, MaxIdleConnsPerHost: 64}}
+type ConnPool struct {
+	// Hosts are the matched host names, as in UpstreamRoute.Hosts.
+	Hosts []string
+	// MaxIdleConnsPerHost, MaxConnsPerHost and IdleConnTimeout are the
+	// settings of http.Transport.
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+}
+
+// connPool returns the ConnPool of host, if any.
+func (proxy *ProxyHttpServer) connPool(host string) *ConnPool {
+	for i := range proxy.ConnPools {
+		if matchHosts(proxy.ConnPools[i].Hosts, host) {
+			return &proxy.ConnPools[i]
+		}
+	}
+	return nil
+}
+
+func (p *ConnPool) apply(tr *http.Transport) {
+	if p.MaxIdleConnsPerHost != 0 {
+		tr.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+	}
+	if p.MaxConnsPerHost != 0 {
+		tr.MaxConnsPerHost = p.MaxConnsPerHost
+	}
+	if p.IdleConnTimeout != 0 {
+		tr.IdleConnTimeout = p.IdleConnTimeout
+	}
+}
@@ -0,0 +1,55 @@
+package goproxy_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnPools(t *testing.T) {
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("bobo"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name  string
+		host  string
+		conns int32
+	}{
+		{"default", "127.0.0.1", 1},
+		{"override", "localhost", 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.ConnPools = []goproxy.ConnPool{{Hosts: []string{"localhost"}, IdleConnTimeout: 20 * time.Millisecond}}
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			conns.Store(0)
+			target := "http://" + net.JoinHostPort(test.host, u.Port()) + "/bobo"
+			for i := 0; i < 2; i++ {
+				assert.Equal(t, "bobo", string(getOrFail(t, target, client)))
+				time.Sleep(100 * time.Millisecond)
+			}
+			assert.Equal(t, test.conns, conns.Load())
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package goproxy
+
+import (
+	"context"
+	"time"
+)
+
+// Context returns the context of the exchange of ctx, cancelled when the
+// client disconnects, when the exchange is over, or when the BaseContext of
+// the proxy is cancelled. The handlers doing slow work, e.g. calling an
+// external service, should stop once it's done. The dials to the
+// destinations and the requests sent upstream are bound to it.
+//
+// The context of a tunnel lasts until the client connection is closed,
+// and the ones of its MITM'd requests until they're answered.
+func (ctx *ProxyCtx) Context() context.Context {
+	if ctx.context != nil {
+		return ctx.context
+	}
+	if ctx.Req != nil {
+		return ctx.Req.Context()
+	}
+	return context.Background()
+}
+
+// withBaseContext returns a context derived from parent, also cancelled
+// with the BaseContext of the proxy.
+func (proxy *ProxyHttpServer) withBaseContext(parent context.Context) (context.Context, context.CancelFunc) {
+	c, cancel := context.WithCancel(parent)
+	if base := proxy.BaseContext; base != nil {
+		go func() {
+			select {
+			case <-base.Done():
+				cancel()
+			case <-c.Done():
+			}
+		}()
+	}
+	return c, cancel
+}
+
+// detachedContext is a context keeping the values of its parent, but not
+// its cancellation, e.g. for a tunnel outliving the CONNECT request.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,92 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextClientDisconnect(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	cancelled := make(chan error, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		select {
+		case <-ctx.Context().Done():
+			cancelled <- ctx.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, srv.URL+"/bobo", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.Error(t, err)
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestContextBaseContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	backend := httptest.NewServer(slow)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(slow)
+	defer tlsBackend.Close()
+
+	for name, target := range map[string]string{"http": backend.URL, "mitm": tlsBackend.URL} {
+		t.Run(name, func(t *testing.T) {
+			base, shutdown := context.WithCancel(context.Background())
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.BaseContext = base
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			handled := make(chan context.Context, 1)
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				handled <- ctx.Context()
+				return req, nil
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				resp, err := client.Get(target)
+				if err == nil {
+					resp.Body.Close()
+				}
+				done <- err
+			}()
+			exchange := <-handled
+			require.NoError(t, exchange.Err())
+			shutdown()
+			select {
+			case <-exchange.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("the context of the exchange wasn't cancelled")
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the exchange wasn't interrupted")
+			}
+		})
+	}
+}
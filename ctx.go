@@ -3,9 +3,13 @@ package goproxy
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
@@ -17,7 +21,10 @@ type ProxyCtx struct {
 	Resp         *http.Response
 	RoundTripper RoundTripper
 	// Specify a custom connection dialer that will be used only for the current
-	// request, including WebSocket connection upgrades
+	// request, including WebSocket connection upgrades, e.g. to reach some hosts
+	// through an SSH tunnel. Set by a CONNECT handler, it's also used by the
+	// MITM'd requests of the tunnel. It dials the destinations or the HTTP
+	// upstream proxies, the SOCKS5 upstream proxies keep their own dialer
 	Dialer func(ctx context.Context, network string, addr string) (net.Conn, error)
 	// will contain the recent error that occurred while trying to send receive or parse traffic
 	Error error
@@ -39,6 +46,135 @@ type ProxyCtx struct {
 	// WebSocketCloseHandler, if set, is called when the WebSocket proxy connection
 	// is fully closed. This allows cleanup of resources.
 	WebSocketCloseHandler WebSocketCloseHandler
+	// WebTransportOpenHandler, if set, is called when a WebTransport session
+	// (or any other HTTP/2 CONNECT stream) has been accepted by the target
+	// and the tunnel is about to start.
+	WebTransportOpenHandler WebTransportHandler
+	// WebTransportCloseHandler, if set, is called when the tunnel of a
+	// WebTransport session (or any other HTTP/2 CONNECT stream) is closed.
+	WebTransportCloseHandler WebTransportHandler
+	// ResponseFixups lists the protocol violations of the remote server
+	// response that have been tolerated, when the proxy LenientResponseParsing
+	// option is enabled. FixupTruncatedBody is only known once the body
+	// has been read.
+	ResponseFixups ResponseFixup
+	// FlowID identifies the logical flow the exchange belongs to, when the
+	// proxy FlowTracker is set. Exchanges following a redirection or an
+	// authentication challenge share the flow ID of the exchange they follow.
+	FlowID string
+	// ClientHello is the TLS ClientHello sent by the client, with its JA3
+	// and JA4 fingerprints, for the requests of MITM'd TLS connections.
+	ClientHello *ClientHello
+	// PeerCertificates are the certificates presented by the MITM'd client,
+	// when the proxy MitmClientAuth option requests them.
+	PeerCertificates []*x509.Certificate
+	// ClientCertificate, if set by a request handler, is presented to the
+	// remote server when it asks for a client certificate (mutual TLS),
+	// overriding the proxy ClientCertificates. It should be reused across
+	// requests, since the connections are pooled by certificate.
+	ClientCertificate *tls.Certificate
+	// Redirects lists the redirections followed by the proxy before getting
+	// the response, when the proxy FollowRedirects option is enabled.
+	Redirects []RedirectHop
+	// Retries lists the failed attempts of the request retried by the
+	// proxy, when the proxy Retry policy is set.
+	Retries []RetryAttempt
+	// DNSOverrides maps hostnames to the IP addresses dialed for them during
+	// this exchange, instead of resolving them, see ResolveTo.
+	DNSOverrides map[string]net.IP
+	// Resolver, if set by a handler, resolves the host names dialed for
+	// this exchange instead of the proxy Resolver. Set by a CONNECT handler,
+	// it's also used by the MITM'd requests of the tunnel.
+	Resolver Resolver
+	// ResolvedIPs are the addresses the last host name dialed for this
+	// exchange resolved to, when resolved by a Resolver. The exchanges
+	// reusing a pooled connection don't resolve anything.
+	ResolvedIPs []net.IP
+	// SourceAddr, if set by a handler, binds the connections of this
+	// exchange instead of the proxy SourceAddr, e.g. to send the traffic
+	// of a tenant from its own address. Set by a CONNECT handler, it's
+	// also used by the MITM'd requests of the tunnel.
+	SourceAddr string
+	// Timeouts, if set by a handler, bound the exchanges of this request,
+	// its non-zero durations overriding the ones of the TimeoutProfiles of
+	// the proxy. Set by a CONNECT handler, they also apply to the tunnel
+	// dial and to the MITM'd requests.
+	Timeouts *Timeouts
+	// UpstreamALPN, if set, lists the application protocols offered to the
+	// remote server for this HTTPS exchange, instead of the defaults of the
+	// proxy Tr. It's set by the proxy MitmALPN hook.
+	UpstreamALPN []string
+	// UpstreamTLSProfile, if set by a request handler, names the TLS
+	// fingerprint the proxy UpstreamTLSHandshake impersonates for this
+	// HTTPS exchange, e.g. "chrome". The upstream connections are pooled
+	// by profile.
+	UpstreamTLSProfile string
+	// UpstreamTLS describes the TLS connection with the remote server for
+	// the HTTPS exchanges: certificate chain, verification result, signed
+	// certificate timestamps and negotiated parameters. It's set once the
+	// response has been received.
+	UpstreamTLS *UpstreamTLSInfo
+	// RawConnectionHandler, if set by a CONNECT handler, handles the
+	// MITM'd TLS connections whose decrypted traffic isn't HTTP, instead
+	// of closing them. RawConnection makes it handle the connection
+	// without looking at its traffic.
+	RawConnectionHandler RawConnectionHandler
+	RawConnection        bool
+	// ConnectDataHandler, if set by a CONNECT handler, handles the tunnels
+	// whose traffic is neither TLS nor HTTP, instead of relaying them.
+	ConnectDataHandler ConnectDataHandler
+	// SecurityHeaders holds the original Strict-Transport-Security and
+	// Expect-CT headers of the response, when the proxy SecurityHeaders
+	// option is set.
+	SecurityHeaders http.Header
+	// Timings are the durations of the phases of the exchange with the
+	// remote server: DNS, connection, TLS handshake, first byte... They're
+	// set once the response has been received.
+	Timings *Timings
+	// ProxyProtocol is the PROXY protocol header of the client connection,
+	// when it was accepted by a ProxyProtocolListener and served by Serve,
+	// ServeTLS or an http.Server using ProxyProtocolConnContext.
+	ProxyProtocol *ProxyProtocolHeader
+	// DatagramHandler, if set by a CONNECT handler, observes or rewrites
+	// the UDP payloads relayed for the CONNECT-UDP requests.
+	DatagramHandler DatagramHandler
+	// TunnelCloseHandler, if set by a CONNECT handler, is called once the
+	// connection of the client is closed, whatever the action, e.g. to
+	// track the tunnels opened by the clients.
+	TunnelCloseHandler func(ctx *ProxyCtx)
+	// ConnectResponse, if set by a CONNECT handler, is sent to the client
+	// instead of the default "200 Connection established" response when
+	// its CONNECT request is accepted, e.g. to add headers. Its status
+	// should be 2xx, its body is ignored. The rejected CONNECT requests get
+	// ctx.Resp instead.
+	ConnectResponse *http.Response
+	// TunnelIdleTimeout and TunnelMaxLifetime, if set by a CONNECT
+	// handler, override the proxy ones for the tunnel of the request. A
+	// negative duration disables the timeout.
+	TunnelIdleTimeout time.Duration
+	TunnelMaxLifetime time.Duration
+	// UpstreamProxy, if set by a handler, is the proxy the request, or the
+	// tunnel of the CONNECT request and its MITM'd requests, go through
+	// instead of the proxy defaults: an http, https, socks5 or socks5h URL
+	// with the credentials in its user info.
+	UpstreamProxy *url.URL
+	// User is the authenticated client of the proxy, set by the handler
+	// that accepted its credentials, e.g. the ones of ext/auth, for the
+	// following handlers and conditions, see UserIs and UserInGroup. Set
+	// for a CONNECT request, it's also the user of the MITM'd requests of
+	// the tunnel. Its name is added to the log messages of the exchange.
+	User *User
+
+	tempDir *exchangeDir
+	abort   AbortKind
+	// context is the context of the exchange, see Context
+	context context.Context
+	// tunnelActivity is the time of the last write to the tunnel of the
+	// request, when it has an idle timeout
+	tunnelActivity *atomic.Int64
+	// upstreamChoice is set by the UpstreamChain for each attempt of a
+	// request
+	upstreamChoice *upstreamChoice
 }
 
 type RoundTripper interface {
@@ -56,13 +192,64 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx.Proxy != nil && len(ctx.Proxy.middlewares) > 0 {
+		return ctx.next(0)(req)
+	}
+	return ctx.exchange(req)
+}
+
+// exchange sends req to its destination, through the CircuitBreaker of the
+// proxy if any.
+func (ctx *ProxyCtx) exchange(req *http.Request) (*http.Response, error) {
+	if ctx.Proxy != nil && ctx.Proxy.CircuitBreaker != nil {
+		return ctx.Proxy.CircuitBreaker.roundTrip(ctx, req, ctx.send)
+	}
+	return ctx.send(req)
+}
+
+// send sends req, following the redirections and retrying it as
+// configured, within the Total timeout of its host.
+func (ctx *ProxyCtx) send(req *http.Request) (*http.Response, error) {
+	return ctx.sendWithTimeout(req, func(req *http.Request) (*http.Response, error) {
+		if ctx.Proxy != nil && ctx.Proxy.FollowRedirects > 0 {
+			return ctx.followRedirects(req)
+		}
+		return ctx.retryRoundTrip(req)
+	})
+}
+
+func (ctx *ProxyCtx) roundTrip(req *http.Request) (*http.Response, error) {
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
+	req, timings := traceTimings(req)
+	if ctx.Proxy.resolvesDials() {
+		req = req.WithContext(context.WithValue(req.Context(), proxyCtxKey{}, ctx))
+	}
+	var resp *http.Response
+	var err error
+	switch {
+	case ctx.Proxy.LenientResponseParsing && req.Header.Get("Upgrade") == "":
+		resp, err = ctx.Proxy.lenientRoundTrip(req, ctx)
+	case ctx.Proxy.UpstreamTLSHandshake != nil && req.URL.Scheme == "https":
+		resp, err = ctx.Proxy.roundTripUpstreamTLS(req, ctx)
+	case ctx.Proxy.SelectUpstream != nil && ctx.UpstreamProxy == nil:
+		resp, err = ctx.Proxy.roundTripSelectedUpstream(ctx.Proxy.traceTLSErrors(req, ctx), ctx)
+	case ctx.Proxy.Upstreams != nil && ctx.UpstreamProxy == nil:
+		resp, err = ctx.Proxy.Upstreams.roundTrip(ctx, ctx.Proxy.traceTLSErrors(req, ctx))
+	default:
+		resp, err = ctx.roundTripUpstreamAuth(ctx.transport(req), ctx.Proxy.traceTLSErrors(req, ctx))
+	}
+	ctx.setUpstreamTLS(req, resp)
+	timings.finish(ctx, resp)
+	return resp, err
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...any) {
+	if ctx.User != nil {
+		ctx.Proxy.Logger.Printf("[%03d] [%s] "+msg+"\n", append([]any{ctx.Session & 0xFFFF, ctx.User.Name}, argv...)...)
+		return
+	}
 	ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]any{ctx.Session & 0xFFFF}, argv...)...)
 }
 
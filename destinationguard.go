@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrBlockedDestination is the error of the connections refused by a
+// DestinationGuard.
+var ErrBlockedDestination = errors.New("destination address blocked")
+
+// DestinationGuard refuses the connections to the loopback, private and
+// link-local addresses, so that the untrusted clients of the proxy can't
+// reach the internal services through it (SSRF):
+//
+//	proxy.DestinationGuard = &goproxy.DestinationGuard{Allow: []string{"metrics.internal"}}
+//
+// The address actually dialed is checked, once the host name of the
+// destination is resolved, so that the redirections followed by the proxy
+// and the DNS rebinding attacks are caught too. It applies to the
+// connections opened by the proxy itself, to the destinations or to the
+// upstream proxies, which must then be allowed when they are private.
+type DestinationGuard struct {
+	// Allow lists the destinations allowed anyway, as in
+	// UpstreamRoute.Hosts: host names, "*.example.com", or networks,
+	// "10.1.0.0/16".
+	Allow []string
+}
+
+// cgnat is the shared address space of RFC 6598.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// Blocked tells whether the connections to ip are refused, unless
+// allowed.
+func (g *DestinationGuard) Blocked(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		cgnat.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// check returns an error if the connections to ip, for host, are refused.
+func (g *DestinationGuard) check(host string, ip net.IP) error {
+	if !g.Blocked(ip) || matchHosts(g.Allow, host) || matchHosts(g.Allow, ip.String()) {
+		return nil
+	}
+	if host != ip.String() {
+		return fmt.Errorf("%w: %s (%s)", ErrBlockedDestination, host, ip)
+	}
+	return fmt.Errorf("%w: %s", ErrBlockedDestination, ip)
+}
+
+// guard returns dial, refusing the connections to the addresses blocked
+// for host.
+func (g *DestinationGuard) guard(
+	host string,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(network, "unix") {
+			return dial(c, network, addr)
+		}
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(h); ip != nil {
+				if err := g.check(host, ip); err != nil {
+					return nil, err
+				}
+			}
+		}
+		conn, err := dial(c, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// The dialers may resolve the host names themselves
+		var ip net.IP
+		switch remote := conn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			ip = remote.IP
+		case *net.UDPAddr:
+			ip = remote.IP
+		}
+		if ip != nil {
+			if err := g.check(host, ip); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,73 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestinationGuardBlocked(t *testing.T) {
+	guard := &goproxy.DestinationGuard{}
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00::1", "fe80::1"} {
+		assert.True(t, guard.Blocked(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:4700:4700::1111"} {
+		assert.False(t, guard.Blocked(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestDestinationGuard(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend string
+		host    string
+		allow   []string
+		action  *goproxy.ConnectAction
+		allowed bool
+	}{
+		{"http", srv.URL, "", nil, nil, false},
+		{"tunnel", https.URL, "", nil, goproxy.OkConnect, false},
+		{"mitm", https.URL, "", nil, goproxy.MitmConnect, false},
+		// The name resolves to a loopback address
+		{"rebinding", srv.URL, "public.test", nil, nil, false},
+		{"allowed-network", srv.URL, "", []string{"127.0.0.0/8"}, nil, true},
+		{"allowed-host", https.URL, "public.test", []string{"public.test"}, goproxy.MitmConnect, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.Resolver = staticResolver{"public.test": true}
+			proxy.DestinationGuard = &goproxy.DestinationGuard{Allow: test.allow}
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			u, err := url.Parse(test.backend)
+			require.NoError(t, err)
+			if test.host != "" {
+				u.Host = net.JoinHostPort(test.host, u.Port())
+			}
+			resp, err := client.Get(u.String() + "/bobo")
+			if !test.allowed {
+				if err == nil {
+					_ = resp.Body.Close()
+					assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+				}
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
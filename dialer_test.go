@@ -0,0 +1,105 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingDialer returns a dialer sending the dialed addresses to the
+// returned channel.
+func recordingDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), chan string) {
+	addrs := make(chan string, 10)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs <- addr
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}, addrs
+}
+
+func TestCtxDialer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dial, addrs := recordingDialer()
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			if test.action == nil {
+				proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+					ctx.Dialer = dial
+					return req, nil
+				})
+			} else {
+				// The MITM'd requests use the dialer of the CONNECT request
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					ctx.Dialer = dial
+					return test.action, host
+				})
+			}
+
+			target, err := url.Parse(test.url)
+			require.NoError(t, err)
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			assert.Equal(t, target.Host, <-addrs)
+		})
+	}
+}
+
+func TestCtxDialerWebSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+	dial, addrs := recordingDialer()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Dialer = dial
+		return req, nil
+	})
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+		backend.URL, backend.Listener.Addr())
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	assert.Equal(t, backend.Listener.Addr().String(), <-addrs)
+}
@@ -0,0 +1,97 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DialTargets maps destination hosts to the address that is actually
+// dialed, which can be a Unix domain socket ("unix:///run/app.sock") or
+// an alternate TCP target ("127.0.0.1:8443", or a host without port to keep
+// the original one).
+// Only the dialed address changes: the Host header and the TLS SNI of the
+// request still use the original destination.
+//
+// Set it as the proxy Hosts, it is then consulted before the DNS resolution
+// of the CONNECT, plain, MITM'd and WebSocket connections, like a hosts
+// file:
+//
+//	targets := goproxy.NewDialTargets()
+//	targets.Set("api.internal", "unix:///var/run/api.sock")
+//	targets.Set("www.example.com", "10.0.0.5")
+//	proxy.Hosts = targets
+//
+// It can also be installed on the proxy transport, as its DialContext.
+type DialTargets struct {
+	// Dialer is used to open the connections, a zero net.Dialer if nil.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.RWMutex
+	targets map[string]string
+}
+
+// NewDialTargets returns an empty DialTargets table.
+func NewDialTargets() *DialTargets {
+	return &DialTargets{targets: make(map[string]string)}
+}
+
+// Set maps host (either "host" or "host:port") to target.
+// It can be safely called while the proxy is running.
+func (t *DialTargets) Set(host, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.targets == nil {
+		t.targets = make(map[string]string)
+	}
+	t.targets[strings.ToLower(host)] = target
+}
+
+// Remove deletes the mapping of host.
+func (t *DialTargets) Remove(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.targets, strings.ToLower(host))
+}
+
+// Lookup returns the network and the address to dial for addr,
+// an exact "host:port" mapping takes precedence over a "host" one.
+func (t *DialTargets) Lookup(network, addr string) (string, string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+
+	t.mu.RLock()
+	target, ok := t.targets[strings.ToLower(addr)]
+	if !ok {
+		target, ok = t.targets[host]
+	}
+	t.mu.RUnlock()
+	if !ok {
+		return network, addr, false
+	}
+
+	if path, isUnix := strings.CutPrefix(target, "unix://"); isUnix {
+		return "unix", path, true
+	}
+	if path, isUnix := strings.CutPrefix(target, "unix:"); isUnix {
+		return "unix", path, true
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil && port != "" {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), port)
+	}
+	return network, target, true
+}
+
+// DialContext dials the target mapped to addr, or addr itself.
+func (t *DialTargets) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	network, addr, _ = t.Lookup(network, addr)
+	if t.Dialer != nil {
+		return t.Dialer(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
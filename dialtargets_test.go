@@ -0,0 +1,98 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialTargetsLookup(t *testing.T) {
+	targets := goproxy.NewDialTargets()
+	targets.Set("api.internal", "unix:///run/api.sock")
+	targets.Set("web.internal", "127.0.0.1")
+	targets.Set("web.internal:8443", "10.0.0.1:443")
+
+	testCases := []struct {
+		addr, network, target string
+		ok                    bool
+	}{
+		{"api.internal:80", "unix", "/run/api.sock", true},
+		{"API.internal:443", "unix", "/run/api.sock", true},
+		{"web.internal:80", "tcp", "127.0.0.1:80", true},
+		{"web.internal:8443", "tcp", "10.0.0.1:443", true},
+		{"other:80", "tcp", "other:80", false},
+	}
+	for _, tc := range testCases {
+		network, target, ok := targets.Lookup("tcp", tc.addr)
+		assert.Equal(t, tc.ok, ok, tc.addr)
+		assert.Equal(t, tc.network, network, tc.addr)
+		assert.Equal(t, tc.target, target, tc.addr)
+	}
+
+	targets.Remove("api.internal")
+	_, _, ok := targets.Lookup("tcp", "api.internal:80")
+	assert.False(t, ok)
+}
+
+func TestDialTargetsUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	var gotHost string
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		_, _ = io.WriteString(w, "from unix socket")
+	})}
+	go func() { _ = s.Serve(l) }()
+	defer s.Close()
+
+	targets := goproxy.NewDialTargets()
+	targets.Set("app.internal", "unix://"+sock)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.DialContext = targets.DialContext
+	client, ps := oneShotProxy(proxy)
+	defer ps.Close()
+
+	body := getOrFail(t, "http://app.internal/hello", client)
+	assert.Equal(t, "from unix socket", string(body))
+	assert.Equal(t, "app.internal", gotHost)
+}
+
+func TestProxyHosts(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend string
+		action  *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			// The mapping takes precedence over the resolver
+			proxy.Resolver = staticResolver{}
+			proxy.Hosts = goproxy.NewDialTargets()
+			proxy.Hosts.Set("staging.test", "127.0.0.1")
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+
+			u, err := url.Parse(test.backend)
+			require.NoError(t, err)
+			u.Host = net.JoinHostPort("staging.test", u.Port())
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, u.String()+"/bobo"))
+		})
+	}
+}
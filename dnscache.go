@@ -0,0 +1,340 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDNSCacheEntries bounds the number of host names cached by a DNSCache.
+const maxDNSCacheEntries = 10000
+
+// DNSCache is a Resolver caching the lookups of another one, so that the
+// busy destinations aren't resolved for every connection. The "no such
+// host" answers are cached too. It counts the lookups, to check its
+// efficiency:
+//
+//	cache := goproxy.NewDNSCache(goproxy.NewDoHResolver("https://1.1.1.1/dns-query", nil))
+//	proxy.Resolver = cache
+//	...
+//	stats := cache.Stats()
+//
+// The addresses are kept as long as the TTL of their records when Resolver
+// is a *net.Resolver: the cache then queries the DNS servers of Resolver
+// with the pure Go resolver, to read the TTLs of their answers.
+type DNSCache struct {
+	// Resolver answers the lookups missing from the cache,
+	// net.DefaultResolver if nil.
+	Resolver Resolver
+	// TTL is the lifetime of the addresses whose TTL is unknown, a minute
+	// if zero.
+	TTL time.Duration
+	// MaxTTL bounds the lifetime of the cached addresses, an hour if zero.
+	MaxTTL time.Duration
+	// NegativeTTL is the lifetime of the "no such host" answers whose TTL
+	// is unknown, 30 seconds if zero. A negative value disables their
+	// caching.
+	NegativeTTL time.Duration
+
+	mu           sync.Mutex
+	entries      map[string]dnsCacheEntry
+	ttlOnce      sync.Once
+	ttlResolver  *net.Resolver
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+}
+
+// DNSCacheStats are the counters of a DNSCache.
+type DNSCacheStats struct {
+	// Hits and NegativeHits are the numbers of lookups answered by the
+	// cache, with addresses or with a "no such host" error.
+	Hits         int64
+	NegativeHits int64
+	// Misses is the number of lookups sent to the Resolver.
+	Misses int64
+	// Entries is the number of cached host names.
+	Entries int
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// NewDNSCache returns a DNSCache of the lookups of resolver,
+// net.DefaultResolver if nil.
+func NewDNSCache(resolver Resolver) *DNSCache {
+	return &DNSCache{Resolver: resolver}
+}
+
+// LookupIPAddr implements Resolver.
+func (c *DNSCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		if entry.err != nil {
+			c.negativeHits.Add(1)
+			return nil, entry.err
+		}
+		c.hits.Add(1)
+		return append([]net.IPAddr(nil), entry.addrs...), nil
+	}
+	c.misses.Add(1)
+
+	ttls := &dnsTTLs{}
+	addrs, err := c.resolver().LookupIPAddr(context.WithValue(ctx, dnsTTLsKey{}, ttls), host)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		ttl, known := ttls.get(false)
+		if !known {
+			ttl = c.TTL
+			if ttl == 0 {
+				ttl = time.Minute
+			}
+		}
+		c.store(key, dnsCacheEntry{addrs: append([]net.IPAddr(nil), addrs...)}, now, ttl)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound && c.NegativeTTL >= 0:
+		ttl, known := ttls.get(true)
+		if !known {
+			ttl = c.NegativeTTL
+			if ttl == 0 {
+				ttl = 30 * time.Second
+			}
+		}
+		c.store(key, dnsCacheEntry{err: err}, now, ttl)
+	}
+	return addrs, err
+}
+
+func (c *DNSCache) store(key string, entry dnsCacheEntry, now time.Time, ttl time.Duration) {
+	maxTTL := c.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = time.Hour
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry.expires = now.Add(ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+	if len(c.entries) >= maxDNSCacheEntries {
+		for host, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, host)
+			}
+		}
+		for host := range c.entries {
+			if len(c.entries) < maxDNSCacheEntries {
+				break
+			}
+			delete(c.entries, host)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// Stats returns the counters of the cache.
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return DNSCacheStats{
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Entries:      entries,
+	}
+}
+
+// Flush empties the cache.
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// resolver returns the resolver of the missing lookups: for a
+// *net.Resolver, a pure Go resolver using its DNS servers and reading the
+// TTLs of their answers.
+func (c *DNSCache) resolver() Resolver {
+	r, ok := c.Resolver.(*net.Resolver)
+	if c.Resolver == nil {
+		r, ok = net.DefaultResolver, true
+	}
+	if !ok {
+		return c.Resolver
+	}
+	c.ttlOnce.Do(func() {
+		dial := r.Dial
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		c.ttlResolver = &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: r.StrictErrors,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dial(ctx, network, address)
+				ttls, _ := ctx.Value(dnsTTLsKey{}).(*dnsTTLs)
+				if err != nil || ttls == nil {
+					return conn, err
+				}
+				if _, ok := conn.(net.PacketConn); ok {
+					return &dnsPacketConn{Conn: conn, ttls: ttls}, nil
+				}
+				return &dnsStreamConn{Conn: conn, ttls: ttls}, nil
+			},
+		}
+	})
+	return c.ttlResolver
+}
+
+// dnsTTLsKey is the context key of the dnsTTLs of a lookup.
+type dnsTTLsKey struct{}
+
+// dnsTTLs collects the TTLs of the DNS answers of a lookup: the shortest
+// one of the records, and of the negative answers.
+type dnsTTLs struct {
+	mu                 sync.Mutex
+	positive, negative time.Duration
+	hasPositive        bool
+	hasNegative        bool
+}
+
+func (t *dnsTTLs) get(negative bool) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if negative {
+		return t.negative, t.hasNegative
+	}
+	return t.positive, t.hasPositive
+}
+
+// observe records the TTLs of the DNS message msg, see RFC 2308 for the
+// negative answers.
+func (t *dnsTTLs) observe(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	answered := false
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeA || h.Type == dnsmessage.TypeAAAA || h.Type == dnsmessage.TypeCNAME {
+			answered = true
+			t.record(false, time.Duration(h.TTL)*time.Second)
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+	if answered {
+		return
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return
+		}
+		ttl := h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		t.record(true, time.Duration(ttl)*time.Second)
+		return
+	}
+}
+
+func (t *dnsTTLs) record(negative bool, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if negative {
+		if !t.hasNegative || ttl < t.negative {
+			t.negative, t.hasNegative = ttl, true
+		}
+	} else if !t.hasPositive || ttl < t.positive {
+		t.positive, t.hasPositive = ttl, true
+	}
+}
+
+// dnsPacketConn observes the DNS messages read from a UDP connection.
+type dnsPacketConn struct {
+	net.Conn
+	ttls *dnsTTLs
+}
+
+func (c *dnsPacketConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		c.ttls.observe(b[:n])
+	}
+	return n, err
+}
+
+func (c *dnsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.Conn.(net.PacketConn).ReadFrom(b)
+	if err == nil {
+		c.ttls.observe(b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *dnsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Conn.(net.PacketConn).WriteTo(b, addr)
+}
+
+// dnsStreamConn observes the DNS messages read from a TCP or TLS
+// connection, prefixed with their length.
+type dnsStreamConn struct {
+	net.Conn
+	ttls *dnsTTLs
+	buf  []byte
+}
+
+func (c *dnsStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+length {
+			break
+		}
+		c.ttls.observe(c.buf[2 : 2+length])
+		c.buf = c.buf[2+length:]
+	}
+	return n, err
+}
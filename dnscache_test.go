@@ -0,0 +1,128 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ttlDNSServer returns a DoH server answering the A queries of
+// cached.test. with a TTL of a minute, of volatile.test. with a TTL of
+// zero, and the other ones with a "no such host" cached for a minute, and
+// the number of queries it received.
+func ttlDNSServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var queries atomic.Int32
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		query, _ := io.ReadAll(r.Body)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(query))
+		msg.Header.Response = true
+		msg.Header.RecursionAvailable = true
+		q := msg.Questions[0]
+		var ttl uint32
+		switch q.Name.String() {
+		case "cached.test.":
+			ttl = 60
+		case "volatile.test.":
+		default:
+			msg.Header.RCode = dnsmessage.RCodeNameError
+			soa, _ := dnsmessage.NewName("test.")
+			msg.Authorities = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: soa, Type: dnsmessage.TypeSOA, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.SOAResource{NS: soa, MBox: soa, Serial: 1, MinTTL: 60},
+			}}
+		}
+		if msg.Header.RCode == dnsmessage.RCodeSuccess && q.Type == dnsmessage.TypeA {
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+			}}
+		}
+		answer, err := msg.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answer)
+	}))
+	return s, &queries
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	s, queries := ttlDNSServer(t)
+	defer s.Close()
+	cache := goproxy.NewDNSCache(goproxy.NewDoHResolver(s.URL+"/dns-query", s.Client()))
+
+	for _, test := range []struct {
+		host   string
+		cached bool
+		err    bool
+	}{
+		{"cached.test", true, false},
+		{"volatile.test", false, false},
+		{"missing.test", true, true},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			before := queries.Load()
+			for i := 0; i < 2; i++ {
+				addrs, err := cache.LookupIPAddr(context.Background(), test.host)
+				if test.err {
+					var dnsErr *net.DNSError
+					require.ErrorAs(t, err, &dnsErr)
+					assert.True(t, dnsErr.IsNotFound)
+					continue
+				}
+				require.NoError(t, err)
+				require.Len(t, addrs, 1)
+				assert.Equal(t, "192.0.2.10", addrs[0].IP.String())
+			}
+			first := queries.Load() - before
+			require.Positive(t, first)
+			if test.cached {
+				_, _ = cache.LookupIPAddr(context.Background(), test.host)
+				assert.Equal(t, first, queries.Load()-before, "the second lookup is answered by the cache")
+			}
+		})
+	}
+
+	stats := cache.Stats()
+	assert.Equal(t, int64(2), stats.Hits)
+	assert.Equal(t, int64(2), stats.NegativeHits)
+	assert.Equal(t, int64(4), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+
+	cache.Flush()
+	assert.Zero(t, cache.Stats().Entries)
+}
+
+// countingResolver resolves every host to 192.0.2.20 and counts the
+// lookups.
+type countingResolver struct {
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	r.lookups.Add(1)
+	return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 20)}}, nil
+}
+
+func TestDNSCacheResolver(t *testing.T) {
+	resolver := &countingResolver{}
+	cache := goproxy.NewDNSCache(resolver)
+	for _, host := range []string{"example.test", "Example.Test.", "EXAMPLE.test"} {
+		addrs, err := cache.LookupIPAddr(context.Background(), host)
+		require.NoError(t, err)
+		require.Len(t, addrs, 1)
+		assert.Equal(t, "192.0.2.20", addrs[0].IP.String())
+	}
+	assert.Equal(t, int32(1), resolver.lookups.Load())
+	assert.Equal(t, goproxy.DNSCacheStats{Hits: 2, Misses: 1, Entries: 1}, cache.Stats())
+}
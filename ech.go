@@ -0,0 +1,39 @@
+package goproxy
+
+// ECHAction is what the proxy does with the MITM'd connections whose
+// client offered Encrypted Client Hello.
+type ECHAction int
+
+const (
+	// ECHStrip intercepts the connection as usual. The MITM handshake
+	// ignores the extension, as a server without the ECH keys would, and
+	// the connection to the remote server is made without ECH, so the
+	// certificate is generated for the public name of ServerName.
+	ECHStrip ECHAction = iota
+	// ECHTunnel tunnels the connection to the host of the CONNECT
+	// request without decrypting it.
+	ECHTunnel
+	// ECHReject closes the connection.
+	ECHReject
+)
+
+// ECHPolicy returns the action applied to a connection whose ClientHello
+// offers Encrypted Client Hello.
+type ECHPolicy func(hello *ClientHello, ctx *ProxyCtx) ECHAction
+
+// AlwaysECH returns an ECHPolicy applying action to all the ECH
+// connections.
+func AlwaysECH(action ECHAction) ECHPolicy {
+	return func(*ClientHello, *ProxyCtx) ECHAction {
+		return action
+	}
+}
+
+// echAction returns the action applied to the connection with the given
+// ClientHello, ECHStrip if it doesn't offer ECH.
+func (proxy *ProxyHttpServer) echAction(hello *ClientHello, ctx *ProxyCtx) ECHAction {
+	if proxy.ECHPolicy == nil || hello == nil || !hello.ECH {
+		return ECHStrip
+	}
+	return proxy.ECHPolicy(hello, ctx)
+}
@@ -0,0 +1,106 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echClientHello returns a TLS record holding a ClientHello for
+// serverName offering ECH.
+func echClientHello(serverName string) []byte {
+	sni := binary.BigEndian.AppendUint16(nil, uint16(len(serverName)+3))
+	sni = append(sni, 0)
+	sni = binary.BigEndian.AppendUint16(sni, uint16(len(serverName)))
+	sni = append(sni, serverName...)
+	ech := []byte{0, 0, 1, 0, 1, 0x42, 0, 0, 0, 0}
+
+	var exts []byte
+	for typ, data := range map[uint16][]byte{0x0000: sni, 0xfe0d: ech} {
+		exts = binary.BigEndian.AppendUint16(exts, typ)
+		exts = binary.BigEndian.AppendUint16(exts, uint16(len(data)))
+		exts = append(exts, data...)
+	}
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0, 0, 2, 0x13, 0x01, 1, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+
+	hello := []byte{1, 0, byte(len(body) >> 8), byte(len(body))}
+	hello = append(hello, body...)
+	record := []byte{0x16, 3, 1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hello)))
+	return append(record, hello...)
+}
+
+func TestParseClientHelloECH(t *testing.T) {
+	record := echClientHello("public.example")
+	hello, err := goproxy.ParseClientHello(record[5:])
+	require.NoError(t, err)
+	assert.True(t, hello.ECH)
+	assert.Equal(t, "public.example", hello.ServerName)
+}
+
+func TestECHPolicy(t *testing.T) {
+	record := echClientHello("public.example")
+	for _, action := range []goproxy.ECHAction{goproxy.ECHTunnel, goproxy.ECHReject} {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		received := make(chan []byte, 1)
+		go func() {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			b := make([]byte, len(record))
+			_, _ = io.ReadFull(c, b)
+			received <- b
+		}()
+
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.ConnectDial = nil
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		hellos := make(chan *goproxy.ClientHello, 1)
+		proxy.ECHPolicy = func(hello *goproxy.ClientHello, ctx *goproxy.ProxyCtx) goproxy.ECHAction {
+			hellos <- hello
+			return action
+		}
+		s := httptest.NewServer(proxy)
+		u, _ := url.Parse(s.URL)
+
+		c, err := net.Dial("tcp", u.Host)
+		require.NoError(t, err)
+		_, err = io.WriteString(c, "CONNECT "+backend.Addr().String()+" HTTP/1.1\r\nHost: "+backend.Addr().String()+"\r\n\r\n")
+		require.NoError(t, err)
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = c.Write(record)
+		require.NoError(t, err)
+
+		switch action {
+		case goproxy.ECHTunnel:
+			assert.Equal(t, record, <-received)
+		case goproxy.ECHReject:
+			_, err = br.ReadByte()
+			assert.ErrorIs(t, err, io.EOF)
+		}
+		assert.Equal(t, "public.example", (<-hellos).ServerName)
+
+		c.Close()
+		s.Close()
+		backend.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package goproxy
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ErrorTemplate renders the body of an ErrorPage from an ErrorPageData. It's
+// implemented by the templates of both html/template and text/template.
+type ErrorTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+// ErrorPage customizes the responses generated by the proxy with a status
+// code, e.g. the 407 challenges of the authentication schemes and the 403
+// denials of a Policy or the ClientACL, see ProxyHttpServer.ErrorPages:
+//
+//	proxy.ErrorPages = map[int]*goproxy.ErrorPage{
+//		http.StatusProxyAuthRequired: {Template: goproxy.BrowserErrorTemplate, CAURL: "http://proxy.lan:8080/ca.pem"},
+//		http.StatusForbidden:         {Template: goproxy.BrowserErrorTemplate},
+//	}
+type ErrorPage struct {
+	// Template, if set, renders the body of the response, replacing the
+	// generated one.
+	Template ErrorTemplate
+	// ContentType is the type of the rendered body. It defaults to
+	// "text/html; charset=utf-8".
+	ContentType string
+	// Header is set in the response, replacing the generated values, e.g.
+	// to challenge the clients with another realm.
+	Header http.Header
+	// CAURL, if set, is where the browsers download the MITM CA
+	// certificate, given to the Template.
+	CAURL string
+}
+
+// ErrorPageData is the data rendered by the Template of an ErrorPage.
+type ErrorPageData struct {
+	StatusCode int
+	// Status is the text of StatusCode, e.g. "Forbidden".
+	Status string
+	// Reason describes why the request was refused.
+	Reason string
+	// URL and Host are the ones of the refused request.
+	URL  string
+	Host string
+	// Client is the IP address of the client.
+	Client string
+	// User is the authenticated user, if any.
+	User string
+	// CAURL is the one of the ErrorPage.
+	CAURL string
+}
+
+// BrowserErrorTemplate is an ErrorTemplate rendering a page meant for web
+// browsers, explaining how to install the MITM CA certificate when the
+// CAURL of the ErrorPage is set.
+var BrowserErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.StatusCode}} {{.Status}}</title></head><body>
+<h1>{{.Status}}</h1>
+<p>The proxy refused the request to <code>{{.Host}}</code>{{with .Reason}}: {{.}}{{end}}.</p>
+{{if .User}}<p>Authenticated as <b>{{.User}}</b>.</p>
+{{end}}{{if .CAURL}}<h2>Installing the proxy CA certificate</h2>
+<p>Download the <a href="{{.CAURL}}">CA certificate</a> and add it to the trusted root certificates:</p>
+<ul>
+<li>Windows: open the file, choose <i>Install Certificate</i> and place it in <i>Trusted Root Certification Authorities</i>.</li>
+<li>macOS: open the file in <i>Keychain Access</i>, add it to the <i>System</i> keychain and set it to <i>Always Trust</i>.</li>
+<li>Linux: copy it to <code>/usr/local/share/ca-certificates/</code> with a <code>.crt</code> extension and run <code>update-ca-certificates</code>.</li>
+<li>Firefox: in <i>Settings &gt; Privacy &amp; Security &gt; Certificates</i>, choose <i>View Certificates</i>, then <i>Import</i> in the <i>Authorities</i> tab.</li>
+</ul>
+{{end}}</body></html>
+`))
+
+// ApplyErrorPage returns resp, a response generated for the request of ctx,
+// customized by the ErrorPage of the proxy for its status code, if any.
+// reason describes why the request was refused.
+func (ctx *ProxyCtx) ApplyErrorPage(resp *http.Response, reason string) *http.Response {
+	if ctx.Proxy == nil {
+		return resp
+	}
+	var user string
+	if ctx.User != nil {
+		user = ctx.User.Name
+	}
+	return ctx.Proxy.applyErrorPage(resp, ctx.Req, user, reason)
+}
+
+// applyErrorPage returns resp, answering req of the client authenticated
+// as user, customized by the ErrorPage for its status code, if any.
+func (proxy *ProxyHttpServer) applyErrorPage(resp *http.Response, req *http.Request, user, reason string) *http.Response {
+	page := proxy.ErrorPages[resp.StatusCode]
+	if page == nil {
+		return resp
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	for name, values := range page.Header {
+		resp.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if page.Template == nil {
+		return resp
+	}
+
+	data := &ErrorPageData{
+		StatusCode: resp.StatusCode,
+		Status:     http.StatusText(resp.StatusCode),
+		Reason:     reason,
+		User:       user,
+		CAURL:      page.CAURL,
+	}
+	if req != nil {
+		data.URL = req.URL.String()
+		data.Host = req.URL.Host
+		if data.Host == "" {
+			data.Host = req.Host
+		}
+		data.Client = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			data.Client = host
+		}
+	}
+	var body bytes.Buffer
+	if err := page.Template.Execute(&body, data); err != nil {
+		proxy.Logger.Printf("WARN: Can't render the error page for status %d: %v", resp.StatusCode, err)
+		return resp
+	}
+	if resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	contentType := page.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = int64(body.Len())
+	resp.Body = io.NopCloser(&body)
+	return resp
+}
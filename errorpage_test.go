@@ -0,0 +1,60 @@
+package goproxy_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorPages(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		page        *goproxy.ErrorPage
+		contentType string
+		body        []string
+	}{
+		{"none", nil, goproxy.ContentTypeText, []string{"Destination blocked by policy"}},
+		{"header-only", &goproxy.ErrorPage{Header: http.Header{"x-reason": {"policy"}}}, goproxy.ContentTypeText, []string{"Destination blocked by policy"}},
+		{"browser", &goproxy.ErrorPage{Template: goproxy.BrowserErrorTemplate, CAURL: "http://proxy.lan/ca.pem"}, "text/html; charset=utf-8", []string{
+			"<h1>Forbidden</h1>", "destination denied by policy", "Authenticated as <b>alice</b>", `<a href="http://proxy.lan/ca.pem">`,
+		}},
+		{"text", &goproxy.ErrorPage{
+			Template:    template.Must(template.New("json").Parse(`{"status":{{.StatusCode}},"host":"{{.Host}}","client":"{{.Client}}"}`)),
+			ContentType: "application/json",
+		}, "application/json", []string{`{"status":403,"host":"` + strings.TrimPrefix(srv.URL, "http://") + `","client":"127.0.0.1"}`}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			if test.page != nil {
+				proxy.ErrorPages = map[int]*goproxy.ErrorPage{http.StatusForbidden: test.page}
+			}
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				ctx.User = &goproxy.User{Name: "alice"}
+				return req, nil
+			})
+			proxy.OnRequest().Do(&goproxy.Policy{Default: goproxy.PolicyDeny})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			resp, err := client.Get(srv.URL + "/bobo")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.Equal(t, test.contentType, resp.Header.Get("Content-Type"))
+			for _, expected := range test.body {
+				assert.Contains(t, string(body), expected)
+			}
+			if test.page != nil && test.page.Header != nil {
+				assert.Equal(t, "policy", resp.Header.Get("X-Reason"))
+			}
+		})
+	}
+}
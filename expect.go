@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// ExpectContinueAction tells the proxy how to handle a MITM request carrying
+// an "Expect: 100-continue" header.
+type ExpectContinueAction int
+
+const (
+	// ExpectContinueSend makes the proxy answer "100 Continue" to the client
+	// by itself, as soon as the request body is needed. This is the default.
+	ExpectContinueSend ExpectContinueAction = iota
+	// ExpectContinueForward forwards the expectation to the remote server,
+	// the client receives "100 Continue" only when the server sends it.
+	ExpectContinueForward
+	// ExpectContinueReject replies to the client with the final response
+	// returned by the handler, without reading the request body.
+	ExpectContinueReject
+)
+
+// ExpectContinueHandler decides how a request with an "Expect: 100-continue"
+// header is handled. The returned response is only used with
+// ExpectContinueReject, a nil response results in 417 Expectation Failed.
+type ExpectContinueHandler func(req *http.Request, ctx *ProxyCtx) (ExpectContinueAction, *http.Response)
+
+// expectContinue applies the ExpectContinueHandler of the proxy to req,
+// writing interim responses to client. A non-nil response means that the
+// request must not be sent and the connection closed after the response.
+func (proxy *ProxyHttpServer) expectContinue(
+	req *http.Request,
+	ctx *ProxyCtx,
+	client io.Writer,
+) (*http.Request, *http.Response) {
+	if !headerContains(req.Header, "Expect", "100-continue") {
+		return req, nil
+	}
+
+	action, resp := ExpectContinueSend, (*http.Response)(nil)
+	if proxy.ExpectContinueHandler != nil {
+		action, resp = proxy.ExpectContinueHandler(req, ctx)
+	}
+	switch action {
+	case ExpectContinueReject:
+		ctx.Logf("Rejecting Expect: 100-continue request")
+		if resp == nil {
+			resp = NewResponse(req, ContentTypeText, http.StatusExpectationFailed, "")
+		}
+		resp.Close = true
+		return req, resp
+	case ExpectContinueForward:
+		var once sync.Once
+		trace := &httptrace.ClientTrace{
+			Got100Continue: func() {
+				once.Do(func() {
+					ctx.Logf("Forwarding 100 Continue to client")
+					if _, err := io.WriteString(client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+						ctx.Warnf("Cannot write 100 Continue to client: %v", err)
+					}
+				})
+			},
+		}
+		return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), nil
+	default:
+		req.Header.Del("Expect")
+		req.Body = &expectContinueReader{ReadCloser: req.Body, ctx: ctx, w: client}
+		return req, nil
+	}
+}
+
+// expectContinueReader sends "100 Continue" to the client on the first read
+// of the request body, like the net/http server does.
+type expectContinueReader struct {
+	io.ReadCloser
+	ctx  *ProxyCtx
+	w    io.Writer
+	once sync.Once
+}
+
+func (r *expectContinueReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		if _, err := io.WriteString(r.w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			r.ctx.Warnf("Cannot write 100 Continue to client: %v", err)
+		}
+	})
+	return r.ReadCloser.Read(p)
+}
@@ -0,0 +1,84 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmExpectContinue(t *testing.T) {
+	echo := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	testCases := []struct {
+		name       string
+		handler    goproxy.ExpectContinueHandler
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "default",
+			wantStatus: http.StatusOK,
+			wantBody:   "payload",
+		},
+		{
+			name: "forward",
+			handler: func(req *http.Request, ctx *goproxy.ProxyCtx) (goproxy.ExpectContinueAction, *http.Response) {
+				return goproxy.ExpectContinueForward, nil
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   "payload",
+		},
+		{
+			name: "reject",
+			handler: func(req *http.Request, ctx *goproxy.ProxyCtx) (goproxy.ExpectContinueAction, *http.Response) {
+				return goproxy.ExpectContinueReject, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "too big")
+			},
+			wantStatus: http.StatusForbidden,
+			wantBody:   "too big",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			proxy.ExpectContinueHandler = tc.handler
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+
+			proxyURL, _ := url.Parse(s.URL)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:                 http.ProxyURL(proxyURL),
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+				ExpectContinueTimeout: 10 * time.Second,
+			}}
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, echo.URL, strings.NewReader("payload"))
+			require.NoError(t, err)
+			req.Header.Set("Expect", "100-continue")
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Less(t, time.Since(start), 5*time.Second)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			assert.Equal(t, tc.wantBody, string(body))
+		})
+	}
+}
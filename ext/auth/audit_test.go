@@ -0,0 +1,61 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+func TestRequireAudit(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	var mu sync.Mutex
+	var events []goproxy.AuditEvent
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.AuditSink = goproxy.AuditSinkFunc(func(e *goproxy.AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, *e)
+	})
+	auth.Require(proxy, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"alice": "secret"}})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for _, credentials := range [][]string{nil, {"alice", "wrong"}, {"alice", "secret"}} {
+		req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+		if credentials != nil {
+			req.SetBasicAuth(credentials[0], credentials[1])
+			req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+			req.Header.Del("Authorization")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []goproxy.AuditEvent{
+		{Kind: goproxy.AuditChallenge},
+		{Kind: goproxy.AuditFailure, User: "alice", Scheme: "Basic"},
+		{Kind: goproxy.AuditSuccess, User: "alice", Scheme: "Basic"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range events {
+		if e.Kind != expected[i].Kind || e.User != expected[i].User || e.Scheme != expected[i].Scheme {
+			t.Errorf("event %d: got %+v, expected %+v", i, e, expected[i])
+		}
+		if e.Client != "127.0.0.1" || e.Destination != background.Listener.Addr().String() {
+			t.Errorf("event %d: client %q, destination %q", i, e.Client, e.Destination)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ErrInvalidCredentials is returned by the Authenticators rejecting the
+// credentials, unlike the other errors telling that the identity backend
+// failed.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks the credentials of the clients against an
+// identity backend, e.g. an LDAP directory, an OIDC provider (resource
+// owner password grant) or a RADIUS server, and returns the authenticated
+// user with its groups and attributes. See BasicScheme.Authenticator.
+type Authenticator interface {
+	Authenticate(ctx context.Context, user, password string) (*goproxy.User, error)
+}
+
+// AuthenticatorFunc is a function implementing Authenticator.
+type AuthenticatorFunc func(ctx context.Context, user, password string) (*goproxy.User, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, user, password string) (*goproxy.User, error) {
+	return f(ctx, user, password)
+}
+
+// FailurePolicy is what a CachedAuthenticator does when its backend
+// fails.
+type FailurePolicy int
+
+const (
+	// FailClosed rejects the credentials.
+	FailClosed FailurePolicy = iota
+	// FailStale accepts the credentials accepted by the backend before,
+	// even if their cache entry expired.
+	FailStale
+	// FailOpen accepts the credentials, the user being the one they claim.
+	FailOpen
+)
+
+// CachedAuthenticator caches the successful authentications of its
+// Authenticator, so that the backend isn't called for every request:
+//
+//	backend := &auth.CachedAuthenticator{Authenticator: ldapAuthenticator, TTL: 5 * time.Minute, OnFailure: auth.FailStale}
+//	auth.Require(proxy, &auth.BasicScheme{Realm: "proxy", Authenticator: backend})
+//
+// The credentials are cached hashed.
+type CachedAuthenticator struct {
+	Authenticator Authenticator
+	// TTL is the lifetime of the cached authentications, one minute by
+	// default.
+	TTL time.Duration
+	// Timeout, if set, bounds the calls to the backend.
+	Timeout time.Duration
+	// OnFailure is what is done when the backend fails.
+	OnFailure FailurePolicy
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedUser
+}
+
+type cachedUser struct {
+	user    *goproxy.User
+	expires time.Time
+}
+
+func (a *CachedAuthenticator) now() time.Time {
+	if a.Now != nil {
+		return a.Now()
+	}
+	return time.Now()
+}
+
+func (a *CachedAuthenticator) Authenticate(ctx context.Context, user, password string) (*goproxy.User, error) {
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := a.now()
+	a.mu.Lock()
+	cached, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.user, nil
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+	authenticated, err := a.Authenticator.Authenticate(ctx, user, password)
+	if err == nil && authenticated == nil {
+		err = ErrInvalidCredentials
+	}
+	switch {
+	case err == nil:
+		ttl := a.TTL
+		if ttl <= 0 {
+			ttl = time.Minute
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.cache == nil {
+			a.cache = make(map[[sha256.Size]byte]cachedUser)
+		}
+		for k, c := range a.cache {
+			if !now.Before(c.expires) {
+				delete(a.cache, k)
+			}
+		}
+		a.cache[key] = cachedUser{user: authenticated, expires: now.Add(ttl)}
+		return authenticated, nil
+	case errors.Is(err, ErrInvalidCredentials):
+		// The credentials may have been revoked
+		a.mu.Lock()
+		delete(a.cache, key)
+		a.mu.Unlock()
+		return nil, err
+	case a.OnFailure == FailOpen:
+		return &goproxy.User{Name: user}, nil
+	case a.OnFailure == FailStale && ok:
+		return cached.user, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,110 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+// directory is an Authenticator standing for an identity backend.
+type directory struct {
+	calls int
+	down  bool
+}
+
+func (d *directory) Authenticate(_ context.Context, user, password string) (*goproxy.User, error) {
+	d.calls++
+	if d.down {
+		return nil, errors.New("directory unreachable")
+	}
+	if user != "alice" || password != "secret" {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return &goproxy.User{Name: user, Groups: []string{"staff"}}, nil
+}
+
+func TestCachedAuthenticator(t *testing.T) {
+	for _, test := range []struct {
+		policy     auth.FailurePolicy
+		cachedOK   bool
+		unknownOK  bool
+		staleUsers bool
+	}{
+		{auth.FailClosed, false, false, false},
+		{auth.FailStale, true, false, true},
+		{auth.FailOpen, true, true, false},
+	} {
+		backend := &directory{}
+		now := time.Unix(1000, 0)
+		cached := &auth.CachedAuthenticator{Authenticator: backend, TTL: time.Minute, OnFailure: test.policy, Now: func() time.Time { return now }}
+		ctx := context.Background()
+
+		for i := 0; i < 3; i++ {
+			user, err := cached.Authenticate(ctx, "alice", "secret")
+			if err != nil || user == nil || user.Name != "alice" {
+				t.Fatalf("policy %d: alice wasn't authenticated: %v", test.policy, err)
+			}
+		}
+		if backend.calls != 1 {
+			t.Fatalf("policy %d: expected one call to the backend, got %d", test.policy, backend.calls)
+		}
+		if _, err := cached.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, auth.ErrInvalidCredentials) {
+			t.Fatalf("policy %d: wrong password accepted: %v", test.policy, err)
+		}
+
+		// The backend fails once the cache entry expired
+		now = now.Add(2 * time.Minute)
+		backend.down = true
+		user, err := cached.Authenticate(ctx, "alice", "secret")
+		if ok := err == nil && user != nil; ok != test.cachedOK {
+			t.Errorf("policy %d: known user accepted %v, expected %v", test.policy, ok, test.cachedOK)
+		}
+		if test.staleUsers && (user == nil || !user.InGroup("staff")) {
+			t.Errorf("policy %d: the cached groups weren't returned", test.policy)
+		}
+		user, err = cached.Authenticate(ctx, "bob", "secret")
+		if ok := err == nil && user != nil; ok != test.unknownOK {
+			t.Errorf("policy %d: unknown user accepted %v, expected %v", test.policy, ok, test.unknownOK)
+		}
+	}
+}
+
+func TestRequireAuthenticator(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	auth.Require(proxy, &auth.BasicScheme{Realm: "proxy", Authenticator: &auth.CachedAuthenticator{Authenticator: &directory{}}})
+	proxy.OnRequest(goproxy.Not(goproxy.UserInGroup("staff"))).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "staff only")
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for _, test := range []struct {
+		userinfo *url.Userinfo
+		status   int
+	}{
+		{url.UserPassword("alice", "secret"), http.StatusOK},
+		{url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+	} {
+		proxyURL, _ := url.Parse(s.URL)
+		proxyURL.User = test.userinfo
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status %d, expected %d", test.userinfo, resp.StatusCode, test.status)
+		}
+	}
+}
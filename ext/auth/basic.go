@@ -1,9 +1,7 @@
 package auth
 
 import (
-	"bytes"
 	"encoding/base64"
-	"io"
 	"net/http"
 	"strings"
 
@@ -14,37 +12,32 @@ var unauthorizedMsg = []byte("407 Proxy Authentication Required")
 
 func BasicUnauthorized(req *http.Request, realm string) *http.Response {
 	// TODO(elazar): verify realm is well formed
-	return &http.Response{
-		StatusCode: http.StatusProxyAuthRequired,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Request:    req,
-		Header: http.Header{
-			"Proxy-Authenticate": []string{"Basic realm=" + realm},
-			"Proxy-Connection":   []string{"close"},
-		},
-		Body:          io.NopCloser(bytes.NewBuffer(unauthorizedMsg)),
-		ContentLength: int64(len(unauthorizedMsg)),
-	}
+	return Unauthorized(req, "Basic realm="+realm)
 }
 
 var proxyAuthorizationHeader = "Proxy-Authorization"
 
-func auth(req *http.Request, f func(user, passwd string) bool) bool {
-	authheader := strings.SplitN(req.Header.Get(proxyAuthorizationHeader), " ", 2)
-	req.Header.Del(proxyAuthorizationHeader)
-	if len(authheader) != 2 || authheader[0] != "Basic" {
-		return false
+func auth(req *http.Request, ctx *goproxy.ProxyCtx, f func(user, passwd string) bool) bool {
+	defer req.Header.Del(proxyAuthorizationHeader)
+	if user, passwd, ok := parseBasic(req.Header.Get(proxyAuthorizationHeader)); ok && f(user, passwd) {
+		ctx.User = &goproxy.User{Name: user}
 	}
-	userpassraw, err := base64.StdEncoding.DecodeString(authheader[1])
-	if err != nil {
-		return false
+	audit(req, ctx, "Basic")
+	return ctx.User != nil
+}
+
+// parseBasic returns the user name and password of the Basic credentials
+// of the Proxy-Authorization header value.
+func parseBasic(header string) (user, passwd string, ok bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
 	}
-	userpass := strings.SplitN(string(userpassraw), ":", 2)
-	if len(userpass) != 2 {
-		return false
+	userpassraw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
 	}
-	return f(userpass[0], userpass[1])
+	return strings.Cut(string(userpassraw), ":")
 }
 
 // Basic returns a basic HTTP authentication handler for requests
@@ -52,8 +45,8 @@ func auth(req *http.Request, f func(user, passwd string) bool) bool {
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func Basic(realm string, f func(user, passwd string) bool) goproxy.ReqHandler {
 	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		if !auth(req, f) {
-			return nil, BasicUnauthorized(req, realm)
+		if !auth(req, ctx, f) {
+			return nil, ctx.ApplyErrorPage(BasicUnauthorized(req, realm), "authentication required")
 		}
 		return req, nil
 	})
@@ -64,8 +57,8 @@ func Basic(realm string, f func(user, passwd string) bool) goproxy.ReqHandler {
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func BasicConnect(realm string, f func(user, passwd string) bool) goproxy.HttpsHandler {
 	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if !auth(ctx.Req, f) {
-			ctx.Resp = BasicUnauthorized(ctx.Req, realm)
+		if !auth(ctx.Req, ctx, f) {
+			ctx.Resp = ctx.ApplyErrorPage(BasicUnauthorized(ctx.Req, realm), "authentication required")
 			return goproxy.RejectConnect, host
 		}
 		return nil, host
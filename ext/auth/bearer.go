@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// TokenValidator checks the bearer tokens of the clients of the proxy, see
+// BearerScheme.
+type TokenValidator interface {
+	// ValidateToken returns the user authenticated by token, or nil if
+	// it's invalid.
+	ValidateToken(token string) *goproxy.User
+}
+
+// TokenValidatorFunc is a function implementing TokenValidator.
+type TokenValidatorFunc func(token string) *goproxy.User
+
+func (f TokenValidatorFunc) ValidateToken(token string) *goproxy.User {
+	return f(token)
+}
+
+// Tokens is a TokenValidator mapping the valid tokens to the names of
+// their users.
+type Tokens map[string]string
+
+func (t Tokens) ValidateToken(token string) *goproxy.User {
+	for valid, user := range t {
+		if subtle.ConstantTimeCompare([]byte(valid), []byte(token)) == 1 {
+			return &goproxy.User{Name: user}
+		}
+	}
+	return nil
+}
+
+// JWTValidator is a TokenValidator accepting the JSON Web Tokens (RFC
+// 7519) signed with Key, whose user is their subject, in the groups of
+// their "groups" claim. Key is a []byte
+// secret for HS256, an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey
+// for ES256, the algorithms of the other tokens are refused.
+type JWTValidator struct {
+	Key any
+	// Issuer and Audience, if set, are the required "iss" and "aud"
+	// claims of the tokens.
+	Issuer   string
+	Audience string
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+}
+
+// jwtClaims are the claims of a JWT checked by JWTValidator.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Groups    []string        `json:"groups"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func (v *JWTValidator) ValidateToken(token string) *goproxy.User {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims jwtClaims
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || decodeJWTPart(parts[0], &header) != nil || decodeJWTPart(parts[1], &claims) != nil {
+		return nil
+	}
+	if !v.verify(header.Alg, parts[0]+"."+parts[1], signature) {
+		return nil
+	}
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	seconds := float64(now.UnixNano()) / float64(time.Second)
+	if (claims.ExpiresAt != nil && seconds >= *claims.ExpiresAt) ||
+		(claims.NotBefore != nil && seconds < *claims.NotBefore) ||
+		(v.Issuer != "" && claims.Issuer != v.Issuer) ||
+		(v.Audience != "" && !claims.hasAudience(v.Audience)) ||
+		claims.Subject == "" {
+		return nil
+	}
+	return &goproxy.User{Name: claims.Subject, Groups: claims.Groups}
+}
+
+// verify tells whether signature is the one of signed with the key of v
+// and the algorithm alg.
+func (v *JWTValidator) verify(alg, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := v.Key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(signed))
+		return alg == "HS256" && hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	}
+	return false
+}
+
+// hasAudience tells whether audience is one of the audiences of the
+// claims, a string or an array of strings.
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var audiences []string
+	if json.Unmarshal(c.Audience, &audiences) != nil {
+		var single string
+		if json.Unmarshal(c.Audience, &single) != nil {
+			return false
+		}
+		audiences = []string{single}
+	}
+	for _, a := range audiences {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJWTPart decodes the base64url encoded JSON part of a JWT into v.
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// BearerScheme is the Bearer authentication Scheme (RFC 6750), checking
+// the tokens of the clients with its Validator, e.g. for the scripted
+// clients holding an API token rather than a user name and password.
+type BearerScheme struct {
+	Realm     string
+	Validator TokenValidator
+}
+
+func (s *BearerScheme) Authenticate(req *http.Request) *goproxy.User {
+	scheme, token, ok := strings.Cut(req.Header.Get(proxyAuthorizationHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return nil
+	}
+	return s.Validator.ValidateToken(token)
+}
+
+func (s *BearerScheme) Challenge(req *http.Request) string {
+	challenge := "Bearer realm=" + quote(s.Realm)
+	if scheme, _, _ := strings.Cut(req.Header.Get(proxyAuthorizationHeader), " "); strings.EqualFold(scheme, "Bearer") {
+		challenge += `, error="invalid_token"`
+	}
+	return challenge
+}
@@ -0,0 +1,104 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+// jwt returns the token of claims signed with sign.
+func jwt(alg, claims string, sign func(signed []byte) []byte) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestRequireBearer(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	secret := []byte("secret")
+	hs256 := func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	now := func() time.Time { return time.Unix(1000, 0) }
+
+	for _, test := range []struct {
+		name      string
+		validator auth.TokenValidator
+		token     string
+		user      string
+	}{
+		{"static", auth.Tokens{"t0ken": "robot"}, "t0ken", "robot"},
+		{"static-invalid", auth.Tokens{"t0ken": "robot"}, "token", ""},
+		{"callback", auth.TokenValidatorFunc(func(token string) *goproxy.User {
+			return &goproxy.User{Name: "cb-" + token}
+		}), "abc", "cb-abc"},
+		{"hs256", &auth.JWTValidator{Key: secret, Issuer: "idp", Audience: "proxy", Now: now},
+			jwt("HS256", `{"sub":"alice","iss":"idp","aud":["proxy"],"exp":2000}`, hs256), "alice"},
+		{"hs256-expired", &auth.JWTValidator{Key: secret, Now: now},
+			jwt("HS256", `{"sub":"alice","exp":999}`, hs256), ""},
+		{"hs256-audience", &auth.JWTValidator{Key: secret, Audience: "proxy", Now: now},
+			jwt("HS256", `{"sub":"alice","aud":"other"}`, hs256), ""},
+		{"alg-none", &auth.JWTValidator{Key: secret, Now: now},
+			jwt("none", `{"sub":"alice"}`, func([]byte) []byte { return nil }), ""},
+		{"es256", &auth.JWTValidator{Key: &ecKey.PublicKey, Now: now},
+			jwt("ES256", `{"sub":"bob","nbf":900}`, es256), "bob"},
+		{"es256-wrong-alg", &auth.JWTValidator{Key: &ecKey.PublicKey, Now: now},
+			jwt("HS256", `{"sub":"bob"}`, hs256), ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			auth.Require(proxy, &auth.BearerScheme{Realm: "proxy", Validator: test.validator})
+			var user string
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				user = ctx.User.Name
+				return req, nil
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+			req.Header.Set("Proxy-Authorization", "Bearer "+test.token)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if test.user == "" {
+				expected := `Bearer realm="proxy", error="invalid_token"`
+				if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != expected {
+					t.Fatalf("status %d, challenge %q", resp.StatusCode, resp.Header.Get("Proxy-Authenticate"))
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK || user != test.user {
+				t.Fatalf("status %d, user %q, expected %q", resp.StatusCode, user, test.user)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// CertificateScheme authenticates the clients connecting to the proxy
+// over TLS with their client certificate (mutual TLS), see
+// goproxy.ProxyHttpServer.ServeTLS. The proxy must request the
+// certificates, and verify them with its client CAs:
+//
+//	proxy.ProxyTLSConfig = &tls.Config{Certificates: certs, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+//	auth.Require(proxy, &auth.CertificateScheme{})
+//
+// The user is named by the common name of the certificate subject, or its
+// first subject alternative name, and its attributes hold the "cn", "san"
+// and SHA-256 "fingerprint" of the certificate. Listing the schemes after
+// it lets the clients without certificate use another one.
+type CertificateScheme struct {
+	// Users, if set, maps the common names, subject alternative names, or
+	// "sha256:" and the hex encoded fingerprints of the certificates to
+	// their users, e.g. to put them in groups: the certificates not
+	// mapped are rejected. The certificates mapped by fingerprint are
+	// accepted even if the proxy doesn't verify them.
+	Users map[string]*goproxy.User
+}
+
+func (s *CertificateScheme) Authenticate(req *http.Request) *goproxy.User {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := req.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	names := certificateNames(cert)
+	verified := len(req.TLS.VerifiedChains) > 0
+
+	if s.Users != nil {
+		if user := s.Users["sha256:"+fingerprint]; user != nil {
+			return user
+		}
+		if !verified {
+			return nil
+		}
+		for _, name := range names {
+			if user := s.Users[name]; user != nil {
+				return user
+			}
+		}
+		return nil
+	}
+	if !verified || len(names) == 0 {
+		return nil
+	}
+	return &goproxy.User{Name: names[0], Attributes: map[string]string{
+		"cn":          cert.Subject.CommonName,
+		"san":         strings.Join(names[1:], ","),
+		"fingerprint": fingerprint,
+	}}
+}
+
+// Challenge returns no challenge, the certificates being requested during
+// the TLS handshake.
+func (s *CertificateScheme) Challenge(*http.Request) string {
+	return ""
+}
+
+// certificateNames returns the common name of the subject of cert, if
+// any, then its subject alternative names.
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.EmailAddresses...)
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
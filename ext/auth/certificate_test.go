@@ -0,0 +1,132 @@
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+// newCertificate returns a certificate for name, signed by parent, or
+// self-signed if parent is nil.
+func newCertificate(t *testing.T, name string, parent *tls.Certificate, isCA bool) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRequireCertificate(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	ca := newCertificate(t, "CA", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	alice := newCertificate(t, "alice", ca, false)
+	selfSigned := newCertificate(t, "robot", nil, false)
+	sum := sha256.Sum256(selfSigned.Leaf.Raw)
+	robot := &goproxy.User{Name: "robot", Groups: []string{"automation"}}
+
+	for _, test := range []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		users      map[string]*goproxy.User
+		cert       *tls.Certificate
+		userinfo   *url.Userinfo
+		user       string
+	}{
+		{"verified", tls.VerifyClientCertIfGiven, nil, alice, nil, "alice"},
+		{"mapped", tls.VerifyClientCertIfGiven, map[string]*goproxy.User{"alice": {Name: "Alice"}}, alice, nil, "Alice"},
+		{"not-mapped", tls.VerifyClientCertIfGiven, map[string]*goproxy.User{"bob": {Name: "bob"}}, alice, nil, ""},
+		{"pinned", tls.RequestClientCert, map[string]*goproxy.User{"sha256:" + hex.EncodeToString(sum[:]): robot}, selfSigned, nil, "robot"},
+		{"not-verified", tls.RequestClientCert, nil, selfSigned, nil, ""},
+		{"basic-fallback", tls.VerifyClientCertIfGiven, nil, nil, url.UserPassword("bob", "secret"), "bob"},
+		{"anonymous", tls.VerifyClientCertIfGiven, nil, nil, nil, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.ProxyTLSConfig = &tls.Config{
+				Certificates: []tls.Certificate{*newCertificate(t, "proxy", ca, false)},
+				ClientAuth:   test.clientAuth,
+			}
+			// The clients only send the certificates of the CAs listed by the
+			// proxy, if any
+			if test.clientAuth == tls.VerifyClientCertIfGiven {
+				proxy.ProxyTLSConfig.ClientCAs = pool
+			}
+			auth.Require(proxy, &auth.CertificateScheme{Users: test.users}, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"bob": "secret"}})
+			var user string
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				user = ctx.User.Name
+				return req, nil
+			})
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go proxy.ServeTLS(l)
+
+			proxyURL := &url.URL{Scheme: "https", Host: l.Addr().String(), User: test.userinfo}
+			tlsConfig := &tls.Config{RootCAs: pool}
+			if test.cert != nil {
+				tlsConfig.Certificates = []tls.Certificate{*test.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig}}
+			resp, err := client.Get(background.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if test.user == "" {
+				if resp.StatusCode != http.StatusProxyAuthRequired || len(resp.Header.Values("Proxy-Authenticate")) != 1 {
+					t.Fatalf("status %d, challenges %q", resp.StatusCode, resp.Header.Values("Proxy-Authenticate"))
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK || user != test.user {
+				t.Fatalf("status %d, user %q, expected %q", resp.StatusCode, user, test.user)
+			}
+		})
+	}
+}
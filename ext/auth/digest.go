@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// PasswordStore returns the passwords of the users, which the Digest
+// scheme needs to check their credentials.
+type PasswordStore interface {
+	Password(user string) (password string, ok bool)
+}
+
+func (u Users) Password(user string) (string, bool) {
+	password, ok := u[user]
+	return password, ok
+}
+
+// defaultNonceLifetime is the lifetime of the Digest nonces by default.
+const defaultNonceLifetime = 5 * time.Minute
+
+// DigestScheme is the Digest authentication Scheme (RFC 7616) with
+// qop=auth, checking the credentials of the clients against the passwords
+// of its Passwords. Unlike Basic, the passwords aren't sent in clear over
+// the connections to the proxy.
+//
+// The nonces are signed by the scheme and expire after NonceLifetime, 5
+// minutes by default: the clients are then challenged with a fresh nonce
+// marked as stale, which they use without asking the user again. The
+// nonce counts of the clients must increase, so that their requests can't
+// be replayed.
+type DigestScheme struct {
+	Realm     string
+	Passwords PasswordStore
+	// Algorithm is the hash algorithm, "MD5" by default or "SHA-256".
+	Algorithm     string
+	NonceLifetime time.Duration
+
+	once sync.Once
+	key  []byte
+	mu   sync.Mutex
+	// counts are the last nonce counts of the nonces in use, the expired
+	// ones are forgotten once per lifetime, at sweep
+	counts map[string]nonceCount
+	sweep  time.Time
+}
+
+type nonceCount struct {
+	nc      uint64
+	expires time.Time
+}
+
+func (s *DigestScheme) init() {
+	s.once.Do(func() {
+		s.key = make([]byte, 32)
+		_, _ = rand.Read(s.key)
+		s.counts = make(map[string]nonceCount)
+	})
+}
+
+func (s *DigestScheme) algorithm() string {
+	if s.Algorithm == "" {
+		return "MD5"
+	}
+	return s.Algorithm
+}
+
+func (s *DigestScheme) lifetime() time.Duration {
+	if s.NonceLifetime <= 0 {
+		return defaultNonceLifetime
+	}
+	return s.NonceLifetime
+}
+
+// newHash returns the hash of the algorithm of s.
+func (s *DigestScheme) newHash() hash.Hash {
+	if strings.EqualFold(s.algorithm(), "SHA-256") {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// digest returns the hex encoded hash of the values joined by colons.
+func (s *DigestScheme) digest(values ...string) string {
+	h := s.newHash()
+	_, _ = h.Write([]byte(strings.Join(values, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// nonce returns a new nonce, its issue time signed by the scheme.
+func (s *DigestScheme) nonce(now time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)[:8+16])
+}
+
+// nonceAge returns the time elapsed since the nonce was issued, and
+// whether the nonce was issued by the scheme.
+func (s *DigestScheme) nonceAge(nonce string, now time.Time) (time.Duration, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+16 {
+		return 0, false
+	}
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil)[:16], b[8:]) {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))), true
+}
+
+// useNonce records the nonce count nc of the client for nonce, which
+// expires at expires, and tells whether it's greater than the last one.
+func (s *DigestScheme) useNonce(nonce string, nc uint64, expires, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.sweep) {
+		for n, count := range s.counts {
+			if now.After(count.expires) {
+				delete(s.counts, n)
+			}
+		}
+		s.sweep = now.Add(s.lifetime())
+	}
+	if nc <= s.counts[nonce].nc {
+		return false
+	}
+	s.counts[nonce] = nonceCount{nc: nc, expires: expires}
+	return true
+}
+
+func (s *DigestScheme) Authenticate(req *http.Request) *goproxy.User {
+	s.init()
+	params, ok := parseDigest(req.Header.Get(proxyAuthorizationHeader))
+	if !ok || params["realm"] != s.Realm || params["qop"] != "auth" ||
+		(params["algorithm"] != "" && !strings.EqualFold(params["algorithm"], s.algorithm())) {
+		return nil
+	}
+	if uri := params["uri"]; uri != req.RequestURI && uri != req.URL.RequestURI() {
+		return nil
+	}
+	now := time.Now()
+	nonce := params["nonce"]
+	age, ok := s.nonceAge(nonce, now)
+	if !ok || age > s.lifetime() {
+		return nil
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || params["cnonce"] == "" {
+		return nil
+	}
+	user := params["username"]
+	password, ok := s.Passwords.Password(user)
+	if !ok {
+		return nil
+	}
+	ha1 := s.digest(user, s.Realm, password)
+	ha2 := s.digest(req.Method, params["uri"])
+	expected := s.digest(ha1, nonce, params["nc"], params["cnonce"], "auth", ha2)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(params["response"]))) || !s.useNonce(nonce, nc, now.Add(s.lifetime()-age), now) {
+		return nil
+	}
+	return &goproxy.User{Name: user}
+}
+
+func (s *DigestScheme) Challenge(req *http.Request) string {
+	s.init()
+	now := time.Now()
+	challenge := "Digest realm=" + quote(s.Realm) + `, qop="auth", algorithm=` + s.algorithm() +
+		", nonce=" + quote(s.nonce(now))
+	// The clients reuse their credentials with a fresh nonce
+	if params, ok := parseDigest(req.Header.Get(proxyAuthorizationHeader)); ok {
+		if age, ok := s.nonceAge(params["nonce"], now); ok && age > s.lifetime() {
+			challenge += ", stale=true"
+		}
+	}
+	return challenge
+}
+
+// parseDigest returns the parameters of the Digest credentials of the
+// Proxy-Authorization header value.
+func parseDigest(header string) (map[string]string, bool) {
+	scheme, rest, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, false
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimLeft(value, " \t")
+		if strings.HasPrefix(value, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			if i == len(value) {
+				return nil, false
+			}
+			params[name], rest = b.String(), value[i+1:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[name], rest = strings.TrimSpace(value), ","+rest
+		}
+		rest = strings.TrimSpace(rest)
+		if rest != "" && !strings.HasPrefix(rest, ",") {
+			return nil, false
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return params, true
+}
@@ -0,0 +1,97 @@
+package auth_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+var nonceParam = regexp.MustCompile(`nonce="([^"]*)"`)
+
+// digestAuthorization returns the Digest credentials of user for the
+// challenge, as sent by a client.
+func digestAuthorization(newHash func() hash.Hash, challenge, user, password, method, uri, nc string) string {
+	h := func(values ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(values, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	nonce := nonceParam.FindStringSubmatch(challenge)[1]
+	response := h(h(user, "proxy", password), nonce, nc, "0a4f113b", "auth", h(method, uri))
+	return `Digest username="` + user + `", realm="proxy", nonce="` + nonce + `", uri="` + uri +
+		`", qop=auth, nc=` + nc + `, cnonce="0a4f113b", response="` + response + `"`
+}
+
+func TestRequireDigest(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	for _, test := range []struct {
+		name      string
+		algorithm string
+		newHash   func() hash.Hash
+		password  string
+		replay    bool
+		expire    bool
+		ok        bool
+	}{
+		{"md5", "", md5.New, "open sesame", false, false, true},
+		{"sha-256", "SHA-256", sha256.New, "open sesame", false, false, true},
+		{"wrong-password", "", md5.New, "sesame", false, false, false},
+		{"replayed", "", md5.New, "open sesame", true, false, false},
+		{"stale", "", md5.New, "open sesame", false, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			scheme := &auth.DigestScheme{Realm: "proxy", Passwords: auth.Users{"user": "open sesame"}, Algorithm: test.algorithm}
+			if test.expire {
+				scheme.NonceLifetime = time.Millisecond
+			}
+			proxy := goproxy.NewProxyHttpServer()
+			auth.Require(proxy, scheme)
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			get := func(authorization string) *http.Response {
+				req, _ := http.NewRequest(http.MethodGet, background.URL+"/", nil)
+				if authorization != "" {
+					req.Header.Set("Proxy-Authorization", authorization)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				return resp
+			}
+			resp := get("")
+			challenge := resp.Header.Get("Proxy-Authenticate")
+			if resp.StatusCode != http.StatusProxyAuthRequired || !strings.HasPrefix(challenge, `Digest realm="proxy", qop="auth"`) {
+				t.Fatalf("status %d, challenge %q", resp.StatusCode, challenge)
+			}
+			if test.expire {
+				time.Sleep(10 * time.Millisecond)
+			}
+			authorization := digestAuthorization(test.newHash, challenge, "user", test.password, http.MethodGet, background.URL+"/", "00000001")
+			resp = get(authorization)
+			if test.replay {
+				resp = get(authorization)
+			}
+			if ok := resp.StatusCode == http.StatusOK; ok != test.ok {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if stale := strings.Contains(resp.Header.Get("Proxy-Authenticate"), "stale=true"); stale != test.expire {
+				t.Errorf("stale %v, challenge %q", stale, resp.Header.Get("Proxy-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// NegotiateAcceptor validates the SPNEGO tokens sent by the clients with
+// the Negotiate scheme, e.g. with a keytab of the service principal of the
+// proxy, HTTP/proxy.example.com@EXAMPLE.COM. It's typically implemented
+// with a Kerberos library or the GSSAPI of the system.
+type NegotiateAcceptor interface {
+	// Accept returns the Kerberos principal authenticated by token, e.g.
+	// "alice@EXAMPLE.COM", or an error if it's invalid.
+	Accept(ctx context.Context, token []byte) (principal string, err error)
+}
+
+// NegotiateAcceptorFunc is a function implementing NegotiateAcceptor.
+type NegotiateAcceptorFunc func(ctx context.Context, token []byte) (string, error)
+
+func (f NegotiateAcceptorFunc) Accept(ctx context.Context, token []byte) (string, error) {
+	return f(ctx, token)
+}
+
+// NegotiateScheme is the Negotiate authentication Scheme (RFC 4559), with
+// which the domain-joined machines authenticate to the proxy with their
+// Kerberos tickets, without asking their users for credentials. The
+// tokens are validated by its Acceptor.
+//
+// The name of the authenticated user is its Kerberos principal, or its
+// part before the realm if StripRealm is set, the principal and the realm
+// being in the "principal" and "realm" attributes of the user. Only the
+// Kerberos mechanism, completed in a single round-trip, is supported, and
+// the token of the proxy for the mutual authentication isn't sent.
+type NegotiateScheme struct {
+	Acceptor   NegotiateAcceptor
+	StripRealm bool
+}
+
+func (s *NegotiateScheme) Authenticate(req *http.Request) *goproxy.User {
+	scheme, encoded, ok := strings.Cut(req.Header.Get(proxyAuthorizationHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Negotiate") {
+		return nil
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(token) == 0 {
+		return nil
+	}
+	principal, err := s.Acceptor.Accept(req.Context(), token)
+	if err != nil || principal == "" {
+		return nil
+	}
+	name, realm := principal, ""
+	if i := strings.LastIndexByte(principal, '@'); i >= 0 {
+		realm = principal[i+1:]
+		if s.StripRealm {
+			name = principal[:i]
+		}
+	}
+	return &goproxy.User{Name: name, Attributes: map[string]string{"principal": principal, "realm": realm}}
+}
+
+func (s *NegotiateScheme) Challenge(*http.Request) string {
+	return "Negotiate"
+}
@@ -0,0 +1,70 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+func TestRequireNegotiate(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	// The tokens of the test carry the principal in clear
+	acceptor := auth.NegotiateAcceptorFunc(func(_ context.Context, token []byte) (string, error) {
+		principal, ok := strings.CutPrefix(string(token), "krb5:")
+		if !ok {
+			return "", errors.New("invalid token")
+		}
+		return principal, nil
+	})
+	for _, test := range []struct {
+		name       string
+		stripRealm bool
+		token      string
+		user       string
+	}{
+		{"principal", false, "krb5:alice@EXAMPLE.COM", "alice@EXAMPLE.COM"},
+		{"strip-realm", true, "krb5:alice@EXAMPLE.COM", "alice"},
+		{"invalid", false, "ntlm:alice", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			auth.Require(proxy, &auth.NegotiateScheme{Acceptor: acceptor, StripRealm: test.stripRealm})
+			var user *goproxy.User
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				user = ctx.User
+				return req, nil
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+			req.Header.Set("Proxy-Authorization", "Negotiate "+base64.StdEncoding.EncodeToString([]byte(test.token)))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if test.user == "" {
+				if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != "Negotiate" {
+					t.Fatalf("status %d, challenge %q", resp.StatusCode, resp.Header.Get("Proxy-Authenticate"))
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusOK || user == nil || user.Name != test.user {
+				t.Fatalf("status %d, user %+v, expected %q", resp.StatusCode, user, test.user)
+			}
+			if user.Attributes["principal"] != "alice@EXAMPLE.COM" || user.Attributes["realm"] != "EXAMPLE.COM" {
+				t.Errorf("unexpected attributes %v", user.Attributes)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Scheme authenticates the clients of the proxy with an HTTP
+// authentication scheme, see Require.
+type Scheme interface {
+	// Authenticate returns the user authenticated by the
+	// Proxy-Authorization header of req, or nil if it's missing or invalid.
+	Authenticate(req *http.Request) *goproxy.User
+	// Challenge returns the Proxy-Authenticate header asking the client of
+	// req for its credentials, if any.
+	Challenge(req *http.Request) string
+}
+
+// Require makes proxy authenticate its clients with schemes before
+// processing their requests, CONNECT requests included: the clients which
+// aren't authenticated by any of them get a 407 response challenging them
+// with every scheme. It must be called before registering the other
+// handlers, which get the authenticated user in ctx.User:
+//
+//	auth.Require(proxy, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"alice": "secret"}})
+//
+// The MITM'd requests of an authenticated tunnel aren't authenticated
+// again. The Proxy-Authorization header isn't forwarded. See Sessions to
+// spare the authenticated clients the following challenges.
+func Require(proxy *goproxy.ProxyHttpServer, schemes ...Scheme) {
+	var cookies []*Sessions
+	for _, scheme := range schemes {
+		if sessions, ok := scheme.(*Sessions); ok && sessions.Cookie != "" {
+			cookies = append(cookies, sessions)
+		}
+	}
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		for _, sessions := range cookies {
+			defer sessions.stripCookie(req)
+		}
+		if ctx.User != nil {
+			return req, nil
+		}
+		defer req.Header.Del(proxyAuthorizationHeader)
+		if !authenticate(req, ctx, schemes) {
+			return nil, ctx.ApplyErrorPage(challenge(req, schemes), "authentication required")
+		}
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if !authenticate(ctx.Req, ctx, schemes) {
+			ctx.Resp = ctx.ApplyErrorPage(challenge(ctx.Req, schemes), "authentication required")
+			return goproxy.RejectConnect, host
+		}
+		return nil, host
+	})
+	if len(cookies) > 0 {
+		proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil || ctx.User == nil || ctx.Req.URL.Scheme != "http" {
+				return resp
+			}
+			for _, sessions := range cookies {
+				sessions.setCookie(resp, ctx.Req)
+			}
+			return resp
+		})
+	}
+}
+
+// authenticate sets ctx.User to the user authenticated by the first of
+// schemes accepting the credentials of req, and tells whether there's one.
+func authenticate(req *http.Request, ctx *goproxy.ProxyCtx, schemes []Scheme) bool {
+	for _, scheme := range schemes {
+		if user := scheme.Authenticate(req); user != nil {
+			ctx.User = user
+			if _, ok := scheme.(*Sessions); !ok {
+				startSessions(req, user, schemes)
+			}
+			audit(req, ctx, schemeName(scheme))
+			return true
+		}
+	}
+	audit(req, ctx, "")
+	return false
+}
+
+// startSessions opens a session for the client of req, authenticated as
+// user, in each of the Sessions among schemes.
+func startSessions(req *http.Request, user *goproxy.User, schemes []Scheme) {
+	for _, scheme := range schemes {
+		if sessions, ok := scheme.(*Sessions); ok {
+			sessions.start(req, user)
+		}
+	}
+}
+
+// audit reports the authentication of the client of req with scheme,
+// successful if ctx.User is set, to the AuditSink of the proxy.
+func audit(req *http.Request, ctx *goproxy.ProxyCtx, scheme string) {
+	if ctx.User != nil {
+		ctx.Audit(goproxy.AuditEvent{Kind: goproxy.AuditSuccess, Scheme: scheme})
+		return
+	}
+	header := req.Header.Get(proxyAuthorizationHeader)
+	if header == "" {
+		ctx.Audit(goproxy.AuditEvent{Kind: goproxy.AuditChallenge})
+		return
+	}
+	// The user claimed by the rejected credentials
+	scheme, _, _ = strings.Cut(header, " ")
+	user, _, _ := parseBasic(header)
+	if params, ok := parseDigest(header); ok {
+		user = params["username"]
+	}
+	ctx.Audit(goproxy.AuditEvent{Kind: goproxy.AuditFailure, Scheme: scheme, User: user})
+}
+
+// schemeName returns the name of the authentication scheme.
+func schemeName(scheme Scheme) string {
+	switch scheme.(type) {
+	case *BasicScheme:
+		return "Basic"
+	case *DigestScheme:
+		return "Digest"
+	case *BearerScheme:
+		return "Bearer"
+	case *NegotiateScheme:
+		return "Negotiate"
+	case *CertificateScheme:
+		return "Certificate"
+	case *Sessions:
+		return "Session"
+	}
+	return fmt.Sprintf("%T", scheme)
+}
+
+// challenge returns the 407 response asking the client of req for its
+// credentials with schemes.
+func challenge(req *http.Request, schemes []Scheme) *http.Response {
+	challenges := make([]string, 0, len(schemes))
+	for _, scheme := range schemes {
+		if challenge := scheme.Challenge(req); challenge != "" {
+			challenges = append(challenges, challenge)
+		}
+	}
+	return Unauthorized(req, challenges...)
+}
+
+// Unauthorized returns a 407 response to req with the Proxy-Authenticate
+// challenges.
+func Unauthorized(req *http.Request, challenges ...string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Proxy-Authenticate": challenges,
+			"Proxy-Connection":   []string{"close"},
+		},
+		Body:          io.NopCloser(bytes.NewBuffer(unauthorizedMsg)),
+		ContentLength: int64(len(unauthorizedMsg)),
+	}
+}
+
+// CredentialValidator checks the user names and passwords of the clients
+// of the proxy, e.g. against a user database, see BasicScheme.
+type CredentialValidator interface {
+	ValidateCredentials(user, password string) bool
+}
+
+// CredentialValidatorFunc is a function implementing CredentialValidator.
+type CredentialValidatorFunc func(user, password string) bool
+
+func (f CredentialValidatorFunc) ValidateCredentials(user, password string) bool {
+	return f(user, password)
+}
+
+// Users is a CredentialValidator mapping the user names to their
+// passwords.
+type Users map[string]string
+
+func (u Users) ValidateCredentials(user, password string) bool {
+	expected, ok := u[user]
+	// The passwords are compared anyway, not to tell the unknown users
+	// apart by the response time
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// BasicScheme is the Basic authentication Scheme (RFC 7617), checking the
+// credentials of the clients with its Validator.
+type BasicScheme struct {
+	Realm     string
+	Validator CredentialValidator
+	// Authenticator, if set, checks the credentials instead of Validator,
+	// e.g. against an external identity backend, and provides the groups
+	// and attributes of the users.
+	Authenticator Authenticator
+}
+
+func (s *BasicScheme) Authenticate(req *http.Request) *goproxy.User {
+	user, password, ok := parseBasic(req.Header.Get(proxyAuthorizationHeader))
+	if !ok {
+		return nil
+	}
+	if s.Authenticator != nil {
+		authenticated, err := s.Authenticator.Authenticate(req.Context(), user, password)
+		if err != nil {
+			return nil
+		}
+		return authenticated
+	}
+	if !s.Validator.ValidateCredentials(user, password) {
+		return nil
+	}
+	return &goproxy.User{Name: user}
+}
+
+func (s *BasicScheme) Challenge(*http.Request) string {
+	return "Basic realm=" + quote(s.Realm) + `, charset="UTF-8"`
+}
+
+// quote returns s as an HTTP quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
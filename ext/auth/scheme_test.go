@@ -0,0 +1,124 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+func TestRequireBasic(t *testing.T) {
+	var forwarded []string
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("Proxy-Authorization"))
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+	tlsBackground := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer tlsBackground.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	auth.Require(proxy, &auth.BasicScheme{Realm: `my "realm"`, Validator: auth.Users{"user": "open sesame"}})
+	var users []string
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		users = append(users, ctx.User.Name)
+		return req, nil
+	})
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for _, test := range []struct {
+		name     string
+		userinfo *url.Userinfo
+		target   string
+		status   int
+	}{
+		{"no-credentials", nil, background.URL, http.StatusProxyAuthRequired},
+		{"wrong-password", url.UserPassword("user", "sesame"), background.URL, http.StatusProxyAuthRequired},
+		{"unknown-user", url.UserPassword("other", "open sesame"), background.URL, http.StatusProxyAuthRequired},
+		{"http", url.UserPassword("user", "open sesame"), background.URL, http.StatusOK},
+		{"connect-no-credentials", nil, tlsBackground.URL, http.StatusProxyAuthRequired},
+		{"mitm", url.UserPassword("user", "open sesame"), tlsBackground.URL, http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			users = nil
+			proxyURL, _ := url.Parse(s.URL)
+			proxyURL.User = test.userinfo
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+			resp, err := client.Get(test.target)
+			if test.status == http.StatusProxyAuthRequired && test.target != background.URL {
+				if err == nil {
+					t.Fatal("CONNECT request accepted without credentials")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, expected %d", resp.StatusCode, test.status)
+			}
+			if resp.StatusCode != http.StatusOK {
+				expected := `Basic realm="my \"realm\"", charset="UTF-8"`
+				if challenge := resp.Header.Get("Proxy-Authenticate"); challenge != expected {
+					t.Errorf("challenge %q, expected %q", challenge, expected)
+				}
+				if len(users) != 0 {
+					t.Errorf("handlers called for the rejected request: %v", users)
+				}
+				return
+			}
+			if len(users) != 1 || users[0] != "user" {
+				t.Errorf("users %v, expected [user]", users)
+			}
+		})
+	}
+	for _, header := range forwarded {
+		if header != "" {
+			t.Errorf("Proxy-Authorization forwarded: %q", header)
+		}
+	}
+}
+
+func TestRequireErrorPage(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ErrorPages = map[int]*goproxy.ErrorPage{http.StatusProxyAuthRequired: {
+		Template: goproxy.BrowserErrorTemplate,
+		Header:   http.Header{"Proxy-Authenticate": {`Basic realm="Corporate proxy"`}},
+		CAURL:    "http://proxy.lan/ca.pem",
+	}}
+	auth.Require(proxy, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"user": "open sesame"}})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if challenge := resp.Header.Get("Proxy-Authenticate"); challenge != `Basic realm="Corporate proxy"` {
+		t.Errorf("challenge %q", challenge)
+	}
+	if !strings.Contains(string(body), "<h1>Proxy Authentication Required</h1>") || !strings.Contains(string(body), "http://proxy.lan/ca.pem") {
+		t.Errorf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// defaultSessionTTL is the lifetime of the Sessions by default.
+const defaultSessionTTL = 10 * time.Minute
+
+// Sessions is a Scheme remembering the users authenticated by the other
+// schemes given to Require, so that the following requests of the same
+// client connection, or of the same client IP address with PerIP, aren't
+// challenged again until the session expires. It must be given first:
+//
+//	auth.Require(proxy, &auth.Sessions{PerIP: true}, &auth.BasicScheme{Realm: "proxy", Validator: users})
+//
+// Without PerIP, the sessions are bound to the client connections by
+// ConnContext, which must be the ConnContext of the http.Server of the
+// proxy, and are forgotten with them.
+//
+// Browsers open a new connection for each CONNECT request, so PerIP is
+// needed to spare them the challenges of the tunnels, at the cost of
+// trusting every client sharing the IP address of an authenticated one.
+//
+// With Cookie set, the plain HTTP responses also set a cookie carrying the
+// session, signed and bound to the client IP address, so that the
+// following requests of the client to the same site reuse it over new
+// connections. The cookie is stripped from the forwarded requests.
+type Sessions struct {
+	// TTL is the lifetime of the sessions, 10 minutes by default. Each
+	// request authenticated by a session extends it.
+	TTL    time.Duration
+	PerIP  bool
+	Cookie string
+	Now    func() time.Time
+
+	once     sync.Once
+	key      []byte
+	mu       sync.Mutex
+	sessions map[string]*session
+	// byIP are the IDs of the sessions of the client IP addresses, with
+	// PerIP
+	byIP      map[string]string
+	lastSweep time.Time
+}
+
+type session struct {
+	user    *goproxy.User
+	expires time.Time
+}
+
+func (s *Sessions) init() {
+	s.once.Do(func() {
+		s.key = make([]byte, 32)
+		_, _ = rand.Read(s.key)
+		s.sessions = make(map[string]*session)
+		s.byIP = make(map[string]string)
+	})
+}
+
+func (s *Sessions) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *Sessions) ttl() time.Duration {
+	if s.TTL <= 0 {
+		return defaultSessionTTL
+	}
+	return s.TTL
+}
+
+// connSessionsKey is the context key of the connSessions of a client
+// connection.
+type connSessionsKey struct{}
+
+// connSessions are the IDs of the sessions of a client connection, by
+// Sessions.
+type connSessions struct {
+	mu  sync.Mutex
+	ids map[*Sessions]string
+}
+
+// ConnContext binds the Sessions to the client connections, it must be the
+// ConnContext of the http.Server of the proxy for the Sessions without
+// PerIP:
+//
+//	srv := &http.Server{Addr: ":8080", Handler: proxy, ConnContext: auth.ConnContext}
+func ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connSessionsKey{}, &connSessions{ids: make(map[*Sessions]string)})
+}
+
+// clientSession returns the ID of the session of the client of req: the
+// one of its connection, or of its IP address with PerIP.
+func (s *Sessions) clientSession(req *http.Request) (string, bool) {
+	if s.PerIP {
+		id, ok := s.byIP[clientIP(req)]
+		return id, ok
+	}
+	conn, _ := req.Context().Value(connSessionsKey{}).(*connSessions)
+	if conn == nil {
+		return "", false
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	id, ok := conn.ids[s]
+	return id, ok
+}
+
+// setClientSession sets the ID of the session of the client of req,
+// forgetting it if id is empty.
+func (s *Sessions) setClientSession(req *http.Request, id string) {
+	if s.PerIP {
+		if id == "" {
+			delete(s.byIP, clientIP(req))
+		} else {
+			s.byIP[clientIP(req)] = id
+		}
+		return
+	}
+	conn, _ := req.Context().Value(connSessionsKey{}).(*connSessions)
+	if conn == nil {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if id == "" {
+		delete(conn.ids, s)
+	} else {
+		conn.ids[s] = id
+	}
+}
+
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// Authenticate returns the user of the session of the client of req, if
+// any, found by its connection, IP address or cookie.
+func (s *Sessions) Authenticate(req *http.Request) *goproxy.User {
+	s.init()
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.clientSession(req)
+	if !ok {
+		if id, ok = s.cookieSession(req); !ok {
+			return nil
+		}
+	}
+	sess := s.sessions[id]
+	if sess == nil || !now.Before(sess.expires) {
+		s.setClientSession(req, "")
+		return nil
+	}
+	s.setClientSession(req, id)
+	sess.expires = now.Add(s.ttl())
+	return sess.user
+}
+
+func (s *Sessions) Challenge(*http.Request) string {
+	return ""
+}
+
+// start opens a session for the client of req, authenticated as user.
+func (s *Sessions) start(req *http.Request, user *goproxy.User) {
+	s.init()
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	s.sessions[id] = &session{user: user, expires: now.Add(s.ttl())}
+	s.setClientSession(req, id)
+}
+
+// sweep forgets the expired sessions, at most once per TTL.
+func (s *Sessions) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.ttl() {
+		return
+	}
+	s.lastSweep = now
+	for id, sess := range s.sessions {
+		if !now.Before(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	for ip, id := range s.byIP {
+		if _, ok := s.sessions[id]; !ok {
+			delete(s.byIP, ip)
+		}
+	}
+}
+
+// sign returns the signature of the session id bound to the client IP
+// address ip.
+func (s *Sessions) sign(id, ip string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id + "|" + ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cookieSession returns the session ID of the signed cookie of req, if
+// any.
+func (s *Sessions) cookieSession(req *http.Request) (string, bool) {
+	if s.Cookie == "" {
+		return "", false
+	}
+	cookie, err := req.Cookie(s.Cookie)
+	if err != nil {
+		return "", false
+	}
+	id, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(id, clientIP(req)))) {
+		return "", false
+	}
+	return id, true
+}
+
+// setCookie sets the cookie of the session of the client of req in resp.
+func (s *Sessions) setCookie(resp *http.Response, req *http.Request) {
+	s.init()
+	s.mu.Lock()
+	id, ok := s.clientSession(req)
+	sess := s.sessions[id]
+	var expires time.Time
+	if sess != nil {
+		expires = sess.expires
+	}
+	s.mu.Unlock()
+	if !ok || sess == nil {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     s.Cookie,
+		Value:    id + "." + s.sign(id, clientIP(req)),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// stripCookie removes the cookie of the sessions from req.
+func (s *Sessions) stripCookie(req *http.Request) {
+	cookies := req.Cookies()
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name == s.Cookie {
+			continue
+		}
+		kept = append(kept, cookie.String())
+	}
+	if len(kept) == len(cookies) {
+		return
+	}
+	req.Header.Del("Cookie")
+	if len(kept) > 0 {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,167 @@
+package auth_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/auth"
+)
+
+func TestSessions(t *testing.T) {
+	var cookies []string
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	now := time.Unix(1000, 0)
+	sessions := &auth.Sessions{TTL: time.Minute, Cookie: "proxy_session", Now: func() time.Time { return now }}
+	proxy := goproxy.NewProxyHttpServer()
+	auth.Require(proxy, sessions, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"user": "open sesame"}})
+	s := httptest.NewUnstartedServer(proxy)
+	s.Config.ConnContext = auth.ConnContext
+	s.Start()
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	get := func(client *http.Client, credentials bool, cookie string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+		if credentials {
+			req.SetBasicAuth("user", "open sesame")
+			req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+			req.Header.Del("Authorization")
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	}
+
+	client := newClient()
+	resp := get(client, true, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authenticated request: status %d", resp.StatusCode)
+	}
+	var session string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "proxy_session" {
+			session = cookie.Name + "=" + cookie.Value
+		}
+	}
+	if session == "" {
+		t.Fatal("no session cookie")
+	}
+	// The connection of the client is authenticated
+	if resp := get(client, false, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("same connection: status %d", resp.StatusCode)
+	}
+	// Another connection is authenticated by the cookie only
+	if resp := get(newClient(), false, ""); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("other connection: status %d", resp.StatusCode)
+	}
+	if resp := get(newClient(), false, "other=1; "+session); resp.StatusCode != http.StatusOK {
+		t.Errorf("other connection with the cookie: status %d", resp.StatusCode)
+	}
+	if resp := get(newClient(), false, session+"0"); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("forged cookie: status %d", resp.StatusCode)
+	}
+	for _, cookie := range cookies {
+		if strings.Contains(cookie, "proxy_session") {
+			t.Errorf("session cookie forwarded: %q", cookie)
+		}
+	}
+	if cookies[len(cookies)-1] != "other=1" {
+		t.Errorf("other cookies not forwarded: %q", cookies[len(cookies)-1])
+	}
+
+	now = now.Add(2 * time.Minute)
+	if resp := get(client, false, ""); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expired session: status %d", resp.StatusCode)
+	}
+}
+
+func TestSessionsPerIP(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	auth.Require(proxy, &auth.Sessions{PerIP: true}, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"user": "open sesame"}})
+	var users []string
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		users = append(users, ctx.User.Name)
+		return req, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for _, userinfo := range []*url.Userinfo{url.UserPassword("user", "open sesame"), nil} {
+		proxyURL, _ := url.Parse(s.URL)
+		proxyURL.User = userinfo
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: status %d", userinfo, resp.StatusCode)
+		}
+	}
+	if len(users) != 2 || users[1] != "user" {
+		t.Errorf("users %v", users)
+	}
+}
+
+func TestSessionsBoundToConnection(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	auth.Require(proxy, &auth.Sessions{}, &auth.BasicScheme{Realm: "proxy", Validator: auth.Users{"user": "open sesame"}})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "ok")
+	})
+
+	serve := func(conn context.Context, credentials bool) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(conn)
+		// The connections have the same address, e.g. a port reused behind
+		// a NAT
+		req.RemoteAddr = "192.0.2.1:40000"
+		if credentials {
+			req.SetBasicAuth("user", "open sesame")
+			req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+			req.Header.Del("Authorization")
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code
+	}
+	first := auth.ConnContext(context.Background(), nil)
+	if code := serve(first, true); code != http.StatusOK {
+		t.Fatalf("authenticated request: status %d", code)
+	}
+	if code := serve(first, false); code != http.StatusOK {
+		t.Errorf("same connection: status %d", code)
+	}
+	if code := serve(auth.ConnContext(context.Background(), nil), false); code != http.StatusProxyAuthRequired {
+		t.Errorf("other connection with the same address: status %d", code)
+	}
+	if code := serve(context.Background(), false); code != http.StatusProxyAuthRequired {
+		t.Errorf("connection without ConnContext: status %d", code)
+	}
+}
@@ -0,0 +1,175 @@
+// Package bandwidth aggregates the traffic going through the proxy by
+// client, destination and content type.
+package bandwidth
+
+import (
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Dimension is a key used to aggregate traffic.
+type Dimension int
+
+const (
+	// ByClient aggregates traffic by client IP address.
+	ByClient Dimension = iota
+	// ByDestination aggregates traffic by destination host.
+	ByDestination
+	// ByContentType aggregates traffic by response media type.
+	ByContentType
+)
+
+// Usage is the traffic accounted for a single key of a Dimension.
+type Usage struct {
+	Key           string
+	Requests      int64
+	RequestBytes  int64
+	ResponseBytes int64
+}
+
+// Total returns the bytes transferred in both directions.
+func (u Usage) Total() int64 {
+	return u.RequestBytes + u.ResponseBytes
+}
+
+// Accounting continuously aggregates the request and response body sizes
+// of the exchanges going through the proxy.
+//
+//	acc := bandwidth.NewAccounting()
+//	proxy.OnRequest().DoFunc(acc.OnRequest)
+//	proxy.OnResponse().DoFunc(acc.OnResponse)
+//	...
+//	for _, u := range acc.TopTalkers(bandwidth.ByClient, 10) { ... }
+type Accounting struct {
+	mu    sync.Mutex
+	usage [3]map[string]*Usage
+}
+
+// NewAccounting returns an empty Accounting.
+func NewAccounting() *Accounting {
+	a := &Accounting{}
+	a.Reset()
+	return a
+}
+
+// Reset discards all the aggregated data.
+func (a *Accounting) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.usage {
+		a.usage[i] = make(map[string]*Usage)
+	}
+}
+
+// OnRequest counts the request body bytes, to be registered with
+// proxy.OnRequest().DoFunc.
+func (a *Accounting) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	keys := [3]string{clientKey(req), req.URL.Hostname(), ""}
+	req.Body = &countingReader{ReadCloser: req.Body, done: func(n int64) {
+		a.add(keys, func(u *Usage) { u.RequestBytes += n })
+	}}
+	return req, nil
+}
+
+// OnResponse counts the response body bytes delivered to the client, to be
+// registered with proxy.OnResponse().DoFunc.
+func (a *Accounting) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	keys := [3]string{clientKey(ctx.Req), ctx.Req.URL.Hostname(), contentType(resp)}
+	a.add(keys, func(u *Usage) { u.Requests++ })
+	if resp.Body == nil {
+		return resp
+	}
+	resp.Body = &countingReader{ReadCloser: resp.Body, done: func(n int64) {
+		a.add(keys, func(u *Usage) { u.ResponseBytes += n })
+	}}
+	return resp
+}
+
+// TopTalkers returns the n keys of dim that transferred the most bytes,
+// in descending order. A non-positive n returns all the keys.
+func (a *Accounting) TopTalkers(dim Dimension, n int) []Usage {
+	a.mu.Lock()
+	result := make([]Usage, 0, len(a.usage[dim]))
+	for _, u := range a.usage[dim] {
+		result = append(result, *u)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total() != result[j].Total() {
+			return result[i].Total() > result[j].Total()
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// add applies f to the usage of every non-empty key.
+func (a *Accounting) add(keys [3]string, f func(u *Usage)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dim, key := range keys {
+		if key == "" {
+			continue
+		}
+		u, ok := a.usage[dim][key]
+		if !ok {
+			u = &Usage{Key: key}
+			a.usage[dim][key] = u
+		}
+		f(u)
+	}
+}
+
+func clientKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func contentType(resp *http.Response) string {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return "unknown"
+	}
+	return mediaType
+}
+
+// countingReader reports the number of bytes read when it's closed.
+type countingReader struct {
+	io.ReadCloser
+	n        int64
+	reported int32
+	done     func(n int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	if atomic.CompareAndSwapInt32(&r.reported, 0, 1) {
+		r.done(atomic.LoadInt64(&r.n))
+	}
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,80 @@
+package bandwidth_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/bandwidth"
+)
+
+func TestTopTalkers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	})
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "ok")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	acc := bandwidth.NewAccounting()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(acc.OnRequest)
+	proxy.OnResponse().DoFunc(acc.OnResponse)
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	do := func(method, path, body string) {
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	do(http.MethodGet, "/big", "")
+	do(http.MethodPost, "/small", "hello")
+	do(http.MethodPost, "/small", "hello")
+	// Make sure that the proxy has finished with the last response
+	p.Close()
+
+	byType := acc.TopTalkers(bandwidth.ByContentType, 0)
+	if len(byType) != 2 {
+		t.Fatalf("Expected 2 content types, got %v", byType)
+	}
+	if byType[0].Key != "application/octet-stream" || byType[0].ResponseBytes != 1000 {
+		t.Errorf("Unexpected top content type %+v", byType[0])
+	}
+	if byType[1].Key != "text/plain" || byType[1].Requests != 2 || byType[1].ResponseBytes != 4 {
+		t.Errorf("Unexpected second content type %+v", byType[1])
+	}
+
+	byClient := acc.TopTalkers(bandwidth.ByClient, 1)
+	if len(byClient) != 1 || byClient[0].Key != "127.0.0.1" {
+		t.Fatalf("Unexpected clients %v", byClient)
+	}
+	if byClient[0].Requests != 3 || byClient[0].RequestBytes != 10 || byClient[0].ResponseBytes != 1004 {
+		t.Errorf("Unexpected client usage %+v", byClient[0])
+	}
+
+	acc.Reset()
+	if len(acc.TopTalkers(bandwidth.ByDestination, 0)) != 0 {
+		t.Error("Expected no data after reset")
+	}
+}
@@ -0,0 +1,283 @@
+// Package browserconfig generates the files needed to point a web browser
+// at the proxy: a PAC file, the MITM CA certificate, a Firefox
+// policies.json and the Chrome command line flags.
+package browserconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Paths of the files served by Config.Handler.
+const (
+	PACPath             = "/proxy.pac"
+	CAPath              = "/ca.pem"
+	FirefoxPoliciesPath = "/firefox/policies.json"
+	ChromeFlagsPath     = "/chrome.txt"
+)
+
+// Config describes how browsers reach the proxy. The bundle is generated
+// from the live configuration of Proxy and Listener, when set, so that it
+// follows the changes of the proxy:
+//
+//	cfg := &browserconfig.Config{Proxy: proxy, Listener: l}
+//	proxy.NonproxyHandler = cfg.Handler()
+//	log.Fatal(http.Serve(l, proxy))
+type Config struct {
+	// Proxy, if set, is the proxy the browsers are pointed at. Its CA, set
+	// by SetCA, is the one installed in the browsers unless CA is set, and
+	// the destinations refused by its DestinationGuard are reached
+	// directly, without the proxy.
+	Proxy *goproxy.ProxyHttpServer
+	// Listener, if set, is the listener of the proxy. ProxyAddr defaults to
+	// its address, with the host name of the machine when it listens on
+	// all the interfaces.
+	Listener net.Listener
+	// ProxyAddr is the host:port of the proxy, as seen by the browsers.
+	ProxyAddr string
+	// BaseURL is the URL where Handler is served, used to generate the
+	// PAC and CA download links. It defaults to "http://" + ProxyAddr,
+	// which works when Handler is used as the NonproxyHandler of the proxy.
+	BaseURL string
+	// CA is the certificate used by the proxy to sign the MITM
+	// certificates. It defaults to the CA of Proxy, or goproxy.GoproxyCa.
+	CA *tls.Certificate
+	// Bypass is the list of host patterns (e.g. "*.internal", "10.*")
+	// that must be reached directly, without the proxy.
+	// Plain host names (without dots) always bypass the proxy.
+	Bypass []string
+	// CAFile is the path where the CA will be installed on the client
+	// machines, used in the Firefox policies. It defaults to "goproxy-ca.pem".
+	CAFile string
+}
+
+// Bundle contains everything needed to configure a browser.
+type Bundle struct {
+	ProxyAddr       string
+	PACURL          string
+	CAURL           string
+	PAC             string
+	CA              []byte
+	FirefoxPolicies []byte
+	ChromeFlags     string
+}
+
+// Bundle generates the browser configuration from the current Config,
+// and the current configuration of its Proxy.
+func (c *Config) Bundle() (*Bundle, error) {
+	addr, err := c.proxyAddr()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.ca()
+	if err != nil {
+		return nil, err
+	}
+	baseURL := c.baseURL(addr)
+	policies, err := c.firefoxPolicies(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{
+		ProxyAddr:       addr,
+		PACURL:          baseURL + PACPath,
+		CAURL:           baseURL + CAPath,
+		PAC:             c.pac(addr),
+		CA:              pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		FirefoxPolicies: policies,
+		ChromeFlags:     chromeFlags(baseURL, cert),
+	}, nil
+}
+
+// proxyAddr returns ProxyAddr, or the address of Listener.
+func (c *Config) proxyAddr() (string, error) {
+	if c.ProxyAddr != "" {
+		return c.ProxyAddr, nil
+	}
+	if c.Listener == nil {
+		return "", errors.New("browserconfig: empty proxy address")
+	}
+	addr := c.Listener.Addr().String()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("browserconfig: listener address: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if host, err = os.Hostname(); err != nil {
+			return "", fmt.Errorf("browserconfig: listener address: %w", err)
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	return addr, nil
+}
+
+func (c *Config) baseURL(addr string) string {
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/")
+	}
+	return "http://" + addr
+}
+
+func (c *Config) ca() (*x509.Certificate, error) {
+	ca := c.CA
+	if ca == nil && c.Proxy != nil {
+		ca = c.Proxy.CA()
+	}
+	if ca == nil {
+		ca = &goproxy.GoproxyCa
+	}
+	if ca.Leaf != nil {
+		return ca.Leaf, nil
+	}
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("browserconfig: empty CA certificate")
+	}
+	return x509.ParseCertificate(ca.Certificate[0])
+}
+
+// guardedNetworks are the IPv4 networks refused by a DestinationGuard.
+var guardedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+}
+
+func (c *Config) pac(addr string) string {
+	proxy := strconv.Quote("PROXY " + addr)
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)) {\n\t\treturn \"DIRECT\";\n\t}\n")
+	for _, pattern := range c.Bypass {
+		fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) {\n\t\treturn \"DIRECT\";\n\t}\n", strconv.Quote(pattern))
+	}
+	if c.Proxy != nil && c.Proxy.DestinationGuard != nil {
+		// The proxy refuses the private destinations it doesn't allow
+		var allowedNetworks []string
+		for _, allowed := range c.Proxy.DestinationGuard.Allow {
+			if strings.Contains(allowed, "/") {
+				allowedNetworks = append(allowedNetworks, allowed)
+				continue
+			}
+			fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) {\n\t\treturn %s;\n\t}\n", strconv.Quote(allowed), proxy)
+		}
+		b.WriteString("\tvar addr = dnsResolve(host);\n")
+		b.WriteString("\tif (addr) {\n")
+		writeIsInNet(&b, allowedNetworks, proxy)
+		writeIsInNet(&b, guardedNetworks, `"DIRECT"`)
+		b.WriteString("\t}\n")
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n", proxy)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeIsInNet writes the PAC statements returning result for the
+// addresses of the IPv4 networks, given in CIDR notation.
+func writeIsInNet(b *strings.Builder, networks []string, result string) {
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+		fmt.Fprintf(b, "\t\tif (isInNet(addr, %q, %q)) {\n\t\t\treturn %s;\n\t\t}\n",
+			ipNet.IP.String(), net.IP(ipNet.Mask).String(), result)
+	}
+}
+
+func (c *Config) firefoxPolicies(baseURL string) ([]byte, error) {
+	caFile := c.CAFile
+	if caFile == "" {
+		caFile = "goproxy-ca.pem"
+	}
+	policies := map[string]any{
+		"policies": map[string]any{
+			"Proxy": map[string]any{
+				"Mode":          "autoConfig",
+				"AutoConfigURL": baseURL + PACPath,
+			},
+			"Certificates": map[string]any{
+				"Install": []string{caFile},
+			},
+		},
+	}
+	return json.MarshalIndent(policies, "", "  ")
+}
+
+// chromeFlags trusts the CA through its public key hash, since Chrome
+// doesn't have a command line flag to add a root certificate.
+func chromeFlags(baseURL string, cert *x509.Certificate) string {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return fmt.Sprintf("--proxy-pac-url=%s --ignore-certificate-errors-spki-list=%s",
+		baseURL+PACPath, base64.StdEncoding.EncodeToString(spki[:]))
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>Proxy configuration</title></head><body>
+<h1>Proxy configuration</h1>
+<ul>
+<li>Proxy: <code>{{.Addr}}</code></li>
+<li>PAC file: <a href="{{.Bundle.PACURL}}">{{.Bundle.PACURL}}</a></li>
+<li>CA certificate: <a href="{{.Bundle.CAURL}}">{{.Bundle.CAURL}}</a></li>
+<li>Firefox: <a href="{{.FirefoxURL}}">policies.json</a></li>
+<li>Chrome: <code>{{.Bundle.ChromeFlags}}</code></li>
+</ul>
+</body></html>
+`))
+
+// Handler returns an http.Handler serving the bundle files, and an index
+// page linking them. The files are generated on each request, so changes to
+// the Config and to the proxy are visible immediately.
+//
+//	cfg := &browserconfig.Config{ProxyAddr: "proxy.lan:8080"}
+//	proxy.NonproxyHandler = cfg.Handler()
+func (c *Config) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle, err := c.Bundle()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case PACPath:
+			w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+			_, _ = w.Write([]byte(bundle.PAC))
+		case CAPath:
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Header().Set("Content-Disposition", `attachment; filename="goproxy-ca.pem"`)
+			_, _ = w.Write(bundle.CA)
+		case FirefoxPoliciesPath:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(bundle.FirefoxPolicies)
+		case ChromeFlagsPath:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte(bundle.ChromeFlags + "\n"))
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_ = indexTemplate.Execute(w, map[string]any{
+				"Addr":       bundle.ProxyAddr,
+				"Bundle":     bundle,
+				"FirefoxURL": c.baseURL(bundle.ProxyAddr) + FirefoxPoliciesPath,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package browserconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/browserconfig"
+)
+
+func TestBundle(t *testing.T) {
+	cfg := &browserconfig.Config{ProxyAddr: "proxy.lan:8080", Bypass: []string{"*.internal"}}
+	bundle, err := cfg.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bundle.PACURL != "http://proxy.lan:8080/proxy.pac" {
+		t.Errorf("Unexpected PAC URL %q", bundle.PACURL)
+	}
+	if !strings.Contains(bundle.PAC, `shExpMatch(host, "*.internal")`) ||
+		!strings.Contains(bundle.PAC, `return "PROXY proxy.lan:8080";`) {
+		t.Errorf("Unexpected PAC file:\n%s", bundle.PAC)
+	}
+
+	block, _ := pem.Decode(bundle.CA)
+	if block == nil {
+		t.Fatal("CA is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(goproxy.GoproxyCa.Leaf) {
+		t.Error("Expected the default goproxy CA")
+	}
+
+	var policies struct {
+		Policies struct {
+			Proxy struct {
+				AutoConfigURL string
+			}
+		}
+	}
+	if err := json.Unmarshal(bundle.FirefoxPolicies, &policies); err != nil {
+		t.Fatal(err)
+	}
+	if policies.Policies.Proxy.AutoConfigURL != bundle.PACURL {
+		t.Errorf("Unexpected Firefox policies %s", bundle.FirefoxPolicies)
+	}
+	if !strings.HasPrefix(bundle.ChromeFlags, "--proxy-pac-url="+bundle.PACURL+" --ignore-certificate-errors-spki-list=") {
+		t.Errorf("Unexpected Chrome flags %q", bundle.ChromeFlags)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	cfg := &browserconfig.Config{ProxyAddr: "proxy.lan:8080"}
+	srv := httptest.NewServer(cfg.Handler())
+	defer srv.Close()
+
+	for path, contentType := range map[string]string{
+		browserconfig.PACPath:             "application/x-ns-proxy-autoconfig",
+		browserconfig.CAPath:              "application/x-x509-ca-cert",
+		browserconfig.FirefoxPoliciesPath: "application/json",
+		"/":                               "text/html; charset=utf-8",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentType {
+			t.Errorf("Unexpected response for %s: %d %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// The configuration is read on every request
+	cfg.ProxyAddr = "other.lan:3128"
+	resp, err := http.Get(srv.URL + browserconfig.PACPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	pac, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(pac), "PROXY other.lan:3128") {
+		t.Errorf("PAC file wasn't updated:\n%s", pac)
+	}
+}
+
+func newCA(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestBundleFromProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.DestinationGuard = &goproxy.DestinationGuard{Allow: []string{"metrics.internal", "10.1.0.0/16"}}
+	ca := newCA(t)
+	proxy.SetCA(ca)
+
+	cfg := &browserconfig.Config{Proxy: proxy, Listener: l}
+	bundle, err := cfg.Bundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.ProxyAddr != l.Addr().String() || bundle.PACURL != "http://"+l.Addr().String()+"/proxy.pac" {
+		t.Errorf("Unexpected proxy address %q, PAC URL %q", bundle.ProxyAddr, bundle.PACURL)
+	}
+	for _, rule := range []string{
+		`if (shExpMatch(host, "metrics.internal")) {
+		return "PROXY ` + l.Addr().String() + `";`,
+		`if (isInNet(addr, "10.1.0.0", "255.255.0.0")) {
+			return "PROXY ` + l.Addr().String() + `";`,
+		`if (isInNet(addr, "192.168.0.0", "255.255.0.0")) {
+			return "DIRECT";`,
+	} {
+		if !strings.Contains(bundle.PAC, rule) {
+			t.Errorf("PAC file without %q:\n%s", rule, bundle.PAC)
+		}
+	}
+	if strings.Index(bundle.PAC, `"10.1.0.0"`) > strings.Index(bundle.PAC, `"10.0.0.0"`) {
+		t.Errorf("Allowed networks must be checked first:\n%s", bundle.PAC)
+	}
+	block, _ := pem.Decode(bundle.CA)
+	if block == nil || !ca.Leaf.Equal(&x509.Certificate{Raw: block.Bytes}) {
+		t.Error("Expected the CA of the proxy")
+	}
+
+	// The CA of the proxy is read on every call
+	proxy.SetCA(nil)
+	if bundle, err = cfg.Bundle(); err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(bundle.CA); block == nil || !goproxy.GoproxyCa.Leaf.Equal(&x509.Certificate{Raw: block.Bytes}) {
+		t.Error("Expected the default goproxy CA")
+	}
+}
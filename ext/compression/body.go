@@ -0,0 +1,240 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// OnRequestBody returns a ReqHandler handing the bodies of the requests to
+// f, read entirely and decoded from their content codings, and forwarding
+// the body returned by f, encoded again with the same codings. The codings
+// are the ones of encodings, Gzip, Deflate, Brotli and Zstd if none is
+// given: the bodies with other codings, or larger than MaxBodySize encoded
+// or decoded, are forwarded as is, without calling f.
+func OnRequestBody(f func(body []byte, req *http.Request, ctx *goproxy.ProxyCtx) []byte, encodings ...Encoding) goproxy.ReqHandler {
+	encodings = bodyEncodings(encodings)
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody {
+			return req, nil
+		}
+		body, untouched, err := rewriteBody(req.Header, req.Body, encodings, ctx, func(body []byte) []byte {
+			return f(body, req, ctx)
+		})
+		if untouched != nil {
+			req.Body = untouched
+		}
+		if body == nil {
+			return req, nil
+		}
+		req.Body = newBody(body, err)
+		req.GetBody = nil
+		req.ContentLength = -1
+		if err == nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				return newBody(body, nil), nil
+			}
+			req.ContentLength = int64(len(body))
+			req.TransferEncoding = nil
+		}
+		return req, nil
+	})
+}
+
+// OnResponseBody returns a RespHandler handing the bodies of the responses
+// to f, read entirely and decoded from their content codings, and
+// forwarding the body returned by f, encoded again with the same codings,
+// see OnRequestBody:
+//
+//	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).Do(compression.OnResponseBody(
+//		func(body []byte, resp *http.Response, ctx *goproxy.ProxyCtx) []byte {
+//			return bytes.ReplaceAll(body, []byte("http://"), []byte("https://"))
+//		}))
+func OnResponseBody(f func(body []byte, resp *http.Response, ctx *goproxy.ProxyCtx) []byte, encodings ...Encoding) goproxy.RespHandler {
+	encodings = bodyEncodings(encodings)
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+			return resp
+		}
+		body, untouched, err := rewriteBody(resp.Header, resp.Body, encodings, ctx, func(body []byte) []byte {
+			return f(body, resp, ctx)
+		})
+		if untouched != nil {
+			resp.Body = untouched
+		}
+		if body == nil {
+			return resp
+		}
+		resp.Body = newBody(body, err)
+		resp.ContentLength = -1
+		if err == nil {
+			resp.ContentLength = int64(len(body))
+			resp.TransferEncoding = nil
+		}
+		return resp
+	})
+}
+
+// MaxBodySize is the size above which the bodies, encoded or decoded, are
+// forwarded as is by OnRequestBody and OnResponseBody.
+var MaxBodySize int64 = 10 << 20
+
+func bodyEncodings(encodings []Encoding) []Encoding {
+	if len(encodings) == 0 {
+		return []Encoding{Gzip, Deflate, Brotli, Zstd}
+	}
+	return encodings
+}
+
+// errTooLarge is returned by decode for the bodies larger than MaxBodySize
+// once decoded.
+var errTooLarge = errors.New("body too large")
+
+// rewriteBody reads body, encoded with the content codings of header, and
+// returns the one returned by f for the decoded body, encoded again, and
+// sets Content-Length to its length. It returns nil if body is left as is,
+// with the body to forward instead of the partly read one if any, and the
+// part read of body with the error that interrupted its reading.
+func rewriteBody(header http.Header, body io.ReadCloser, encodings []Encoding, ctx *goproxy.ProxyCtx, f func([]byte) []byte) ([]byte, io.ReadCloser, error) {
+	codings, err := contentCodings(header, encodings)
+	if err != nil {
+		ctx.Warnf("Cannot decode body: %v", err)
+		return nil, nil, nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, MaxBodySize+1))
+	if err != nil {
+		body.Close()
+		ctx.Warnf("Cannot read body: %v", err)
+		header.Del("Content-Length")
+		return raw, nil, err
+	}
+	if int64(len(raw)) > MaxBodySize {
+		ctx.Logf("Body larger than %d bytes, sending it as is", MaxBodySize)
+		return nil, &multiReadCloser{io.MultiReader(bytes.NewReader(raw), body), body}, nil
+	}
+	body.Close()
+
+	decoded, err := decode(raw, codings)
+	if errors.Is(err, errTooLarge) {
+		ctx.Logf("Decoded body larger than %d bytes, sending it as is", MaxBodySize)
+		return nil, newBody(raw, nil), nil
+	}
+	if err != nil {
+		ctx.Warnf("Cannot decode body, sending it as is: %v", err)
+		return raw, nil, nil
+	}
+	rewritten := f(decoded)
+	if rewritten == nil {
+		rewritten = []byte{}
+	}
+	encoded, err := encode(rewritten, codings)
+	if err != nil {
+		ctx.Warnf("Cannot encode body, sending it decoded: %v", err)
+		header.Del("Content-Encoding")
+		encoded = rewritten
+	}
+	header.Set("Content-Length", strconv.Itoa(len(encoded)))
+	return encoded, nil, nil
+}
+
+// newBody returns a body reading b, and then failing with err if it's not
+// nil.
+func newBody(b []byte, err error) io.ReadCloser {
+	if err == nil {
+		return io.NopCloser(bytes.NewReader(b))
+	}
+	return io.NopCloser(io.MultiReader(bytes.NewReader(b), errorReader{err}))
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// contentCodings returns the encodings of the content codings of header,
+// in the order they were applied.
+func contentCodings(header http.Header, encodings []Encoding) ([]Encoding, error) {
+	var codings []Encoding
+	for _, value := range header.Values("Content-Encoding") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.EqualFold(name, "identity") {
+				continue
+			}
+			encoding, ok := findEncoding(name, encodings)
+			if !ok {
+				return nil, fmt.Errorf("unsupported content coding %q", name)
+			}
+			codings = append(codings, encoding)
+		}
+	}
+	return codings, nil
+}
+
+func findEncoding(name string, encodings []Encoding) (Encoding, bool) {
+	for _, encoding := range encodings {
+		if strings.EqualFold(encoding.Name, name) {
+			return encoding, encoding.NewReader != nil && encoding.NewWriter != nil
+		}
+	}
+	return Encoding{}, false
+}
+
+// decode returns body decoded from codings, undoing the last one first, or
+// errTooLarge if it gets larger than MaxBodySize.
+func decode(body []byte, codings []Encoding) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := codings[i].NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", codings[i].Name, err)
+		}
+		body, err = io.ReadAll(io.LimitReader(r, MaxBodySize+1))
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", codings[i].Name, err)
+		}
+		if int64(len(body)) > MaxBodySize {
+			return nil, errTooLarge
+		}
+	}
+	return body, nil
+}
+
+// encode returns body encoded with codings, in order.
+func encode(body []byte, codings []Encoding) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	for _, coding := range codings {
+		var buf bytes.Buffer
+		w, err := coding.NewWriter(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", coding.Name, err)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, fmt.Errorf("%s: %w", coding.Name, err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("%s: %w", coding.Name, err)
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
@@ -0,0 +1,225 @@
+package compression_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/compression"
+)
+
+// xor is a toy content coding, standing for the third-party ones.
+var xor = compression.Encoding{
+	Name: "x-xor",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{xorWriter{w}}, nil
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		data, err := io.ReadAll(r)
+		return io.NopCloser(bytes.NewReader(xorBytes(data))), err
+	},
+}
+
+func xorBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		out[i] = c ^ 0x55
+	}
+	return out
+}
+
+type xorWriter struct{ w io.Writer }
+
+func (w xorWriter) Write(p []byte) (int, error) { return w.w.Write(xorBytes(p)) }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func encodeWith(t *testing.T, codings []compression.Encoding, data []byte) []byte {
+	t.Helper()
+	for _, coding := range codings {
+		var buf bytes.Buffer
+		w, err := coding.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+		data = buf.Bytes()
+	}
+	return data
+}
+
+func TestOnResponseBody(t *testing.T) {
+	page := []byte("<html>http://example.com/</html>")
+	for _, test := range []struct {
+		name     string
+		encoding string
+		codings  []compression.Encoding
+		modified bool
+	}{
+		{"identity", "", nil, true},
+		{"gzip", "gzip", []compression.Encoding{compression.Gzip}, true},
+		{"deflate", "deflate", []compression.Encoding{compression.Deflate}, true},
+		{"br", "br", []compression.Encoding{compression.Brotli}, true},
+		{"zstd", "zstd", []compression.Encoding{compression.Zstd}, true},
+		{"chained", "deflate, x-xor", []compression.Encoding{compression.Deflate, xor}, true},
+		{"unsupported", "x-unknown", []compression.Encoding{xor}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodeWith(t, test.codings, page)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+				}
+				w.Write(encoded)
+			}))
+			defer srv.Close()
+
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.KeepAcceptEncoding = true
+			called := false
+			proxy.OnResponse().Do(compression.OnResponseBody(func(body []byte, resp *http.Response, ctx *goproxy.ProxyCtx) []byte {
+				called = true
+				if !bytes.Equal(body, page) {
+					t.Errorf("decoded body %q", body)
+				}
+				return bytes.ReplaceAll(body, []byte("http://"), []byte("https://"))
+			}, compression.Gzip, compression.Deflate, compression.Brotli, compression.Zstd, xor))
+			p := httptest.NewServer(proxy)
+			defer p.Close()
+			proxyURL, _ := url.Parse(p.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd, x-xor, x-unknown")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if called != test.modified {
+				t.Fatalf("handler called %v, expected %v", called, test.modified)
+			}
+			if !test.modified {
+				if !bytes.Equal(body, encoded) {
+					t.Errorf("body modified: %q", body)
+				}
+				return
+			}
+			if resp.Header.Get("Content-Encoding") != test.encoding {
+				t.Errorf("Content-Encoding %q, expected %q", resp.Header.Get("Content-Encoding"), test.encoding)
+			}
+			expected := encodeWith(t, test.codings, []byte("<html>https://example.com/</html>"))
+			if !bytes.Equal(body, expected) {
+				t.Errorf("body %q, expected %q", body, expected)
+			}
+		})
+	}
+}
+
+func TestOnResponseBodyMaxSize(t *testing.T) {
+	defer func(size int64) { compression.MaxBodySize = size }(compression.MaxBodySize)
+	compression.MaxBodySize = 64
+	page := bytes.Repeat([]byte("a"), 1000)
+	for _, test := range []struct {
+		name     string
+		encoding string
+		codings  []compression.Encoding
+	}{
+		{"encoded", "", nil},
+		{"decoded", "gzip", []compression.Encoding{compression.Gzip}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodeWith(t, test.codings, page)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+				}
+				w.Write(encoded)
+			}))
+			defer srv.Close()
+
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.KeepAcceptEncoding = true
+			proxy.OnResponse().Do(compression.OnResponseBody(func(body []byte, resp *http.Response, ctx *goproxy.ProxyCtx) []byte {
+				t.Error("handler called for a large body")
+				return body
+			}))
+			p := httptest.NewServer(proxy)
+			defer p.Close()
+			proxyURL, _ := url.Parse(p.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, encoded) {
+				t.Errorf("body modified: %q", body)
+			}
+		})
+	}
+}
+
+func TestOnRequestBody(t *testing.T) {
+	var received []byte
+	var length string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length = r.Header.Get("Content-Length")
+		body := io.Reader(r.Body)
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			body, _ = gzip.NewReader(r.Body)
+		case "deflate":
+			body, _ = zlib.NewReader(r.Body)
+		}
+		received, _ = io.ReadAll(body)
+	}))
+	defer srv.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(compression.OnRequestBody(func(body []byte, req *http.Request, ctx *goproxy.ProxyCtx) []byte {
+		return append(body, " rewritten"...)
+	}))
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, coding := range []compression.Encoding{compression.Gzip, compression.Deflate} {
+		encoded := encodeWith(t, []compression.Encoding{coding}, []byte("upload"))
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader(encoded))
+		req.Header.Set("Content-Encoding", coding.Name)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if string(received) != "upload rewritten" {
+			t.Errorf("%s: received %q", coding.Name, received)
+		}
+		if n, err := strconv.Atoi(length); err != nil || n == len(encoded) {
+			t.Errorf("%s: Content-Length %q not updated", coding.Name, length)
+		}
+	}
+}
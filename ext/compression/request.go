@@ -0,0 +1,213 @@
+// Package compression compresses the request bodies sent to the remote
+// servers, to save bandwidth on constrained links between the proxy and
+// the origins. It also hands the decoded bodies of the requests and
+// responses to handlers, see OnRequestBody and OnResponseBody.
+package compression
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/elazarl/goproxy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is a content coding that bodies can be compressed with.
+type Encoding struct {
+	// Name is the content coding, as used in Content-Encoding.
+	Name string
+	// NewWriter returns a writer compressing the data written to w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing the data read from r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip is the gzip content coding.
+var Gzip = Encoding{
+	Name: "gzip",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// Deflate is the deflate content coding, that is the zlib format
+// (RFC 9110).
+var Deflate = Encoding{
+	Name: "deflate",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+// Brotli is the br content coding (RFC 7932).
+var Brotli = Encoding{
+	Name: "br",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriter(w), nil
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	},
+}
+
+// Zstd is the zstd content coding (RFC 8878).
+var Zstd = Encoding{
+	Name: "zstd",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	},
+	NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+}
+
+// RequestCompressor compresses the request bodies sent to the servers that
+// advertise support for compressed requests, with an Accept-Encoding header
+// in their responses (RFC 7694). The requests to compress are selected by
+// the conditions it's registered with:
+//
+//	c := compression.NewRequestCompressor(compression.Gzip)
+//	proxy.OnRequest(goproxy.DstHostIs("api.example.com")).DoFunc(c.OnRequest)
+//	proxy.OnResponse().DoFunc(c.OnResponse)
+type RequestCompressor struct {
+	// Encodings are the content codings that can be used, in order of
+	// preference.
+	Encodings []Encoding
+	// MinSize is the size below which the request bodies of known length
+	// are sent as is.
+	MinSize int64
+	// Assume, if true, compresses the requests to the servers that haven't
+	// advertised their supported codings yet, with the first of Encodings.
+	Assume bool
+
+	mu        sync.Mutex
+	supported map[string][]string
+}
+
+// NewRequestCompressor returns a RequestCompressor using the given codings,
+// gzip if none is given, for request bodies of at least 1KB.
+func NewRequestCompressor(encodings ...Encoding) *RequestCompressor {
+	if len(encodings) == 0 {
+		encodings = []Encoding{Gzip}
+	}
+	return &RequestCompressor{
+		Encodings: encodings,
+		MinSize:   1024,
+		supported: make(map[string][]string),
+	}
+}
+
+// OnRequest compresses the request body when the server supports one of
+// the codings, to be registered with proxy.OnRequest().DoFunc.
+func (c *RequestCompressor) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return req, nil
+	}
+	if req.ContentLength >= 0 && req.ContentLength < c.MinSize {
+		return req, nil
+	}
+	encoding, ok := c.encoding(req.URL.Host)
+	if !ok {
+		return req, nil
+	}
+
+	pr, pw := io.Pipe()
+	w, err := encoding.NewWriter(pw)
+	if err != nil {
+		ctx.Warnf("Cannot compress request body with %s: %v", encoding.Name, err)
+		return req, nil
+	}
+	body := req.Body
+	go func() {
+		_, err := io.Copy(w, body)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	req.Body = pr
+	req.GetBody = nil
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Encoding", encoding.Name)
+	return req, nil
+}
+
+// OnResponse records the codings supported by the server, to be
+// registered with proxy.OnResponse().DoFunc.
+func (c *RequestCompressor) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	host := ctx.Req.URL.Host
+	accept, advertised := resp.Header["Accept-Encoding"]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case advertised:
+		c.supported[host] = parseAcceptEncoding(strings.Join(accept, ","))
+	case resp.StatusCode == http.StatusUnsupportedMediaType && ctx.Req.Header.Get("Content-Encoding") != "":
+		// The compressed request was rejected
+		c.supported[host] = nil
+	}
+	return resp
+}
+
+// encoding returns the preferred coding supported by host.
+func (c *RequestCompressor) encoding(host string) (Encoding, bool) {
+	c.mu.Lock()
+	supported, known := c.supported[host]
+	c.mu.Unlock()
+	if !known {
+		if c.Assume && len(c.Encodings) > 0 {
+			return c.Encodings[0], true
+		}
+		return Encoding{}, false
+	}
+	for _, encoding := range c.Encodings {
+		for _, name := range supported {
+			if strings.EqualFold(name, encoding.Name) {
+				return encoding, true
+			}
+		}
+	}
+	return Encoding{}, false
+}
+
+// parseAcceptEncoding returns the codings of an Accept-Encoding header,
+// without the ones refused with q=0.
+func parseAcceptEncoding(header string) []string {
+	codings := []string{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		codings = append(codings, name)
+	}
+	return codings
+}
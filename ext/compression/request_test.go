@@ -0,0 +1,70 @@
+package compression_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/compression"
+)
+
+func TestRequestCompressor(t *testing.T) {
+	payload := strings.Repeat("compressible ", 200)
+	var encodings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, _ := io.ReadAll(body)
+		if string(data) != payload {
+			http.Error(w, "unexpected body", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Accept-Encoding", "br;q=0, gzip")
+	}))
+	defer srv.Close()
+
+	c := compression.NewRequestCompressor()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(c.OnRequest)
+	proxy.OnResponse().DoFunc(c.OnResponse)
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	post := func(body string) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+	}
+	// The first request teaches the proxy that the server accepts gzip
+	post(payload)
+	post(payload)
+
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "gzip" {
+		t.Errorf("unexpected request encodings %q", encodings)
+	}
+}
@@ -0,0 +1,189 @@
+// Package dnsserver implements a DNS server resolving the client queries to
+// the proxy address, to intercept the traffic of devices that can't be
+// configured to use a proxy: the devices use it as their DNS server, and
+// connect to the transparent listeners of the proxy (see
+// examples/goproxy-transparent) instead of the origins.
+package dnsserver
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server answers the A and AAAA queries with the proxy addresses.
+//
+//	s := dnsserver.NewServer(net.ParseIP("192.168.1.2"))
+//	s.Match = dnsserver.MatchDomains("example.com")
+//	s.Upstream = "1.1.1.1:53"
+//	log.Fatal(s.ListenAndServe())
+type Server struct {
+	// Addr is the UDP address to listen on, ":53" if empty.
+	Addr string
+	// ProxyIPs are the addresses returned for the redirected names, the
+	// IPv4 ones in A answers and the IPv6 ones in AAAA answers.
+	ProxyIPs []net.IP
+	// Match selects the names (without the trailing dot) redirected to the
+	// proxy, all of them if nil.
+	Match func(name string) bool
+	// Upstream is the address (host:port) of the DNS server the other
+	// queries are forwarded to. They are refused if it's empty.
+	Upstream string
+	// TTL is the lifetime of the answers, in seconds.
+	TTL uint32
+	// Timeout bounds the wait for the Upstream answers.
+	Timeout time.Duration
+}
+
+// NewServer returns a Server redirecting all the names to the given
+// proxy addresses, with 60 seconds TTLs.
+func NewServer(proxyIPs ...net.IP) *Server {
+	return &Server{ProxyIPs: proxyIPs, TTL: 60, Timeout: 5 * time.Second}
+}
+
+// MatchDomains returns a Match function selecting the given domains and
+// their subdomains.
+func MatchDomains(domains ...string) func(name string) bool {
+	return func(name string) bool {
+		name = strings.ToLower(name)
+		for _, domain := range domains {
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ListenAndServe listens on s.Addr and serves the DNS queries.
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":53"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve serves the DNS queries received on conn, until it's closed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.answer(query); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// answer returns the response to query, nil if it must be dropped.
+func (s *Server) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return s.reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	if s.Match != nil && !s.Match(name) {
+		if s.Upstream == "" {
+			return s.reply(header, &question, dnsmessage.RCodeRefused, nil)
+		}
+		resp, err := s.forward(query)
+		if err != nil {
+			return s.reply(header, &question, dnsmessage.RCodeServerFailure, nil)
+		}
+		return resp
+	}
+
+	var ips []net.IP
+	for _, ip := range s.ProxyIPs {
+		switch {
+		case question.Type == dnsmessage.TypeA && ip.To4() != nil,
+			question.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			ips = append(ips, ip)
+		}
+	}
+	return s.reply(header, &question, dnsmessage.RCodeSuccess, ips)
+}
+
+// reply builds a response to the query with the given header and question,
+// answering with ips.
+func (s *Server) reply(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if question == nil {
+		msg, _ := b.Finish()
+		return msg
+	}
+	_ = b.StartQuestions()
+	_ = b.Question(*question)
+	_ = b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.TTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			_ = b.AResource(rh, a)
+		} else {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			_ = b.AAAAResource(rh, aaaa)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// forward sends query to the upstream server and returns its response.
+func (s *Server) forward(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", s.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
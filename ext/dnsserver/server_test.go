@@ -0,0 +1,64 @@
+package dnsserver_test
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/elazarl/goproxy/ext/dnsserver"
+)
+
+func serve(t *testing.T, s *dnsserver.Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func resolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+func lookup(t *testing.T, r *net.Resolver, host string) []string {
+	t.Helper()
+	addrs, err := r.LookupHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", host, err)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestServer(t *testing.T) {
+	upstream := serve(t, dnsserver.NewServer(net.ParseIP("192.0.2.1")))
+
+	s := dnsserver.NewServer(net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1"))
+	s.Match = dnsserver.MatchDomains("example.com")
+	s.Upstream = upstream
+	r := resolver(serve(t, s))
+
+	if addrs := lookup(t, r, "www.Example.com"); len(addrs) != 2 || addrs[0] != "10.0.0.1" || addrs[1] != "fd00::1" {
+		t.Errorf("unexpected redirected addresses %v", addrs)
+	}
+	if addrs := lookup(t, r, "other.org"); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Errorf("unexpected forwarded addresses %v", addrs)
+	}
+
+	s = dnsserver.NewServer(net.ParseIP("10.0.0.1"))
+	s.Match = dnsserver.MatchDomains("example.com")
+	r = resolver(serve(t, s))
+	if _, err := r.LookupHost(context.Background(), "other.org"); err == nil {
+		t.Error("unmatched query should be refused without upstream")
+	}
+}
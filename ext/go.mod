@@ -1,12 +1,14 @@
 module github.com/elazarl/goproxy/ext
 
-go 1.20
+go 1.23.0
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/elazarl/goproxy v0.0.0-20241217120900-7711dfa3811c
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/net v0.36.0
-	golang.org/x/text v0.22.0
+	golang.org/x/text v0.23.0
 )
 
 require (
@@ -14,3 +16,5 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/elazarl/goproxy => ../
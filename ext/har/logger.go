@@ -73,6 +73,8 @@ func (l *Logger) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Re
         Time:           time.Since(startTime).Milliseconds(),
         Request:        parseRequest(ctx),
         Response:       parseResponse(ctx),
+        FlowID:         ctx.FlowID,
+        User:           userName(ctx.User),
         Timings: Timings{
             Send:    0,
             Wait:    time.Since(startTime).Milliseconds(),
@@ -122,3 +124,11 @@ func (l *Logger) exportLoop() {
 func (l *Logger) Stop() {
     close(l.dataCh)
 }
+
+// userName returns the name of user, if any
+func userName(user *goproxy.User) string {
+    if user == nil {
+        return ""
+    }
+    return user.Name
+}
@@ -0,0 +1,268 @@
+package har
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Paginator inspects a replayed exchange and returns the request for the
+// following page of the same collection, or nil if there isn't one.
+type Paginator func(req *http.Request, resp *http.Response, body []byte) *http.Request
+
+var linkNextRe = regexp.MustCompile(`<([^>]+)>\s*;[^,]*rel="?next"?`)
+
+// LinkHeaderPaginator follows RFC 8288 Link headers with rel="next",
+// as used by GitHub-style APIs.
+func LinkHeaderPaginator(req *http.Request, resp *http.Response, body []byte) *http.Request {
+	for _, link := range resp.Header.Values("Link") {
+		m := linkNextRe.FindStringSubmatch(link)
+		if m == nil {
+			continue
+		}
+		next, err := req.URL.Parse(m[1])
+		if err != nil {
+			return nil
+		}
+		return cloneWithURL(req, next)
+	}
+	return nil
+}
+
+// PageParamPaginator increments the numeric query parameter param
+// (e.g. "page") as long as the response is successful and holds a JSON
+// collection with items.
+func PageParamPaginator(param string) Paginator {
+	return func(req *http.Request, resp *http.Response, body []byte) *http.Request {
+		if resp.StatusCode != http.StatusOK || !hasItems(body) {
+			return nil
+		}
+		q := req.URL.Query()
+		page, err := strconv.Atoi(q.Get(param))
+		if err != nil {
+			return nil
+		}
+		q.Set(param, strconv.Itoa(page+1))
+		next := *req.URL
+		next.RawQuery = q.Encode()
+		return cloneWithURL(req, &next)
+	}
+}
+
+// OffsetParamPaginator advances the offset query parameter by the value of
+// the limit query parameter, stopping on an unsuccessful page, or one
+// without a JSON collection with items.
+func OffsetParamPaginator(offsetParam, limitParam string) Paginator {
+	return func(req *http.Request, resp *http.Response, body []byte) *http.Request {
+		if resp.StatusCode != http.StatusOK || !hasItems(body) {
+			return nil
+		}
+		q := req.URL.Query()
+		limit, err := strconv.Atoi(q.Get(limitParam))
+		if err != nil || limit <= 0 {
+			return nil
+		}
+		offset, _ := strconv.Atoi(q.Get(offsetParam))
+		q.Set(offsetParam, strconv.Itoa(offset+limit))
+		next := *req.URL
+		next.RawQuery = q.Encode()
+		return cloneWithURL(req, &next)
+	}
+}
+
+// JSONCursorPaginator reads the cursor found at the dot separated path
+// field (e.g. "meta.next_cursor") in a JSON response body and sends it
+// back in the query parameter param. If the value found is an absolute
+// or relative URL, it is followed directly instead.
+func JSONCursorPaginator(field, param string) Paginator {
+	path := strings.Split(field, ".")
+	return func(req *http.Request, resp *http.Response, body []byte) *http.Request {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil
+		}
+		for _, key := range path {
+			m, ok := doc.(map[string]any)
+			if !ok {
+				return nil
+			}
+			doc = m[key]
+		}
+		cursor, ok := doc.(string)
+		if !ok || cursor == "" {
+			return nil
+		}
+		if strings.HasPrefix(cursor, "/") || strings.Contains(cursor, "://") {
+			next, err := req.URL.Parse(cursor)
+			if err != nil {
+				return nil
+			}
+			return cloneWithURL(req, next)
+		}
+		q := req.URL.Query()
+		if q.Get(param) == cursor {
+			// The server keeps returning the same cursor, stop here
+			return nil
+		}
+		q.Set(param, cursor)
+		next := *req.URL
+		next.RawQuery = q.Encode()
+		return cloneWithURL(req, &next)
+	}
+}
+
+// DefaultPaginators are used by a Replayer without explicit paginators.
+var DefaultPaginators = []Paginator{
+	LinkHeaderPaginator,
+	JSONCursorPaginator("next", "cursor"),
+	JSONCursorPaginator("next_cursor", "cursor"),
+	JSONCursorPaginator("nextPageToken", "pageToken"),
+	PageParamPaginator("page"),
+	OffsetParamPaginator("offset", "limit"),
+}
+
+// ErrTooManyPages is returned when a collection has more pages than
+// Replayer.MaxPages allows.
+var ErrTooManyPages = errors.New("har: too many pages")
+
+// Replayer sends recorded entries again, following the pagination of each
+// recorded response so that the replay covers the full collection instead
+// of only the recorded pages.
+type Replayer struct {
+	// Client used to send requests, http.DefaultClient when nil
+	Client *http.Client
+	// Paginators are tried in order, the first one returning a request wins.
+	// DefaultPaginators are used when empty.
+	Paginators []Paginator
+	// MaxPages limits the number of pages fetched for each recorded entry,
+	// including the recorded one. Zero means 100.
+	MaxPages int
+}
+
+// Replay replays the entries in order, calling f for every page received.
+// Pages already fetched (by URL) are not requested twice, so that recorded
+// pages reached through pagination of a previous entry are skipped.
+func (r *Replayer) Replay(
+	ctx context.Context,
+	entries []Entry,
+	f func(req *http.Request, resp *http.Response, body []byte),
+) error {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	paginators := r.Paginators
+	if len(paginators) == 0 {
+		paginators = DefaultPaginators
+	}
+	maxPages := r.MaxPages
+	if maxPages <= 0 {
+		maxPages = 100
+	}
+
+	seen := make(map[string]bool)
+	for i := range entries {
+		if entries[i].Request == nil {
+			continue
+		}
+		req, err := NewHTTPRequest(ctx, entries[i].Request)
+		if err != nil {
+			return err
+		}
+		for page := 0; req != nil; page++ {
+			if seen[req.Method+" "+req.URL.String()] {
+				break
+			}
+			if page == maxPages {
+				return ErrTooManyPages
+			}
+			seen[req.Method+" "+req.URL.String()] = true
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			f(req, resp, body)
+
+			var next *http.Request
+			for _, p := range paginators {
+				if next = p(req, resp, body); next != nil {
+					break
+				}
+			}
+			req = next
+		}
+	}
+	return nil
+}
+
+// NewHTTPRequest rebuilds an *http.Request from a recorded HAR request.
+func NewHTTPRequest(ctx context.Context, r *Request) (*http.Request, error) {
+	var body io.Reader
+	if r.PostData != nil {
+		if r.PostData.Text != "" {
+			body = strings.NewReader(r.PostData.Text)
+		} else if len(r.PostData.Params) > 0 {
+			form := url.Values{}
+			for _, p := range r.PostData.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = strings.NewReader(form.Encode())
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.Url, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range r.Headers {
+		if strings.EqualFold(h.Name, "Content-Length") {
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	return req, nil
+}
+
+func cloneWithURL(req *http.Request, u *url.URL) *http.Request {
+	next := req.Clone(req.Context())
+	next.URL = u
+	next.Host = u.Host
+	if req.GetBody != nil {
+		next.Body, _ = req.GetBody()
+	}
+	return next
+}
+
+// hasItems reports whether body is a non-empty JSON array, or an object
+// with a non-empty array member. The other bodies aren't recognized as
+// pages of a collection.
+func hasItems(body []byte) bool {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false
+	}
+	switch v := doc.(type) {
+	case []any:
+		return len(v) > 0
+	case map[string]any:
+		for _, member := range v {
+			if arr, ok := member.([]any); ok && len(arr) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package har
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFollowsPagination(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pages", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page > 3 {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprintf(w, `[%d]`, page)
+	})
+	mux.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("p") == "" {
+			w.Header().Set("Link", `</links?p=2>; rel="next", </links>; rel="first"`)
+		}
+		fmt.Fprint(w, `[1]`)
+	})
+	mux.HandleFunc("/cursor", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("cursor") {
+		case "":
+			fmt.Fprint(w, `{"items":[1],"next":"abc"}`)
+		case "abc":
+			fmt.Fprint(w, `{"items":[2],"next":""}`)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	testCases := []struct {
+		name string
+		url  string
+		want []string
+	}{
+		{
+			name: "page parameter",
+			url:  srv.URL + "/pages?page=2",
+			want: []string{"/pages?page=2", "/pages?page=3", "/pages?page=4"},
+		},
+		{
+			name: "link header",
+			url:  srv.URL + "/links",
+			want: []string{"/links", "/links?p=2"},
+		},
+		{
+			name: "json cursor",
+			url:  srv.URL + "/cursor",
+			want: []string{"/cursor", "/cursor?cursor=abc"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			r := &Replayer{}
+			err := r.Replay(context.Background(), []Entry{
+				{Request: &Request{Method: http.MethodGet, Url: tc.url}},
+			}, func(req *http.Request, resp *http.Response, body []byte) {
+				got = append(got, req.URL.RequestURI())
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestReplaySkipsAlreadyFetchedPages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page > 2 {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[1]`)
+	}))
+	defer srv.Close()
+
+	var count int
+	r := &Replayer{}
+	err := r.Replay(context.Background(), []Entry{
+		{Request: &Request{Method: http.MethodGet, Url: srv.URL + "/?page=1"}},
+		{Request: &Request{Method: http.MethodGet, Url: srv.URL + "/?page=2"}},
+	}, func(req *http.Request, resp *http.Response, body []byte) {
+		count++
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestReplayMaxPages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[1]`)
+	}))
+	defer srv.Close()
+
+	r := &Replayer{MaxPages: 5}
+	err := r.Replay(context.Background(), []Entry{
+		{Request: &Request{Method: http.MethodGet, Url: srv.URL + "/?page=1"}},
+	}, func(req *http.Request, resp *http.Response, body []byte) {})
+	assert.ErrorIs(t, err, ErrTooManyPages)
+}
+
+func TestHasItems(t *testing.T) {
+	for body, items := range map[string]bool{
+		``:                            false,
+		`not json`:                    false,
+		`<html></html>`:               false,
+		`[]`:                          false,
+		`[1]`:                         true,
+		`{"items": []}`:               false,
+		`{"items": [1]}`:              true,
+		`{"items": [], "links": [1]}`: true,
+		`{"items": [1], "links": []}`: true,
+		`{"items": [], "errors": []}`: false,
+		`{"next": null}`:              false,
+		`{"id": 1}`:                   false,
+		`"text"`:                      false,
+	} {
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, items, hasItems([]byte(body)), body)
+		}
+	}
+}
+
+func TestReplayStopsOnUnrecognizedPages(t *testing.T) {
+	for _, body := range []string{`<html>page</html>`, `{"id": 1}`} {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			fmt.Fprint(w, body)
+		}))
+		r := &Replayer{MaxPages: 5}
+		err := r.Replay(context.Background(), []Entry{
+			{Request: &Request{Method: http.MethodGet, Url: srv.URL + "/?page=1&offset=0&limit=10"}},
+		}, func(req *http.Request, resp *http.Response, body []byte) {})
+		srv.Close()
+		assert.NoError(t, err, body)
+		assert.Equal(t, 1, requests, body)
+	}
+}
@@ -79,6 +79,12 @@ type Entry struct {
 	ServerIpAddress string    `json:"serverIpAddress,omitempty"`
 	Connection      string    `json:"connection,omitempty"`
 	Comment         string    `json:"comment,omitempty"`
+	// FlowID is the goproxy.ProxyCtx.FlowID of the exchange, a custom
+	// field linking the entries of redirect chains and authentication dances.
+	FlowID string `json:"_flowId,omitempty"`
+	// User is the name of the goproxy.ProxyCtx.User of the exchange, a
+	// custom field.
+	User string `json:"_user,omitempty"`
 }
 
 type Cache struct {
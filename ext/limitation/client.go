@@ -0,0 +1,218 @@
+package limitation
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ClientLimits describes the limits applied to a client of the proxy.
+type ClientLimits struct {
+	// MaxTunnels is the maximum number of concurrent CONNECT tunnels.
+	// Zero means no limit.
+	MaxTunnels int
+	// MaxWebSockets is the maximum number of concurrent WebSocket
+	// connections, whether they're MITM'd or not. Zero means no limit.
+	MaxWebSockets int
+}
+
+// ClientLimiter limits the concurrent CONNECT tunnels and WebSocket
+// connections of each client IP address and of each authenticated user,
+// to protect the proxy from misbehaving clients. The requests exceeding
+// the limits are rejected with 429 Too Many Requests.
+//
+//	limiter := limitation.NewClientLimiter(limitation.ClientLimits{MaxTunnels: 64}, limitation.ClientLimits{})
+//	proxy.OnRequest().Do(limiter)
+//	proxy.OnRequest().HandleConnect(limiter)
+type ClientLimiter struct {
+	// User, if set, returns the authenticated user of a request, or an
+	// empty string. It defaults to the name of ctx.User, or the user name
+	// of the Basic Proxy-Authorization header, that is only sent with the
+	// CONNECT requests and the plain HTTP requests.
+	User func(ctx *goproxy.ProxyCtx) string
+	// StatusCode is the status of the responses to the rejected
+	// requests, 429 Too Many Requests if it isn't set. 503 Service
+	// Unavailable is also a common choice.
+	StatusCode int
+
+	perIP   ClientLimits
+	perUser ClientLimits
+
+	mu     sync.Mutex
+	counts map[clientKey]int
+}
+
+type connectionKind int
+
+const (
+	kindTunnel connectionKind = iota
+	kindWebSocket
+)
+
+type clientKey struct {
+	kind connectionKind
+	// Either ip or user is set
+	ip   string
+	user string
+}
+
+// NewClientLimiter returns a ClientLimiter applying perIP to every client
+// IP address, and perUser to every authenticated user.
+func NewClientLimiter(perIP, perUser ClientLimits) *ClientLimiter {
+	return &ClientLimiter{
+		perIP:   perIP,
+		perUser: perUser,
+		counts:  make(map[clientKey]int),
+	}
+}
+
+// Handle implements goproxy.ReqHandler, limiting the WebSocket
+// connections.
+func (l *ClientLimiter) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !isWebSocketRequest(req) {
+		return req, nil
+	}
+	release, ok := l.acquire(kindWebSocket, req, ctx)
+	if !ok {
+		return req, l.rejection(req, "WebSocket connections")
+	}
+	// The request lasts as long as the WebSocket connection
+	go func() {
+		<-req.Context().Done()
+		release()
+	}()
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, limiting the CONNECT
+// tunnels. It never chooses an action for the accepted tunnels, so that the
+// following CONNECT handlers are still evaluated.
+func (l *ClientLimiter) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	release, ok := l.acquire(kindTunnel, ctx.Req, ctx)
+	if !ok {
+		ctx.Resp = l.rejection(ctx.Req, "tunnels")
+		return goproxy.RejectConnect, host
+	}
+	if previous := ctx.TunnelCloseHandler; previous != nil {
+		ctx.TunnelCloseHandler = func(ctx *goproxy.ProxyCtx) {
+			release()
+			previous(ctx)
+		}
+	} else {
+		ctx.TunnelCloseHandler = func(*goproxy.ProxyCtx) { release() }
+	}
+	return nil, host
+}
+
+// Count returns the number of concurrent tunnels and WebSocket connections
+// of a client IP address.
+func (l *ClientLimiter) Count(ip string) (tunnels, webSockets int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[clientKey{kind: kindTunnel, ip: ip}], l.counts[clientKey{kind: kindWebSocket, ip: ip}]
+}
+
+// acquire counts a new connection of kind for the client of req, unless
+// it exceeds its limits. The returned function must be called once the
+// connection is closed.
+func (l *ClientLimiter) acquire(kind connectionKind, req *http.Request, ctx *goproxy.ProxyCtx) (func(), bool) {
+	var keys []clientKey
+	if limit := l.perIP.limit(kind); limit > 0 {
+		keys = append(keys, clientKey{kind: kind, ip: clientIP(req)})
+	}
+	if limit := l.perUser.limit(kind); limit > 0 {
+		if user := l.user(req, ctx); user != "" {
+			keys = append(keys, clientKey{kind: kind, user: user})
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		limits := l.perIP
+		if key.user != "" {
+			limits = l.perUser
+		}
+		if l.counts[key] >= limits.limit(kind) {
+			return nil, false
+		}
+	}
+	for _, key := range keys {
+		l.counts[key]++
+	}
+	var once sync.Once
+	return func() { once.Do(func() { l.release(keys) }) }, true
+}
+
+func (l *ClientLimiter) release(keys []clientKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		if l.counts[key]--; l.counts[key] <= 0 {
+			delete(l.counts, key)
+		}
+	}
+}
+
+func (l *ClientLimiter) user(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	return userName(req, ctx, l.User)
+}
+
+// userName returns the authenticated user of req, as returned by custom if
+// set.
+func userName(req *http.Request, ctx *goproxy.ProxyCtx, custom func(ctx *goproxy.ProxyCtx) string) string {
+	if custom != nil {
+		return custom(ctx)
+	}
+	if ctx.User != nil {
+		return ctx.User.Name
+	}
+	// Proxy-Authorization has the syntax of Authorization
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	user, _, _ := auth.BasicAuth()
+	return user
+}
+
+func (l *ClientLimiter) rejection(req *http.Request, what string) *http.Response {
+	status := l.StatusCode
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, "Too many concurrent "+what)
+	resp.Header.Set("Retry-After", "1")
+	return resp
+}
+
+func (limits ClientLimits) limit(kind connectionKind) int {
+	if kind == kindTunnel {
+		return limits.MaxTunnels
+	}
+	return limits.MaxWebSockets
+}
+
+// clientIP returns the IP address of the client of req.
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func isWebSocketRequest(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") &&
+		headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
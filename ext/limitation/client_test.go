@@ -0,0 +1,165 @@
+package limitation_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+)
+
+func connectRequest(t *testing.T, remoteAddr, user string) *goproxy.ProxyCtx {
+	t.Helper()
+	req := newRequest(t, context.Background(), "http://a.example:443")
+	req.Method = http.MethodConnect
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	return &goproxy.ProxyCtx{Req: req}
+}
+
+func TestClientLimiterTunnelsPerIP(t *testing.T) {
+	limiter := limitation.NewClientLimiter(limitation.ClientLimits{MaxTunnels: 1}, limitation.ClientLimits{})
+
+	first := connectRequest(t, "192.0.2.1:1234", "")
+	if action, _ := limiter.HandleConnect("a.example:443", first); action != nil {
+		t.Fatal("First tunnel wasn't accepted")
+	}
+	second := connectRequest(t, "192.0.2.1:1235", "")
+	if action, _ := limiter.HandleConnect("a.example:443", second); action != goproxy.RejectConnect {
+		t.Fatal("Second tunnel wasn't rejected")
+	}
+	if second.Resp == nil || second.Resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 response for the second tunnel")
+	}
+	// Other clients aren't affected
+	if action, _ := limiter.HandleConnect("a.example:443", connectRequest(t, "192.0.2.2:1234", "")); action != nil {
+		t.Fatal("Tunnel of another client wasn't accepted")
+	}
+
+	first.TunnelCloseHandler(first)
+	if tunnels, _ := limiter.Count("192.0.2.1"); tunnels != 0 {
+		t.Fatalf("Expected no tunnel after closing, got %d", tunnels)
+	}
+	if action, _ := limiter.HandleConnect("a.example:443", connectRequest(t, "192.0.2.1:1236", "")); action != nil {
+		t.Fatal("Tunnel wasn't accepted after the first one was closed")
+	}
+}
+
+func TestClientLimiterTunnelsPerUser(t *testing.T) {
+	limiter := limitation.NewClientLimiter(limitation.ClientLimits{}, limitation.ClientLimits{MaxTunnels: 1})
+	limiter.StatusCode = http.StatusServiceUnavailable
+
+	if action, _ := limiter.HandleConnect("a.example:443", connectRequest(t, "192.0.2.1:1234", "alice")); action != nil {
+		t.Fatal("First tunnel wasn't accepted")
+	}
+	ctx := connectRequest(t, "192.0.2.2:1234", "alice")
+	if action, _ := limiter.HandleConnect("a.example:443", ctx); action != goproxy.RejectConnect {
+		t.Fatal("Second tunnel of the user wasn't rejected")
+	}
+	if ctx.Resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 response, got %d", ctx.Resp.StatusCode)
+	}
+	if action, _ := limiter.HandleConnect("a.example:443", connectRequest(t, "192.0.2.1:1234", "bob")); action != nil {
+		t.Fatal("Tunnel of another user wasn't accepted")
+	}
+}
+
+func TestClientLimiterWebSockets(t *testing.T) {
+	limiter := limitation.NewClientLimiter(limitation.ClientLimits{MaxWebSockets: 1}, limitation.ClientLimits{})
+	webSocket := func(ctx context.Context) *http.Request {
+		req := newRequest(t, ctx, "http://a.example/ws")
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		return req
+	}
+
+	firstCtx, closeFirst := context.WithCancel(context.Background())
+	if _, resp := limiter.Handle(webSocket(firstCtx), &goproxy.ProxyCtx{}); resp != nil {
+		t.Fatal("First WebSocket connection wasn't accepted")
+	}
+	if _, resp := limiter.Handle(webSocket(context.Background()), &goproxy.ProxyCtx{}); resp == nil {
+		t.Fatal("Second WebSocket connection wasn't rejected")
+	}
+	// Other requests aren't limited
+	req := newRequest(t, context.Background(), "http://a.example/")
+	req.RemoteAddr = "192.0.2.1:1234"
+	if _, resp := limiter.Handle(req, &goproxy.ProxyCtx{}); resp != nil {
+		t.Fatal("Plain request was rejected")
+	}
+
+	closeFirst()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, webSockets := limiter.Count("192.0.2.1"); webSockets == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WebSocket connection wasn't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientLimiterProxy(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+
+	limiter := limitation.NewClientLimiter(limitation.ClientLimits{MaxTunnels: 1}, limitation.ClientLimits{})
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(limiter)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		host := backend.Listener.Addr().String()
+		if _, err := c.Write([]byte("CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp.StatusCode
+	}
+
+	first, status := connect()
+	if status != http.StatusOK {
+		t.Fatalf("Expected first tunnel to be accepted, got %d", status)
+	}
+	second, status := connect()
+	_ = second.Close()
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Expected second tunnel to be rejected, got %d", status)
+	}
+
+	_ = first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if tunnels, _ := limiter.Count("127.0.0.1"); tunnels == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Tunnel wasn't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, status := connect()
+	_ = third.Close()
+	if status != http.StatusOK {
+		t.Fatalf("Expected tunnel to be accepted after the first one was closed, got %d", status)
+	}
+}
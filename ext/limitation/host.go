@@ -0,0 +1,291 @@
+package limitation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// HostLimits describes the politeness limits applied to a destination.
+type HostLimits struct {
+	// RequestsPerSecond is the sustained rate of requests allowed toward
+	// the destination. Zero disables rate limiting.
+	RequestsPerSecond float64
+	// Burst is the number of requests that can be sent at once when the
+	// destination has been idle. Values lower than 1 are treated as 1.
+	Burst int
+	// MaxConcurrent is the maximum number of requests in flight toward the
+	// destination. Zero means no limit.
+	MaxConcurrent int
+	// MaxWait bounds how long a request exceeding the limits waits for its
+	// turn before being rejected. Zero waits as long as the client does, a
+	// negative value rejects it right away.
+	MaxWait time.Duration
+	// MaxQueued is the maximum number of requests waiting for their turn,
+	// the next ones being rejected. Zero means no limit.
+	MaxQueued int
+}
+
+// ErrHostLimited is returned by HostLimiter.Acquire for the requests
+// rejected by the MaxWait and MaxQueued limits.
+var ErrHostLimited = errors.New("host rate limit exceeded")
+
+// HostLimiter enforces HostLimits for each destination host and port,
+// shared by all the clients of the proxy, so that tools behind the proxy
+// can't accidentally overload a target.
+// Requests exceeding the limits wait for their turn, or fail with
+// 503 Service Unavailable if the client gives up before, or if they're
+// rejected by the MaxWait and MaxQueued limits.
+//
+//	limiter := limitation.NewHostLimiter(limitation.HostLimits{RequestsPerSecond: 5, MaxConcurrent: 2})
+//	proxy.OnRequest().Do(limiter)
+//	proxy.OnRequest().HandleConnect(limiter)
+type HostLimiter struct {
+	defaults HostLimits
+
+	mu        sync.Mutex
+	overrides map[string]HostLimits
+	hosts     map[string]*hostState
+}
+
+type hostState struct {
+	limits   HostLimits
+	tokens   float64
+	last     time.Time
+	inflight int
+	queued   int
+	// wake is closed, and replaced, to wake up all the waiting requests
+	// when a request finishes or when the limits change
+	wake chan struct{}
+}
+
+// setLimits applies limits to s, must be called with the lock of its
+// HostLimiter held.
+func (s *hostState) setLimits(limits HostLimits) {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	s.limits = limits
+	if burst := float64(limits.Burst); s.tokens > burst {
+		s.tokens = burst
+	}
+}
+
+// wakeAll wakes up the requests waiting on s, must be called with the
+// lock of its HostLimiter held.
+func (s *hostState) wakeAll() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// maxIdleHosts is the number of tracked hosts above which idle state
+// is discarded.
+const maxIdleHosts = 1024
+
+// NewHostLimiter returns a HostLimiter applying limits to every destination.
+func NewHostLimiter(limits HostLimits) *HostLimiter {
+	return &HostLimiter{
+		defaults:  limits,
+		overrides: make(map[string]HostLimits),
+		hosts:     make(map[string]*hostState),
+	}
+}
+
+// SetHostLimits overrides the limits of a single destination, host can be
+// either "host" or "host:port". The requests in flight and waiting for
+// their turn are then counted against the new limits.
+func (l *HostLimiter) SetHostLimits(host string, limits HostLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	host = strings.ToLower(host)
+	l.overrides[host] = limits
+	for key, state := range l.hosts {
+		if key == host || strings.HasPrefix(key, host+":") {
+			state.setLimits(l.limitsFor(key))
+			state.wakeAll()
+		}
+	}
+}
+
+// Handle implements goproxy.ReqHandler.
+func (l *HostLimiter) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	release, err := l.Acquire(req.Context(), hostKey(req.URL.Scheme, req.URL.Host))
+	if err != nil {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable,
+			"Rate limit exceeded for "+req.URL.Host)
+	}
+	go func() {
+		<-req.Context().Done()
+		release()
+	}()
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, applying the rate limit to
+// CONNECT requests. It never chooses an action, so that the following
+// CONNECT handlers are still evaluated.
+func (l *HostLimiter) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	release, err := l.Acquire(ctx.Req.Context(), hostKey("https", host))
+	if err != nil {
+		ctx.Resp = goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusServiceUnavailable,
+			"Rate limit exceeded for "+host)
+		return goproxy.RejectConnect, host
+	}
+	// The lifetime of a tunnel isn't tracked, only its opening is limited
+	release()
+	return nil, host
+}
+
+// Acquire waits until a request to hostport is allowed by the limits,
+// the returned function must be called once the request is completed.
+func (l *HostLimiter) Acquire(ctx context.Context, hostport string) (func(), error) {
+	var queuedOn *hostState
+	defer func() {
+		if queuedOn != nil {
+			l.mu.Lock()
+			queuedOn.queued--
+			l.mu.Unlock()
+		}
+	}()
+	waitCtx := ctx
+	for {
+		wait, wake, state := l.reserve(hostport)
+		if wait == 0 {
+			var once sync.Once
+			return func() { once.Do(func() { l.release(state) }) }, nil
+		}
+		if queuedOn == nil {
+			maxWait, ok := l.enqueue(state)
+			if !ok {
+				return nil, ErrHostLimited
+			}
+			queuedOn = state
+			if maxWait > 0 {
+				var cancel context.CancelFunc
+				waitCtx, cancel = context.WithTimeout(ctx, maxWait)
+				defer cancel()
+			}
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-waitCtx.Done():
+		case <-timeout:
+		case <-wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if waitCtx.Err() != nil {
+			if ctx.Err() == nil {
+				return nil, ErrHostLimited
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reserve takes a slot for hostport if possible, otherwise it returns how
+// long to wait before trying again, a negative duration until the state
+// of hostport is woken up, and the channel closed when it is.
+func (l *HostLimiter) reserve(hostport string) (time.Duration, <-chan struct{}, *hostState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, ok := l.hosts[hostport]
+	if !ok {
+		if len(l.hosts) >= maxIdleHosts {
+			l.sweep()
+		}
+		state = &hostState{last: time.Now(), wake: make(chan struct{})}
+		state.setLimits(l.limitsFor(hostport))
+		state.tokens = float64(state.limits.Burst)
+		l.hosts[hostport] = state
+	}
+
+	if state.limits.MaxConcurrent > 0 && state.inflight >= state.limits.MaxConcurrent {
+		// Woken up by release
+		return -1, state.wake, state
+	}
+	if rps := state.limits.RequestsPerSecond; rps > 0 {
+		now := time.Now()
+		state.tokens += now.Sub(state.last).Seconds() * rps
+		if burst := float64(state.limits.Burst); state.tokens > burst {
+			state.tokens = burst
+		}
+		state.last = now
+		if state.tokens < 1 {
+			return time.Duration((1 - state.tokens) / rps * float64(time.Second)), state.wake, state
+		}
+		state.tokens--
+	}
+	state.inflight++
+	return 0, nil, state
+}
+
+// enqueue tells whether a request can wait for its turn on state, and
+// counts it, returning how long it can wait.
+func (l *HostLimiter) enqueue(state *hostState) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state.limits.MaxWait < 0 || (state.limits.MaxQueued > 0 && state.queued >= state.limits.MaxQueued) {
+		return 0, false
+	}
+	state.queued++
+	return state.limits.MaxWait, true
+}
+
+func (l *HostLimiter) release(state *hostState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state.inflight--
+	state.wakeAll()
+}
+
+// sweep discards the state of idle hosts, must be called with l.mu held.
+func (l *HostLimiter) sweep() {
+	now := time.Now()
+	for key, state := range l.hosts {
+		refilled := state.limits.RequestsPerSecond <= 0 ||
+			state.tokens+now.Sub(state.last).Seconds()*state.limits.RequestsPerSecond >= float64(state.limits.Burst)
+		if state.inflight == 0 && state.queued == 0 && refilled {
+			delete(l.hosts, key)
+		}
+	}
+}
+
+// limitsFor must be called with l.mu held.
+func (l *HostLimiter) limitsFor(hostport string) HostLimits {
+	if limits, ok := l.overrides[hostport]; ok {
+		return limits
+	}
+	host, _, _ := net.SplitHostPort(hostport)
+	if limits, ok := l.overrides[host]; ok {
+		return limits
+	}
+	return l.defaults
+}
+
+// hostKey returns the lowercase host:port of an origin.
+func hostKey(scheme, host string) string {
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if scheme == "https" || scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,173 @@
+package limitation_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+)
+
+func newRequest(t *testing.T, ctx context.Context, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestHostLimiterRate(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{RequestsPerSecond: 10})
+	ctx := &goproxy.ProxyCtx{}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		reqCtx, cancel := context.WithCancel(context.Background())
+		if _, resp := limiter.Handle(newRequest(t, reqCtx, "http://a.example/"), ctx); resp != nil {
+			t.Fatal("unexpected response")
+		}
+		cancel()
+	}
+	// The first request uses the burst, the other two wait 100ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Limiter was too fast: %v", elapsed)
+	}
+
+	// Other hosts aren't affected
+	start = time.Now()
+	limiter.Handle(newRequest(t, context.Background(), "http://b.example/"), ctx)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Limiter took too long for another host: %v", elapsed)
+	}
+}
+
+func TestHostLimiterConcurrency(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{MaxConcurrent: 1})
+	ctx := &goproxy.ProxyCtx{}
+
+	firstCtx, finishFirst := context.WithCancel(context.Background())
+	limiter.Handle(newRequest(t, firstCtx, "http://a.example/"), ctx)
+
+	done := make(chan struct{})
+	go func() {
+		limiter.Handle(newRequest(t, context.Background(), "http://a.example/x"), ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Limiter was too fast")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	finishFirst()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Limiter took too long")
+	}
+}
+
+func TestHostLimiterCancelledRequest(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{RequestsPerSecond: 0.1})
+	limiter.SetHostLimits("slow.example", limitation.HostLimits{RequestsPerSecond: 0.1})
+	ctx := &goproxy.ProxyCtx{}
+
+	limiter.Handle(newRequest(t, context.Background(), "http://slow.example/"), ctx)
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, resp := limiter.Handle(newRequest(t, reqCtx, "http://slow.example/"), ctx)
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected 503 response for a request cancelled while waiting")
+	}
+}
+
+func TestHostLimiterReject(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{MaxConcurrent: 1, MaxWait: -1})
+	ctx := &goproxy.ProxyCtx{}
+
+	firstCtx, finishFirst := context.WithCancel(context.Background())
+	defer finishFirst()
+	limiter.Handle(newRequest(t, firstCtx, "http://a.example/"), ctx)
+
+	start := time.Now()
+	_, resp := limiter.Handle(newRequest(t, context.Background(), "http://a.example/x"), ctx)
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the request to be rejected, got %v", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("The rejected request waited: %v", elapsed)
+	}
+}
+
+func TestHostLimiterMaxWaitAndQueue(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{
+		MaxConcurrent: 1,
+		MaxWait:       50 * time.Millisecond,
+		MaxQueued:     1,
+	})
+	release, err := limiter.Acquire(context.Background(), "a.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	queued := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "a.example:80")
+		queued <- err
+	}()
+	// Let the first waiter queue up, the next one finds the queue full
+	time.Sleep(10 * time.Millisecond)
+	if _, err := limiter.Acquire(context.Background(), "a.example:80"); !errors.Is(err, limitation.ErrHostLimited) {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+	if err := <-queued; !errors.Is(err, limitation.ErrHostLimited) {
+		t.Errorf("Expected the queued request to time out, got %v", err)
+	}
+}
+
+func TestHostLimiterSetHostLimits(t *testing.T) {
+	limiter := limitation.NewHostLimiter(limitation.HostLimits{MaxConcurrent: 1})
+	release, err := limiter.Acquire(context.Background(), "a.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests in flight are still counted against the new limits
+	limiter.SetHostLimits("a.example", limitation.HostLimits{MaxConcurrent: 1, MaxWait: -1})
+	if _, err := limiter.Acquire(context.Background(), "a.example:80"); !errors.Is(err, limitation.ErrHostLimited) {
+		t.Errorf("Expected the request in flight to be counted, got %v", err)
+	}
+
+	// Raising the limits wakes up all the waiting requests
+	limiter.SetHostLimits("a.example", limitation.HostLimits{MaxConcurrent: 1})
+	acquired := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			release, err := limiter.Acquire(context.Background(), "a.example:80")
+			if err == nil {
+				defer release()
+			}
+			acquired <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetHostLimits("a.example", limitation.HostLimits{MaxConcurrent: 3})
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("The waiting requests weren't woken up")
+		}
+	}
+	release()
+}
@@ -0,0 +1,254 @@
+package limitation
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// QuotaLimits are the quotas of a client over each interval of a Quota.
+type QuotaLimits struct {
+	// MaxRequests is the maximum number of requests, CONNECT requests
+	// included. Zero means no limit.
+	MaxRequests int64
+	// MaxBytes is the maximum number of bytes transferred: the request and
+	// response bodies, and the data of the opaque tunnels. Zero means no
+	// limit.
+	MaxBytes int64
+}
+
+// QuotaEnforcement is what a Quota does with the requests of the clients
+// exceeding their quotas.
+type QuotaEnforcement int
+
+const (
+	// QuotaBlock rejects the requests, with 429 Too Many Requests by
+	// default.
+	QuotaBlock QuotaEnforcement = iota
+	// QuotaLogOnly logs the requests, and lets them through.
+	QuotaLogOnly
+)
+
+// Usage is the usage of the quotas of a client in the current interval.
+type Usage struct {
+	Requests int64
+	Bytes    int64
+	// Reset is the end of the interval, when the usage is reset.
+	Reset time.Time
+}
+
+// Quota counts the requests and the bytes transferred by each client IP
+// address and each authenticated user over fixed intervals, and enforces
+// their quotas until the end of the interval:
+//
+//	quota := limitation.NewQuota(time.Hour, limitation.QuotaLimits{MaxRequests: 10000}, limitation.QuotaLimits{MaxBytes: 1 << 30})
+//	proxy.OnRequest().Do(quota)
+//	proxy.OnRequest().HandleConnect(quota)
+//	proxy.OnResponse().DoFunc(quota.HandleResponse)
+//	proxy.OnTunnelClose = quota.OnTunnelClose
+//
+// The bytes are counted as they're transferred: the transfer exceeding a
+// quota completes, the following requests are rejected.
+type Quota struct {
+	// User, if set, returns the authenticated user of a request, or an
+	// empty string, as in ClientLimiter.
+	User func(ctx *goproxy.ProxyCtx) string
+	// Enforcement is what is done with the requests exceeding the quotas.
+	Enforcement QuotaEnforcement
+	// StatusCode is the status of the responses to the rejected requests,
+	// 429 Too Many Requests if it isn't set.
+	StatusCode int
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+
+	interval time.Duration
+	perIP    QuotaLimits
+	perUser  QuotaLimits
+
+	mu    sync.Mutex
+	usage map[clientKey]*Usage
+}
+
+// NewQuota returns a Quota applying perIP to every client IP address, and
+// perUser to every authenticated user, over intervals of interval.
+func NewQuota(interval time.Duration, perIP, perUser QuotaLimits) *Quota {
+	return &Quota{
+		interval: interval,
+		perIP:    perIP,
+		perUser:  perUser,
+		usage:    make(map[clientKey]*Usage),
+	}
+}
+
+// Handle implements goproxy.ReqHandler, counting the requests and their
+// bodies.
+func (q *Quota) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	keys := q.keys(req, ctx)
+	if resp := q.charge(req, ctx, keys); resp != nil {
+		return req, resp
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &quotaBody{ReadCloser: req.Body, quota: q, keys: keys}
+	}
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, counting the CONNECT
+// requests. It never chooses an action for the accepted tunnels, so that
+// the following CONNECT handlers are still evaluated.
+func (q *Quota) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if resp := q.charge(ctx.Req, ctx, q.keys(ctx.Req, ctx)); resp != nil {
+		ctx.Resp = resp
+		return goproxy.RejectConnect, host
+	}
+	return nil, host
+}
+
+// HandleResponse is a response handler counting the response bodies.
+func (q *Quota) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp != nil && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &quotaBody{ReadCloser: resp.Body, quota: q, keys: q.keys(ctx.Req, ctx)}
+	}
+	return resp
+}
+
+// OnTunnelClose counts the data of the opaque tunnels, as the proxy
+// OnTunnelClose hook.
+func (q *Quota) OnTunnelClose(stats *goproxy.TunnelStats, ctx *goproxy.ProxyCtx) {
+	q.addBytes(q.keys(ctx.Req, ctx), stats.BytesSent+stats.BytesReceived)
+}
+
+// IPUsage returns the usage of the quotas of a client IP address.
+func (q *Quota) IPUsage(ip string) Usage {
+	return q.current(clientKey{ip: ip})
+}
+
+// UserUsage returns the usage of the quotas of an authenticated user.
+func (q *Quota) UserUsage(user string) Usage {
+	return q.current(clientKey{user: user})
+}
+
+func (q *Quota) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+// keys returns the keys of the client of req with quotas.
+func (q *Quota) keys(req *http.Request, ctx *goproxy.ProxyCtx) []clientKey {
+	var keys []clientKey
+	if q.perIP != (QuotaLimits{}) {
+		keys = append(keys, clientKey{ip: clientIP(req)})
+	}
+	if q.perUser != (QuotaLimits{}) {
+		if user := userName(req, ctx, q.User); user != "" {
+			keys = append(keys, clientKey{user: user})
+		}
+	}
+	return keys
+}
+
+// lookup returns the usage of key in the current interval. q.mu must be
+// held.
+func (q *Quota) lookup(key clientKey, now time.Time) *Usage {
+	usage := q.usage[key]
+	if usage == nil || !now.Before(usage.Reset) {
+		usage = &Usage{Reset: now.Add(q.interval)}
+		q.usage[key] = usage
+		// Forget the clients idle for a whole interval
+		for k, u := range q.usage {
+			if !now.Before(u.Reset) {
+				delete(q.usage, k)
+			}
+		}
+	}
+	return usage
+}
+
+func (q *Quota) current(key clientKey) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if usage := q.usage[key]; usage != nil && q.now().Before(usage.Reset) {
+		return *usage
+	}
+	return Usage{}
+}
+
+// charge counts a request of the client with keys, and returns the
+// response rejecting it if one of its quotas is exhausted.
+func (q *Quota) charge(req *http.Request, ctx *goproxy.ProxyCtx, keys []clientKey) *http.Response {
+	now := q.now()
+	q.mu.Lock()
+	var exceeded *clientKey
+	var reset time.Time
+	for i, key := range keys {
+		limits := q.perIP
+		if key.user != "" {
+			limits = q.perUser
+		}
+		usage := q.lookup(key, now)
+		if (limits.MaxRequests > 0 && usage.Requests >= limits.MaxRequests) ||
+			(limits.MaxBytes > 0 && usage.Bytes >= limits.MaxBytes) {
+			exceeded, reset = &keys[i], usage.Reset
+			break
+		}
+	}
+	if exceeded == nil || q.Enforcement == QuotaLogOnly {
+		for _, key := range keys {
+			q.lookup(key, now).Requests++
+		}
+	}
+	q.mu.Unlock()
+
+	if exceeded == nil {
+		return nil
+	}
+	client := exceeded.ip
+	if exceeded.user != "" {
+		client = "user " + exceeded.user
+	}
+	if q.Enforcement == QuotaLogOnly {
+		if ctx.Proxy != nil {
+			ctx.Warnf("Quota of %s exceeded", client)
+		}
+		return nil
+	}
+	status := q.StatusCode
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, "Quota exceeded")
+	retryAfter := int64(reset.Sub(now)/time.Second) + 1
+	resp.Header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	return resp
+}
+
+func (q *Quota) addBytes(keys []clientKey, n int64) {
+	if n <= 0 || len(keys) == 0 {
+		return
+	}
+	now := q.now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, key := range keys {
+		q.lookup(key, now).Bytes += n
+	}
+}
+
+// quotaBody counts the bytes read from a body.
+type quotaBody struct {
+	io.ReadCloser
+	quota *Quota
+	keys  []clientKey
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.quota.addBytes(b.keys, int64(n))
+	return n, err
+}
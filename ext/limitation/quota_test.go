@@ -0,0 +1,114 @@
+package limitation_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+)
+
+func TestQuotaRequestsPerIP(t *testing.T) {
+	now := time.Unix(1000, 0)
+	quota := limitation.NewQuota(time.Minute, limitation.QuotaLimits{MaxRequests: 2}, limitation.QuotaLimits{})
+	quota.Now = func() time.Time { return now }
+
+	request := func(remoteAddr string) *http.Response {
+		req := newRequest(t, context.Background(), "http://a.example/")
+		req.RemoteAddr = remoteAddr
+		_, resp := quota.Handle(req, &goproxy.ProxyCtx{Req: req})
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := request("192.0.2.1:1234"); resp != nil {
+			t.Fatalf("Request %d was rejected", i)
+		}
+	}
+	resp := request("192.0.2.1:1235")
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 response once the quota is exhausted")
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "61" {
+		t.Fatalf("Expected Retry-After 61, got %q", retryAfter)
+	}
+	if action, _ := quota.HandleConnect("a.example:443", connectRequest(t, "192.0.2.1:1236", "")); action != goproxy.RejectConnect {
+		t.Fatal("CONNECT request wasn't rejected")
+	}
+	if resp := request("192.0.2.2:1234"); resp != nil {
+		t.Fatal("Request of another client was rejected")
+	}
+	if usage := quota.IPUsage("192.0.2.1"); usage.Requests != 2 || !usage.Reset.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Unexpected usage %+v", usage)
+	}
+
+	now = now.Add(time.Minute)
+	if resp := request("192.0.2.1:1237"); resp != nil {
+		t.Fatal("Request was rejected after the end of the interval")
+	}
+	if usage := quota.IPUsage("192.0.2.1"); usage.Requests != 1 {
+		t.Fatalf("Expected the usage to be reset, got %+v", usage)
+	}
+}
+
+func TestQuotaBytesPerUser(t *testing.T) {
+	quota := limitation.NewQuota(time.Hour, limitation.QuotaLimits{}, limitation.QuotaLimits{MaxBytes: 10})
+
+	request := func(user, body string) *http.Response {
+		req := newRequest(t, context.Background(), "http://a.example/")
+		req.Method = http.MethodPost
+		req.Body = io.NopCloser(strings.NewReader(body))
+		ctx := &goproxy.ProxyCtx{Req: req, User: &goproxy.User{Name: user}}
+		req, resp := quota.Handle(req, ctx)
+		if resp != nil {
+			return resp
+		}
+		if _, err := io.ReadAll(req.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp = &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("response"))}
+		resp = quota.HandleResponse(resp, ctx)
+		if _, err := io.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := request("alice", "hello"); resp.StatusCode != http.StatusOK {
+		t.Fatal("First request was rejected")
+	}
+	if usage := quota.UserUsage("alice"); usage.Requests != 1 || usage.Bytes != 13 {
+		t.Fatalf("Unexpected usage %+v", usage)
+	}
+	if resp := request("alice", "hello"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Request exceeding the quota wasn't rejected")
+	}
+	if resp := request("bob", "hello"); resp.StatusCode != http.StatusOK {
+		t.Fatal("Request of another user was rejected")
+	}
+
+	// The opaque tunnels are counted once closed
+	ctx := connectRequest(t, "192.0.2.1:1234", "")
+	ctx.User = &goproxy.User{Name: "bob"}
+	quota.OnTunnelClose(&goproxy.TunnelStats{BytesSent: 1, BytesReceived: 2}, ctx)
+	if usage := quota.UserUsage("bob"); usage.Bytes != 16 {
+		t.Fatalf("Expected 16 bytes, got %+v", usage)
+	}
+}
+
+func TestQuotaLogOnly(t *testing.T) {
+	quota := limitation.NewQuota(time.Hour, limitation.QuotaLimits{MaxRequests: 1}, limitation.QuotaLimits{})
+	quota.Enforcement = limitation.QuotaLogOnly
+
+	for i := 0; i < 3; i++ {
+		ctx := connectRequest(t, "192.0.2.1:1234", "")
+		if action, _ := quota.HandleConnect("a.example:443", ctx); action != nil {
+			t.Fatalf("CONNECT request %d was rejected", i)
+		}
+	}
+	if usage := quota.IPUsage("192.0.2.1"); usage.Requests != 3 {
+		t.Fatalf("Expected 3 requests, got %+v", usage)
+	}
+}
@@ -0,0 +1,259 @@
+package limitation
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// RateAlgorithm is the algorithm of a RateLimiter.
+type RateAlgorithm int
+
+const (
+	// TokenBucket lets the clients send bursts of requests, refilled at
+	// the limited rate.
+	TokenBucket RateAlgorithm = iota
+	// SlidingWindow limits the requests over the last interval, weighting
+	// the ones of the previous interval.
+	SlidingWindow
+)
+
+// RateLimits describe the request rate allowed to a client.
+type RateLimits struct {
+	// Requests is the number of requests allowed per Interval. Zero means
+	// no limit.
+	Requests int
+	Interval time.Duration
+	// Burst is the number of requests a TokenBucket allows at once,
+	// Requests by default.
+	Burst int
+}
+
+// RateLimiter limits the rate of the requests of each client IP address
+// and of each authenticated user, CONNECT requests included, so that
+// runaway clients can't overload the proxy or the destinations. The
+// requests exceeding the limits are rejected with 429 Too Many Requests
+// and a Retry-After header.
+//
+//	limiter := limitation.NewRateLimiter(limitation.RateLimits{Requests: 100, Interval: time.Second}, limitation.RateLimits{})
+//	proxy.OnRequest().Do(limiter)
+//	proxy.OnRequest().HandleConnect(limiter)
+type RateLimiter struct {
+	Algorithm RateAlgorithm
+	// User, if set, returns the authenticated user of a request, or an
+	// empty string, as in ClientLimiter.
+	User func(ctx *goproxy.ProxyCtx) string
+	// ExemptIPs are the client IP addresses or networks, "10.0.0.0/8",
+	// which aren't limited.
+	ExemptIPs []string
+	// ExemptUsers are the users who aren't limited.
+	ExemptUsers []string
+	// StatusCode is the status of the responses to the rejected requests,
+	// 429 Too Many Requests if it isn't set.
+	StatusCode int
+	// Now returns the current time, time.Now by default.
+	Now func() time.Time
+
+	perIP   RateLimits
+	perUser RateLimits
+
+	mu        sync.Mutex
+	states    map[clientKey]*rateState
+	lastSweep time.Time
+}
+
+// rateState is the state of the limits of a client.
+type rateState struct {
+	// tokens and updated are the token bucket
+	tokens  float64
+	updated time.Time
+	// window, previous and current are the sliding window
+	window            time.Time
+	previous, current int
+}
+
+// NewRateLimiter returns a RateLimiter applying perIP to every client IP
+// address, and perUser to every authenticated user.
+func NewRateLimiter(perIP, perUser RateLimits) *RateLimiter {
+	return &RateLimiter{
+		perIP:   perIP,
+		perUser: perUser,
+		states:  make(map[clientKey]*rateState),
+	}
+}
+
+// Handle implements goproxy.ReqHandler.
+func (l *RateLimiter) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if wait, ok := l.allow(req, ctx); !ok {
+		return req, l.rejection(req, wait)
+	}
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler. It never chooses an
+// action for the accepted tunnels, so that the following CONNECT handlers
+// are still evaluated.
+func (l *RateLimiter) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if wait, ok := l.allow(ctx.Req, ctx); !ok {
+		ctx.Resp = l.rejection(ctx.Req, wait)
+		return goproxy.RejectConnect, host
+	}
+	return nil, host
+}
+
+func (l *RateLimiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// exempt tells whether the client at ip isn't limited.
+func (l *RateLimiter) exempt(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, e := range l.ExemptIPs {
+		if e == ip {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(e); err == nil && parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// allow counts a request of the client of req, unless it exceeds its
+// limits: the time to wait before the next request is then returned.
+func (l *RateLimiter) allow(req *http.Request, ctx *goproxy.ProxyCtx) (time.Duration, bool) {
+	var keys []clientKey
+	if l.perIP.Requests > 0 {
+		if ip := clientIP(req); !l.exempt(ip) {
+			keys = append(keys, clientKey{ip: ip})
+		}
+	}
+	if l.perUser.Requests > 0 {
+		if user := userName(req, ctx, l.User); user != "" {
+			exempt := false
+			for _, e := range l.ExemptUsers {
+				exempt = exempt || e == user
+			}
+			if !exempt {
+				keys = append(keys, clientKey{user: user})
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return 0, true
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	var wait time.Duration
+	for _, key := range keys {
+		if w := l.wait(key, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for _, key := range keys {
+		state := l.states[key]
+		if l.Algorithm == SlidingWindow {
+			state.current++
+		} else {
+			state.tokens--
+		}
+	}
+	return 0, true
+}
+
+// limits returns the limits of key.
+func (l *RateLimiter) limits(key clientKey) RateLimits {
+	if key.user != "" {
+		return l.perUser
+	}
+	return l.perIP
+}
+
+// wait returns the time the client with key must wait before its next
+// request, after updating its state to now. l.mu must be held.
+func (l *RateLimiter) wait(key clientKey, now time.Time) time.Duration {
+	limits := l.limits(key)
+	state := l.states[key]
+	if l.Algorithm == SlidingWindow {
+		if state == nil {
+			state = &rateState{window: now}
+			l.states[key] = state
+		}
+		if elapsed := now.Sub(state.window); elapsed >= 2*limits.Interval {
+			state.window, state.previous, state.current = now, 0, 0
+		} else if elapsed >= limits.Interval {
+			state.window, state.previous, state.current = state.window.Add(limits.Interval), state.current, 0
+		}
+		elapsed := now.Sub(state.window)
+		weight := 1 - float64(elapsed)/float64(limits.Interval)
+		if float64(state.previous)*weight+float64(state.current) < float64(limits.Requests) {
+			return 0
+		}
+		interval := float64(limits.Interval)
+		if state.current >= limits.Requests {
+			// Until the current requests, then the previous ones, weigh
+			// less than the limit
+			return limits.Interval - elapsed +
+				time.Duration(interval*(1-float64(limits.Requests)/float64(state.current))) + time.Millisecond
+		}
+		// Until the previous requests weigh less than the room left
+		return time.Duration(interval*(1-float64(limits.Requests-state.current)/float64(state.previous))) -
+			elapsed + time.Millisecond
+	}
+
+	burst := limits.Burst
+	if burst <= 0 {
+		burst = limits.Requests
+	}
+	rate := float64(limits.Requests) / float64(limits.Interval)
+	if state == nil {
+		state = &rateState{tokens: float64(burst), updated: now}
+		l.states[key] = state
+	}
+	state.tokens = math.Min(float64(burst), state.tokens+float64(now.Sub(state.updated))*rate)
+	state.updated = now
+	if state.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - state.tokens) / rate))
+}
+
+// sweep forgets the clients idle for long enough for their limits to be
+// reset, at most once per minute. l.mu must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.states {
+		interval := l.limits(key).Interval
+		if now.Sub(state.updated) > 2*interval && now.Sub(state.window) > 2*interval {
+			delete(l.states, key)
+		}
+	}
+}
+
+func (l *RateLimiter) rejection(req *http.Request, wait time.Duration) *http.Response {
+	status := l.StatusCode
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, "Too many requests")
+	seconds := int64(math.Ceil(wait.Seconds()))
+	resp.Header.Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	return resp
+}
@@ -0,0 +1,121 @@
+package limitation_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/limitation"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := limitation.NewRateLimiter(limitation.RateLimits{Requests: 1, Interval: 2 * time.Second, Burst: 2}, limitation.RateLimits{})
+	limiter.Now = func() time.Time { return now }
+
+	request := func(remoteAddr string) *http.Response {
+		req := newRequest(t, context.Background(), "http://a.example/")
+		req.RemoteAddr = remoteAddr
+		_, resp := limiter.Handle(req, &goproxy.ProxyCtx{Req: req})
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := request("192.0.2.1:1234"); resp != nil {
+			t.Fatalf("Request %d of the burst was rejected", i)
+		}
+	}
+	resp := request("192.0.2.1:1234")
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 response once the burst is exhausted")
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "2" {
+		t.Fatalf("Expected Retry-After 2, got %q", retryAfter)
+	}
+	if resp := request("192.0.2.2:1234"); resp != nil {
+		t.Fatal("Request of another client was rejected")
+	}
+
+	now = now.Add(time.Second)
+	if resp := request("192.0.2.1:1234"); resp == nil {
+		t.Fatal("Request was accepted before a token was refilled")
+	}
+	now = now.Add(time.Second)
+	if resp := request("192.0.2.1:1234"); resp != nil {
+		t.Fatal("Request was rejected after a token was refilled")
+	}
+}
+
+func TestRateLimiterSlidingWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := limitation.NewRateLimiter(limitation.RateLimits{}, limitation.RateLimits{Requests: 2, Interval: 10 * time.Second})
+	limiter.Algorithm = limitation.SlidingWindow
+	limiter.Now = func() time.Time { return now }
+
+	connect := func() *goproxy.ProxyCtx {
+		ctx := connectRequest(t, "192.0.2.1:1234", "alice")
+		limiter.HandleConnect("a.example:443", ctx)
+		return ctx
+	}
+	for i := 0; i < 2; i++ {
+		if ctx := connect(); ctx.Resp != nil {
+			t.Fatalf("Request %d was rejected", i)
+		}
+	}
+	ctx := connect()
+	if ctx.Resp == nil || ctx.Resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 response once the window is full")
+	}
+	if retryAfter := ctx.Resp.Header.Get("Retry-After"); retryAfter != "11" {
+		t.Fatalf("Expected Retry-After 11, got %q", retryAfter)
+	}
+
+	// The requests of the previous window still weigh 2*(1-4/10)
+	now = now.Add(14 * time.Second)
+	if ctx := connect(); ctx.Resp != nil {
+		t.Fatal("Request was rejected in the next window")
+	}
+	ctx = connect()
+	if ctx.Resp == nil {
+		t.Fatal("Request was accepted while the previous window weighs the limit")
+	}
+	if retryAfter := ctx.Resp.Header.Get("Retry-After"); retryAfter != "2" {
+		t.Fatalf("Expected Retry-After 2, got %q", retryAfter)
+	}
+	now = now.Add(2 * time.Second)
+	if ctx := connect(); ctx.Resp != nil {
+		t.Fatal("Request was rejected once the previous window weighs less")
+	}
+}
+
+func TestRateLimiterExemptions(t *testing.T) {
+	limiter := limitation.NewRateLimiter(limitation.RateLimits{Requests: 1, Interval: time.Hour}, limitation.RateLimits{Requests: 1, Interval: time.Hour})
+	limiter.ExemptIPs = []string{"10.0.0.0/8", "192.0.2.9"}
+	limiter.ExemptUsers = []string{"robot"}
+
+	for _, test := range []struct {
+		remoteAddr string
+		user       string
+		limited    bool
+	}{
+		{"10.1.2.3:1234", "", false},
+		{"192.0.2.9:1234", "", false},
+		{"192.0.2.1:1234", "", true},
+		// The user is exempted, but not the IP address
+		{"192.0.2.2:1234", "robot", true},
+		{"10.1.2.3:1234", "robot", false},
+		{"10.1.2.3:1234", "alice", true},
+	} {
+		limited := false
+		for i := 0; i < 2; i++ {
+			ctx := connectRequest(t, test.remoteAddr, test.user)
+			if action, _ := limiter.HandleConnect("a.example:443", ctx); action == goproxy.RejectConnect {
+				limited = true
+			}
+		}
+		if limited != test.limited {
+			t.Errorf("%s %q: limited %v, expected %v", test.remoteAddr, test.user, limited, test.limited)
+		}
+	}
+}
@@ -0,0 +1,574 @@
+package pac
+
+import (
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment is what the PAC helper functions know of the host running
+// the proxy.
+type environment struct {
+	resolver *net.Resolver
+	now      func() time.Time
+	myIP     func() string
+}
+
+func newBuiltin(name string, fn func(in *interp, args []value) (value, error)) *builtin {
+	return &builtin{name: name, fn: fn}
+}
+
+// arg returns the i-th argument, undefined if it's missing.
+func arg(args []value, i int) value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func stringArg(args []value, i int) string {
+	return toString(arg(args, i))
+}
+
+// declareGlobals declares the global functions: the standard PAC helpers
+// and a few JavaScript ones.
+func (in *interp) declareGlobals(s *scope) {
+	for _, b := range []*builtin{
+		newBuiltin("isPlainHostName", func(in *interp, args []value) (value, error) {
+			return !strings.Contains(stringArg(args, 0), "."), nil
+		}),
+		newBuiltin("dnsDomainIs", func(in *interp, args []value) (value, error) {
+			host, domain := strings.ToLower(stringArg(args, 0)), strings.ToLower(stringArg(args, 1))
+			return strings.HasSuffix(host, domain), nil
+		}),
+		newBuiltin("localHostOrDomainIs", func(in *interp, args []value) (value, error) {
+			host, hostdom := strings.ToLower(stringArg(args, 0)), strings.ToLower(stringArg(args, 1))
+			return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."), nil
+		}),
+		newBuiltin("isResolvable", func(in *interp, args []value) (value, error) {
+			return in.resolve(stringArg(args, 0)) != nil, nil
+		}),
+		newBuiltin("dnsResolve", func(in *interp, args []value) (value, error) {
+			if ip := in.resolve(stringArg(args, 0)); ip != nil {
+				return ip.String(), nil
+			}
+			return null, nil
+		}),
+		newBuiltin("isInNet", func(in *interp, args []value) (value, error) {
+			ip := in.resolve(stringArg(args, 0))
+			pattern := net.ParseIP(stringArg(args, 1)).To4()
+			mask := net.ParseIP(stringArg(args, 2)).To4()
+			if ip == nil || pattern == nil || mask == nil {
+				return false, nil
+			}
+			return ip.Mask(net.IPMask(mask)).Equal(pattern.Mask(net.IPMask(mask))), nil
+		}),
+		newBuiltin("myIpAddress", func(in *interp, args []value) (value, error) {
+			return in.env.myIP(), nil
+		}),
+		newBuiltin("dnsDomainLevels", func(in *interp, args []value) (value, error) {
+			return float64(strings.Count(stringArg(args, 0), ".")), nil
+		}),
+		newBuiltin("convert_addr", func(in *interp, args []value) (value, error) {
+			ip := net.ParseIP(stringArg(args, 0)).To4()
+			if ip == nil {
+				return 0.0, nil
+			}
+			return float64(uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])), nil
+		}),
+		newBuiltin("shExpMatch", func(in *interp, args []value) (value, error) {
+			return shExpMatch(stringArg(args, 0), stringArg(args, 1)), nil
+		}),
+		newBuiltin("weekdayRange", func(in *interp, args []value) (value, error) {
+			return weekdayRange(in.env.now(), args), nil
+		}),
+		newBuiltin("dateRange", func(in *interp, args []value) (value, error) {
+			return dateRange(in.env.now(), args), nil
+		}),
+		newBuiltin("timeRange", func(in *interp, args []value) (value, error) {
+			return timeRange(in.env.now(), args), nil
+		}),
+		newBuiltin("alert", func(in *interp, args []value) (value, error) {
+			return nil, nil
+		}),
+		newBuiltin("parseInt", func(in *interp, args []value) (value, error) {
+			return parseInt(stringArg(args, 0), toInteger(arg(args, 1))), nil
+		}),
+		newBuiltin("parseFloat", func(in *interp, args []value) (value, error) {
+			s := strings.TrimSpace(stringArg(args, 0))
+			for end := len(s); end > 0; end-- {
+				if n, err := strconv.ParseFloat(s[:end], 64); err == nil {
+					return n, nil
+				}
+			}
+			return math.NaN(), nil
+		}),
+		newBuiltin("isNaN", func(in *interp, args []value) (value, error) {
+			return math.IsNaN(toNumber(arg(args, 0))), nil
+		}),
+		newBuiltin("String", func(in *interp, args []value) (value, error) {
+			if len(args) == 0 {
+				return "", nil
+			}
+			return toString(args[0]), nil
+		}),
+		newBuiltin("Number", func(in *interp, args []value) (value, error) {
+			if len(args) == 0 {
+				return 0.0, nil
+			}
+			return toNumber(args[0]), nil
+		}),
+	} {
+		s.vars[b.name] = b
+	}
+}
+
+// resolve returns the IPv4 address of host, or nil if it can't be
+// resolved.
+func (in *interp) resolve(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ips, err := in.env.resolver.LookupIP(in.ctx, "ip4", host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	return ips[0].To4()
+}
+
+// shExpMatch matches a shell expression, where * matches any sequence of
+// characters and ? any single character.
+func shExpMatch(s, pattern string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return err == nil && re.MatchString(s)
+}
+
+func parseInt(s string, radix int) float64 {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if (radix == 0 || radix == 16) && len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s, radix = s[2:], 16
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	if radix < 2 || radix > 36 {
+		return math.NaN()
+	}
+	end := 0
+	for end < len(s) {
+		d := strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyz", lowerByte(s[end]))
+		if d < 0 || d >= radix {
+			break
+		}
+		end++
+	}
+	if end == 0 {
+		return math.NaN()
+	}
+	n, err := strconv.ParseInt(s[:end], radix, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return sign * float64(n)
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// localTime returns now in UTC when the last argument of a time
+// function is "GMT", and the arguments without it.
+func localTime(now time.Time, args []value) (time.Time, []value) {
+	if len(args) > 0 && strings.EqualFold(toString(args[len(args)-1]), "GMT") {
+		return now.UTC(), args[:len(args)-1]
+	}
+	return now.Local(), args
+}
+
+// inRange tells whether v is between start and end, the range wrapping
+// around when start is after end.
+func inRange(v, start, end int) bool {
+	if start <= end {
+		return start <= v && v <= end
+	}
+	return v >= start || v <= end
+}
+
+var weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+func weekdayRange(now time.Time, args []value) bool {
+	now, args = localTime(now, args)
+	if len(args) == 0 {
+		return false
+	}
+	start := indexFold(weekdays, toString(args[0]))
+	end := start
+	if len(args) > 1 {
+		end = indexFold(weekdays, toString(args[1]))
+	}
+	if start < 0 || end < 0 {
+		return false
+	}
+	return inRange(int(now.Weekday()), start, end)
+}
+
+var months = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func indexFold(list []string, s string) int {
+	for i, item := range list {
+		if strings.EqualFold(item, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// dateRange implements the dateRange forms: a day, a month, a year, or
+// ranges of days, months, years, or of their combinations.
+func dateRange(now time.Time, args []value) bool {
+	now, args = localTime(now, args)
+	type field int
+	const (
+		day field = iota
+		month
+		year
+	)
+	var fields []field
+	var values []int
+	for _, a := range args {
+		if m := indexFold(months, toString(a)); m >= 0 {
+			fields, values = append(fields, month), append(values, m+1)
+			continue
+		}
+		n := toNumber(a)
+		if math.IsNaN(n) || n < 1 {
+			return false
+		}
+		if n > 31 {
+			fields, values = append(fields, year), append(values, int(n))
+		} else {
+			fields, values = append(fields, day), append(values, int(n))
+		}
+	}
+	current := map[field]int{day: now.Day(), month: int(now.Month()), year: now.Year()}
+	// key orders the selected fields of a date, from the most significant
+	key := func(fields []field, values []int) int {
+		k := 0
+		for _, f := range []field{year, month, day} {
+			for i := range fields {
+				if fields[i] == f {
+					k = k*10000 + values[i]
+				}
+			}
+		}
+		return k
+	}
+	switch len(values) {
+	case 1:
+		return current[fields[0]] == values[0]
+	case 2, 4, 6:
+		half := len(values) / 2
+		for i := 0; i < half; i++ {
+			if fields[i] != fields[half+i] {
+				return false
+			}
+		}
+		currentValues := make([]int, half)
+		for i := range currentValues {
+			currentValues[i] = current[fields[i]]
+		}
+		v := key(fields[:half], currentValues)
+		start, end := key(fields[:half], values[:half]), key(fields[half:], values[half:])
+		for _, f := range fields[:half] {
+			if f == year {
+				return start <= v && v <= end
+			}
+		}
+		return inRange(v, start, end)
+	}
+	return false
+}
+
+// timeRange implements the timeRange forms: an hour, a range of hours, of
+// hours and minutes, or of hours, minutes and seconds.
+func timeRange(now time.Time, args []value) bool {
+	now, args = localTime(now, args)
+	n := make([]int, len(args))
+	for i, a := range args {
+		f := toNumber(a)
+		if math.IsNaN(f) {
+			return false
+		}
+		n[i] = int(f)
+	}
+	seconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(n) {
+	case 1:
+		return now.Hour() == n[0]
+	case 2:
+		if n[0] == n[1] {
+			return now.Hour() == n[0]
+		}
+		// The end hour is excluded: timeRange(9, 17) ends at 16:59:59
+		return inRange(seconds, n[0]*3600, n[1]*3600-1)
+	case 4:
+		return inRange(seconds, n[0]*3600+n[1]*60, n[2]*3600+n[3]*60)
+	case 6:
+		return inRange(seconds, n[0]*3600+n[1]*60+n[2], n[3]*3600+n[4]*60+n[5])
+	}
+	return false
+}
+
+func stringMethod(s string, name string) value {
+	var fn func(args []value) value
+	switch name {
+	case "toLowerCase":
+		fn = func([]value) value { return strings.ToLower(s) }
+	case "toUpperCase":
+		fn = func([]value) value { return strings.ToUpper(s) }
+	case "trim":
+		fn = func([]value) value { return strings.TrimSpace(s) }
+	case "charAt":
+		fn = func(args []value) value {
+			i := int(toNumber(arg(args, 0)))
+			if i < 0 || i >= len(s) {
+				return ""
+			}
+			return s[i : i+1]
+		}
+	case "charCodeAt":
+		fn = func(args []value) value {
+			i := int(toNumber(arg(args, 0)))
+			if i < 0 || i >= len(s) {
+				return math.NaN()
+			}
+			return float64(s[i])
+		}
+	case "indexOf":
+		fn = func(args []value) value {
+			from := clamp(toInteger(arg(args, 1)), len(s))
+			i := strings.Index(s[from:], stringArg(args, 0))
+			if i < 0 {
+				return -1.0
+			}
+			return float64(from + i)
+		}
+	case "lastIndexOf":
+		fn = func(args []value) value { return float64(strings.LastIndex(s, stringArg(args, 0))) }
+	case "startsWith":
+		fn = func(args []value) value { return strings.HasPrefix(s, stringArg(args, 0)) }
+	case "endsWith":
+		fn = func(args []value) value { return strings.HasSuffix(s, stringArg(args, 0)) }
+	case "includes":
+		fn = func(args []value) value { return strings.Contains(s, stringArg(args, 0)) }
+	case "substring":
+		fn = func(args []value) value {
+			start := clamp(toInteger(arg(args, 0)), len(s))
+			end := len(s)
+			if arg(args, 1) != nil {
+				end = clamp(toInteger(arg(args, 1)), len(s))
+			}
+			if start > end {
+				start, end = end, start
+			}
+			return s[start:end]
+		}
+	case "substr":
+		fn = func(args []value) value {
+			start := relativeIndex(toInteger(arg(args, 0)), len(s))
+			end := len(s)
+			if arg(args, 1) != nil {
+				end = clamp(start+toInteger(arg(args, 1)), len(s))
+			}
+			if end < start {
+				return ""
+			}
+			return s[start:end]
+		}
+	case "slice":
+		fn = func(args []value) value {
+			start := relativeIndex(toInteger(arg(args, 0)), len(s))
+			end := len(s)
+			if arg(args, 1) != nil {
+				end = relativeIndex(toInteger(arg(args, 1)), len(s))
+			}
+			if end < start {
+				return ""
+			}
+			return s[start:end]
+		}
+	case "split":
+		fn = func(args []value) value {
+			var parts []string
+			switch sep := arg(args, 0).(type) {
+			case nil:
+				parts = []string{s}
+			case *regexp.Regexp:
+				parts = sep.Split(s, -1)
+			default:
+				parts = strings.Split(s, toString(sep))
+			}
+			a := &array{elems: make([]value, len(parts))}
+			for i, part := range parts {
+				a.elems[i] = part
+			}
+			return a
+		}
+	case "replace":
+		fn = func(args []value) value {
+			replacement := stringArg(args, 1)
+			if re, ok := arg(args, 0).(*regexp.Regexp); ok {
+				return re.ReplaceAllLiteralString(s, replacement)
+			}
+			return strings.Replace(s, stringArg(args, 0), replacement, 1)
+		}
+	case "match":
+		fn = func(args []value) value {
+			re, ok := arg(args, 0).(*regexp.Regexp)
+			if !ok {
+				var err error
+				if re, err = regexp.Compile(stringArg(args, 0)); err != nil {
+					return null
+				}
+			}
+			match := re.FindStringSubmatch(s)
+			if match == nil {
+				return null
+			}
+			a := &array{elems: make([]value, len(match))}
+			for i, m := range match {
+				a.elems[i] = m
+			}
+			return a
+		}
+	case "concat":
+		fn = func(args []value) value {
+			for _, a := range args {
+				s += toString(a)
+			}
+			return s
+		}
+	case "toString":
+		fn = func([]value) value { return s }
+	default:
+		return nil
+	}
+	return newBuiltin(name, func(in *interp, args []value) (value, error) { return fn(args), nil })
+}
+
+func arrayMethod(a *array, name string) value {
+	var fn func(args []value) value
+	switch name {
+	case "indexOf":
+		fn = func(args []value) value {
+			for i, elem := range a.elems {
+				if strictEquals(elem, arg(args, 0)) {
+					return float64(i)
+				}
+			}
+			return -1.0
+		}
+	case "includes":
+		fn = func(args []value) value {
+			for _, elem := range a.elems {
+				if strictEquals(elem, arg(args, 0)) {
+					return true
+				}
+			}
+			return false
+		}
+	case "join":
+		fn = func(args []value) value {
+			sep := ","
+			if arg(args, 0) != nil {
+				sep = stringArg(args, 0)
+			}
+			parts := make([]string, len(a.elems))
+			for i, elem := range a.elems {
+				if elem != nil && elem != null {
+					parts[i] = toString(elem)
+				}
+			}
+			return strings.Join(parts, sep)
+		}
+	case "push":
+		fn = func(args []value) value {
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems))
+		}
+	case "toString":
+		fn = func([]value) value { return toString(a) }
+	default:
+		return nil
+	}
+	return newBuiltin(name, func(in *interp, args []value) (value, error) { return fn(args), nil })
+}
+
+func regexpMethod(re *regexp.Regexp, name string) value {
+	switch name {
+	case "test":
+		return newBuiltin(name, func(in *interp, args []value) (value, error) {
+			return re.MatchString(stringArg(args, 0)), nil
+		})
+	case "source":
+		return re.String()
+	}
+	return nil
+}
+
+func toInteger(v value) int {
+	n := toNumber(v)
+	switch {
+	case math.IsNaN(n):
+		return 0
+	case n > math.MaxInt32:
+		return math.MaxInt32
+	case n < math.MinInt32:
+		return math.MinInt32
+	}
+	return int(n)
+}
+
+func clamp(i, length int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > length {
+		return length
+	}
+	return i
+}
+
+// relativeIndex resolves the negative indexes from the end of a string.
+func relativeIndex(i, length int) int {
+	if i < 0 {
+		i += length
+	}
+	return clamp(i, length)
+}
@@ -0,0 +1,800 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The values of the interpreter are nil (undefined), null, bool, float64,
+// string, *array, *object, *function, *builtin and *regexp.Regexp.
+type value interface{}
+
+type nullValue struct{}
+
+var null value = nullValue{}
+
+type array struct{ elems []value }
+
+type object struct {
+	keys   []string
+	values map[string]value
+}
+
+type function struct {
+	decl  *funcDecl
+	scope *scope
+}
+
+type builtin struct {
+	name string
+	fn   func(in *interp, args []value) (value, error)
+}
+
+type scope struct {
+	vars   map[string]value
+	parent *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{vars: make(map[string]value), parent: parent}
+}
+
+func (s *scope) lookup(name string) (*scope, bool) {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Limits of the evaluations, protecting the proxy from the scripts never
+// returning.
+const (
+	maxSteps     = 1000000
+	maxCallDepth = 200
+)
+
+var errStepLimit = errors.New("script exceeded its evaluation limit")
+
+// interp evaluates a script. It isn't safe for concurrent use.
+type interp struct {
+	ctx     context.Context
+	globals *scope
+	env     *environment
+	steps   int
+	depth   int
+}
+
+type completion int
+
+const (
+	normal completion = iota
+	returned
+	broke
+	continued
+)
+
+func (in *interp) step() error {
+	in.steps++
+	if in.steps > maxSteps {
+		return errStepLimit
+	}
+	if in.steps%1024 == 0 {
+		return in.ctx.Err()
+	}
+	return nil
+}
+
+// hoist declares the functions and variables of a function body, before
+// its execution.
+func (in *interp) hoist(body []stmt, s *scope) {
+	for _, st := range body {
+		switch st := st.(type) {
+		case *funcDecl:
+			s.vars[st.name] = &function{decl: st, scope: s}
+		case *varStmt:
+			for _, name := range st.names {
+				if _, ok := s.vars[name]; !ok {
+					s.vars[name] = nil
+				}
+			}
+		case *blockStmt:
+			in.hoist(st.body, s)
+		case *ifStmt:
+			in.hoist([]stmt{st.then, st.els}, s)
+		case *forStmt:
+			in.hoist([]stmt{st.init, st.body}, s)
+		case *whileStmt:
+			in.hoist([]stmt{st.body}, s)
+		case *switchStmt:
+			for _, c := range st.cases {
+				in.hoist(c.body, s)
+			}
+		}
+	}
+}
+
+func (in *interp) execBlock(body []stmt, s *scope) (completion, value, error) {
+	for _, st := range body {
+		c, v, err := in.exec(st, s)
+		if err != nil || c != normal {
+			return c, v, err
+		}
+	}
+	return normal, nil, nil
+}
+
+func (in *interp) exec(st stmt, s *scope) (completion, value, error) {
+	if err := in.step(); err != nil {
+		return normal, nil, err
+	}
+	switch st := st.(type) {
+	case nil, *emptyStmt, *funcDecl:
+		return normal, nil, nil
+	case *exprStmt:
+		_, err := in.eval(st.x, s)
+		return normal, nil, err
+	case *varStmt:
+		for i, name := range st.names {
+			if st.inits[i] == nil {
+				continue
+			}
+			v, err := in.eval(st.inits[i], s)
+			if err != nil {
+				return normal, nil, err
+			}
+			s.vars[name] = v
+		}
+		return normal, nil, nil
+	case *blockStmt:
+		return in.execBlock(st.body, s)
+	case *ifStmt:
+		test, err := in.eval(st.test, s)
+		if err != nil {
+			return normal, nil, err
+		}
+		if toBool(test) {
+			return in.exec(st.then, s)
+		}
+		return in.exec(st.els, s)
+	case *whileStmt:
+		return in.loop(nil, st.test, nil, st.body, s)
+	case *forStmt:
+		return in.loop(st.init, st.test, st.update, st.body, s)
+	case *switchStmt:
+		return in.switchCases(st, s)
+	case *returnStmt:
+		if st.value == nil {
+			return returned, nil, nil
+		}
+		v, err := in.eval(st.value, s)
+		return returned, v, err
+	case *breakStmt:
+		return broke, nil, nil
+	case *continueStmt:
+		return continued, nil, nil
+	}
+	return normal, nil, fmt.Errorf("unsupported statement %T", st)
+}
+
+func (in *interp) loop(init stmt, test, update expr, body stmt, s *scope) (completion, value, error) {
+	if _, _, err := in.exec(init, s); err != nil {
+		return normal, nil, err
+	}
+	for {
+		if err := in.step(); err != nil {
+			return normal, nil, err
+		}
+		if test != nil {
+			v, err := in.eval(test, s)
+			if err != nil {
+				return normal, nil, err
+			}
+			if !toBool(v) {
+				return normal, nil, nil
+			}
+		}
+		c, v, err := in.exec(body, s)
+		if err != nil || c == returned {
+			return c, v, err
+		}
+		if c == broke {
+			return normal, nil, nil
+		}
+		if update != nil {
+			if _, err := in.eval(update, s); err != nil {
+				return normal, nil, err
+			}
+		}
+	}
+}
+
+// switchCases runs the clauses of a switch statement from the first one
+// whose test strictly equals its discriminant, or from the default clause,
+// up to a break.
+func (in *interp) switchCases(st *switchStmt, s *scope) (completion, value, error) {
+	disc, err := in.eval(st.disc, s)
+	if err != nil {
+		return normal, nil, err
+	}
+	start := -1
+	for i, c := range st.cases {
+		if c.test == nil {
+			continue
+		}
+		v, err := in.eval(c.test, s)
+		if err != nil {
+			return normal, nil, err
+		}
+		if strictEquals(disc, v) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		for i, c := range st.cases {
+			if c.test == nil {
+				start = i
+			}
+		}
+		if start < 0 {
+			return normal, nil, nil
+		}
+	}
+	for _, c := range st.cases[start:] {
+		comp, v, err := in.execBlock(c.body, s)
+		if err != nil || comp == returned || comp == continued {
+			return comp, v, err
+		}
+		if comp == broke {
+			return normal, nil, nil
+		}
+	}
+	return normal, nil, nil
+}
+
+func (in *interp) eval(x expr, s *scope) (value, error) {
+	switch x := x.(type) {
+	case *numberLit:
+		return x.value, nil
+	case *stringLit:
+		return x.value, nil
+	case *regexpLit:
+		return x.re, nil
+	case *constant:
+		return x.value, nil
+	case *funcLit:
+		return &function{decl: x.fn, scope: s}, nil
+	case *ident:
+		return in.lookup(x.name, s)
+	case *arrayLit:
+		a := &array{elems: make([]value, len(x.elems))}
+		for i, elem := range x.elems {
+			v, err := in.eval(elem, s)
+			if err != nil {
+				return nil, err
+			}
+			a.elems[i] = v
+		}
+		return a, nil
+	case *objectLit:
+		o := &object{values: make(map[string]value)}
+		for i, key := range x.keys {
+			v, err := in.eval(x.values[i], s)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key, v)
+		}
+		return o, nil
+	case *unaryExpr:
+		if x.op == "typeof" {
+			if id, ok := x.x.(*ident); ok {
+				if _, found := s.lookup(id.name); !found {
+					return "undefined", nil
+				}
+			}
+		}
+		v, err := in.eval(x.x, s)
+		if err != nil {
+			return nil, err
+		}
+		return unary(x.op, v), nil
+	case *updateExpr:
+		old, err := in.eval(x.target, s)
+		if err != nil {
+			return nil, err
+		}
+		n := toNumber(old)
+		updated := n + 1
+		if x.op == "--" {
+			updated = n - 1
+		}
+		if err := in.assign(x.target, updated, s); err != nil {
+			return nil, err
+		}
+		if x.prefix {
+			return updated, nil
+		}
+		return n, nil
+	case *binaryExpr:
+		l, err := in.eval(x.l, s)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "&&":
+			if !toBool(l) {
+				return l, nil
+			}
+			return in.eval(x.r, s)
+		case "||":
+			if toBool(l) {
+				return l, nil
+			}
+			return in.eval(x.r, s)
+		}
+		r, err := in.eval(x.r, s)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x.op, l, r)
+	case *condExpr:
+		test, err := in.eval(x.test, s)
+		if err != nil {
+			return nil, err
+		}
+		if toBool(test) {
+			return in.eval(x.then, s)
+		}
+		return in.eval(x.els, s)
+	case *assignExpr:
+		v, err := in.eval(x.value, s)
+		if err != nil {
+			return nil, err
+		}
+		if x.op != "=" {
+			old, err := in.eval(x.target, s)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = binary(strings.TrimSuffix(x.op, "="), old, v); err != nil {
+				return nil, err
+			}
+		}
+		return v, in.assign(x.target, v, s)
+	case *memberExpr:
+		obj, err := in.eval(x.obj, s)
+		if err != nil {
+			return nil, err
+		}
+		prop, err := in.eval(x.prop, s)
+		if err != nil {
+			return nil, err
+		}
+		return member(obj, prop)
+	case *callExpr:
+		callee, err := in.eval(x.callee, s)
+		if err != nil {
+			return nil, err
+		}
+		args := make([]value, len(x.args))
+		for i, arg := range x.args {
+			if args[i], err = in.eval(arg, s); err != nil {
+				return nil, err
+			}
+		}
+		return in.call(callee, args, describe(x.callee))
+	}
+	return nil, fmt.Errorf("unsupported expression %T", x)
+}
+
+func (in *interp) lookup(name string, s *scope) (value, error) {
+	if found, ok := s.lookup(name); ok {
+		return found.vars[name], nil
+	}
+	switch name {
+	case "undefined":
+		return nil, nil
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	}
+	return nil, fmt.Errorf("%s is not defined", name)
+}
+
+func (in *interp) assign(target expr, v value, s *scope) error {
+	switch target := target.(type) {
+	case *ident:
+		found, ok := s.lookup(target.name)
+		if !ok {
+			found = in.globals
+		}
+		found.vars[target.name] = v
+		return nil
+	case *memberExpr:
+		obj, err := in.eval(target.obj, s)
+		if err != nil {
+			return err
+		}
+		prop, err := in.eval(target.prop, s)
+		if err != nil {
+			return err
+		}
+		switch obj := obj.(type) {
+		case *object:
+			obj.set(toString(prop), v)
+			return nil
+		case *array:
+			i, ok := arrayIndex(prop)
+			if !ok || i > len(obj.elems)+maxSteps {
+				return fmt.Errorf("invalid array index %s", toString(prop))
+			}
+			for len(obj.elems) <= i {
+				obj.elems = append(obj.elems, nil)
+			}
+			obj.elems[i] = v
+			return nil
+		}
+		return fmt.Errorf("cannot set property %s of %s", toString(prop), toString(obj))
+	}
+	return fmt.Errorf("invalid assignment target")
+}
+
+func (in *interp) call(callee value, args []value, name string) (value, error) {
+	if err := in.step(); err != nil {
+		return nil, err
+	}
+	switch fn := callee.(type) {
+	case *builtin:
+		return fn.fn(in, args)
+	case *function:
+		if in.depth >= maxCallDepth {
+			return nil, fmt.Errorf("maximum call depth exceeded in %s", name)
+		}
+		in.depth++
+		defer func() { in.depth-- }()
+		s := newScope(fn.scope)
+		for i, param := range fn.decl.params {
+			if i < len(args) {
+				s.vars[param] = args[i]
+			} else {
+				s.vars[param] = nil
+			}
+		}
+		in.hoist(fn.decl.body, s)
+		_, v, err := in.execBlock(fn.decl.body, s)
+		return v, err
+	}
+	return nil, fmt.Errorf("%s is not a function", name)
+}
+
+// describe names a callee in the error messages.
+func describe(x expr) string {
+	switch x := x.(type) {
+	case *ident:
+		return x.name
+	case *memberExpr:
+		if prop, ok := x.prop.(*stringLit); ok {
+			return describe(x.obj) + "." + prop.value
+		}
+		return describe(x.obj) + "[...]"
+	}
+	return "expression"
+}
+
+func (o *object) set(key string, v value) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+}
+
+func arrayIndex(prop value) (int, bool) {
+	n := toNumber(prop)
+	if n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func member(obj, prop value) (value, error) {
+	name := toString(prop)
+	switch obj := obj.(type) {
+	case nil, nullValue:
+		return nil, fmt.Errorf("cannot read property %s of %s", name, toString(obj))
+	case string:
+		if name == "length" {
+			return float64(len(obj)), nil
+		}
+		if i, ok := arrayIndex(prop); ok && (!isString(prop) || name == strconv.Itoa(i)) {
+			if i < len(obj) {
+				return obj[i : i+1], nil
+			}
+			return nil, nil
+		}
+		return stringMethod(obj, name), nil
+	case *array:
+		if name == "length" {
+			return float64(len(obj.elems)), nil
+		}
+		if i, ok := arrayIndex(prop); ok && (!isString(prop) || name == strconv.Itoa(i)) {
+			if i < len(obj.elems) {
+				return obj.elems[i], nil
+			}
+			return nil, nil
+		}
+		return arrayMethod(obj, name), nil
+	case *object:
+		return obj.values[name], nil
+	case *regexp.Regexp:
+		return regexpMethod(obj, name), nil
+	}
+	return nil, nil
+}
+
+func isString(v value) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func toBool(v value) bool {
+	switch v := v.(type) {
+	case nil, nullValue:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func toNumber(v value) float64 {
+	switch v := v.(type) {
+	case nil:
+		return math.NaN()
+	case nullValue:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		n, err := parseNumber(s)
+		if err != nil {
+			return math.NaN()
+		}
+		return n
+	case *array:
+		return toNumber(toString(v))
+	}
+	return math.NaN()
+}
+
+func formatNumber(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "NaN"
+	case math.IsInf(n, 1):
+		return "Infinity"
+	case math.IsInf(n, -1):
+		return "-Infinity"
+	case n == math.Trunc(n) && math.Abs(n) < 1e21:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "undefined"
+	case nullValue:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	case *array:
+		parts := make([]string, len(v.elems))
+		for i, elem := range v.elems {
+			if elem != nil && elem != null {
+				parts[i] = toString(elem)
+			}
+		}
+		return strings.Join(parts, ",")
+	case *object:
+		return "[object Object]"
+	case *function:
+		return "function " + v.decl.name + "() { [code] }"
+	case *builtin:
+		return "function " + v.name + "() { [native code] }"
+	case *regexp.Regexp:
+		return "/" + v.String() + "/"
+	}
+	return ""
+}
+
+func typeOf(v value) string {
+	switch v.(type) {
+	case nil:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *function, *builtin:
+		return "function"
+	}
+	return "object"
+}
+
+// toPrimitive converts the arrays and objects to strings, as the
+// operators do.
+func toPrimitive(v value) value {
+	switch v.(type) {
+	case *array, *object, *function, *builtin, *regexp.Regexp:
+		return toString(v)
+	}
+	return v
+}
+
+func unary(op string, v value) value {
+	switch op {
+	case "!":
+		return !toBool(v)
+	case "-":
+		return -toNumber(v)
+	case "+":
+		return toNumber(v)
+	case "~":
+		return float64(^toInt32(v))
+	case "typeof":
+		return typeOf(v)
+	}
+	// void
+	return nil
+}
+
+func toInt32(v value) int32 {
+	n := toNumber(v)
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Mod(math.Trunc(n), 1<<32))))
+}
+
+func binary(op string, l, r value) (value, error) {
+	switch op {
+	case "===":
+		return strictEquals(l, r), nil
+	case "!==":
+		return !strictEquals(l, r), nil
+	case "==":
+		return looseEquals(l, r), nil
+	case "!=":
+		return !looseEquals(l, r), nil
+	case "in":
+		o, ok := r.(*object)
+		if !ok {
+			return nil, fmt.Errorf("cannot use 'in' operator on %s", toString(r))
+		}
+		_, found := o.values[toString(l)]
+		return found, nil
+	}
+	l, r = toPrimitive(l), toPrimitive(r)
+	if op == "+" {
+		if isString(l) || isString(r) {
+			return toString(l) + toString(r), nil
+		}
+		return toNumber(l) + toNumber(r), nil
+	}
+	switch op {
+	case "<", ">", "<=", ">=":
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return compare(op, strings.Compare(ls, rs)), nil
+			}
+		}
+		a, b := toNumber(l), toNumber(r)
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return false, nil
+		}
+		switch {
+		case a < b:
+			return compare(op, -1), nil
+		case a > b:
+			return compare(op, 1), nil
+		}
+		return compare(op, 0), nil
+	}
+	a, b := toNumber(l), toNumber(r)
+	switch op {
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return math.Mod(a, b), nil
+	case "&":
+		return float64(toInt32(a) & toInt32(b)), nil
+	case "|":
+		return float64(toInt32(a) | toInt32(b)), nil
+	case "^":
+		return float64(toInt32(a) ^ toInt32(b)), nil
+	case "<<":
+		return float64(toInt32(a) << (uint32(toInt32(b)) & 31)), nil
+	case ">>":
+		return float64(toInt32(a) >> (uint32(toInt32(b)) & 31)), nil
+	case ">>>":
+		return float64(uint32(toInt32(a)) >> (uint32(toInt32(b)) & 31)), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+func compare(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	}
+	return c >= 0
+}
+
+func strictEquals(l, r value) bool {
+	switch l := l.(type) {
+	case float64:
+		r, ok := r.(float64)
+		return ok && l == r
+	case string, bool, nil, nullValue:
+		return l == r
+	}
+	return l == r
+}
+
+func looseEquals(l, r value) bool {
+	isNullish := func(v value) bool { return v == nil || v == null }
+	if isNullish(l) || isNullish(r) {
+		return isNullish(l) && isNullish(r)
+	}
+	switch l.(type) {
+	case *array, *object, *function, *builtin, *regexp.Regexp:
+		switch r.(type) {
+		case *array, *object, *function, *builtin, *regexp.Regexp:
+			return l == r
+		}
+	}
+	l, r = toPrimitive(l), toPrimitive(r)
+	if ls, ok := l.(string); ok {
+		if rs, ok := r.(string); ok {
+			return ls == rs
+		}
+	}
+	return toNumber(l) == toNumber(r)
+}
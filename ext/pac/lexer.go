@@ -0,0 +1,239 @@
+package pac
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokPunct
+	tokRegexp
+)
+
+type token struct {
+	kind tokenKind
+	// text is the punctuator, the identifier, the decoded string, the
+	// pattern of the regular expression or the source of the number.
+	text  string
+	num   float64
+	flags string
+	line  int
+}
+
+// punctuators are sorted by decreasing length, for the longest match.
+var punctuators = []string{
+	">>>", "===", "!==",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/", "%",
+	"!", "~", "&", "|", "^", "=", "?", ":", ".",
+}
+
+// lex splits a script into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			s, n, err := lexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, line: line})
+			i += n
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (isIdentByte(src[j]) || src[j] == '.' ||
+				(src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E') && !strings.HasPrefix(strings.ToLower(src[i:]), "0x")) {
+				j++
+			}
+			num, err := parseNumber(src[i:j])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid number %q", line, src[i:j])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:j], num: num, line: line})
+			i = j
+		case isIdentByte(c) || c >= utf8.RuneSelf:
+			j := i
+			for j < len(src) {
+				r, size := utf8.DecodeRuneInString(src[j:])
+				if r < utf8.RuneSelf && !isIdentByte(byte(r)) || r >= utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			if j == i {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, src[i:i+1])
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:j], line: line})
+			i = j
+		case c == '/' && !followsValue(tokens):
+			pattern, flags, n, err := lexRegexp(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			tokens = append(tokens, token{kind: tokRegexp, text: pattern, flags: flags, line: line})
+			i += n
+		default:
+			p := ""
+			for _, candidate := range punctuators {
+				if strings.HasPrefix(src[i:], candidate) {
+					p = candidate
+					break
+				}
+			}
+			if p == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, src[i:i+1])
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: p, line: line})
+			i += len(p)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
+
+func isIdentByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '$'
+}
+
+// followsValue tells whether a slash after tokens is a division, rather
+// than the start of a regular expression.
+func followsValue(tokens []token) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	switch last.kind {
+	case tokNumber, tokString, tokRegexp:
+		return true
+	case tokIdent:
+		switch last.text {
+		case "return", "typeof", "case", "do", "else", "in", "new", "void", "delete":
+			return false
+		}
+		return true
+	case tokPunct:
+		return last.text == ")" || last.text == "]" || last.text == "}"
+	}
+	return false
+}
+
+func parseNumber(s string) (float64, error) {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// lexString decodes the string literal at the start of src, and returns
+// its length in src.
+func lexString(src string) (string, int, error) {
+	quote := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(src) {
+			break
+		}
+		switch e := src[i]; e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			// Line continuation
+		case 'x', 'u':
+			size := 2
+			if e == 'u' {
+				size = 4
+			}
+			if i+size >= len(src) {
+				return "", 0, fmt.Errorf("invalid escape sequence")
+			}
+			r, err := strconv.ParseUint(src[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid escape sequence %q", src[i-1:i+1+size])
+			}
+			b.WriteRune(rune(r))
+			i += size
+		default:
+			b.WriteByte(e)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// lexRegexp reads the regular expression literal at the start of src, and
+// returns its pattern, its flags and its length in src.
+func lexRegexp(src string) (string, string, int, error) {
+	inClass := false
+	for i := 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '\n':
+			return "", "", 0, fmt.Errorf("unterminated regular expression")
+		case '/':
+			if inClass {
+				continue
+			}
+			j := i + 1
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			return src[1:i], src[i+1 : j], j, nil
+		}
+	}
+	return "", "", 0, fmt.Errorf("unterminated regular expression")
+}
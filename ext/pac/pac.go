@@ -0,0 +1,328 @@
+// Package pac evaluates proxy auto-config (PAC) files, so that the proxy
+// reaches every destination the way the browsers of the network would: a
+// corporate PAC file can send the intranet traffic directly, and the rest
+// through the gateway proxies.
+//
+// The PAC files are interpreted by a small JavaScript interpreter,
+// supporting the syntax and the helper functions (isInNet, shExpMatch,
+// dnsResolve, ...) used by such files, but not the whole language.
+//
+//	p, err := pac.Load("http://wpad.corp.example/wpad.dat")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	proxy.OnRequest().Do(p)
+//	proxy.OnRequest().HandleConnect(p)
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Script is a parsed PAC file. It's safe for concurrent use.
+type Script struct {
+	// Resolver resolves the host names for dnsResolve, isResolvable and
+	// isInNet, net.DefaultResolver if nil.
+	Resolver *net.Resolver
+	// Now returns the time used by weekdayRange, dateRange and timeRange,
+	// time.Now if nil.
+	Now func() time.Time
+	// MyIPAddress returns the result of myIpAddress. It defaults to the
+	// address of the interface routing to the internet.
+	MyIPAddress func() string
+
+	body []stmt
+}
+
+// Parse parses the source of a PAC file.
+func Parse(src string) (*Script, error) {
+	body, err := parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PAC file: %w", err)
+	}
+	return &Script{body: body}, nil
+}
+
+// FindProxyForURL evaluates the FindProxyForURL function of the script for
+// u, and returns its raw result, such as "PROXY gw:3128; DIRECT". Like the
+// browsers, the path and the query of the https URLs aren't disclosed to
+// the script.
+func (s *Script) FindProxyForURL(ctx context.Context, u *url.URL) (string, error) {
+	in := &interp{ctx: ctx, env: s.environment(), globals: newScope(nil)}
+	in.declareGlobals(in.globals)
+	program := newScope(in.globals)
+	in.globals = program
+	in.hoist(s.body, program)
+	if _, _, err := in.execBlock(s.body, program); err != nil {
+		return "", err
+	}
+	fn, err := in.lookup("FindProxyForURL", program)
+	if err != nil {
+		return "", err
+	}
+	target := u.String()
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		target = u.Scheme + "://" + u.Host + "/"
+	}
+	result, err := in.call(fn, []value{target, u.Hostname()}, "FindProxyForURL")
+	if err != nil {
+		return "", err
+	}
+	return toString(result), nil
+}
+
+func (s *Script) environment() *environment {
+	env := &environment{resolver: s.Resolver, now: s.Now, myIP: s.MyIPAddress}
+	if env.resolver == nil {
+		env.resolver = net.DefaultResolver
+	}
+	if env.now == nil {
+		env.now = time.Now
+	}
+	if env.myIP == nil {
+		env.myIP = defaultIPAddress
+	}
+	return env
+}
+
+// defaultIPAddress returns the address of the interface routing to the
+// internet. Connecting a UDP socket doesn't send anything.
+func defaultIPAddress() string {
+	c, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// ParseResult parses a result of FindProxyForURL into the list of the
+// proxies to try, in order: a nil URL stands for DIRECT, PROXY and HTTP
+// entries are http URLs, HTTPS entries https URLs, and SOCKS and SOCKS5
+// entries socks5h URLs. The SOCKS4 entries, that the proxy can't use, are
+// skipped as well as the invalid ones.
+func ParseResult(result string) []*url.URL {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			proxies = append(proxies, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5h"
+		default:
+			continue
+		}
+		u, err := url.Parse(scheme + "://" + fields[1])
+		if err != nil || u.Host == "" {
+			continue
+		}
+		proxies = append(proxies, u)
+	}
+	return proxies
+}
+
+// maxCachedResults bounds the number of the results kept by a PAC.
+const maxCachedResults = 10000
+
+// PAC chooses the upstream proxy of the requests with a PAC file, fetched
+// from URL and refreshed periodically, in the background. The results are
+// cached per scheme and host: the cache must be disabled for the scripts
+// whose results depend on the path of the URLs.
+//
+// It's used both as a request handler and as a CONNECT handler, setting
+// ProxyCtx.UpstreamProxy to the first usable proxy of the result. DIRECT
+// leaves the proxy defaults. When the PAC file can't be evaluated, the
+// error is logged and the proxy defaults are used as well.
+type PAC struct {
+	// URL is the location of the PAC file, an http, https or file URL.
+	URL string
+	// Client fetches the PAC file, http.DefaultClient if nil.
+	Client *http.Client
+	// RefreshInterval is the delay between the fetches of the PAC file.
+	// Zero disables the refreshes.
+	RefreshInterval time.Duration
+	// CacheTTL is the lifetime of the cached results. Zero disables the
+	// cache.
+	CacheTTL time.Duration
+	// Configure, if set, is called on every fetched script, e.g. to set
+	// its Resolver.
+	Configure func(s *Script)
+
+	mu         sync.Mutex
+	script     *Script
+	fetched    time.Time
+	refreshing bool
+	cache      map[string]cachedResult
+}
+
+type cachedResult struct {
+	proxies []*url.URL
+	expires time.Time
+}
+
+// Load fetches the PAC file at pacURL, and returns a PAC using it,
+// refreshed every 30 minutes, with results cached for a minute.
+func Load(pacURL string) (*PAC, error) {
+	p := &PAC{URL: pacURL, RefreshInterval: 30 * time.Minute, CacheTTL: time.Minute}
+	if err := p.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewPAC returns a PAC using a static script, with results cached for a
+// minute.
+func NewPAC(script *Script) *PAC {
+	return &PAC{script: script, CacheTTL: time.Minute}
+}
+
+// Refresh fetches the PAC file now. The previous script is kept when it
+// fails.
+func (p *PAC) Refresh(ctx context.Context) error {
+	src, err := p.fetch(ctx)
+	var script *Script
+	if err == nil {
+		script, err = Parse(src)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// A failed fetch is retried after RefreshInterval too
+	p.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+	if p.Configure != nil {
+		p.Configure(script)
+	}
+	p.script = script
+	p.cache = nil
+	return nil
+}
+
+func (p *PAC) fetch(ctx context.Context) (string, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "file" {
+		src, err := os.ReadFile(u.Path)
+		return string(src), err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching PAC file %s: %s", p.URL, resp.Status)
+	}
+	src, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return string(src), err
+}
+
+// Proxies returns the proxies to try for u, in order, as ParseResult does.
+func (p *PAC) Proxies(ctx context.Context, u *url.URL) ([]*url.URL, error) {
+	key := u.Scheme + "://" + u.Host
+	now := time.Now()
+	p.mu.Lock()
+	script := p.script
+	if p.URL != "" && p.RefreshInterval > 0 && !p.refreshing && now.Sub(p.fetched) >= p.RefreshInterval {
+		p.refreshing = true
+		go func() {
+			_ = p.Refresh(context.Background())
+			p.mu.Lock()
+			p.refreshing = false
+			p.mu.Unlock()
+		}()
+	}
+	if cached, ok := p.cache[key]; ok && now.Before(cached.expires) {
+		p.mu.Unlock()
+		return cached.proxies, nil
+	}
+	p.mu.Unlock()
+	if script == nil {
+		return nil, errors.New("no PAC file loaded")
+	}
+
+	result, err := script.FindProxyForURL(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	proxies := ParseResult(result)
+	if p.CacheTTL > 0 {
+		p.mu.Lock()
+		if p.script == script {
+			if p.cache == nil || len(p.cache) >= maxCachedResults {
+				p.cache = make(map[string]cachedResult)
+			}
+			p.cache[key] = cachedResult{proxies: proxies, expires: now.Add(p.CacheTTL)}
+		}
+		p.mu.Unlock()
+	}
+	return proxies, nil
+}
+
+// upstream sets the upstream proxy of ctx for u.
+func (p *PAC) upstream(u *url.URL, ctx *goproxy.ProxyCtx) {
+	proxies, err := p.Proxies(ctx.Req.Context(), u)
+	if err != nil {
+		ctx.Warnf("Can't evaluate the PAC file for %s: %v", u.Redacted(), err)
+		return
+	}
+	if len(proxies) > 0 {
+		ctx.UpstreamProxy = proxies[0]
+	}
+}
+
+// Handle implements goproxy.ReqHandler, choosing the upstream proxy of the
+// plain HTTP requests and of the MITM'd ones.
+func (p *PAC) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	p.upstream(req.URL, ctx)
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, choosing the upstream
+// proxy of the CONNECT tunnels. It never chooses an action, so that the
+// following CONNECT handlers are still evaluated.
+func (p *PAC) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	p.upstream(&url.URL{Scheme: "https", Host: host}, ctx)
+	return nil, host
+}
@@ -0,0 +1,343 @@
+package pac_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/pac"
+)
+
+const corporatePAC = `
+// Corporate PAC file
+var gateways = ["PROXY gw1.corp:3128", "PROXY gw2.corp:3128"];
+
+function isIntranet(host) {
+	return dnsDomainIs(host, ".corp.example") || isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0");
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || isIntranet(host)) {
+		return "DIRECT";
+	}
+	if (shExpMatch(url, "http://*.cdn.example/*") || /^static\./.test(host)) {
+		return "SOCKS5 socks.corp:1080; DIRECT";
+	}
+	if (url.substring(0, 6) == "https:") {
+		return "HTTPS secure.corp:443";
+	}
+	var i = dnsDomainLevels(host) % gateways.length;
+	return gateways[i] + "; DIRECT";
+}
+`
+
+func evaluate(t *testing.T, script *pac.Script, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := script.FindProxyForURL(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestFindProxyForURL(t *testing.T) {
+	script, err := pac.Parse(corporatePAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawURL, expected := range map[string]string{
+		"http://intranet/":                   "DIRECT",
+		"http://wiki.corp.example/page":      "DIRECT",
+		"http://10.1.2.3/":                   "DIRECT",
+		"http://img.cdn.example/a.png":       "SOCKS5 socks.corp:1080; DIRECT",
+		"http://STATIC.example.org/":         "SOCKS5 socks.corp:1080; DIRECT",
+		"https://example.com/secret?token=1": "HTTPS secure.corp:443",
+		"http://example.com/":                "PROXY gw2.corp:3128; DIRECT",
+		"http://www.example.com/":            "PROXY gw1.corp:3128; DIRECT",
+	} {
+		if result := evaluate(t, script, rawURL); result != expected {
+			t.Errorf("FindProxyForURL(%s) = %q, expected %q", rawURL, result, expected)
+		}
+	}
+}
+
+func TestFindProxyForURLHidesHTTPSPath(t *testing.T) {
+	script, err := pac.Parse(`function FindProxyForURL(url, host) { return url; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := evaluate(t, script, "https://example.com/secret?token=1"); result != "https://example.com/" {
+		t.Errorf("Unexpected URL passed to the script: %s", result)
+	}
+	if result := evaluate(t, script, "http://example.com/page?q=1"); result != "http://example.com/page?q=1" {
+		t.Errorf("Unexpected URL passed to the script: %s", result)
+	}
+}
+
+func TestScriptLanguage(t *testing.T) {
+	for src, expected := range map[string]string{
+		`return 1 + 2 * 3 - 4 / 2;`: "5",
+		`return "a" + 1 + 2;`:       "a12",
+		`return 1 + 2 + "a";`:       "3a",
+		`var s = 0; for (var i = 0; i < 10; i++) { if (i == 5) continue; if (i > 7) break; s += i; } return s;`:       "23",
+		`var n = 3, f = 1; while (n > 0) { f *= n--; } return f;`:                                                     "6",
+		`function fact(n) { return n <= 1 ? 1 : n * fact(n - 1); } return fact(5);`:                                   "120",
+		`var add = function(a, b) { return a + b; }; return add(2, 3);`:                                               "5",
+		`return typeof missing + " " + typeof 1 + " " + typeof "" + " " + typeof dnsResolve;`:                         "undefined number string function",
+		`return [1, "a", null].join("-") + " " + [1, 2].length + " " + [3, 4].indexOf(4);`:                            "1-a- 2 1",
+		`var o = {a: 1, "b": 2}; o.c = o.a + o["b"]; return o.c;`:                                                     "3",
+		`return "1" == 1 && null == undefined && "1" !== 1 && !(0 || "") && (0 || "x") == "x";`:                       "true",
+		`return "a.b.c".split(".").length + "abc".indexOf("c") + "abcdef".substr(-3, 2) + "abc".slice(1);`:            "5debc",
+		`return "Hello".charAt(1) + "Hello".toUpperCase() + "x-y".replace("-", "+") + "aXbX".replace(/X/g, "");`:      "eHELLOx+yab",
+		`return 0x10 | 1 + (255 >>> 4) + (1 << 3) + (~0);`:                                                            "23",
+		`return parseInt("42px") + parseInt("ff", 16) + parseFloat("1.5e1x");`:                                        "312",
+		`return convert_addr("10.0.0.1") + " " + dnsDomainLevels("a.b.c") + " " + dnsResolve("127.0.0.1");`:           "167772161 2 127.0.0.1",
+		`return localHostOrDomainIs("www", "www.corp") + " " + localHostOrDomainIs("www.other", "www.corp");`:         "true false",
+		`return shExpMatch("a.b.example", "*.example") + " " + shExpMatch("ab", "a?") + " " + shExpMatch("a", "a?");`: "true true false",
+		`return myIpAddress();`:                                        "192.168.1.10",
+		`return isResolvable("192.168.1.1");`:                          "true",
+		`var x; return x === undefined && !x;`:                         "true",
+		`return "abc".match(/b(c)/)[1];`:                               "c",
+		`return isInNet("192.168.1.7", "192.168.0.0", "255.255.0.0");`: "true",
+		`var s = ""; switch (1 + 1) { case "2": s += "a"; case 2: s += "b"; case 3: s += "c"; break; default: s += "d"; } return s;`: "bc",
+		`switch ("x") { case "y": return "y"; default: return "default"; case "z": return "z"; }`:                                    "default",
+		`var s = 0; for (var i = 0; i < 4; i++) { switch (i % 2) { case 0: continue; } s += i; } return s;`:                          "4",
+	} {
+		script, err := pac.Parse("function FindProxyForURL(url, host) {\n" + src + "\n}")
+		if err != nil {
+			t.Errorf("Can't parse %s: %v", src, err)
+			continue
+		}
+		script.MyIPAddress = func() string { return "192.168.1.10" }
+		if result := evaluate(t, script, "http://example.com/"); result != expected {
+			t.Errorf("%s = %q, expected %q", src, result, expected)
+		}
+	}
+}
+
+func TestTimeFunctions(t *testing.T) {
+	// A Wednesday
+	now := time.Date(2024, time.March, 13, 14, 30, 0, 0, time.UTC)
+	for src, expected := range map[string]bool{
+		`weekdayRange("MON", "FRI", "GMT")`:                 true,
+		`weekdayRange("SAT", "SUN", "GMT")`:                 false,
+		`weekdayRange("FRI", "WED", "GMT")`:                 true,
+		`weekdayRange("WED", "GMT")`:                        true,
+		`timeRange(14, "GMT")`:                              true,
+		`timeRange(9, 14, "GMT")`:                           false,
+		`timeRange(9, 15, "GMT")`:                           true,
+		`timeRange(22, 6, "GMT")`:                           false,
+		`timeRange(14, 0, 14, 45, "GMT")`:                   true,
+		`timeRange(14, 31, 0, 15, 0, 0, "GMT")`:             false,
+		`dateRange(13, "GMT")`:                              true,
+		`dateRange("MAR", "GMT")`:                           true,
+		`dateRange(2024, "GMT")`:                            true,
+		`dateRange("JAN", "FEB", "GMT")`:                    false,
+		`dateRange("NOV", "MAR", "GMT")`:                    true,
+		`dateRange(1, "MAR", 12, "MAR", "GMT")`:             false,
+		`dateRange(1, "MAR", 2024, 31, "DEC", 2024, "GMT")`: true,
+		`dateRange(2020, 2023, "GMT")`:                      false,
+	} {
+		script, err := pac.Parse("function FindProxyForURL(url, host) { return " + src + "; }")
+		if err != nil {
+			t.Fatal(err)
+		}
+		script.Now = func() time.Time { return now }
+		if result := evaluate(t, script, "http://example.com/"); result != strconvBool(expected) {
+			t.Errorf("%s = %s, expected %v", src, result, expected)
+		}
+	}
+}
+
+func strconvBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func TestScriptErrors(t *testing.T) {
+	for _, src := range []string{
+		`function FindProxyForURL(url, host) { return "DIRECT"`,
+		`function FindProxyForURL(url, host) { switch (host) { case 1 } }`,
+		`function FindProxyForURL(url, host) { switch (host) { default: default: } }`,
+		`function FindProxyForURL(url, host) { return "unterminated; }`,
+		`function (url, host) {}`,
+	} {
+		if _, err := pac.Parse(src); err == nil {
+			t.Errorf("Parse(%q) succeeded", src)
+		}
+	}
+
+	u, _ := url.Parse("http://example.com/")
+	for _, src := range []string{
+		`function other() {}`,
+		`function FindProxyForURL(url, host) { return undefinedFunction(host); }`,
+		`function FindProxyForURL(url, host) { while (true) {} }`,
+		`function FindProxyForURL(url, host) { return FindProxyForURL(url, host); }`,
+		`function FindProxyForURL(url, host) { return null.length; }`,
+	} {
+		script, err := pac.Parse(src)
+		if err != nil {
+			t.Fatalf("Can't parse %s: %v", src, err)
+		}
+		if result, err := script.FindProxyForURL(context.Background(), u); err == nil {
+			t.Errorf("%s evaluated to %q", src, result)
+		}
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	proxies := pac.ParseResult("PROXY gw:3128; SOCKS4 old:1080;HTTPS secure:443 ; SOCKS s:1080; bogus; DIRECT")
+	var got []string
+	for _, u := range proxies {
+		if u == nil {
+			got = append(got, "DIRECT")
+		} else {
+			got = append(got, u.String())
+		}
+	}
+	expected := "http://gw:3128 https://secure:443 socks5h://s:1080 DIRECT"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("Unexpected proxies %v, expected %s", got, expected)
+	}
+}
+
+func TestPACHandlers(t *testing.T) {
+	script, err := pac.Parse(`function FindProxyForURL(url, host) {
+		if (host == "direct.example") return "DIRECT";
+		return "SOCKS4 old:1080; PROXY gw.corp:3128";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pac.NewPAC(script)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}
+	p.Handle(req, ctx)
+	if ctx.UpstreamProxy == nil || ctx.UpstreamProxy.String() != "http://gw.corp:3128" {
+		t.Errorf("Unexpected upstream proxy %v", ctx.UpstreamProxy)
+	}
+
+	req = httptest.NewRequest(http.MethodConnect, "http://direct.example:443", nil)
+	ctx = &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}
+	if action, host := p.HandleConnect("direct.example:443", ctx); action != nil || host != "direct.example:443" {
+		t.Errorf("Unexpected action %v for %s", action, host)
+	}
+	if ctx.UpstreamProxy != nil {
+		t.Errorf("Unexpected upstream proxy %v for DIRECT", ctx.UpstreamProxy)
+	}
+}
+
+func TestPACCachePerHost(t *testing.T) {
+	script, err := pac.Parse(`function FindProxyForURL(url, host) { myIpAddress(); return "DIRECT"; }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evaluations atomic.Int32
+	script.MyIPAddress = func() string {
+		evaluations.Add(1)
+		return "192.168.1.10"
+	}
+	p := pac.NewPAC(script)
+	for _, rawURL := range []string{"http://example.com/a", "http://example.com/b?q=1", "https://example.com/", "http://example.com/c"} {
+		u, _ := url.Parse(rawURL)
+		if _, err := p.Proxies(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := evaluations.Load(); n != 2 {
+		t.Errorf("%d evaluations, expected one per scheme and host", n)
+	}
+}
+
+func TestLoadAndRefresh(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		if version.Load() == 1 {
+			_, _ = w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY one:3128"; }`))
+		} else {
+			_, _ = w.Write([]byte(`function FindProxyForURL(url, host) { return "PROXY two:3128"; }`))
+		}
+	}))
+	defer srv.Close()
+
+	p, err := pac.Load(srv.URL + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://example.com/")
+	first := func() string {
+		proxies, err := p.Proxies(context.Background(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxies[0].Host
+	}
+	if host := first(); host != "one:3128" {
+		t.Fatalf("Unexpected proxy %s", host)
+	}
+
+	// The results are cached until the next refresh
+	version.Store(2)
+	if host := first(); host != "one:3128" {
+		t.Fatalf("Unexpected proxy %s", host)
+	}
+	if err := p.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if host := first(); host != "two:3128" {
+		t.Fatalf("Unexpected proxy %s after a refresh", host)
+	}
+
+	// The periodic refreshes happen in the background
+	version.Store(1)
+	p.RefreshInterval = time.Millisecond
+	p.CacheTTL = 0
+	time.Sleep(2 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for first() != "one:3128" {
+		if time.Now().After(deadline) {
+			t.Fatal("The PAC file wasn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := pac.Load(srv.URL + "/proxy.pac"); err == nil {
+		t.Error("Load succeeded on a 404")
+	}
+
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(path, []byte(`function FindProxyForURL(url, host) { return "DIRECT" `), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pac.Load("file://" + path); err == nil {
+		t.Error("Load succeeded on an invalid PAC file")
+	}
+	if err := os.WriteFile(path, []byte(`function FindProxyForURL(url, host) { return "DIRECT"; }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pac.Load("file://" + path); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,737 @@
+package pac
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The syntax tree of the supported subset of JavaScript: the statements
+// and expressions found in the PAC files, without objects constructors
+// nor exceptions.
+
+type (
+	expr interface{}
+	stmt interface{}
+
+	numberLit struct{ value float64 }
+	stringLit struct{ value string }
+	regexpLit struct{ re *regexp.Regexp }
+	// constant is true, false or null
+	constant  struct{ value interface{} }
+	ident     struct{ name string }
+	arrayLit  struct{ elems []expr }
+	objectLit struct {
+		keys   []string
+		values []expr
+	}
+	funcLit   struct{ fn *funcDecl }
+	unaryExpr struct {
+		op string
+		x  expr
+	}
+	updateExpr struct {
+		op     string
+		prefix bool
+		target expr
+	}
+	binaryExpr struct {
+		op   string
+		l, r expr
+	}
+	condExpr struct {
+		test, then, els expr
+	}
+	assignExpr struct {
+		op     string
+		target expr
+		value  expr
+	}
+	callExpr struct {
+		callee expr
+		args   []expr
+	}
+	memberExpr struct {
+		obj  expr
+		prop expr
+	}
+
+	varStmt struct {
+		names []string
+		inits []expr
+	}
+	funcDecl struct {
+		name   string
+		params []string
+		body   []stmt
+	}
+	ifStmt struct {
+		test      expr
+		then, els stmt
+	}
+	forStmt struct {
+		init         stmt
+		test, update expr
+		body         stmt
+	}
+	whileStmt struct {
+		test expr
+		body stmt
+	}
+	switchStmt struct {
+		disc  expr
+		cases []switchCase
+	}
+	// switchCase is a case clause, or the default clause if test is nil
+	switchCase struct {
+		test expr
+		body []stmt
+	}
+	returnStmt   struct{ value expr }
+	breakStmt    struct{}
+	continueStmt struct{}
+	blockStmt    struct{ body []stmt }
+	exprStmt     struct{ x expr }
+	emptyStmt    struct{}
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse builds the syntax tree of a script.
+func parse(src string) ([]stmt, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	var body []stmt
+	for p.peek().kind != tokEOF {
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	return body, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is tells whether the next token is the punctuator or keyword s.
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tokPunct || t.kind == tokIdent) && t.text == s
+}
+
+// accept consumes the next token if it's the punctuator or keyword s.
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return p.unexpected(fmt.Sprintf("%q", s))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(expected string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("line %d: unexpected end of script, expected %s", t.line, expected)
+	}
+	return fmt.Errorf("line %d: unexpected %q, expected %s", t.line, t.text, expected)
+}
+
+func (p *parser) identifier() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent || keywords[t.text] {
+		return "", p.unexpected("an identifier")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+var keywords = map[string]bool{
+	"break": true, "case": true, "continue": true, "default": true, "do": true, "else": true,
+	"for": true, "function": true, "if": true, "in": true, "new": true, "return": true,
+	"switch": true, "typeof": true, "var": true, "while": true, "let": true, "const": true,
+	"true": true, "false": true, "null": true,
+}
+
+// endStatement consumes the semicolon ending a statement, that can be
+// omitted before a closing brace or the end of the script.
+func (p *parser) endStatement() error {
+	if p.accept(";") || p.is("}") || p.peek().kind == tokEOF {
+		return nil
+	}
+	if p.pos > 0 && p.tokens[p.pos-1].line < p.peek().line {
+		return nil
+	}
+	return p.unexpected(`";"`)
+}
+
+func (p *parser) statement() (stmt, error) {
+	t := p.peek()
+	if t.kind == tokPunct {
+		switch t.text {
+		case "{":
+			p.pos++
+			body, err := p.block()
+			return &blockStmt{body: body}, err
+		case ";":
+			p.pos++
+			return &emptyStmt{}, nil
+		}
+	}
+	if t.kind == tokIdent {
+		switch t.text {
+		case "var", "let", "const":
+			s, err := p.varStatement()
+			if err != nil {
+				return nil, err
+			}
+			return s, p.endStatement()
+		case "function":
+			p.pos++
+			return p.function(true)
+		case "if":
+			return p.ifStatement()
+		case "for":
+			return p.forStatement()
+		case "while":
+			p.pos++
+			test, err := p.parenthesized()
+			if err != nil {
+				return nil, err
+			}
+			body, err := p.statement()
+			return &whileStmt{test: test, body: body}, err
+		case "return":
+			p.pos++
+			s := &returnStmt{}
+			if !p.is(";") && !p.is("}") && p.peek().line == t.line {
+				x, err := p.expression()
+				if err != nil {
+					return nil, err
+				}
+				s.value = x
+			}
+			return s, p.endStatement()
+		case "break":
+			p.pos++
+			return &breakStmt{}, p.endStatement()
+		case "continue":
+			p.pos++
+			return &continueStmt{}, p.endStatement()
+		case "switch":
+			return p.switchStatement()
+		case "do", "try", "throw", "with", "class":
+			return nil, fmt.Errorf("line %d: unsupported %q statement", t.line, t.text)
+		}
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &exprStmt{x: x}, p.endStatement()
+}
+
+// block parses the statements up to the closing brace.
+func (p *parser) block() ([]stmt, error) {
+	var body []stmt
+	for !p.accept("}") {
+		if p.peek().kind == tokEOF {
+			return nil, p.unexpected(`"}"`)
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	return body, nil
+}
+
+func (p *parser) varStatement() (*varStmt, error) {
+	p.pos++
+	s := &varStmt{}
+	for {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		var init expr
+		if p.accept("=") {
+			if init, err = p.assignment(); err != nil {
+				return nil, err
+			}
+		}
+		s.names = append(s.names, name)
+		s.inits = append(s.inits, init)
+		if !p.accept(",") {
+			return s, nil
+		}
+	}
+}
+
+// function parses a function after the function keyword. Its name is
+// required for the declarations, and optional for the expressions.
+func (p *parser) function(declaration bool) (*funcDecl, error) {
+	fn := &funcDecl{}
+	if !p.is("(") || declaration {
+		name, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		fn.name = name
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		param, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, param)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	fn.body = body
+	return fn, err
+}
+
+func (p *parser) parenthesized() (expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	x, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return x, p.expect(")")
+}
+
+func (p *parser) ifStatement() (stmt, error) {
+	p.pos++
+	test, err := p.parenthesized()
+	if err != nil {
+		return nil, err
+	}
+	s := &ifStmt{test: test}
+	if s.then, err = p.statement(); err != nil {
+		return nil, err
+	}
+	if p.accept("else") {
+		if s.els, err = p.statement(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) switchStatement() (stmt, error) {
+	p.pos++
+	disc, err := p.parenthesized()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	s := &switchStmt{disc: disc}
+	hasDefault := false
+	for !p.accept("}") {
+		var c switchCase
+		switch t := p.next(); {
+		case t.kind == tokIdent && t.text == "case":
+			if c.test, err = p.expression(); err != nil {
+				return nil, err
+			}
+		case t.kind == tokIdent && t.text == "default" && !hasDefault:
+			hasDefault = true
+		default:
+			p.pos--
+			return nil, p.unexpected(`"case" or "default"`)
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		for !p.is("case") && !p.is("default") && !p.is("}") {
+			if p.peek().kind == tokEOF {
+				return nil, p.unexpected(`"}"`)
+			}
+			st, err := p.statement()
+			if err != nil {
+				return nil, err
+			}
+			c.body = append(c.body, st)
+		}
+		s.cases = append(s.cases, c)
+	}
+	return s, nil
+}
+
+func (p *parser) forStatement() (stmt, error) {
+	line := p.next().line
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	s := &forStmt{}
+	switch {
+	case p.is("var") || p.is("let") || p.is("const"):
+		init, err := p.varStatement()
+		if err != nil {
+			return nil, err
+		}
+		s.init = init
+	case !p.is(";"):
+		x, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		s.init = &exprStmt{x: x}
+	}
+	if p.is("in") || p.is("of") {
+		return nil, fmt.Errorf("line %d: unsupported %q loop", line, "for "+p.peek().text)
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(";") {
+		test, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		s.test = test
+	}
+	if err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	if !p.is(")") {
+		update, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		s.update = update
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.statement()
+	s.body = body
+	return s, err
+}
+
+func (p *parser) expression() (expr, error) {
+	return p.assignment()
+}
+
+var assignOps = map[string]bool{"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true}
+
+func (p *parser) assignment() (expr, error) {
+	x, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokPunct && assignOps[t.text] {
+		switch x.(type) {
+		case *ident, *memberExpr:
+		default:
+			return nil, fmt.Errorf("line %d: invalid assignment target", t.line)
+		}
+		p.pos++
+		value, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		return &assignExpr{op: t.text, target: x, value: value}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) conditional() (expr, error) {
+	test, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return test, err
+	}
+	then, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.assignment()
+	if err != nil {
+		return nil, err
+	}
+	return &condExpr{test: test, then: then, els: els}, nil
+}
+
+// binaryPrecedence lists the binary operators by increasing precedence.
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!=", "===", "!=="},
+	{"<", ">", "<=", ">=", "in"},
+	{"<<", ">>", ">>>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokPunct && !(t.kind == tokIdent && t.text == "in") || !contains(binaryPrecedence[level], t.text) {
+			return x, nil
+		}
+		p.pos++
+		r, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op: t.text, l: x, r: r}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) unary() (expr, error) {
+	t := p.peek()
+	if t.kind == tokPunct && (t.text == "!" || t.text == "-" || t.text == "+" || t.text == "~") ||
+		t.kind == tokIdent && (t.text == "typeof" || t.text == "void") {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: t.text, x: x}, nil
+	}
+	if t.kind == tokPunct && (t.text == "++" || t.text == "--") {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &updateExpr{op: t.text, prefix: true, target: x}, nil
+	}
+	x, err := p.postfix()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokPunct && (t.text == "++" || t.text == "--") && t.line == p.tokens[p.pos-1].line {
+		p.pos++
+		return &updateExpr{op: t.text, target: x}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) postfix() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokIdent {
+				p.pos--
+				return nil, p.unexpected("a property name")
+			}
+			x = &memberExpr{obj: x, prop: &stringLit{value: t.text}}
+		case p.accept("["):
+			prop, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &memberExpr{obj: x, prop: prop}
+		case p.accept("("):
+			call := &callExpr{callee: x}
+			for !p.accept(")") {
+				if len(call.args) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				call.args = append(call.args, arg)
+			}
+			x = call
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &numberLit{value: t.num}, nil
+	case tokString:
+		return &stringLit{value: t.text}, nil
+	case tokRegexp:
+		re, err := compileRegexp(t.text, t.flags)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", t.line, err)
+		}
+		return &regexpLit{re: re}, nil
+	case tokIdent:
+		switch t.text {
+		case "function":
+			fn, err := p.function(false)
+			if err != nil {
+				return nil, err
+			}
+			return &funcLit{fn: fn}, nil
+		case "true", "false":
+			return &constant{value: t.text == "true"}, nil
+		case "null":
+			return &constant{value: null}, nil
+		case "new":
+			return nil, fmt.Errorf("line %d: unsupported %q operator", t.line, t.text)
+		}
+		if keywords[t.text] {
+			p.pos--
+			return nil, p.unexpected("an expression")
+		}
+		return &ident{name: t.text}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			x, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			array := &arrayLit{}
+			for !p.accept("]") {
+				if len(array.elems) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+					if p.accept("]") {
+						break
+					}
+				}
+				elem, err := p.assignment()
+				if err != nil {
+					return nil, err
+				}
+				array.elems = append(array.elems, elem)
+			}
+			return array, nil
+		case "{":
+			return p.object()
+		}
+	}
+	p.pos--
+	return nil, p.unexpected("an expression")
+}
+
+func (p *parser) object() (expr, error) {
+	object := &objectLit{}
+	for !p.accept("}") {
+		if len(object.keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		t := p.next()
+		var key string
+		switch t.kind {
+		case tokIdent, tokString:
+			key = t.text
+		case tokNumber:
+			key = formatNumber(t.num)
+		default:
+			p.pos--
+			return nil, p.unexpected("a property name")
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.assignment()
+		if err != nil {
+			return nil, err
+		}
+		object.keys = append(object.keys, key)
+		object.values = append(object.values, value)
+	}
+	return object, nil
+}
+
+// compileRegexp translates a JavaScript regular expression to the RE2
+// syntax. The expressions using backreferences or lookarounds are
+// rejected.
+func compileRegexp(pattern, flags string) (*regexp.Regexp, error) {
+	var prefix strings.Builder
+	for _, flag := range flags {
+		switch flag {
+		case 'i':
+			prefix.WriteString("(?i)")
+		case 'm':
+			prefix.WriteString("(?m)")
+		case 's':
+			prefix.WriteString("(?s)")
+		case 'g', 'u', 'y':
+		default:
+			return nil, fmt.Errorf("invalid regular expression flag %q", flag)
+		}
+	}
+	return regexp.Compile(prefix.String() + pattern)
+}
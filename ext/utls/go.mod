@@ -0,0 +1,21 @@
+module github.com/elazarl/goproxy/ext/utls
+
+// github.com/refraction-networking/utls v1.8.2 requires go 1.24, the
+// package is a module of its own so that the other ext packages don't.
+go 1.24
+
+require (
+	github.com/elazarl/goproxy v0.0.0-20241217120900-7711dfa3811c
+	github.com/refraction-networking/utls v1.8.2
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+)
+
+replace github.com/elazarl/goproxy => ../../
@@ -0,0 +1,117 @@
+// Package utls makes the TLS handshakes of the proxy with the remote
+// servers with uTLS, impersonating the ClientHello of a browser instead of
+// the easily fingerprinted one of crypto/tls:
+//
+//	proxy.UpstreamTLSHandshake = utls.Handshake(utls.Chrome, map[string]utls.Profile{
+//		"firefox": utls.Firefox,
+//		"safari":  utls.Safari,
+//	})
+//	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		if strings.Contains(req.UserAgent(), "Firefox") {
+//			ctx.UpstreamTLSProfile = "firefox"
+//		}
+//		return req, nil
+//	})
+package utls
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/elazarl/goproxy"
+	utls "github.com/refraction-networking/utls"
+)
+
+// Profile is a ClientHello impersonated by Handshake: the one of a uTLS
+// ClientHelloID, or the one built by Spec.
+type Profile struct {
+	ID utls.ClientHelloID
+	// Spec, if set, returns the ClientHello of a custom profile. It's
+	// called for every handshake, since the extensions can't be shared by
+	// several connections.
+	Spec func() (*utls.ClientHelloSpec, error)
+}
+
+// The profiles of the latest browsers known to uTLS.
+var (
+	Chrome  = Profile{ID: utls.HelloChrome_Auto}
+	Firefox = Profile{ID: utls.HelloFirefox_Auto}
+	Safari  = Profile{ID: utls.HelloSafari_Auto}
+	Edge    = Profile{ID: utls.HelloEdge_Auto}
+	IOS     = Profile{ID: utls.HelloIOS_Auto}
+)
+
+// Custom returns the profile sending the ClientHello returned by spec,
+// e.g. one parsed from a captured fingerprint with
+// utls.Fingerprinter.
+func Custom(spec func() (*utls.ClientHelloSpec, error)) Profile {
+	return Profile{ID: utls.HelloCustom, Spec: spec}
+}
+
+// spec returns the ClientHello of the profile.
+func (p Profile) spec() (*utls.ClientHelloSpec, error) {
+	if p.Spec != nil {
+		return p.Spec()
+	}
+	spec, err := utls.UTLSIdToSpec(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Handshake returns a goproxy.UpstreamTLSHandshake impersonating the
+// profile named by the ProxyCtx.UpstreamTLSProfile of the exchanges in
+// profiles, or fallback if it's empty or unknown.
+//
+// The ClientHello only offers the application protocols the proxy can
+// speak, config.NextProtos, in place of the ones of the profile. The
+// server certificates are verified as set by config, but its
+// VerifyConnection callback, which crypto/tls can't pass to uTLS.
+func Handshake(fallback Profile, profiles map[string]Profile) goproxy.UpstreamTLSHandshake {
+	return func(ctx *goproxy.ProxyCtx, conn net.Conn, config *tls.Config) (net.Conn, error) {
+		profile, ok := profiles[ctx.UpstreamTLSProfile]
+		if !ok {
+			profile = fallback
+		}
+		spec, err := profile.spec()
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = config.NextProtos
+			}
+		}
+		uconn := utls.UClient(conn, uConfig(config), utls.HelloCustom)
+		if err := uconn.ApplyPreset(spec); err != nil {
+			return nil, err
+		}
+		if err := uconn.HandshakeContext(ctx.Context()); err != nil {
+			return nil, err
+		}
+		return uconn, nil
+	}
+}
+
+// uConfig returns the uTLS configuration matching config.
+func uConfig(config *tls.Config) *utls.Config {
+	uconfig := &utls.Config{
+		ServerName:            config.ServerName,
+		NextProtos:            config.NextProtos,
+		RootCAs:               config.RootCAs,
+		InsecureSkipVerify:    config.InsecureSkipVerify,
+		VerifyPeerCertificate: config.VerifyPeerCertificate,
+		MinVersion:            config.MinVersion,
+		MaxVersion:            config.MaxVersion,
+		KeyLogWriter:          config.KeyLogWriter,
+	}
+	for _, cert := range config.Certificates {
+		uconfig.Certificates = append(uconfig.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		})
+	}
+	return uconfig
+}
@@ -0,0 +1,82 @@
+package utls_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/utls"
+)
+
+// isGREASE tells whether a cipher suite is a GREASE value (RFC 8701),
+// which Chrome sends and crypto/tls doesn't.
+func isGREASE(suite uint16) bool {
+	return suite&0x0f0f == 0x0a0a && suite>>8 == suite&0xff
+}
+
+func TestHandshake(t *testing.T) {
+	var mu sync.Mutex
+	var hellos []*tls.ClientHelloInfo
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "bobo")
+	}))
+	backend.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		hellos = append(hellos, hello)
+		return nil, nil
+	}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.UpstreamTLSProfile = req.URL.Query().Get("profile")
+		return req, nil
+	})
+	proxy.UpstreamTLSHandshake = utls.Handshake(utls.Chrome, map[string]utls.Profile{"firefox": utls.Firefox})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, profile := range []string{"", "firefox"} {
+		resp, err := client.Get(backend.URL + "/?profile=" + profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "bobo" {
+			t.Errorf("expected bobo, got %q", body)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hellos) != 2 {
+		t.Fatalf("expected 2 handshakes, got %d", len(hellos))
+	}
+	for i, hello := range hellos {
+		if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != "http/1.1" {
+			t.Errorf("expected only http/1.1 to be offered, got %v", hello.SupportedProtos)
+		}
+		grease := false
+		for _, suite := range hello.CipherSuites {
+			grease = grease || isGREASE(suite)
+		}
+		// Only the Chrome ClientHello has GREASE values
+		if grease != (i == 0) {
+			t.Errorf("unexpected GREASE cipher suites in handshake %d: %v", i, hello.CipherSuites)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Package watermark embeds invisible per-client markers into the HTML and
+// JSON responses going through the proxy, and detects them in leaked
+// content, to trace it back to the client it was served to.
+package watermark
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// markSize is the size of the markers, in bytes.
+const markSize = 8
+
+// Strategy embeds mark in a response body of the given media type, whose
+// parameters (such as the charset) are params, and reports whether it
+// did. It must leave the meaning of the body unchanged.
+type Strategy func(body []byte, mediaType string, params map[string]string, mark []byte) ([]byte, bool)
+
+// Watermarker marks the responses with a marker derived from the identity
+// of the client, the same for all the responses to a client:
+//
+//	w := watermark.New([]byte("secret"))
+//	proxy.OnResponse().DoFunc(w.OnResponse)
+//	...
+//	clients := w.Detect(leaked)
+type Watermarker struct {
+	// Secret keys the derivation of the markers from the identities.
+	Secret []byte
+	// Identity returns the identity of the client of an exchange, its IP
+	// address if nil.
+	Identity func(ctx *goproxy.ProxyCtx) string
+	// Strategies are the ways the markers are embedded, tried in order
+	// until one applies to the response.
+	Strategies []Strategy
+	// MaxSize is the size above which the response bodies are left
+	// unmarked.
+	MaxSize int64
+	// MaxIdentities is the number of marked identities remembered by
+	// Detect, the least recently marked ones are forgotten first. 10000 if
+	// zero.
+	MaxIdentities int
+
+	mu         sync.Mutex
+	identities map[string]*list.Element
+	lru        list.List
+}
+
+type markedIdentity struct {
+	mark, identity string
+}
+
+// New returns a Watermarker embedding zero-width markers in the HTML
+// responses and whitespace markers in the JSON responses up to 10MB.
+func New(secret []byte) *Watermarker {
+	return &Watermarker{
+		Secret:     secret,
+		Strategies: []Strategy{HTMLZeroWidth, JSONWhitespace},
+		MaxSize:    10 << 20,
+	}
+}
+
+// Mark returns the marker of identity.
+func (w *Watermarker) Mark(identity string) []byte {
+	h := hmac.New(sha256.New, w.Secret)
+	_, _ = io.WriteString(h, identity)
+	return h.Sum(nil)[:markSize]
+}
+
+// OnResponse marks the response body, to be registered with
+// proxy.OnResponse().DoFunc.
+func (w *Watermarker) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return resp
+	}
+	if resp.ContentLength > w.MaxSize {
+		return resp
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return resp
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, w.MaxSize+1))
+	if err != nil {
+		ctx.Warnf("Cannot read response body to watermark: %v", err)
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+		return resp
+	}
+	if int64(len(body)) > w.MaxSize {
+		resp.Body = &multiReadCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+
+	identity := w.identity(ctx)
+	mark := w.Mark(identity)
+	for _, strategy := range w.Strategies {
+		if marked, ok := strategy(body, mediaType, params, mark); ok {
+			w.remember(hex.EncodeToString(mark), identity)
+			body = marked
+			break
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-MD5")
+	return resp
+}
+
+// remember records the identity of mark for Detect.
+func (w *Watermarker) remember(mark, identity string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.identities[mark]; ok {
+		w.lru.MoveToFront(e)
+		return
+	}
+	if w.identities == nil {
+		w.identities = make(map[string]*list.Element)
+	}
+	w.identities[mark] = w.lru.PushFront(&markedIdentity{mark, identity})
+	max := w.MaxIdentities
+	if max <= 0 {
+		max = 10000
+	}
+	for w.lru.Len() > max {
+		oldest := w.lru.Remove(w.lru.Back()).(*markedIdentity)
+		delete(w.identities, oldest.mark)
+	}
+}
+
+func (w *Watermarker) identity(ctx *goproxy.ProxyCtx) string {
+	if w.Identity != nil {
+		return w.Identity(ctx)
+	}
+	if ctx.Req == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(ctx.Req.RemoteAddr)
+	if err != nil {
+		return ctx.Req.RemoteAddr
+	}
+	return host
+}
+
+// Detect returns the identities whose marker is embedded in content, among
+// the identities marked so far and candidates (to detect the markers
+// embedded by another Watermarker using the same Secret).
+func (w *Watermarker) Detect(content []byte, candidates ...string) []string {
+	known := make(map[string]string, len(candidates))
+	for _, identity := range candidates {
+		known[hex.EncodeToString(w.Mark(identity))] = identity
+	}
+	w.mu.Lock()
+	for mark, e := range w.identities {
+		known[mark] = e.Value.(*markedIdentity).identity
+	}
+	w.mu.Unlock()
+
+	var identities []string
+	seen := make(map[string]bool)
+	for _, mark := range Marks(content) {
+		key := hex.EncodeToString(mark)
+		if identity, ok := known[key]; ok && !seen[key] {
+			seen[key] = true
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+// The zero-width markers are made of a bit per character, between two
+// word joiners. The whitespace markers are made of a bit per space or tab,
+// between two line feeds.
+const (
+	zeroWidthDelimiter  = "\u2060"
+	zeroWidthZero       = "\u200b"
+	zeroWidthOne        = "\u200c"
+	whitespaceDelimiter = "\n"
+	whitespaceZero      = " "
+	whitespaceOne       = "\t"
+)
+
+var (
+	zeroWidthMark  = regexp.MustCompile(zeroWidthDelimiter + "((?:" + zeroWidthZero + "|" + zeroWidthOne + "){" + strconv.Itoa(markSize*8) + "})" + zeroWidthDelimiter)
+	whitespaceMark = regexp.MustCompile(whitespaceDelimiter + "([" + whitespaceZero + whitespaceOne + "]{" + strconv.Itoa(markSize*8) + "})" + whitespaceDelimiter)
+	commentMark    = regexp.MustCompile(`<!-- wm:([0-9a-f]{` + strconv.Itoa(markSize*2) + `}) -->`)
+	bodyTag        = regexp.MustCompile(`(?i)<body[^>]*>`)
+	metaCharset    = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([\w-]+)`)
+)
+
+// encodeBits returns mark with a character per bit, between delimiters.
+func encodeBits(mark []byte, delimiter, zero, one string) []byte {
+	var b bytes.Buffer
+	b.WriteString(delimiter)
+	for _, c := range mark {
+		for i := 7; i >= 0; i-- {
+			if c>>i&1 == 1 {
+				b.WriteString(one)
+			} else {
+				b.WriteString(zero)
+			}
+		}
+	}
+	b.WriteString(delimiter)
+	return b.Bytes()
+}
+
+// decodeBits returns the mark encoded by encodeBits in bits.
+func decodeBits(bits []byte, one string) []byte {
+	mark := make([]byte, 0, markSize)
+	var c byte
+	r := bytes.NewReader(bits)
+	for i := 0; r.Len() > 0; i++ {
+		ch, _, _ := r.ReadRune()
+		c <<= 1
+		if string(ch) == one {
+			c |= 1
+		}
+		if i%8 == 7 {
+			mark = append(mark, c)
+			c = 0
+		}
+	}
+	return mark
+}
+
+// Marks returns the markers embedded in content.
+func Marks(content []byte) [][]byte {
+	var marks [][]byte
+	for _, m := range zeroWidthMark.FindAllSubmatch(content, -1) {
+		marks = append(marks, decodeBits(m[1], zeroWidthOne))
+	}
+	for _, m := range whitespaceMark.FindAllSubmatch(content, -1) {
+		marks = append(marks, decodeBits(m[1], whitespaceOne))
+	}
+	for _, m := range commentMark.FindAllSubmatch(content, -1) {
+		if mark, err := hex.DecodeString(string(m[1])); err == nil {
+			marks = append(marks, mark)
+		}
+	}
+	return marks
+}
+
+// HTMLZeroWidth embeds the marker as zero-width characters at the start of
+// the HTML body, invisible in the rendered page and copied with its text.
+// It only marks the UTF-8 documents.
+func HTMLZeroWidth(body []byte, mediaType string, params map[string]string, mark []byte) ([]byte, bool) {
+	if mediaType != "text/html" || !isUTF8(htmlCharset(body, params)) {
+		return nil, false
+	}
+	loc := bodyTag.FindIndex(body)
+	if loc == nil {
+		return nil, false
+	}
+	return insert(body, loc[1], encodeBits(mark, zeroWidthDelimiter, zeroWidthZero, zeroWidthOne)), true
+}
+
+// HTMLComment embeds the marker in an HTML comment at the end of the
+// document, which survives the minification of text but is easier to spot.
+// It only marks the documents in a charset compatible with ASCII.
+func HTMLComment(body []byte, mediaType string, params map[string]string, mark []byte) ([]byte, bool) {
+	if mediaType != "text/html" || !isASCIICompatible(htmlCharset(body, params)) {
+		return nil, false
+	}
+	comment := []byte("<!-- wm:" + hex.EncodeToString(mark) + " -->")
+	return append(append([]byte(nil), body...), comment...), true
+}
+
+// JSONWhitespace embeds the marker as whitespace after a JSON document,
+// which doesn't change the decoded value. It only marks the valid
+// documents in a charset compatible with ASCII.
+func JSONWhitespace(body []byte, mediaType string, params map[string]string, mark []byte) ([]byte, bool) {
+	if mediaType != "application/json" && mediaType != "text/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, false
+	}
+	if !isASCIICompatible(params["charset"]) || !json.Valid(body) {
+		return nil, false
+	}
+	return insert(body, len(body), encodeBits(mark, whitespaceDelimiter, whitespaceZero, whitespaceOne)), true
+}
+
+// htmlCharset returns the charset of an HTML document, from its media type
+// parameters or its meta tags, "" if it isn't declared.
+func htmlCharset(body []byte, params map[string]string) string {
+	if charset, ok := params["charset"]; ok {
+		return charset
+	}
+	if m := metaCharset.FindSubmatch(body); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// isUTF8 tells whether charset is UTF-8, or one of its subsets. An
+// undeclared charset is assumed to be UTF-8.
+func isUTF8(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// isASCIICompatible tells whether the ASCII characters are encoded as in
+// ASCII in charset.
+func isASCIICompatible(charset string) bool {
+	charset = strings.ToLower(charset)
+	return !strings.HasPrefix(charset, "utf-16") && !strings.HasPrefix(charset, "utf-32") &&
+		!strings.HasPrefix(charset, "ucs-") && charset != "utf-7"
+}
+
+func insert(body []byte, at int, data []byte) []byte {
+	out := make([]byte, 0, len(body)+len(data))
+	out = append(out, body[:at]...)
+	out = append(out, data...)
+	return append(out, body[at:]...)
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
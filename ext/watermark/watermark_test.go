@@ -0,0 +1,141 @@
+package watermark_test
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/ext/watermark"
+)
+
+func TestWatermark(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"title": "report", "pages": 3}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, "<html><body class=main><p>secret</p></body></html>")
+	}))
+	defer srv.Close()
+
+	w := watermark.New([]byte("key"))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().DoFunc(w.OnResponse)
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(path string) string {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	html := get("/")
+	if !strings.Contains(html, "<p>secret</p>") || html == "<html><body class=main><p>secret</p></body></html>" {
+		t.Fatalf("unexpected marked page %q", html)
+	}
+	if ids := w.Detect([]byte(html)); len(ids) != 1 || ids[0] != "127.0.0.1" {
+		t.Errorf("unexpected identities %q", ids)
+	}
+
+	json := get("/json")
+	if !strings.HasPrefix(json, `{"title": "report", "pages": 3}`) || len(json) == len(`{"title": "report", "pages": 3}`) {
+		t.Fatalf("unexpected marked JSON %q", json)
+	}
+	var value map[string]any
+	if err := stdjson.Unmarshal([]byte(json), &value); err != nil || value["title"] != "report" {
+		t.Errorf("marked JSON decoded to %v: %v", value, err)
+	}
+	// Another instance finds the marker among candidate identities
+	other := watermark.New([]byte("key"))
+	if ids := other.Detect([]byte(json), "10.0.0.1", "127.0.0.1"); len(ids) != 1 || ids[0] != "127.0.0.1" {
+		t.Errorf("unexpected identities %q", ids)
+	}
+	if ids := watermark.New([]byte("other key")).Detect([]byte(json), "127.0.0.1"); len(ids) != 0 {
+		t.Errorf("marker detected with another secret: %q", ids)
+	}
+}
+
+func TestHTMLComment(t *testing.T) {
+	w := watermark.New([]byte("key"))
+	mark := w.Mark("alice")
+	marked, ok := watermark.HTMLComment([]byte("<p>hello</p>"), "text/html", nil, mark)
+	if !ok {
+		t.Fatal("HTML not marked")
+	}
+	if ids := w.Detect(marked, "bob", "alice"); len(ids) != 1 || ids[0] != "alice" {
+		t.Errorf("unexpected identities %q", ids)
+	}
+}
+
+func TestHTMLZeroWidthCharset(t *testing.T) {
+	mark := watermark.New([]byte("key")).Mark("alice")
+	for _, test := range []struct {
+		body   string
+		params map[string]string
+		marked bool
+	}{
+		{"<body>hello</body>", nil, true},
+		{"<body>hello</body>", map[string]string{"charset": "UTF-8"}, true},
+		{"<body>hello</body>", map[string]string{"charset": "iso-8859-1"}, false},
+		{`<meta charset="windows-1252"><body>hello</body>`, nil, false},
+	} {
+		if _, ok := watermark.HTMLZeroWidth([]byte(test.body), "text/html", test.params, mark); ok != test.marked {
+			t.Errorf("%q %v marked: %v", test.body, test.params, ok)
+		}
+	}
+	if _, ok := watermark.JSONWhitespace([]byte(`{"a": `), "application/json", nil, mark); ok {
+		t.Error("invalid JSON marked")
+	}
+}
+
+func TestMaxIdentities(t *testing.T) {
+	w := watermark.New([]byte("key"))
+	w.MaxIdentities = 2
+	w.Identity = func(ctx *goproxy.ProxyCtx) string { return ctx.Req.Header.Get("X-User") }
+	var marked [][]byte
+	for _, user := range []string{"alice", "bob", "carol"} {
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(`{}`)),
+			ContentLength: -1,
+		}
+		ctx := &goproxy.ProxyCtx{Req: &http.Request{Header: http.Header{"X-User": {user}}}}
+		body, err := io.ReadAll(w.OnResponse(resp, ctx).Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		marked = append(marked, body)
+	}
+	if ids := w.Detect(marked[0]); len(ids) != 0 {
+		t.Errorf("forgotten identity detected: %q", ids)
+	}
+	if ids := w.Detect(marked[0], "alice"); len(ids) != 1 || ids[0] != "alice" {
+		t.Errorf("unexpected identities %q", ids)
+	}
+	if ids := w.Detect(marked[2]); len(ids) != 1 || ids[0] != "carol" {
+		t.Errorf("unexpected identities %q", ids)
+	}
+}
@@ -0,0 +1,106 @@
+package goproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FlowTracker links the exchanges forming a logical flow, a redirect chain
+// (3xx response and the request following it) or an authentication dance
+// (401/407 response and the authenticated retry), under a single
+// ProxyCtx.FlowID.
+//
+//	proxy.FlowTracker = goproxy.NewFlowTracker()
+type FlowTracker struct {
+	// TTL is how long a follow-up request is awaited after a redirection
+	// or an authentication challenge.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	pending map[string]pendingFlow
+}
+
+type pendingFlow struct {
+	id      string
+	expires time.Time
+}
+
+// maxPendingFlows is the number of awaited follow-ups above which the
+// expired ones are discarded.
+const maxPendingFlows = 1024
+
+// NewFlowTracker returns a FlowTracker awaiting follow-up requests for
+// 30 seconds.
+func NewFlowTracker() *FlowTracker {
+	return &FlowTracker{TTL: 30 * time.Second, pending: make(map[string]pendingFlow)}
+}
+
+// request sets the flow ID of a new exchange, reusing the flow of the
+// exchange it follows if any.
+func (t *FlowTracker) request(req *http.Request, ctx *ProxyCtx) {
+	key := flowKey(req, req.URL.String())
+	t.mu.Lock()
+	flow, ok := t.pending[key]
+	if ok {
+		delete(t.pending, key)
+	}
+	t.mu.Unlock()
+
+	if ok && time.Now().Before(flow.expires) {
+		ctx.FlowID = flow.id
+		return
+	}
+	ctx.FlowID = newFlowID()
+}
+
+// response records the follow-up request expected after resp.
+func (t *FlowTracker) response(resp *http.Response, ctx *ProxyCtx) {
+	if resp == nil || ctx.Req == nil || ctx.FlowID == "" {
+		return
+	}
+
+	var next string
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		location, err := resp.Location()
+		if err != nil {
+			return
+		}
+		next = location.String()
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusProxyAuthRequired:
+		next = ctx.Req.URL.String()
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if len(t.pending) >= maxPendingFlows {
+		for key, flow := range t.pending {
+			if now.After(flow.expires) {
+				delete(t.pending, key)
+			}
+		}
+	}
+	t.pending[flowKey(ctx.Req, next)] = pendingFlow{id: ctx.FlowID, expires: now.Add(t.TTL)}
+}
+
+// flowKey identifies a request to url made by the client of req.
+func flowKey(req *http.Request, url string) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	return client + " " + url
+}
+
+func newFlowID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
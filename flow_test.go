@@ -0,0 +1,78 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowTracker(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, "welcome")
+	})
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "other")
+	})
+	backend := httptest.NewServer(mux)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.FlowTracker = goproxy.NewFlowTracker()
+	var mu sync.Mutex
+	flows := make(map[string]string)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := req.URL.Path
+		if _, _, ok := req.BasicAuth(); ok {
+			key += "+auth"
+		}
+		flows[key] = ctx.FlowID
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	// The redirection is followed by the client, then the authentication
+	// challenge is answered manually
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL+"/start", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL+"/login", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("user", "pass")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	getOrFail(t, backend.URL+"/other", client)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, flows["/start"])
+	assert.Equal(t, flows["/start"], flows["/login"])
+	assert.Equal(t, flows["/start"], flows["/login+auth"])
+	assert.NotEmpty(t, flows["/other"])
+	assert.NotEqual(t, flows["/start"], flows["/other"])
+}
@@ -22,6 +22,10 @@ type H2Transport struct {
 	ClientWriter io.Writer
 	TLSConfig    *tls.Config
 	Host         string
+
+	// dial opens the connection to Host, through the dialers of the proxy
+	// for the MITM'd connections. A TCP connection is opened if it's nil.
+	dial func(network, addr string) (net.Conn, error)
 }
 
 // RoundTrip executes an HTTP/2 session (including all contained streams).
@@ -32,7 +36,11 @@ func (r *H2Transport) RoundTrip(_ *http.Request) (*http.Response, error) {
 	if !strings.Contains(raddr, ":") {
 		raddr += ":443"
 	}
-	rawServerTLS, err := dial("tcp", raddr)
+	dialServer := r.dial
+	if dialServer == nil {
+		dialServer = dial
+	}
+	rawServerTLS, err := dialServer("tcp", raddr)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,76 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestH2DestinationGuard(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		allow   []string
+		allowed bool
+	}{
+		{"blocked", nil, false},
+		{"allowed", []string{"127.0.0.0/8"}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			var accepted atomic.Int32
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					accepted.Add(1)
+					_ = c.Close()
+				}
+			}()
+
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.AllowHTTP2 = true
+			proxy.DestinationGuard = &goproxy.DestinationGuard{Allow: test.allow}
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+
+			conn, err := net.Dial("tcp", s.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err = io.WriteString(conn, "CONNECT "+l.Addr().String()+" HTTP/1.1\r\nHost: "+l.Addr().String()+"\r\n\r\n")
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			_, err = io.WriteString(tlsConn, http2.ClientPreface)
+			require.NoError(t, err)
+			// The proxy closes the connection once the server leg fails
+			_, err = tlsConn.Read(make([]byte, 1))
+			require.Error(t, err)
+
+			if test.allowed {
+				assert.Positive(t, accepted.Load())
+			} else {
+				assert.Zero(t, accepted.Load())
+			}
+		})
+	}
+}
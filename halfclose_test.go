@@ -0,0 +1,65 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingServer answers with the number of bytes received once the client
+// has finished sending, like the protocols relying on half-close.
+func countingServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				_, _ = fmt.Fprintf(c, "received %d bytes", n)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	backend := countingServer(t)
+	defer backend.Close()
+
+	// The TLS client connections of the proxy aren't TCP connections
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	addr := tlsProxy(t, proxy)
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	defer c.Close()
+	host := backend.Addr().String()
+	_, err = io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = io.WriteString(c, "backup data")
+	require.NoError(t, err)
+	require.NoError(t, c.CloseWrite())
+	reply, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "received 11 bytes", string(reply))
+}
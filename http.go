@@ -1,6 +1,7 @@
 package goproxy
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"strings"
@@ -8,9 +9,17 @@ import (
 )
 
 func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
+	exchangeContext, cancel := proxy.withBaseContext(r.Context())
+	defer cancel()
+	r = r.WithContext(exchangeContext)
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, ProxyProtocol: proxyProtocolHeader(r), context: exchangeContext}
+	defer ctx.finishExchange()
 
 	ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
+	if proxy.RevocationResponder != nil && proxy.RevocationResponder.handles(r) {
+		proxy.RevocationResponder.ServeHTTP(w, r)
+		return
+	}
 	if !r.URL.IsAbs() {
 		proxy.NonproxyHandler.ServeHTTP(w, r)
 		return
@@ -22,6 +31,7 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 			RemoveProxyHeaders(ctx, r)
 		}
 
+		r = proxy.traceInformational(r, ctx, writeInformationalTo(w))
 		var err error
 		resp, err = ctx.RoundTrip(r)
 		if err != nil {
@@ -37,6 +47,9 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 	}
 
 	resp = proxy.filterResponse(resp, ctx)
+	if proxy.abortHTTP(ctx, w) {
+		return
+	}
 
 	if resp == nil {
 		var errorString string
@@ -94,4 +107,9 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 		ctx.Warnf("Can't close response body %v", err)
 	}
 	ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+	if errors.Is(err, ErrBodyAborted) {
+		// Close the client connection, so that the response doesn't look
+		// complete
+		panic(http.ErrAbortHandler)
+	}
 }
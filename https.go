@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -16,9 +18,11 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/elazarl/goproxy/internal/http1parser"
 	"github.com/elazarl/goproxy/internal/signer"
+	"github.com/elazarl/goproxy/wire"
 )
 
 type ConnectActionLiteral int
@@ -51,6 +55,11 @@ type ConnectAction struct {
 	Action    ConnectActionLiteral
 	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
+	// Bypass, if set, is called with the server name (SNI) sent by the client
+	// before a TLS MITM, e.g. when the CONNECT request only gives an IP
+	// address. Returning true tunnels the connection to the remote server
+	// instead of intercepting it.
+	Bypass func(serverName string, ctx *ProxyCtx) bool
 }
 
 func stripPort(s string) string {
@@ -76,20 +85,47 @@ func stripPort(s string) string {
 }
 
 func (proxy *ProxyHttpServer) dial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	dialCtx := ctx.Context()
+	if timeout := ctx.hostTimeouts(addr).Dial; timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, timeout)
+		defer cancel()
+	}
+	addr = ctx.resolveAddr(addr)
 	if ctx.Dialer != nil {
-		return ctx.Dialer(ctx.Req.Context(), network, addr)
+		return proxy.dialResolved(ctx, dialCtx, ctx.Dialer, network, addr)
 	}
 
 	if proxy.Tr != nil && proxy.Tr.DialContext != nil {
-		return proxy.Tr.DialContext(ctx.Req.Context(), network, addr)
+		return proxy.dialResolved(ctx, dialCtx, proxy.Tr.DialContext, network, addr)
+	}
+
+	if source := proxy.sourceAddr(ctx); source != "" {
+		return proxy.dialResolved(ctx, dialCtx, sourceDialer(source), network, addr)
 	}
 
 	// if the user didn't specify any dialer, we just use the default one,
-	// provided by net package
-	return net.Dial(network, addr)
+	// provided by net package, bounded by the context of the exchange
+	return proxy.dialResolved(ctx, dialCtx, (&net.Dialer{}).DialContext, network, addr)
 }
 
 func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	if ctx.UpstreamProxy != nil {
+		return proxy.dialUpstreamProxy(ctx, ctx.UpstreamProxy, network, addr)
+	}
+	if proxy.SelectUpstream != nil {
+		u, err := proxy.SelectUpstream(ctx.Req, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return proxy.dial(ctx, network, addr)
+		}
+		return proxy.dialUpstreamProxy(ctx, u, network, addr)
+	}
+	if proxy.Upstreams != nil {
+		return proxy.Upstreams.dial(ctx, network, addr)
+	}
 	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
 		return proxy.dial(ctx, network, addr)
 	}
@@ -110,7 +146,12 @@ type halfClosable interface {
 var _ halfClosable = (*net.TCPConn)(nil)
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	// The tunnel outlives the CONNECT request, its context is cancelled
+	// once the client connection is closed
+	tunnelContext, cancelTunnel := proxy.withBaseContext(detachedContext{r.Context()})
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore, context: tunnelContext}
+	ctx.DNSOverrides = transparentOverrides(r)
+	ctx.ProxyProtocol = proxyProtocolHeader(r)
 
 	hij, ok := w.(http.Hijacker)
 	if !ok {
@@ -119,172 +160,52 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 
 	proxyClient, _, e := hij.Hijack()
 	if e != nil {
+		cancelTunnel()
 		panic("Cannot hijack connection " + e.Error())
 	}
+	proxyClient = notifyClose(proxyClient, cancelTunnel)
 
-	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
-	todo, host := OkConnect, r.URL.Host
-	for i, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleConnect(host, ctx)
-
-		// If found a result, break the loop immediately
-		if newtodo != nil {
-			todo, host = newtodo, newhost
-			ctx.Logf("on %dth handler: %v %s", i, todo, host)
-			break
-		}
+	todo, host := proxy.filterConnect(r.URL.Host, ctx)
+	todo = proxy.PinningBypass.action(todo, host, ctx)
+	if ctx.TunnelCloseHandler != nil {
+		proxyClient = notifyClose(proxyClient, func() { ctx.TunnelCloseHandler(ctx) })
 	}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
+		var targetSiteCon net.Conn
+		var err error
+		if proxy.CircuitBreaker != nil {
+			targetSiteCon, err = proxy.CircuitBreaker.dial(host, func() (net.Conn, error) {
+				return proxy.connectDial(ctx, "tcp", host)
+			})
+		} else {
+			targetSiteCon, err = proxy.connectDial(ctx, "tcp", host)
+		}
 		if err != nil {
 			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
 			httpError(proxyClient, ctx, err)
 			return
 		}
 		ctx.Logf("Accepting CONNECT to %s", host)
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+		ctx.writeConnectEstablished(proxyClient, "Connection established")
 
-		targetTCP, targetOK := targetSiteCon.(halfClosable)
-		proxyClientTCP, clientOK := proxyClient.(halfClosable)
-		if targetOK && clientOK {
-			go func() {
-				var wg sync.WaitGroup
-				wg.Add(2)
-				go copyAndClose(ctx, targetTCP, proxyClientTCP, &wg)
-				go copyAndClose(ctx, proxyClientTCP, targetTCP, &wg)
-				wg.Wait()
-				// Make sure to close the underlying TCP socket.
-				// CloseRead() and CloseWrite() keep it open until its timeout,
-				// causing error when there are thousands of requests.
-				proxyClientTCP.Close()
-				targetTCP.Close()
-			}()
+		if ctx.ConnectDataHandler != nil {
+			go proxy.handleConnectData(ctx, proxyClient, targetSiteCon, host)
 		} else {
-			// There is a race with the runtime here. In the case where the
-			// connection to the target site times out, we cannot control which
-			// io.Copy loop will receive the timeout signal first. This means
-			// that in some cases the error passed to the ConnErrorHandler will
-			// be the timeout error, and in other cases it will be an error raised
-			// by the use of a closed network connection.
-			//
-			// 2020/05/28 23:42:17 [001] WARN: Error copying to client: read tcp 127.0.0.1:33742->127.0.0.1:34763: i/o timeout
-			// 2020/05/28 23:42:17 [001] WARN: Error copying to client: read tcp 127.0.0.1:45145->127.0.0.1:60494: use of closed
-			//                                                          network connection
-			//
-			// It's also not possible to synchronize these connection closures due to
-			// TCP connections which are half-closed. When this happens, only the one
-			// side of the connection breaks out of its io.Copy loop. The other side
-			// of the connection remains open until it either times out or is reset by
-			// the client.
-			go func() {
-				err := copyOrWarn(ctx, targetSiteCon, proxyClient)
-				if err != nil && proxy.ConnectionErrHandler != nil {
-					proxy.ConnectionErrHandler(proxyClient, ctx, err)
-				}
-				_ = targetSiteCon.Close()
-			}()
-
-			go func() {
-				_ = copyOrWarn(ctx, proxyClient, targetSiteCon)
-				_ = proxyClient.Close()
-			}()
+			proxy.relayTunnel(ctx, proxyClient, targetSiteCon, host)
 		}
 
 	case ConnectHijack:
 		todo.Hijack(r, proxyClient, ctx)
 	case ConnectHTTPMitm:
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		ctx.writeConnectEstablished(proxyClient, "OK")
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
-
-		var targetSiteCon net.Conn
-		var remote *bufio.Reader
-
-		client := http1parser.NewRequestReader(proxy.PreventCanonicalization, proxyClient)
-		for !client.IsEOF() {
-			req, err := client.ReadRequest()
-			if err != nil && !errors.Is(err, io.EOF) {
-				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
-			}
-			if err != nil {
-				return
-			}
-
-			if requestOk := func(req *http.Request) bool {
-				// Since we handled the request parsing by our own, we manually
-				// need to set a cancellable context when we finished the request
-				// processing (same behaviour of the stdlib)
-				requestContext, finishRequest := context.WithCancel(req.Context())
-				req = req.WithContext(requestContext)
-				defer finishRequest()
-
-				// since we're converting the request, need to carry over the
-				// original connecting IP as well
-				req.RemoteAddr = r.RemoteAddr
-				ctx.Logf("req %v", r.Host)
-				ctx.Req = req
-
-				req, resp := proxy.filterRequest(req, ctx)
-				if resp == nil {
-					// Establish a connection with the remote server only if the proxy
-					// doesn't produce a response
-					if targetSiteCon == nil {
-						targetSiteCon, err = proxy.connectDial(ctx, "tcp", host)
-						if err != nil {
-							ctx.Warnf("Error dialing to %s: %s", host, err.Error())
-							return false
-						}
-						remote = bufio.NewReader(targetSiteCon)
-					}
-
-					if err := req.Write(targetSiteCon); err != nil {
-						httpError(proxyClient, ctx, err)
-						return false
-					}
-					resp, err = func() (*http.Response, error) {
-						defer req.Body.Close()
-						return http.ReadResponse(remote, req)
-					}()
-					if err != nil {
-						httpError(proxyClient, ctx, err)
-						return false
-					}
-				}
-				resp = proxy.filterResponse(resp, ctx)
-
-				isWebsocket := isWebSocketHandshake(resp.Header)
-
-				if isWebsocket {
-					// For WebSocket, write the 101 response to client
-					err = resp.Write(proxyClient)
-					if err != nil {
-						httpError(proxyClient, ctx, err)
-						return false
-					}
-
-					ctx.Logf("Response looks like websocket upgrade.")
-					wsServerConn := &bufferedConn{r: remote, Conn: targetSiteCon}
-					proxy.proxyWebsocket(ctx, wsServerConn, proxyClient)
-					return false
-				}
-
-				defer resp.Body.Close()
-				err = resp.Write(proxyClient)
-				if err != nil {
-					httpError(proxyClient, ctx, err)
-					return false
-				}
-
-				return true
-			}(req); !requestOk {
-				break
-			}
-		}
+		proxy.serveMitmHTTPConn(ctx, r, proxyClient, host)
 	case ConnectMitm:
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		ctx.writeConnectEstablished(proxyClient, "OK")
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
@@ -300,206 +221,18 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}
 		}
 		go func() {
-			// TODO: cache connections to the remote website
-			rawClientTls := tls.Server(proxyClient, tlsConfig)
-			defer rawClientTls.Close()
-			if err := rawClientTls.Handshake(); err != nil {
-				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
-				return
-			}
-
-			clientTlsReader := http1parser.NewRequestReader(proxy.PreventCanonicalization, rawClientTls)
-			for !clientTlsReader.IsEOF() {
-				req, err := clientTlsReader.ReadRequest()
-				ctx := &ProxyCtx{
-					Req:                   req,
-					Session:               atomic.AddInt64(&proxy.sess, 1),
-					Proxy:                 proxy,
-					UserData:              ctx.UserData,
-					RoundTripper:          ctx.RoundTripper,
-					WebSocketHandler:      ctx.WebSocketHandler,
-					WebSocketCopyHandler:  ctx.WebSocketCopyHandler,
-					WebSocketCloseHandler: ctx.WebSocketCloseHandler,
-				}
-				if err != nil && !errors.Is(err, io.EOF) {
-					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
-				}
-				if err != nil {
-					return
-				}
-
-				// since we're converting the request, need to carry over the
-				// original connecting IP as well
-				req.RemoteAddr = r.RemoteAddr
-				ctx.Logf("req %v", r.Host)
-
-				if !strings.HasPrefix(req.URL.String(), "https://") {
-					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
-				}
-
-				if continueLoop := func(req *http.Request) bool {
-					// Since we handled the request parsing by our own, we manually
-					// need to set a cancellable context when we finished the request
-					// processing (same behaviour of the stdlib)
-					requestContext, finishRequest := context.WithCancel(req.Context())
-					req = req.WithContext(requestContext)
-					defer finishRequest()
-
-					// Bug fix which goproxy fails to provide request
-					// information URL in the context when does HTTPS MITM
-					ctx.Req = req
-
-					req, resp := proxy.filterRequest(req, ctx)
-					if resp == nil {
-						if req.Method == "PRI" {
-							// Handle HTTP/2 connections.
-
-							// NOTE: As of 1.22, golang's http module will not recognize or
-							// parse the HTTP Body for PRI requests. This leaves the body of
-							// the http2.ClientPreface ("SM\r\n\r\n") on the wire which we need
-							// to clear before setting up the connection.
-							reader := clientTlsReader.Reader()
-							_, err := reader.Discard(6)
-							if err != nil {
-								ctx.Warnf("Failed to process HTTP2 client preface: %v", err)
-								return false
-							}
-							if !proxy.AllowHTTP2 {
-								ctx.Warnf("HTTP2 connection failed: disallowed")
-								return false
-							}
-							tr := H2Transport{reader, rawClientTls, tlsConfig.Clone(), host}
-							if _, err := tr.RoundTrip(req); err != nil {
-								ctx.Warnf("HTTP2 connection failed: %v", err)
-							} else {
-								ctx.Logf("Exiting on EOF")
-							}
-							return false
-						}
-						if err != nil {
-							if req.URL != nil {
-								ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
-							} else {
-								ctx.Warnf("Illegal URL %s", "https://"+r.Host)
-							}
-							return false
-						}
-						if !proxy.KeepHeader {
-							RemoveProxyHeaders(ctx, req)
-						}
-						resp, err = func() (*http.Response, error) {
-							// explicitly discard request body to avoid data races in certain RoundTripper implementations
-							// see https://github.com/golang/go/issues/61596#issuecomment-1652345131
-							defer req.Body.Close()
-							return ctx.RoundTrip(req)
-						}()
-						if err != nil {
-							ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-							return false
-						}
-						ctx.Logf("resp %v", resp.Status)
-					}
-					origBody := resp.Body
-					resp = proxy.filterResponse(resp, ctx)
-					bodyModified := resp.Body != origBody
-					defer resp.Body.Close()
-
-					text := resp.Status
-					statusCode := strconv.Itoa(resp.StatusCode) + " "
-					text = strings.TrimPrefix(text, statusCode)
-					// always use 1.1 to support chunked encoding
-					if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
-						ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
-						return false
-					}
-
-					isWebsocket := isWebSocketHandshake(resp.Header)
-					if isWebsocket || resp.Request.Method == http.MethodHead {
-						// don't change Content-Length for HEAD request
-					} else if (resp.StatusCode >= 100 && resp.StatusCode < 200) ||
-						resp.StatusCode == http.StatusNoContent {
-						// RFC7230: A server MUST NOT send a Content-Length header field in any response
-						// with a status code of 1xx (Informational) or 204 (No Content)
-						resp.Header.Del("Content-Length")
-					} else if bodyModified {
-						// Since we don't know the length of resp, return chunked encoded response
-						resp.Header.Del("Content-Length")
-						resp.Header.Set("Transfer-Encoding", "chunked")
-					}
-					// Force connection close otherwise chrome will keep CONNECT tunnel open forever
-					if !isWebsocket {
-						resp.Header.Set("Connection", "close")
-					}
-					if err := resp.Header.Write(rawClientTls); err != nil {
-						ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
-						return false
-					}
-					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-						ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
-						return false
-					}
-
-					if isWebsocket {
-						ctx.Logf("Response looks like websocket upgrade.")
-
-						// According to resp.Body documentation:
-						// As of Go 1.12, the Body will also implement io.Writer
-						// on a successful "101 Switching Protocols" response,
-						// as used by WebSockets and HTTP/2's "h2c" mode.
-						wsConn, ok := resp.Body.(io.ReadWriter)
-						if !ok {
-							ctx.Warnf("Unable to use Websocket connection")
-							return false
-						}
-						proxy.proxyWebsocket(ctx, wsConn, rawClientTls)
-						// We can't reuse connection after WebSocket handshake,
-						// by returning false here, the underlying connection will be closed
-						return false
-					}
-
-					if resp.Request.Method == http.MethodHead ||
-						(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
-						resp.StatusCode == http.StatusNoContent ||
-						resp.StatusCode == http.StatusNotModified {
-						// Don't write out a response body, when it's not allowed
-						// in RFC7230
-					} else {
-						if bodyModified {
-							chunked := newChunkedWriter(rawClientTls)
-							if _, err := io.Copy(chunked, resp.Body); err != nil {
-								ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-								return false
-							}
-							if err := chunked.Close(); err != nil {
-								ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
-								return false
-							}
-							if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-								ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
-								return false
-							}
-						} else {
-							if _, err := io.Copy(rawClientTls, resp.Body); err != nil {
-								ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-								return false
-							}
-							if err := rawClientTls.Close(); err != nil {
-								ctx.Warnf("Cannot write TLS EOF from mitm'd client: %v", err)
-								return false
-							}
-						}
-					}
-
-					return true
-				}(req); !continueLoop {
+			if todo.Bypass != nil || proxy.ECHPolicy != nil {
+				var bypassed bool
+				if proxyClient, bypassed = proxy.bypassMitm(ctx, todo, proxyClient, host); bypassed {
 					return
 				}
 			}
-			ctx.Logf("Exiting on EOF")
+			// TODO: cache connections to the remote website
+			proxy.serveMitmConn(ctx, r, proxyClient, host, tlsConfig)
 		}()
 	case ConnectAutoMitm:
 		// Auto-detect TLS vs plain HTTP by peeking at first byte from client
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		ctx.writeConnectEstablished(proxyClient, "OK")
 
 		// We need to peek at the first byte to determine if this is TLS or plain HTTP
 		// TLS handshake records start with 0x16 (22 = handshake record type)
@@ -528,11 +261,27 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					return
 				}
 			}
-			go proxy.handleAutoMitmTLS(ctx, r, peekedConn, host, tlsConfig)
+			go func() {
+				proxyClient := net.Conn(peekedConn)
+				if todo.Bypass != nil || proxy.ECHPolicy != nil {
+					var bypassed bool
+					if proxyClient, bypassed = proxy.bypassMitm(ctx, todo, proxyClient, host); bypassed {
+						return
+					}
+				}
+				proxy.serveMitmConn(ctx, r, proxyClient, host, tlsConfig)
+			}()
 		} else {
+			client := net.Conn(peekedConn)
+			if ctx.ConnectDataHandler != nil {
+				var handled bool
+				if client, handled = proxy.autoMitmConnectData(ctx, client, host); handled {
+					return
+				}
+			}
 			ctx.Logf("Auto-detected plain HTTP connection, http mitm proxying it")
 			// Handle as HTTP MITM
-			proxy.handleAutoMitmHTTP(ctx, r, peekedConn, host)
+			proxy.serveMitmHTTPConn(ctx, r, client, host)
 		}
 	case ConnectProxyAuthHijack:
 		_, _ = proxyClient.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
@@ -547,6 +296,135 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// writeConnectEstablished writes the response to an accepted CONNECT
+// request: ctx.ConnectResponse if set, or a bare 200 response with reason
+// otherwise.
+func (ctx *ProxyCtx) writeConnectEstablished(w io.Writer, reason string) {
+	resp := ctx.ConnectResponse
+	if resp == nil {
+		_, _ = io.WriteString(w, "HTTP/1.0 200 "+reason+"\r\n\r\n")
+		return
+	}
+	code := resp.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	status := resp.Status
+	if !strings.HasPrefix(status, strconv.Itoa(code)+" ") {
+		status = strconv.Itoa(code) + " " + http.StatusText(code)
+	}
+	major, minor := resp.ProtoMajor, resp.ProtoMinor
+	if major == 0 {
+		major, minor = 1, 0
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/%d.%d %s\r\n", major, minor, status)
+	// A 2xx response to a CONNECT request has no body, so no framing
+	// headers
+	_ = resp.Header.WriteSubset(&buf, map[string]bool{"Content-Length": true, "Transfer-Encoding": true})
+	buf.WriteString("\r\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		ctx.Warnf("Cannot write CONNECT response: %v", err)
+	}
+}
+
+// relayTunnel copies the data of an accepted CONNECT tunnel between
+// proxyClient and targetSiteCon, in the background.
+func (proxy *ProxyHttpServer) relayTunnel(ctx *ProxyCtx, proxyClient, targetSiteCon net.Conn, host string) {
+	tracker := proxy.openTunnel(ctx, host)
+	watch := ctx.watchTunnel(host, proxyClient, targetSiteCon)
+	targetTCP, targetOK := targetSiteCon.(halfClosable)
+	proxyClientTCP, clientOK := proxyClient.(halfClosable)
+	if targetOK && clientOK {
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				tracker.done(copyAndClose(ctx, targetTCP, proxyClientTCP, &wg), true)
+				watch.done()
+			}()
+			// Copy the other direction in this goroutine, the tunnel
+			// uses one goroutine per direction
+			tracker.done(copyAndClose(ctx, proxyClientTCP, targetTCP, &wg), false)
+			watch.done()
+			wg.Wait()
+			// Make sure to close the underlying TCP socket.
+			// CloseRead() and CloseWrite() keep it open until its timeout,
+			// causing error when there are thousands of requests.
+			proxyClientTCP.Close()
+			targetTCP.Close()
+		}()
+	} else {
+		// There is a race with the runtime here. In the case where the
+		// connection to the target site times out, we cannot control which
+		// io.Copy loop will receive the timeout signal first. This means
+		// that in some cases the error passed to the ConnErrorHandler will
+		// be the timeout error, and in other cases it will be an error raised
+		// by the use of a closed network connection.
+		//
+		// 2020/05/28 23:42:17 [001] WARN: Error copying to client: read tcp 127.0.0.1:33742->127.0.0.1:34763: i/o timeout
+		// 2020/05/28 23:42:17 [001] WARN: Error copying to client: read tcp 127.0.0.1:45145->127.0.0.1:60494: use of closed
+		//                                                          network connection
+		//
+		// The end of one direction is propagated with a half-close when the
+		// connections support it (TLS...), and both connections are closed
+		// once both directions are done. Otherwise the end of one direction
+		// closes both.
+		var remaining atomic.Int32
+		remaining.Store(2)
+		finish := func() {
+			if remaining.Add(-1) == 0 {
+				_ = proxyClient.Close()
+				_ = targetSiteCon.Close()
+			}
+		}
+		go func() {
+			n, err := copyTunnelOrWarn(ctx, targetSiteCon, proxyClient)
+			if err != nil && proxy.ConnectionErrHandler != nil {
+				proxy.ConnectionErrHandler(proxyClient, ctx, err)
+			}
+			if err != nil || !closeWrite(targetSiteCon) {
+				_ = targetSiteCon.Close()
+			}
+			tracker.done(n, true)
+			watch.done()
+			finish()
+		}()
+
+		go func() {
+			n, err := copyTunnelOrWarn(ctx, proxyClient, targetSiteCon)
+			if err != nil || !closeWrite(proxyClient) {
+				_ = proxyClient.Close()
+			}
+			tracker.done(n, false)
+			watch.done()
+			finish()
+		}()
+	}
+}
+
+// filterConnect runs the CONNECT handlers, returning the action chosen by
+// the first one that returns a non-nil result, or OkConnect.
+func (proxy *ProxyHttpServer) filterConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
+	todo := OkConnect
+	originalHost := host
+	for i, h := range proxy.httpsHandlers {
+		newtodo, newhost := h.HandleConnect(host, ctx)
+
+		// If found a result, break the loop immediately
+		if newtodo != nil {
+			todo, host = newtodo, newhost
+			ctx.Logf("on %dth handler: %v %s", i, todo, host)
+			break
+		}
+	}
+	if proxy.ReadOnly() {
+		return observeConnect(todo, host, originalHost, ctx)
+	}
+	return todo, host
+}
+
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 	if ctx.Proxy.ConnectionErrHandler != nil {
 		ctx.Proxy.ConnectionErrHandler(w, ctx, err)
@@ -567,18 +445,25 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 }
 
 func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader) error {
-	_, err := io.Copy(dst, src)
+	_, err := copyTunnelOrWarn(ctx, dst, src)
+	return err
+}
+
+// copyTunnelOrWarn is copyOrWarn, also returning the number of bytes
+// copied.
+func copyTunnelOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader) (int64, error) {
+	n, err := copyTunnel(ctx.tunnelWriter(dst), src)
 	if err != nil && errors.Is(err, net.ErrClosed) {
 		// Discard closed connection errors
 		err = nil
 	} else if err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
-	return err
+	return n, err
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) {
-	_, err := io.Copy(dst, src)
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) int64 {
+	n, err := copyTunnel(ctx.tunnelWriter(dst), src)
 	if err != nil && !errors.Is(err, net.ErrClosed) {
 		ctx.Warnf("Error copying to client: %s", err.Error())
 	}
@@ -586,6 +471,7 @@ func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) {
 	_ = dst.CloseWrite()
 	_ = src.CloseRead()
 	wg.Done()
+	return n
 }
 
 func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn, error) {
@@ -616,39 +502,21 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 			u.Host += ":80"
 		}
 		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: http.MethodConnect,
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(&ProxyCtx{Req: &http.Request{}}, network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			_ = connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				_ = c.Close()
+			return proxy.connectThroughProxy(u, addr, connectReqHandler, func() (net.Conn, error) {
+				return proxy.dial(&ProxyCtx{Req: &http.Request{}}, network, u.Host)
+			})
+		}
+	}
+	if isSOCKS5(u) {
+		dial, err := socks5Dialer(u)
+		if err != nil {
+			proxy.Logger.Printf("WARN: Cannot dial through SOCKS5 proxy %s: %v", u.Redacted(), err)
+			return func(network, addr string) (net.Conn, error) {
 				return nil, err
 			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				resp, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
-				if err != nil {
-					return nil, err
-				}
-				_ = c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
-			}
-			return c, nil
+		}
+		return func(network, addr string) (net.Conn, error) {
+			return dial(context.Background(), network, addr)
 		}
 	}
 	if u.Scheme == "https" || u.Scheme == "wss" {
@@ -656,46 +524,14 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 			u.Host += ":443"
 		}
 		return func(network, addr string) (net.Conn, error) {
-			ctx := &ProxyCtx{Req: &http.Request{}}
-			c, err := proxy.dial(ctx, network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-
-			c, err = proxy.initializeTLSconnection(ctx, c, proxy.Tr.TLSClientConfig, u.Host)
-			if err != nil {
-				return nil, err
-			}
-
-			connectReq := &http.Request{
-				Method: http.MethodConnect,
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			_ = connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				_ = c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != http.StatusOK {
-				body, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
+			return proxy.connectThroughProxy(u, addr, connectReqHandler, func() (net.Conn, error) {
+				ctx := &ProxyCtx{Req: &http.Request{}}
+				c, err := proxy.dial(ctx, network, u.Host)
 				if err != nil {
 					return nil, err
 				}
-				_ = c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
-			}
-			return c, nil
+				return proxy.initializeProxyTLSconnection(ctx, c, proxy.Tr.TLSClientConfig, u.Host)
+			})
 		}
 	}
 	return nil
@@ -706,15 +542,57 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		var err error
 		var cert *tls.Certificate
 
-		hostname := stripPort(host)
+		hostname := signer.NormalizeHost(stripPort(host))
 		config := defaultTLSConfig.Clone()
-		ctx.Logf("signing for %s", stripPort(host))
-
+		ctx.Logf("signing for %s", hostname)
+
+		signingCA := ca
+		certHosts := []string{hostname}
+		storeKey := hostname
+		keyType := signer.KeyTypeAuto
+		if ctx.Proxy != nil {
+			keyType = signer.KeyType(ctx.Proxy.CertKeyType)
+			if wildcard, ok := ctx.Proxy.wildcardCertHosts(hostname); ok {
+				certHosts = wildcard
+				storeKey = wildcard[1]
+			}
+			if rotated := ctx.Proxy.CA(); rotated != nil {
+				signingCA = rotated
+			}
+			if ctx.Proxy.CASelector != nil {
+				selected, err := ctx.Proxy.CASelector(host, ctx)
+				if err != nil {
+					ctx.Warnf("Cannot select CA for %s: %s", hostname, err)
+					return nil, err
+				}
+				if selected != nil {
+					signingCA = selected
+				}
+			}
+			if signingCA != ca {
+				// Certificates signed by different CAs must not be mixed up
+				fingerprint := sha256.Sum256(signingCA.Certificate[0])
+				storeKey += "@" + hex.EncodeToString(fingerprint[:8])
+			}
+		}
+		opts := signer.Options{KeyType: keyType}
+		if ctx.Proxy != nil {
+			ctx.Proxy.LeafProfile.apply(&opts)
+		}
+		if ctx.Proxy != nil && ctx.Proxy.RevocationResponder != nil {
+			ocspURL, crlURL, err := ctx.Proxy.RevocationResponder.register(signingCA)
+			if err != nil {
+				ctx.Warnf("Cannot register CA to the revocation responder: %s", err)
+				return nil, err
+			}
+			opts.OCSPServers = []string{ocspURL}
+			opts.CRLDistributionPoints = []string{crlURL}
+		}
 		genCert := func() (*tls.Certificate, error) {
-			return signer.SignHost(*ca, []string{hostname})
+			return signer.SignHostWithOptions(*signingCA, certHosts, opts)
 		}
 		if ctx.certStore != nil {
-			cert, err = ctx.certStore.Fetch(hostname, genCert)
+			cert, err = ctx.certStore.Fetch(storeKey, genCert)
 		} else {
 			cert, err = genCert()
 		}
@@ -729,12 +607,41 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 	}
 }
 
+// initializeTLSconnection performs the TLS handshake of targetConn, a
+// connection to the remote server at addr, with UpstreamTLSHandshake if
+// set.
 func (proxy *ProxyHttpServer) initializeTLSconnection(
 	ctx *ProxyCtx,
 	targetConn net.Conn,
 	tlsConfig *tls.Config,
 	addr string,
 ) (net.Conn, error) {
+	return proxy.handshakeTLS(ctx, targetConn, tlsConfig, addr, proxy.UpstreamTLSHandshake)
+}
+
+// initializeProxyTLSconnection performs the TLS handshake of proxyConn, a
+// connection to the https upstream proxy at addr. UpstreamTLSHandshake
+// only impersonates the clients of the remote servers, so crypto/tls is
+// always used.
+func (proxy *ProxyHttpServer) initializeProxyTLSconnection(
+	ctx *ProxyCtx,
+	proxyConn net.Conn,
+	tlsConfig *tls.Config,
+	addr string,
+) (net.Conn, error) {
+	return proxy.handshakeTLS(ctx, proxyConn, tlsConfig, addr, nil)
+}
+
+func (proxy *ProxyHttpServer) handshakeTLS(
+	ctx *ProxyCtx,
+	targetConn net.Conn,
+	tlsConfig *tls.Config,
+	addr string,
+	handshake UpstreamTLSHandshake,
+) (net.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
 	// Infer target ServerName, it's a copy of implementation inside tls.Dial()
 	if tlsConfig.ServerName == "" {
 		colonPos := strings.LastIndex(addr, ":")
@@ -748,8 +655,22 @@ func (proxy *ProxyHttpServer) initializeTLSconnection(
 		tlsConfig = c
 	}
 
-	tlsConn := tls.Client(targetConn, tlsConfig)
+	tlsConfig = withClientCertificate(tlsConfig, ctx.upstreamClientCertificate(tlsConfig.ServerName))
+	if net.ParseIP(tlsConfig.ServerName) != nil {
+		// The IP addresses aren't sent as server names, see withUpstreamPins
+		tlsConfig = proxy.withUpstreamPins(tlsConfig, tlsConfig.ServerName)
+	}
+	start := time.Now()
+	if handshake != nil {
+		conn, err := handshake(ctx, proxy.UpstreamTLSRecords.WrapConn(targetConn), proxy.upstreamTLSConfig(ctx, tlsConfig))
+		if err != nil {
+			proxy.tlsHandshakeFailed(ctx, addr, TLSLegUpstream, err, start, ctx.ClientHello)
+		}
+		return conn, err
+	}
+	tlsConn := tls.Client(proxy.UpstreamTLSRecords.WrapConn(targetConn), proxy.upstreamTLSConfig(ctx, tlsConfig))
 	if err := tlsConn.HandshakeContext(ctx.Req.Context()); err != nil {
+		proxy.tlsHandshakeFailed(ctx, addr, TLSLegUpstream, err, start, ctx.ClientHello)
 		return nil, err
 	}
 	return tlsConn, nil
@@ -765,6 +686,13 @@ func (c *peekedConn) Read(b []byte) (int, error) {
 	return c.Reader.Read(b)
 }
 
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
 // bufferedConn wraps a bufio.Reader and net.Conn for WebSocket proxying
 // when http.ReadResponse has buffered data we need to read
 type bufferedConn struct {
@@ -776,35 +704,78 @@ func (c *bufferedConn) Read(b []byte) (int, error) {
 	return c.r.Read(b)
 }
 
-// handleAutoMitmTLS handles the CONNECT tunnel when TLS is detected
-func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request, proxyClient net.Conn, host string, tlsConfig *tls.Config) {
-	rawClientTls := tls.Server(proxyClient, tlsConfig)
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// serveMitmConn handshakes with the MITM client connection proxyClient,
+// as the server host, and serves the requests it sends.
+func (proxy *ProxyHttpServer) serveMitmConn(ctx *ProxyCtx, r *http.Request, proxyClient net.Conn, host string, tlsConfig *tls.Config) {
+	helloConn := &clientHelloConn{Conn: proxyClient}
+	var upstreamALPN []string
+	rawClientTls := tls.Server(proxy.ClientTLSRecords.WrapConn(helloConn), proxy.mitmALPNConfig(ctx, proxy.clientTLSConfig(ctx, host, tlsConfig), &upstreamALPN))
 	defer rawClientTls.Close()
+	handshakeStart := time.Now()
 	if err := rawClientTls.Handshake(); err != nil {
 		ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
+		proxy.tlsHandshakeFailed(ctx, host, TLSLegClient, err, handshakeStart, helloConn.clientHello())
+		proxy.wildcardHandshakeFailed(stripPort(host))
+		proxy.PinningBypass.connectionDone(pinningHost(helloConn.clientHello(), host), isCertificateRejection(err))
 		return
 	}
+	clientHello := helloConn.clientHello()
+	peerCertificates := rawClientTls.ConnectionState().PeerCertificates
+	proxy.PinningBypass.connectionDone(pinningHost(clientHello, host), false)
 
 	clientTlsReader := http1parser.NewRequestReader(proxy.PreventCanonicalization, rawClientTls)
-	for !clientTlsReader.IsEOF() {
-		req, err := clientTlsReader.ReadRequest()
+	if proxy.handleRawConnection(ctx, rawClientTls, clientTlsReader.Reader(), host) {
+		return
+	}
+	requests := newRequestQueue(clientTlsReader, rawClientTls, mitmIdleTimeout(r))
+	for {
+		req, body, err := requests.next()
 		ctx := &ProxyCtx{
 			Req:                   req,
 			Session:               atomic.AddInt64(&proxy.sess, 1),
 			Proxy:                 proxy,
 			UserData:              ctx.UserData,
 			RoundTripper:          ctx.RoundTripper,
+			Dialer:                ctx.Dialer,
+			Resolver:              ctx.Resolver,
+			SourceAddr:            ctx.SourceAddr,
+			Timeouts:              ctx.Timeouts,
 			WebSocketHandler:      ctx.WebSocketHandler,
 			WebSocketCopyHandler:  ctx.WebSocketCopyHandler,
 			WebSocketCloseHandler: ctx.WebSocketCloseHandler,
+			ClientHello:           clientHello,
+			PeerCertificates:      peerCertificates,
+			UpstreamALPN:          upstreamALPN,
+			DNSOverrides:          transparentOverrides(r),
+			ProxyProtocol:         proxyProtocolHeader(r),
+			UpstreamProxy:         ctx.UpstreamProxy,
+			User:                  ctx.User,
+			context:               ctx.context,
 		}
-		if err != nil && !errors.Is(err, io.EOF) {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, errClientIdle) {
 			ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
 		}
+		if errors.Is(err, io.EOF) {
+			ctx.Logf("Exiting on EOF")
+		}
+		if errors.Is(err, errClientIdle) {
+			ctx.Logf("Closing idle client connection of %v", r.Host)
+		}
 		if err != nil {
 			return
 		}
 
+		clientClose := req.Close
+
+		// since we're converting the request, need to carry over the
+		// original connecting IP as well
 		req.RemoteAddr = r.RemoteAddr
 		ctx.Logf("req %v", r.Host)
 
@@ -813,15 +784,32 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 		}
 
 		if continueLoop := func(req *http.Request) bool {
-			requestContext, finishRequest := context.WithCancel(req.Context())
+			defer ctx.finishExchange()
+
+			// Since we handled the request parsing by our own, we manually
+			// need to set a cancellable context when we finished the request
+			// processing (same behaviour of the stdlib)
+			requestContext, finishRequest := context.WithCancel(ctx.Context())
 			req = req.WithContext(requestContext)
+			ctx.context = requestContext
 			defer finishRequest()
 
+			// Bug fix which goproxy fails to provide request
+			// information URL in the context when does HTTPS MITM
 			ctx.Req = req
 
 			req, resp := proxy.filterRequest(req, ctx)
+			if resp == nil {
+				req, resp = proxy.expectContinue(req, ctx, rawClientTls)
+			}
 			if resp == nil {
 				if req.Method == "PRI" {
+					// Handle HTTP/2 connections.
+
+					// NOTE: As of 1.22, golang's http module will not recognize or
+					// parse the HTTP Body for PRI requests. This leaves the body of
+					// the http2.ClientPreface ("SM\r\n\r\n") on the wire which we need
+					// to clear before setting up the connection.
 					reader := clientTlsReader.Reader()
 					_, err := reader.Discard(6)
 					if err != nil {
@@ -832,7 +820,15 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 						ctx.Warnf("HTTP2 connection failed: disallowed")
 						return false
 					}
-					tr := H2Transport{reader, rawClientTls, tlsConfig.Clone(), host}
+					tr := H2Transport{
+						ClientReader: reader,
+						ClientWriter: rawClientTls,
+						TLSConfig:    proxy.withKeyLog(tlsConfig).Clone(),
+						Host:         host,
+						dial: func(network, addr string) (net.Conn, error) {
+							return proxy.connectDial(ctx, network, addr)
+						},
+					}
 					if _, err := tr.RoundTrip(req); err != nil {
 						ctx.Warnf("HTTP2 connection failed: %v", err)
 					} else {
@@ -851,7 +847,12 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 				if !proxy.KeepHeader {
 					RemoveProxyHeaders(ctx, req)
 				}
+				req = proxy.traceInformational(req, ctx, func(code int, header http.Header) error {
+					return writeInformational(rawClientTls, code, header)
+				})
 				resp, err = func() (*http.Response, error) {
+					// explicitly discard request body to avoid data races in certain RoundTripper implementations
+					// see https://github.com/golang/go/issues/61596#issuecomment-1652345131
 					defer req.Body.Close()
 					return ctx.RoundTrip(req)
 				}()
@@ -863,27 +864,50 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 			}
 			origBody := resp.Body
 			resp = proxy.filterResponse(resp, ctx)
+			if ctx.abortConn(proxyClient) {
+				return false
+			}
 			bodyModified := resp.Body != origBody
 			defer resp.Body.Close()
 
+			isWebsocket := isWebSocketHandshake(resp.Header)
+			// Keep the connection open unless the client or the server close it,
+			// the next request of the client is read while the response is
+			// written, and the response must then be delimited
+			reusable := body.finish() && !resp.Close
+			keepAlive := reusable && !clientClose && !isWebsocket
+			chunkedBody := bodyModified || (keepAlive && resp.ContentLength < 0)
+			if keepAlive {
+				requests.readNext()
+			}
+
 			text := resp.Status
 			statusCode := strconv.Itoa(resp.StatusCode) + " "
 			text = strings.TrimPrefix(text, statusCode)
+			// always use 1.1 to support chunked encoding
 			if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
 				ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
 				return false
 			}
 
-			isWebsocket := isWebSocketHandshake(resp.Header)
 			if isWebsocket || resp.Request.Method == http.MethodHead {
+				// don't change Content-Length for HEAD request
 			} else if (resp.StatusCode >= 100 && resp.StatusCode < 200) ||
 				resp.StatusCode == http.StatusNoContent {
+				// RFC7230: A server MUST NOT send a Content-Length header field in any response
+				// with a status code of 1xx (Informational) or 204 (No Content)
 				resp.Header.Del("Content-Length")
-			} else if bodyModified {
+			} else if chunkedBody {
+				// Since we don't know the length of resp, return chunked encoded response
 				resp.Header.Del("Content-Length")
 				resp.Header.Set("Transfer-Encoding", "chunked")
+			} else if keepAlive && resp.ContentLength >= 0 {
+				resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
 			}
-			if !isWebsocket {
+			// Tell the client when the connection is closed after the response
+			if keepAlive && !isWebsocket {
+				resp.Header.Del("Connection")
+			} else if !isWebsocket {
 				resp.Header.Set("Connection", "close")
 			}
 			if err := resp.Header.Write(rawClientTls); err != nil {
@@ -897,12 +921,19 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 
 			if isWebsocket {
 				ctx.Logf("Response looks like websocket upgrade.")
+
+				// According to resp.Body documentation:
+				// As of Go 1.12, the Body will also implement io.Writer
+				// on a successful "101 Switching Protocols" response,
+				// as used by WebSockets and HTTP/2's "h2c" mode.
 				wsConn, ok := resp.Body.(io.ReadWriter)
 				if !ok {
 					ctx.Warnf("Unable to use Websocket connection")
 					return false
 				}
 				proxy.proxyWebsocket(ctx, wsConn, rawClientTls)
+				// We can't reuse connection after WebSocket handshake,
+				// by returning false here, the underlying connection will be closed
 				return false
 			}
 
@@ -910,9 +941,11 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 				(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
 				resp.StatusCode == http.StatusNoContent ||
 				resp.StatusCode == http.StatusNotModified {
+				// Don't write out a response body, when it's not allowed
+				// in RFC7230
 			} else {
-				if bodyModified {
-					chunked := newChunkedWriter(rawClientTls)
+				if chunkedBody {
+					chunked := wire.NewChunkedWriter(rawClientTls)
 					if _, err := io.Copy(chunked, resp.Body); err != nil {
 						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 						return false
@@ -930,6 +963,9 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 						return false
 					}
+					if keepAlive {
+						return true
+					}
 					if err := rawClientTls.Close(); err != nil {
 						ctx.Warnf("Cannot write TLS EOF from mitm'd client: %v", err)
 						return false
@@ -937,23 +973,27 @@ func (proxy *ProxyHttpServer) handleAutoMitmTLS(ctx *ProxyCtx, r *http.Request,
 				}
 			}
 
-			return true
+			// The connection can't be reused when the request body
+			// hasn't been read, e.g. rejected Expect: 100-continue
+			return keepAlive
 		}(req); !continueLoop {
 			return
 		}
 	}
-	ctx.Logf("Exiting on EOF")
 }
 
-// handleAutoMitmHTTP handles the CONNECT tunnel when plain HTTP is detected
-func (proxy *ProxyHttpServer) handleAutoMitmHTTP(ctx *ProxyCtx, r *http.Request, proxyClient net.Conn, host string) {
+// serveMitmHTTPConn serves the plain HTTP requests of the MITM client
+// connection proxyClient, sent to host.
+func (proxy *ProxyHttpServer) serveMitmHTTPConn(ctx *ProxyCtx, r *http.Request, proxyClient net.Conn, host string) {
 	var targetSiteCon net.Conn
 	var remote *bufio.Reader
 
-	client := http1parser.NewRequestReader(proxy.PreventCanonicalization, proxyClient)
-	for !client.IsEOF() {
-		req, err := client.ReadRequest()
-		if err != nil && !errors.Is(err, io.EOF) {
+	requests := newRequestQueue(http1parser.NewRequestReader(proxy.PreventCanonicalization, proxyClient), proxyClient, mitmIdleTimeout(r))
+	for {
+		req, body, err := requests.next()
+		if errors.Is(err, errClientIdle) {
+			ctx.Logf("Closing idle client connection of %v", r.Host)
+		} else if err != nil && !errors.Is(err, io.EOF) {
 			ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
 		}
 		if err != nil {
@@ -961,16 +1001,25 @@ func (proxy *ProxyHttpServer) handleAutoMitmHTTP(ctx *ProxyCtx, r *http.Request,
 		}
 
 		if requestOk := func(req *http.Request) bool {
-			requestContext, finishRequest := context.WithCancel(req.Context())
+			defer ctx.finishExchange()
+
+			// Since we handled the request parsing by our own, we manually
+			// need to set a cancellable context when we finished the request
+			// processing (same behaviour of the stdlib)
+			requestContext, finishRequest := context.WithCancel(ctx.Context())
 			req = req.WithContext(requestContext)
 			defer finishRequest()
 
+			// since we're converting the request, need to carry over the
+			// original connecting IP as well
 			req.RemoteAddr = r.RemoteAddr
 			ctx.Logf("req %v", r.Host)
 			ctx.Req = req
 
 			req, resp := proxy.filterRequest(req, ctx)
 			if resp == nil {
+				// Establish a connection with the remote server only if the proxy
+				// doesn't produce a response
 				if targetSiteCon == nil {
 					targetSiteCon, err = proxy.connectDial(ctx, "tcp", host)
 					if err != nil {
@@ -986,7 +1035,7 @@ func (proxy *ProxyHttpServer) handleAutoMitmHTTP(ctx *ProxyCtx, r *http.Request,
 				}
 				resp, err = func() (*http.Response, error) {
 					defer req.Body.Close()
-					return http.ReadResponse(remote, req)
+					return proxy.readResponse(remote, req, ctx, proxyClient)
 				}()
 				if err != nil {
 					httpError(proxyClient, ctx, err)
@@ -994,6 +1043,9 @@ func (proxy *ProxyHttpServer) handleAutoMitmHTTP(ctx *ProxyCtx, r *http.Request,
 				}
 			}
 			resp = proxy.filterResponse(resp, ctx)
+			if ctx.abortConn(proxyClient) {
+				return false
+			}
 
 			isWebsocket := isWebSocketHandshake(resp.Header)
 
@@ -1012,13 +1064,21 @@ func (proxy *ProxyHttpServer) handleAutoMitmHTTP(ctx *ProxyCtx, r *http.Request,
 			}
 
 			defer resp.Body.Close()
+			reusable := body.finish()
+			if reusable {
+				// Delimit the body for the next request of the client
+				delimitResponse(resp)
+			}
 			err = resp.Write(proxyClient)
 			if err != nil {
 				httpError(proxyClient, ctx, err)
 				return false
 			}
 
-			return true
+			if reusable {
+				requests.readNext()
+			}
+			return reusable
 		}(req); !requestOk {
 			break
 		}
@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// InformationalResponseHandler is called for every interim 1xx response
+// (e.g. 102 Processing, 103 Early Hints) received from the remote server.
+// The handler can modify the header, returning false drops the response
+// instead of forwarding it to the client.
+// 100 Continue is handled separately, see ExpectContinueHandler.
+type InformationalResponseHandler func(code int, header http.Header, ctx *ProxyCtx) bool
+
+// OnInformationalResponse registers a handler for interim 1xx responses.
+// Interim responses are forwarded to the client by default, handlers are
+// called in the order they were registered until one of them drops it.
+//
+//	proxy.OnInformationalResponse(func(code int, header http.Header, ctx *goproxy.ProxyCtx) bool {
+//		return code != http.StatusEarlyHints
+//	})
+func (proxy *ProxyHttpServer) OnInformationalResponse(h InformationalResponseHandler) {
+	proxy.infoHandlers = append(proxy.infoHandlers, h)
+}
+
+// filterInformational runs the informational handlers, reporting whether the
+// response must be forwarded to the client.
+func (proxy *ProxyHttpServer) filterInformational(code int, header http.Header, ctx *ProxyCtx) bool {
+	if code == http.StatusContinue || code == http.StatusSwitchingProtocols {
+		return false
+	}
+	for _, h := range proxy.infoHandlers {
+		if !h(code, header, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// traceInformational returns req with a client trace forwarding the interim
+// responses received by the RoundTripper using write.
+func (proxy *ProxyHttpServer) traceInformational(
+	req *http.Request,
+	ctx *ProxyCtx,
+	write func(code int, header http.Header) error,
+) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			h := http.Header(header).Clone()
+			if !proxy.filterInformational(code, h, ctx) {
+				return nil
+			}
+			ctx.Logf("Forwarding interim response %d to client", code)
+			if err := write(code, h); err != nil {
+				ctx.Warnf("Cannot write interim response to client: %v", err)
+			}
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func writeInformational(w io.Writer, code int, header http.Header) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code)); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+func writeInformationalTo(w http.ResponseWriter) func(code int, header http.Header) error {
+	return func(code int, header http.Header) error {
+		copyHeaders(w.Header(), header, false)
+		w.WriteHeader(code)
+		// The header map is kept by net/http after an interim response,
+		// make sure that it doesn't leak into the final one.
+		for k := range header {
+			w.Header().Del(k)
+		}
+		return nil
+	}
+}
+
+// readResponse reads the response to req from remote, forwarding the
+// interim responses preceding it to client.
+func (proxy *ProxyHttpServer) readResponse(
+	remote *bufio.Reader,
+	req *http.Request,
+	ctx *ProxyCtx,
+	client io.Writer,
+) (*http.Response, error) {
+	for {
+		resp, err := proxy.parseResponse(remote, req, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode > 199 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if resp.StatusCode == http.StatusContinue || proxy.filterInformational(resp.StatusCode, resp.Header, ctx) {
+			if err := writeInformational(client, resp.StatusCode, resp.Header); err != nil {
+				ctx.Warnf("Cannot write interim response to client: %v", err)
+			}
+		}
+	}
+}
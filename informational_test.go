@@ -0,0 +1,80 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func earlyHintsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+	_, _ = io.WriteString(w, "done")
+}
+
+func TestInformationalResponsePassthrough(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(earlyHintsHandler))
+	defer plain.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(earlyHintsHandler))
+	defer tlsSrv.Close()
+
+	testCases := []struct {
+		name  string
+		url   string
+		drop  bool
+		hints int
+	}{
+		{name: "http", url: plain.URL, hints: 1},
+		{name: "mitm", url: tlsSrv.URL, hints: 1},
+		{name: "http dropped", url: plain.URL, drop: true},
+		{name: "mitm dropped", url: tlsSrv.URL, drop: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			var seen int
+			proxy.OnInformationalResponse(func(code int, header http.Header, ctx *goproxy.ProxyCtx) bool {
+				seen++
+				return !tc.drop
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			var links []string
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					if code == http.StatusEarlyHints {
+						links = append(links, header.Get("Link"))
+					}
+					return nil
+				},
+			}
+			ctx := httptrace.WithClientTrace(context.Background(), trace)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "done", string(body))
+			assert.Empty(t, resp.Header.Get("Link"))
+			assert.Equal(t, 1, seen)
+			assert.Len(t, links, tc.hints)
+			if tc.hints > 0 {
+				assert.Equal(t, "</style.css>; rel=preload; as=style", links[0])
+			}
+		})
+	}
+}
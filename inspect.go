@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrBodyAborted is the error of the bodies whose inspection was aborted,
+// see InspectBody.
+var ErrBodyAborted = errors.New("body inspection aborted")
+
+// BodyInspector observes a body chunk by chunk as it streams, see
+// InspectBody. It's called with each chunk read from the body, which it
+// mustn't retain, and then with a nil chunk and eof set once the body is
+// over. Returning an error aborts the stream.
+type BodyInspector func(chunk []byte, eof bool, ctx *ProxyCtx) error
+
+// InspectBody returns body, observed by inspect as it's read, without
+// buffering it, e.g. to scan or hash large uploads and downloads with
+// bounded memory. When inspect returns an error, the reads of the body
+// fail with ErrBodyAborted and the exchange is aborted: the client
+// connection is closed before the end of the response, and the requests
+// aren't sent entirely to their destination.
+func (ctx *ProxyCtx) InspectBody(body io.ReadCloser, inspect BodyInspector) io.ReadCloser {
+	return &inspectedBody{body: body, inspect: inspect, ctx: ctx}
+}
+
+// InspectRequestBody returns a ReqHandler observing the bodies of the
+// requests with inspect, see InspectBody.
+func InspectRequestBody(inspect BodyInspector) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = ctx.InspectBody(req.Body, inspect)
+		}
+		return req, nil
+	})
+}
+
+// InspectResponseBody returns a RespHandler observing the bodies of the
+// responses with inspect, see InspectBody:
+//
+//	proxy.OnResponse().Do(goproxy.InspectResponseBody(func(chunk []byte, eof bool, ctx *goproxy.ProxyCtx) error {
+//		return scanner.Scan(chunk, eof)
+//	}))
+func InspectResponseBody(inspect BodyInspector) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp != nil && resp.Body != nil && resp.Body != http.NoBody {
+			resp.Body = ctx.InspectBody(resp.Body, inspect)
+		}
+		return resp
+	})
+}
+
+type inspectedBody struct {
+	body    io.ReadCloser
+	inspect BodyInspector
+	ctx     *ProxyCtx
+	// err is the error of the inspection, once over
+	err  error
+	done bool
+}
+
+func (b *inspectedBody) Read(p []byte) (int, error) {
+	if b.done {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	n, err := b.body.Read(p)
+	if n > 0 {
+		if inspectErr := b.inspect(p[:n], false, b.ctx); inspectErr != nil {
+			return 0, b.abort(inspectErr)
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		b.done = true
+		if inspectErr := b.inspect(nil, true, b.ctx); inspectErr != nil {
+			return n, b.abort(inspectErr)
+		}
+	}
+	return n, err
+}
+
+func (b *inspectedBody) abort(err error) error {
+	b.done = true
+	b.err = fmt.Errorf("%w: %w", ErrBodyAborted, err)
+	if b.ctx.Proxy != nil {
+		b.ctx.Warnf("Body inspection aborted: %v", err)
+	}
+	return b.err
+}
+
+func (b *inspectedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,119 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectResponseBody(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(payload)
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	expected := sha256.Sum256(payload)
+
+	for _, test := range []struct {
+		name  string
+		url   string
+		limit int
+	}{
+		{"http", backend.URL, 0},
+		{"mitm", tlsBackend.URL, 0},
+		{"http-aborted", backend.URL, 100 * 1024},
+		{"mitm-aborted", tlsBackend.URL, 100 * 1024},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var digest hash.Hash
+			var seen, largest, eofs int
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			proxy.OnResponse().Do(goproxy.InspectResponseBody(func(chunk []byte, eof bool, ctx *goproxy.ProxyCtx) error {
+				if digest == nil {
+					digest = sha256.New()
+				}
+				if eof {
+					eofs++
+					return nil
+				}
+				digest.Write(chunk)
+				seen += len(chunk)
+				if len(chunk) > largest {
+					largest = len(chunk)
+				}
+				if test.limit > 0 && seen > test.limit {
+					return errors.New("too large")
+				}
+				return nil
+			}))
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			resp, err := client.Get(test.url)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if test.limit > 0 {
+				assert.Error(t, err)
+				assert.Less(t, len(body), len(payload))
+				assert.Equal(t, 0, eofs)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, payload, body)
+			assert.Equal(t, expected[:], digest.Sum(nil))
+			assert.Equal(t, 1, eofs)
+			assert.Less(t, largest, len(payload))
+		})
+	}
+}
+
+func TestInspectRequestBody(t *testing.T) {
+	var received atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	var seen atomic.Int64
+	proxy.OnRequest().Do(goproxy.InspectRequestBody(func(chunk []byte, eof bool, ctx *goproxy.ProxyCtx) error {
+		seen.Add(int64(len(chunk)))
+		if bytes.Contains(chunk, []byte("EICAR")) {
+			return errors.New("malware")
+		}
+		return nil
+	}))
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	upload := strings.Repeat("a", 256*1024)
+	resp, err := client.Post(backend.URL, "text/plain", strings.NewReader(upload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(upload)), seen.Load())
+	assert.Equal(t, int64(len(upload)), received.Load())
+
+	received.Store(0)
+	resp, err = client.Post(backend.URL, "text/plain", strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, int64(0), received.Load())
+}
@@ -0,0 +1,222 @@
+package http1parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Fixup is a set of protocol violations tolerated by ReadLenientResponse.
+type Fixup uint
+
+const (
+	// FixupMissingReason means that the status line had no reason phrase.
+	FixupMissingReason Fixup = 1 << iota
+	// FixupBareLF means that a line was terminated by LF instead of CRLF.
+	FixupBareLF
+	// FixupMalformedStatusLine means that the status line had to be
+	// normalized (lowercase protocol, extra spaces, ...).
+	FixupMalformedStatusLine
+	// FixupMalformedHeader means that invalid header lines were dropped.
+	FixupMalformedHeader
+	// FixupInvalidContentLength means that an invalid or conflicting
+	// Content-Length was dropped, and the body read until EOF.
+	FixupInvalidContentLength
+	// FixupTruncatedBody means that the connection was closed before the
+	// end of the announced body.
+	FixupTruncatedBody
+)
+
+var ErrMalformedResponse = errors.New("malformed HTTP response")
+
+// ReadLenientResponse reads an HTTP/1.x response from r like
+// http.ReadResponse, but tolerates common violations of the protocol made
+// by broken servers. onFixup is called with the violations that have been
+// fixed, possibly after ReadLenientResponse returned, while the body is read.
+// Data is never read past the end of the response, so r can be used to
+// read the next response on the same connection.
+func ReadLenientResponse(r *bufio.Reader, req *http.Request, onFixup func(Fixup)) (*http.Response, error) {
+	line, err := readLine(r, onFixup)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{Request: req, Header: make(http.Header)}
+	proto, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	rest = strings.TrimLeft(rest, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if upper := strings.ToUpper(proto); upper != proto || strings.Contains(line, "  ") {
+		onFixup(FixupMalformedStatusLine)
+		proto = upper
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok || major != 1 {
+		return nil, fmt.Errorf("%w: bad status line %q", ErrMalformedResponse, line)
+	}
+	resp.StatusCode, err = strconv.Atoi(code)
+	if err != nil || len(code) != 3 || resp.StatusCode < 100 {
+		return nil, fmt.Errorf("%w: bad status code %q", ErrMalformedResponse, code)
+	}
+	if reason = strings.TrimSpace(reason); reason == "" {
+		onFixup(FixupMissingReason)
+		reason = http.StatusText(resp.StatusCode)
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = proto, major, minor
+	resp.Status = code + " " + reason
+
+	var lastKey string
+	for {
+		line, err := readLine(r, onFixup)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Obsolete line folding, append it to the previous value
+			if lastKey == "" {
+				onFixup(FixupMalformedHeader)
+				continue
+			}
+			values := resp.Header[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			onFixup(FixupMalformedHeader)
+			lastKey = ""
+			continue
+		}
+		lastKey = textproto.CanonicalMIMEHeaderKey(k)
+		resp.Header.Add(lastKey, strings.TrimSpace(v))
+	}
+
+	resp.Close = headerHasToken(resp.Header, "Connection", "close") ||
+		(resp.ProtoMinor == 0 && !headerHasToken(resp.Header, "Connection", "keep-alive"))
+
+	if !hasBody(req, resp.StatusCode) {
+		resp.Body = http.NoBody
+		return resp, nil
+	}
+
+	if headerHasToken(resp.Header, "Transfer-Encoding", "chunked") {
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = []string{"chunked"}
+		resp.ContentLength = -1
+		resp.Body = &lenientBody{r: httputil.NewChunkedReader(r), trailer: r, onFixup: onFixup, remaining: -1}
+		return resp, nil
+	}
+
+	resp.ContentLength = -1
+	if values := resp.Header.Values("Content-Length"); len(values) > 0 {
+		length, ok := parseContentLength(values)
+		if ok {
+			resp.ContentLength = length
+		} else {
+			onFixup(FixupInvalidContentLength)
+			resp.Header.Del("Content-Length")
+		}
+	}
+	if resp.ContentLength >= 0 {
+		resp.Body = &lenientBody{r: io.LimitReader(r, resp.ContentLength), onFixup: onFixup, remaining: resp.ContentLength}
+	} else {
+		// Close delimited body
+		resp.Close = true
+		resp.Body = &lenientBody{r: r, onFixup: onFixup, remaining: -1}
+	}
+	return resp, nil
+}
+
+// readLine reads a CRLF or LF terminated line, without the terminator.
+func readLine(r *bufio.Reader, onFixup func(Fixup)) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if strings.HasSuffix(line, "\r\n") {
+		return line[:len(line)-2], nil
+	}
+	onFixup(FixupBareLF)
+	return line[:len(line)-1], nil
+}
+
+func hasBody(req *http.Request, code int) bool {
+	if req != nil && req.Method == http.MethodHead {
+		return false
+	}
+	return !(code >= 100 && code < 200) && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// parseContentLength accepts repeated values only when they are identical.
+func parseContentLength(values []string) (int64, bool) {
+	var length int64 = -1
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil || n < 0 || (length >= 0 && n != length) {
+				return -1, false
+			}
+			length = n
+		}
+	}
+	return length, length >= 0
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lenientBody turns a premature end of the body into a normal EOF.
+type lenientBody struct {
+	r         io.Reader
+	trailer   *bufio.Reader
+	onFixup   func(Fixup)
+	remaining int64
+}
+
+func (b *lenientBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		b.onFixup(FixupTruncatedBody)
+		err = io.EOF
+	case errors.Is(err, io.EOF) && b.remaining > 0:
+		b.onFixup(FixupTruncatedBody)
+		b.remaining = 0
+	case errors.Is(err, io.EOF) && b.trailer != nil:
+		// Discard the trailer section of a chunked body
+		for {
+			line, lineErr := readLine(b.trailer, b.onFixup)
+			if lineErr != nil || line == "" {
+				break
+			}
+		}
+		b.trailer = nil
+	}
+	return n, err
+}
+
+func (b *lenientBody) Close() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package http1parser_test
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy/internal/http1parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLenient(t *testing.T, data string, method string) (*http.Response, string, http1parser.Fixup, *bufio.Reader) {
+	t.Helper()
+	var fixups http1parser.Fixup
+	r := bufio.NewReader(strings.NewReader(data))
+	req, err := http.NewRequest(method, "http://example.com/", nil)
+	require.NoError(t, err)
+	resp, err := http1parser.ReadLenientResponse(r, req, func(f http1parser.Fixup) { fixups |= f })
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body), fixups, r
+}
+
+func TestReadLenientResponse_Valid(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello" +
+		"HTTP/1.1 204 No Content\r\n\r\n"
+
+	resp, body, fixups, r := readLenient(t, data, http.MethodGet)
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, "hello", body)
+	assert.Zero(t, fixups)
+
+	// The next response on the connection is untouched
+	next, err := http1parser.ReadLenientResponse(r, nil, func(http1parser.Fixup) {})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, next.StatusCode)
+}
+
+func TestReadLenientResponse_MissingReasonAndBareLF(t *testing.T) {
+	data := "http/1.1 404\n" +
+		"Content-Type: text/plain\n" +
+		"Invalid header line\n" +
+		"\n" +
+		"not found"
+
+	resp, body, fixups, _ := readLenient(t, data, http.MethodGet)
+	assert.Equal(t, "404 Not Found", resp.Status)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "not found", body)
+	assert.True(t, resp.Close)
+	assert.Equal(t, http1parser.FixupMissingReason|http1parser.FixupBareLF|
+		http1parser.FixupMalformedStatusLine|http1parser.FixupMalformedHeader, fixups)
+}
+
+func TestReadLenientResponse_InvalidContentLength(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 3\r\n" +
+		"Content-Length: 12\r\n" +
+		"\r\n" +
+		"hello world!"
+
+	resp, body, fixups, _ := readLenient(t, data, http.MethodGet)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Equal(t, "hello world!", body)
+	assert.Equal(t, http1parser.FixupInvalidContentLength, fixups)
+}
+
+func TestReadLenientResponse_TruncatedBody(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 100\r\n" +
+		"\r\n" +
+		"short"
+
+	_, body, fixups, _ := readLenient(t, data, http.MethodGet)
+	assert.Equal(t, "short", body)
+	assert.Equal(t, http1parser.FixupTruncatedBody, fixups)
+}
+
+func TestReadLenientResponse_Chunked(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+
+	_, body, fixups, r := readLenient(t, data, http.MethodGet)
+	assert.Equal(t, "hello", body)
+	assert.Zero(t, fixups)
+
+	next, err := http1parser.ReadLenientResponse(r, nil, func(http1parser.Fixup) {})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), next.ContentLength)
+}
+
+func TestReadLenientResponse_Head(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 100\r\n" +
+		"\r\n"
+
+	resp, body, fixups, _ := readLenient(t, data, http.MethodHead)
+	assert.Equal(t, "100", resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+	assert.Zero(t, fixups)
+}
+
+func TestReadLenientResponse_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 abc OK\r\n\r\n",
+		"garbage\r\n\r\n",
+	} {
+		r := bufio.NewReader(strings.NewReader(data))
+		_, err := http1parser.ReadLenientResponse(r, nil, func(http1parser.Fixup) {})
+		require.ErrorIs(t, err, http1parser.ErrMalformedResponse, data)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"golang.org/x/net/idna"
 )
 
 const _goproxySignerVersion = ":goproxy2"
@@ -31,7 +33,76 @@ func hashSorted(lst []string) []byte {
 	return h.Sum(nil)
 }
 
+// KeyType is the key algorithm of the generated leaf certificates.
+type KeyType int
+
+const (
+	// KeyTypeAuto uses the algorithm of the CA key.
+	KeyTypeAuto KeyType = iota
+	KeyTypeRSA
+	KeyTypeECDSA
+	KeyTypeEd25519
+)
+
 func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+	return SignHostWithKeyType(ca, hosts, KeyTypeAuto)
+}
+
+func SignHostWithKeyType(ca tls.Certificate, hosts []string, keyType KeyType) (cert *tls.Certificate, err error) {
+	return SignHostWithOptions(ca, hosts, Options{KeyType: keyType})
+}
+
+// Options are the optional settings of the generated leaf certificates.
+type Options struct {
+	KeyType KeyType
+	// OCSPServers and CRLDistributionPoints are the revocation URLs
+	// embedded in the certificates.
+	OCSPServers           []string
+	CRLDistributionPoints []string
+	// Backdate and Validity set the validity window of the certificates,
+	// 30 days before and 365 days after now if zero.
+	Backdate time.Duration
+	Validity time.Duration
+	// Organization is the organization of the certificate subject.
+	Organization []string
+	// KeyUsage and ExtKeyUsage replace the default key usages.
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	// IPAddressesAsDNSNames also lists the IP addresses as DNS names, for
+	// the clients that don't match the IP address SANs.
+	IPAddressesAsDNSNames bool
+	// OmitCommonName leaves the common name of the subject empty.
+	OmitCommonName bool
+}
+
+// NormalizeHost returns the form of host used in the certificates: IP
+// addresses without brackets nor IPv6 zone, which can't be certified, and
+// lower case host names with their internationalized labels converted to
+// punycode.
+func NormalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if addr, _, ok := strings.Cut(host, "%"); ok && net.ParseIP(addr) != nil {
+		return addr
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	wildcard := strings.HasPrefix(host, "*.")
+	if wildcard {
+		host = host[2:]
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	if wildcard {
+		host = "*." + host
+	}
+	return host
+}
+
+func SignHostWithOptions(ca tls.Certificate, hosts []string, opts Options) (cert *tls.Certificate, err error) {
+	keyType := opts.KeyType
 	// Use the provided CA for certificate generation.
 	// Use already parsed Leaf certificate when present.
 	x509ca := ca.Leaf
@@ -44,6 +115,20 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	now := time.Now()
 	start := now.Add(-30 * 24 * time.Hour) // -30 days
 	end := now.Add(365 * 24 * time.Hour)   // 365 days
+	if opts.Backdate != 0 {
+		start = now.Add(-opts.Backdate)
+	}
+	if opts.Validity != 0 {
+		end = now.Add(opts.Validity)
+	}
+	organization := []string{"GoProxy untrusted MITM proxy Inc"}
+	if opts.Organization != nil {
+		organization = opts.Organization
+	}
+	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if opts.ExtKeyUsage != nil {
+		extKeyUsage = opts.ExtKeyUsage
+	}
 
 	// Always generate a positive int value
 	// (Two complement is not enabled when the first bit is 0)
@@ -54,23 +139,55 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		SerialNumber: big.NewInt(int64(generated)),
 		Issuer:       x509ca.Subject,
 		Subject: pkix.Name{
-			Organization: []string{"GoProxy untrusted MITM proxy Inc"},
+			Organization: organization,
 		},
 		NotBefore: start,
 		NotAfter:  end,
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           extKeyUsage,
 		BasicConstraintsValid: true,
+
+		OCSPServer:            opts.OCSPServers,
+		CRLDistributionPoints: opts.CRLDistributionPoints,
 	}
 	for _, h := range hosts {
+		h = NormalizeHost(h)
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
+			if opts.IPAddressesAsDNSNames {
+				template.DNSNames = append(template.DNSNames, h)
+			}
 		} else {
 			template.DNSNames = append(template.DNSNames, h)
 			template.Subject.CommonName = h
 		}
 	}
+	if opts.OmitCommonName {
+		template.Subject.CommonName = ""
+	}
+
+	if keyType == KeyTypeAuto {
+		switch ca.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			keyType = KeyTypeRSA
+		case *ecdsa.PrivateKey:
+			keyType = KeyTypeECDSA
+		case ed25519.PrivateKey:
+			keyType = KeyTypeEd25519
+		default:
+			return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+		}
+	} else {
+		// Don't reuse the key generated for another algorithm
+		hosts = append(hosts[:len(hosts):len(hosts)], fmt.Sprintf(":key%d", keyType))
+	}
+	if opts.KeyUsage != 0 {
+		template.KeyUsage = opts.KeyUsage
+	} else if keyType != KeyTypeRSA {
+		// Key encipherment is only used by RSA key exchanges
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
 
 	hash := hashSorted(append(hosts, _goproxySignerVersion, ":"+runtime.Version()))
 	var csprng CounterEncryptorRand
@@ -79,21 +196,21 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	}
 
 	var certpriv crypto.Signer
-	switch ca.PrivateKey.(type) {
-	case *rsa.PrivateKey:
+	switch keyType {
+	case KeyTypeRSA:
 		if certpriv, err = rsa.GenerateKey(&csprng, 2048); err != nil {
 			return nil, err
 		}
-	case *ecdsa.PrivateKey:
+	case KeyTypeECDSA:
 		if certpriv, err = ecdsa.GenerateKey(elliptic.P256(), &csprng); err != nil {
 			return nil, err
 		}
-	case ed25519.PrivateKey:
+	case KeyTypeEd25519:
 		if _, certpriv, err = ed25519.GenerateKey(&csprng); err != nil {
 			return nil, err
 		}
 	default:
-		return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+		return nil, fmt.Errorf("unsupported key type %d", keyType)
 	}
 
 	derBytes, err := x509.CreateCertificate(&csprng, &template, x509ca, certpriv.Public(), ca.PrivateKey)
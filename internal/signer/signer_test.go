@@ -111,6 +111,46 @@ func TestSignerEcdsaX509(t *testing.T) {
 	testSignerX509(t, EcdsaCa)
 }
 
+func TestSignerKeyTypes(t *testing.T) {
+	testCases := []struct {
+		keyType signer.KeyType
+		key     x509.PublicKeyAlgorithm
+	}{
+		{signer.KeyTypeAuto, x509.RSA},
+		{signer.KeyTypeRSA, x509.RSA},
+		{signer.KeyTypeECDSA, x509.ECDSA},
+		{signer.KeyTypeEd25519, x509.Ed25519},
+	}
+	for _, tc := range testCases {
+		cert, err := signer.SignHostWithKeyType(goproxy.GoproxyCa, []string{"example.com"}, tc.keyType)
+		orFatal(t, "SignHostWithKeyType", err)
+		if cert.Leaf.PublicKeyAlgorithm != tc.key {
+			t.Errorf("Expected %v key for key type %d, got %v", tc.key, tc.keyType, cert.Leaf.PublicKeyAlgorithm)
+		}
+		certpool := x509.NewCertPool()
+		certpool.AddCert(goproxy.GoproxyCa.Leaf)
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: certpool})
+		orFatal(t, "Verify", err)
+	}
+}
+
+func TestSignerHostNames(t *testing.T) {
+	cert, err := signer.SignHost(goproxy.GoproxyCa, []string{"[fe80::1%eth0]", "2001:db8::1", "Bücher.Example.", "*.bücher.example"})
+	orFatal(t, "SignHost", err)
+	var ips []string
+	for _, ip := range cert.Leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	if strings.Join(ips, ",") != "fe80::1,2001:db8::1" {
+		t.Errorf("Unexpected IP addresses %v", ips)
+	}
+	if names := strings.Join(cert.Leaf.DNSNames, ","); names != "xn--bcher-kva.example,*.xn--bcher-kva.example" {
+		t.Errorf("Unexpected DNS names %s", names)
+	}
+	orFatal(t, "VerifyHostname", cert.Leaf.VerifyHostname("www.xn--bcher-kva.example"))
+	orFatal(t, "VerifyHostname", cert.Leaf.VerifyHostname("fe80::1"))
+}
+
 func BenchmarkSignRsa(b *testing.B) {
 	var cert *tls.Certificate
 	var err error
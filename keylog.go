@@ -0,0 +1,62 @@
+package goproxy
+
+import (
+	"crypto/tls"
+)
+
+// applyUpstreamTLSOptions makes the requests sent through Tr log their TLS
+// keys to KeyLogWriter, resume their sessions from UpstreamSessionCache,
+// follow UpstreamTLSPolicy and check UpstreamPins. It's called once, before
+// the first request is handled.
+func (proxy *ProxyHttpServer) applyUpstreamTLSOptions() {
+	if proxy.Tr == nil || (proxy.KeyLogWriter == nil && proxy.UpstreamSessionCache == nil && proxy.UpstreamTLSPolicy == nil && proxy.UpstreamPins == nil) {
+		return
+	}
+	config := proxy.Tr.TLSClientConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.KeyLogWriter == nil {
+		config.KeyLogWriter = proxy.KeyLogWriter
+	}
+	if config.ClientSessionCache == nil && proxy.UpstreamSessionCache != nil {
+		config.ClientSessionCache = proxy.UpstreamSessionCache
+	}
+	proxy.Tr.TLSClientConfig = proxy.withUpstreamPins(proxy.UpstreamTLSPolicy.apply(config), "")
+}
+
+// withKeyLog returns config logging its TLS keys to KeyLogWriter.
+func (proxy *ProxyHttpServer) withKeyLog(config *tls.Config) *tls.Config {
+	if proxy.KeyLogWriter == nil || config.KeyLogWriter != nil {
+		return config
+	}
+	config = config.Clone()
+	config.KeyLogWriter = proxy.KeyLogWriter
+	return config
+}
+
+// clientTLSConfig returns the configuration of the TLS connections with
+// the MITM'd clients connecting to host.
+func (proxy *ProxyHttpServer) clientTLSConfig(ctx *ProxyCtx, host string, config *tls.Config) *tls.Config {
+	config = proxy.withKeyLog(proxy.ClientTLSRecords.config(config))
+	config = proxy.clientTLSPolicy(stripPort(host), ctx).apply(config)
+	if proxy.MitmClientAuth != tls.NoClientCert {
+		config = config.Clone()
+		config.ClientAuth = proxy.MitmClientAuth
+		config.ClientCAs = proxy.MitmClientCAs
+	}
+	return config
+}
+
+// upstreamTLSConfig returns the configuration of the TLS connections
+// opened by the proxy.
+func (proxy *ProxyHttpServer) upstreamTLSConfig(ctx *ProxyCtx, config *tls.Config) *tls.Config {
+	config = proxy.withKeyLog(proxy.UpstreamTLSRecords.config(config))
+	policy, _ := proxy.upstreamTLSPolicy(config.ServerName, ctx)
+	config = policy.apply(config)
+	if proxy.UpstreamSessionCache != nil && config.ClientSessionCache == nil {
+		config = config.Clone()
+		config.ClientSessionCache = proxy.UpstreamSessionCache
+	}
+	return config
+}
@@ -0,0 +1,52 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	keyLog := &syncBuffer{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.KeyLogWriter = keyLog
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+
+	// Both the client and the upstream handshakes are logged, each under
+	// its own client random
+	randoms := make(map[string]bool)
+	for _, line := range strings.Split(keyLog.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && strings.HasPrefix(fields[0], "CLIENT_") {
+			randoms[fields[1]] = true
+		}
+	}
+	assert.Len(t, randoms, 2)
+}
@@ -0,0 +1,163 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	"github.com/elazarl/goproxy/internal/http1parser"
+)
+
+// ResponseFixup is a set of protocol violations of a remote server response
+// that have been tolerated when ProxyHttpServer.LenientResponseParsing is
+// enabled, see ProxyCtx.ResponseFixups.
+type ResponseFixup uint
+
+const (
+	// FixupMissingReason means that the status line had no reason phrase.
+	FixupMissingReason = ResponseFixup(http1parser.FixupMissingReason)
+	// FixupBareLF means that lines were terminated by LF instead of CRLF.
+	FixupBareLF = ResponseFixup(http1parser.FixupBareLF)
+	// FixupMalformedStatusLine means that the status line was normalized.
+	FixupMalformedStatusLine = ResponseFixup(http1parser.FixupMalformedStatusLine)
+	// FixupMalformedHeader means that invalid header lines were dropped.
+	FixupMalformedHeader = ResponseFixup(http1parser.FixupMalformedHeader)
+	// FixupInvalidContentLength means that an invalid or conflicting
+	// Content-Length was ignored, and the body was read until the
+	// connection was closed.
+	FixupInvalidContentLength = ResponseFixup(http1parser.FixupInvalidContentLength)
+	// FixupTruncatedBody means that the connection was closed before the
+	// end of the announced body.
+	FixupTruncatedBody = ResponseFixup(http1parser.FixupTruncatedBody)
+)
+
+func (ctx *ProxyCtx) addFixup(f http1parser.Fixup) {
+	ctx.ResponseFixups |= ResponseFixup(f)
+}
+
+// parseResponse reads a single response from remote, using the lenient
+// parser if it's enabled.
+func (proxy *ProxyHttpServer) parseResponse(remote *bufio.Reader, req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	if proxy.LenientResponseParsing {
+		return http1parser.ReadLenientResponse(remote, req, ctx.addFixup)
+	}
+	return http.ReadResponse(remote, req)
+}
+
+// lenientRoundTrip sends req over a new connection to the remote server,
+// that is used for this single request, and parses the response with the
+// lenient parser.
+// The connection goes through the upstream proxy of the request, if any,
+// tunneled with CONNECT even for plain http requests.
+func (proxy *ProxyHttpServer) lenientRoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	addr := req.URL.Host
+	if !hasPort.MatchString(addr) {
+		if req.URL.Scheme == "https" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	conn, err := proxy.lenientDial(ctx, req, addr)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		tlsConfig := tlsClientSkipVerify
+		if proxy.Tr != nil && proxy.Tr.TLSClientConfig != nil {
+			tlsConfig = proxy.Tr.TLSClientConfig
+		}
+		// The lenient parser only speaks HTTP/1.x
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tlsConn, err := proxy.initializeTLSconnection(ctx, conn, tlsConfig, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.Close = true
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- outReq.Write(conn)
+	}()
+
+	trace := httptrace.ContextClientTrace(req.Context())
+	remote := bufio.NewReader(conn)
+	for {
+		resp, err := proxy.parseResponse(remote, req, ctx)
+		if err != nil {
+			conn.Close()
+			select {
+			case werr := <-writeErr:
+				if werr != nil {
+					return nil, werr
+				}
+			default:
+			}
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode < 100 {
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				state := tlsConn.ConnectionState()
+				resp.TLS = &state
+			}
+			resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+			return resp, nil
+		}
+		if trace != nil {
+			if resp.StatusCode == http.StatusContinue && trace.Got100Continue != nil {
+				trace.Got100Continue()
+			}
+			if trace.Got1xxResponse != nil {
+				if err := trace.Got1xxResponse(resp.StatusCode, textproto.MIMEHeader(resp.Header)); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+		}
+	}
+}
+
+// lenientDial opens the connection of lenientRoundTrip, like the CONNECT
+// tunnels, falling back to the proxy of Tr when nothing else picks the
+// upstream.
+func (proxy *ProxyHttpServer) lenientDial(ctx *ProxyCtx, req *http.Request, addr string) (net.Conn, error) {
+	if ctx.UpstreamProxy == nil && proxy.SelectUpstream == nil && proxy.Upstreams == nil &&
+		proxy.ConnectDial == nil && proxy.ConnectDialWithReq == nil &&
+		proxy.Tr != nil && proxy.Tr.Proxy != nil {
+		u, err := proxy.Tr.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return proxy.dialUpstreamProxy(ctx, u, "tcp", addr)
+		}
+	}
+	return proxy.connectDial(ctx, "tcp", addr)
+}
+
+// connBody closes the connection of a single use response with its body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	once sync.Once
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if cerr := b.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,99 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenServer answers every connection with the raw response.
+func brokenServer(t *testing.T, response string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, response)
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestLenientResponseParsing(t *testing.T) {
+	url := brokenServer(t, "HTTP/1.1 200\n"+
+		"Content-Length: 2, 7\n"+
+		"\n"+
+		"lenient")
+
+	proxy := goproxy.NewProxyHttpServer()
+	fixups := make(chan goproxy.ResponseFixup, 1)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		fixups <- ctx.ResponseFixups
+		return resp
+	})
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	// Without the option, the response is rejected
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Zero(t, <-fixups)
+
+	proxy.LenientResponseParsing = true
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "lenient", string(body))
+	assert.Equal(t, goproxy.FixupMissingReason|goproxy.FixupBareLF|goproxy.FixupInvalidContentLength, <-fixups)
+}
+
+func TestLenientResponseParsingUpstreamProxy(t *testing.T) {
+	target := brokenServer(t, "HTTP/1.1 200\n"+
+		"\n"+
+		"lenient")
+	addr, hosts := upstreamSOCKS5(t)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.LenientResponseParsing = true
+	require.NoError(t, proxy.UseUpstreamProxy(&url.URL{
+		Scheme: "socks5",
+		User:   url.UserPassword("user", "secret"),
+		Host:   addr,
+	}))
+	var sent *http.Request
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		sent = req
+		return req, nil
+	})
+
+	assert.Equal(t, "lenient", getThroughProxy(t, proxy, target))
+	assert.Equal(t, strings.TrimPrefix(target, "http://"), <-hosts)
+	assert.False(t, sent.Close)
+}
@@ -0,0 +1,52 @@
+package goproxy
+
+import "net/http"
+
+// Next continues a middleware chain with req, eventually sending it to its
+// destination, see Middleware.
+type Next func(req *http.Request) (*http.Response, error)
+
+// Middleware wraps the exchanges of the requests with their destinations,
+// see ProxyHttpServer.Use. It calls next to continue the chain, and runs
+// code both before and after it, e.g. to time the exchange or to rewrite
+// the response. It aborts the exchange by returning a response, or an
+// error, without calling next.
+type Middleware interface {
+	Intercept(req *http.Request, ctx *ProxyCtx, next Next) (*http.Response, error)
+}
+
+// MiddlewareFunc is a function implementing Middleware.
+type MiddlewareFunc func(req *http.Request, ctx *ProxyCtx, next Next) (*http.Response, error)
+
+func (f MiddlewareFunc) Intercept(req *http.Request, ctx *ProxyCtx, next Next) (*http.Response, error) {
+	return f(req, ctx, next)
+}
+
+// Use appends middlewares to the chain wrapping the exchanges of the
+// plain HTTP and MITM'd requests with their destinations. They're called
+// in order, the first one being the outermost, after the OnRequest
+// handlers and before the OnResponse handlers, which get the response of
+// the chain. Unlike the handlers, a middleware runs around the exchange:
+//
+//	proxy.Use(goproxy.MiddlewareFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.Next) (*http.Response, error) {
+//		start := time.Now()
+//		resp, err := next(req)
+//		ctx.Logf("%s took %v", req.URL, time.Since(start))
+//		return resp, err
+//	}))
+//
+// Use must be called before serving requests.
+func (proxy *ProxyHttpServer) Use(middlewares ...Middleware) {
+	proxy.middlewares = append(proxy.middlewares, middlewares...)
+}
+
+// next returns the Next continuing the middleware chain of the proxy from
+// its i-th middleware.
+func (ctx *ProxyCtx) next(i int) Next {
+	if i == len(ctx.Proxy.middlewares) {
+		return ctx.exchange
+	}
+	return func(req *http.Request) (*http.Response, error) {
+		return ctx.Proxy.middlewares[i].Intercept(req, ctx, ctx.next(i+1))
+	}
+}
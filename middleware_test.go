@@ -0,0 +1,100 @@
+package goproxy_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var calls []string
+	record := func(name string) goproxy.Middleware {
+		return goproxy.MiddlewareFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.Next) (*http.Response, error) {
+			calls = append(calls, name+" before")
+			resp, err := next(req)
+			calls = append(calls, name+" after")
+			return resp, err
+		})
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		calls = append(calls, "request handler")
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp != nil {
+			calls = append(calls, "response handler "+resp.Header.Get("X-Middleware"))
+		}
+		return resp
+	})
+	proxy.Use(record("outer"), record("inner"))
+	proxy.Use(goproxy.MiddlewareFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.Next) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/abort":
+			return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTeapot, "aborted"), nil
+		case "/error":
+			return nil, errors.New("aborted")
+		}
+		req.URL.Path = "/bobo"
+		resp, err := next(req)
+		if err == nil {
+			resp.Header.Set("X-Middleware", "wrapped")
+		}
+		return resp, err
+	}))
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/rewritten", http.StatusOK, "bobo"},
+		{"/abort", http.StatusTeapot, "aborted"},
+		{"/error", http.StatusInternalServerError, "aborted\n"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			calls = nil
+			resp, err := client.Get(srv.URL + test.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.status, resp.StatusCode)
+			assert.Equal(t, test.body, string(body))
+			expected := []string{"request handler", "outer before", "inner before", "inner after", "outer after"}
+			if test.status == http.StatusOK {
+				expected = append(expected, "response handler wrapped")
+			} else if test.status == http.StatusTeapot {
+				expected = append(expected, "response handler ")
+			}
+			assert.Equal(t, expected, calls)
+		})
+	}
+}
+
+func TestMiddlewareMitm(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var urls []string
+	proxy.Use(goproxy.MiddlewareFunc(func(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.Next) (*http.Response, error) {
+		urls = append(urls, req.URL.String())
+		return next(req)
+	}))
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", string(body))
+	assert.Equal(t, []string{https.URL + "/bobo"}, urls)
+}
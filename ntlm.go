@@ -0,0 +1,256 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLMUpstreamAuth returns an UpstreamHandshake answering the NTLM
+// challenges with NTLMv2 responses, computed with the credentials returned
+// by credentials for the proxy. The user info of the proxy URL, such as
+// `CORP\user:password`, is used when credentials is nil or has none.
+func NTLMUpstreamAuth(credentials func(proxyURL *url.URL) (domain, user, password string, ok bool)) UpstreamHandshake {
+	return &upstreamHandshake{scheme: "NTLM", start: func(proxyURL *url.URL) (UpstreamHandshakeSession, error) {
+		var domain, user, password string
+		ok := false
+		if credentials != nil {
+			domain, user, password, ok = credentials(proxyURL)
+		}
+		if !ok && proxyURL.User != nil {
+			user = proxyURL.User.Username()
+			password, _ = proxyURL.User.Password()
+			if d, u, found := strings.Cut(user, `\`); found {
+				domain, user = d, u
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, nil
+		}
+		return &ntlmSession{domain: domain, user: user, password: password}, nil
+	}}
+}
+
+// The NTLM negotiation flags, see MS-NLMP 2.2.2.5.
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiateKeyExch                 = 0x40000000
+	ntlmNegotiate56                      = 0x80000000
+)
+
+// ntlmAvTimestamp is the AV pair holding the time of the server.
+const ntlmAvTimestamp = 7
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+type ntlmSession struct {
+	domain, user, password string
+
+	now  func() time.Time
+	rand io.Reader
+}
+
+// Next returns the NEGOTIATE message, then the AUTHENTICATE message
+// answering the CHALLENGE message of the proxy.
+func (s *ntlmSession) Next(challenge []byte) ([]byte, bool, error) {
+	if challenge == nil {
+		return ntlmNegotiateMessage(), false, nil
+	}
+	msg, err := s.authenticateMessage(challenge)
+	return msg, true, err
+}
+
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateUnicode|ntlmNegotiateOEM|ntlmRequestTarget|
+		ntlmNegotiateNTLM|ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSessionSecurity|
+		ntlmNegotiateTargetInfo|ntlmNegotiate128|ntlmNegotiate56)
+	return msg
+}
+
+// ntlmField returns the payload described by the field at offset of msg.
+func ntlmField(msg []byte, offset int) ([]byte, error) {
+	if len(msg) < offset+8 {
+		return nil, errors.New("truncated NTLM message")
+	}
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start > len(msg) || length > len(msg)-start {
+		return nil, errors.New("invalid NTLM message field")
+	}
+	return msg[start : start+length], nil
+}
+
+func (s *ntlmSession) authenticateMessage(challenge []byte) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:]) &^ ntlmNegotiateKeyExch
+	serverChallenge := challenge[24:32]
+	var targetInfo []byte
+	if len(challenge) >= 48 {
+		var err error
+		if targetInfo, err = ntlmField(challenge, 40); err != nil {
+			return nil, err
+		}
+	}
+
+	random := s.rand
+	if random == nil {
+		random = rand.Reader
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := io.ReadFull(random, clientChallenge); err != nil {
+		return nil, err
+	}
+	timestamp := ntlmAvPair(targetInfo, ntlmAvTimestamp)
+	if timestamp == nil {
+		now := time.Now
+		if s.now != nil {
+			now = s.now
+		}
+		// FILETIME: 100ns intervals since January 1, 1601
+		timestamp = binary.LittleEndian.AppendUint64(nil, uint64(now().UnixNano()/100+116444736000000000))
+	}
+	hash := ntlmV2Hash(s.domain, s.user, s.password)
+	ntResponse, lmResponse := ntlmV2Responses(hash, serverChallenge, clientChallenge, timestamp, targetInfo)
+	if ntlmAvPair(targetInfo, ntlmAvTimestamp) != nil {
+		// The LMv2 response is omitted when the server sent its time
+		lmResponse = make([]byte, 24)
+	}
+
+	encode := func(s string) []byte {
+		if flags&ntlmNegotiateUnicode != 0 {
+			return utf16LE(s)
+		}
+		return []byte(s)
+	}
+	fields := [][]byte{lmResponse, ntResponse, encode(s.domain), encode(s.user), nil, nil}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+	return msg, nil
+}
+
+// ntlmAvPair returns the value of the AV pair id of targetInfo, or nil.
+func ntlmAvPair(targetInfo []byte, id uint16) []byte {
+	for len(targetInfo) >= 4 {
+		pairID := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if pairID == 0 || len(targetInfo) < 4+length {
+			return nil
+		}
+		if pairID == id {
+			return targetInfo[4 : 4+length]
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil
+}
+
+// ntlmV2Hash returns the NTOWFv2 of the credentials, see MS-NLMP 3.3.2.
+func ntlmV2Hash(domain, user, password string) []byte {
+	mac := hmac.New(md5.New, md4Sum(utf16LE(password)))
+	mac.Write(utf16LE(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Responses returns the NTLMv2 and LMv2 responses to serverChallenge.
+func ntlmV2Responses(hash, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	blob := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, hash)
+	mac.Write(serverChallenge)
+	mac.Write(blob)
+	nt = append(mac.Sum(nil), blob...)
+
+	mac.Reset()
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lm = append(mac.Sum(nil), clientChallenge...)
+	return nt, lm
+}
+
+func utf16LE(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], unit)
+	}
+	return b
+}
+
+// md4Sum returns the MD4 digest of data (RFC 1320), that NTLM still uses.
+func md4Sum(data []byte) []byte {
+	msg := append(append([]byte(nil), data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(data))*8)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	var x [16]uint32
+	for ; len(msg) > 0; msg = msg[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		for _, i := range [4]int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[i], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		for i := 0; i < 4; i++ {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range [4]int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+	sum := make([]byte, 16)
+	binary.LittleEndian.PutUint32(sum, a)
+	binary.LittleEndian.PutUint32(sum[4:], b)
+	binary.LittleEndian.PutUint32(sum[8:], c)
+	binary.LittleEndian.PutUint32(sum[12:], d)
+	return sum
+}
@@ -0,0 +1,73 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMD4(t *testing.T) {
+	// RFC 1320 A.5
+	for input, sum := range map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		assert.Equal(t, sum, hex.EncodeToString(md4Sum([]byte(input))), input)
+	}
+}
+
+func TestNTLMv2Responses(t *testing.T) {
+	// MS-NLMP 4.2.4
+	hash := ntlmV2Hash("Domain", "User", "Password")
+	assert.Equal(t, "0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(hash))
+
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	targetInfo := append(append([]byte{2, 0, 12, 0}, utf16LE("Domain")...), 1, 0, 12, 0)
+	targetInfo = append(append(targetInfo, utf16LE("Server")...), 0, 0, 0, 0)
+	nt, lm := ntlmV2Responses(hash, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	assert.Equal(t, "68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(nt[:16]))
+	assert.Equal(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa", hex.EncodeToString(lm))
+}
+
+func TestNTLMSession(t *testing.T) {
+	session := &ntlmSession{domain: "CORP", user: "user", password: "secret", rand: bytes.NewReader(make([]byte, 8))}
+	negotiate, done, err := session.Next(nil)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(negotiate[8:]))
+
+	// A CHALLENGE message with the time of the server
+	targetInfo := []byte{ntlmAvTimestamp, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0}
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateKeyExch)
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, targetInfo...)
+
+	authenticate, done, err := session.Next(challenge)
+	require.NoError(t, err)
+	assert.True(t, done)
+	field := func(offset int) []byte {
+		value, err := ntlmField(authenticate, offset)
+		require.NoError(t, err)
+		return value
+	}
+	// The LMv2 response is omitted, and the NTLMv2 one uses the server time
+	assert.Equal(t, make([]byte, 24), field(12))
+	assert.Equal(t, targetInfo[4:12], field(20)[24:32])
+	assert.Equal(t, targetInfo, field(20)[44:44+len(targetInfo)])
+	assert.Equal(t, utf16LE("CORP"), field(28))
+	assert.Equal(t, utf16LE("user"), field(36))
+	assert.Equal(t, uint32(ntlmNegotiateUnicode|ntlmNegotiateNTLM), binary.LittleEndian.Uint32(authenticate[60:]))
+
+	_, _, err = session.Next([]byte("NTLMSSP"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PinningBypass tunnels the connections to the hosts whose clients reject
+// the MITM certificates, usually because they pin the certificates of the
+// servers: the hosts are recorded when their clients fail the handshake,
+// or close the connection right after it without sending a request, and
+// the next CONNECT requests to them are tunneled instead of intercepted.
+//
+//	proxy.PinningBypass = goproxy.NewPinningBypass()
+//	proxy.PinningBypass.Add("pinned.example.com")
+type PinningBypass struct {
+	// TTL is how long a host is tunneled after being recorded, forever if
+	// zero.
+	TTL time.Duration
+	// Threshold is the number of consecutive rejected certificates after
+	// which a host is recorded. The rejections are forgotten after an
+	// hour without one.
+	Threshold int
+
+	mu       sync.Mutex
+	failures map[string]pinningFailures
+	hosts    map[string]time.Time
+}
+
+// maxPinningFailures bounds the number of hosts whose rejections are
+// counted by a PinningBypass, failureTTL is how long they are counted.
+const (
+	maxPinningFailures = 4096
+	failureTTL         = time.Hour
+)
+
+type pinningFailures struct {
+	count int
+	last  time.Time
+}
+
+// NewPinningBypass returns a PinningBypass recording the hosts after 2
+// rejected certificates, for 24 hours.
+func NewPinningBypass() *PinningBypass {
+	return &PinningBypass{TTL: 24 * time.Hour, Threshold: 2}
+}
+
+// Add records host, so that its connections are tunneled. It can be used
+// to seed the known pinned hosts.
+func (p *PinningBypass) Add(host string) {
+	var expires time.Time
+	if p.TTL > 0 {
+		expires = time.Now().Add(p.TTL)
+	}
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hosts == nil {
+		p.hosts = make(map[string]time.Time)
+	}
+	p.hosts[host] = expires
+	delete(p.failures, host)
+}
+
+// Remove forgets host, so that its connections are intercepted again.
+func (p *PinningBypass) Remove(host string) {
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.hosts, host)
+	delete(p.failures, host)
+}
+
+// Contains reports whether the connections to host are tunneled.
+func (p *PinningBypass) Contains(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expires, ok := p.hosts[host]
+	if ok && !expires.IsZero() && time.Now().After(expires) {
+		delete(p.hosts, host)
+		return false
+	}
+	return ok
+}
+
+// Hosts returns the recorded hosts, sorted.
+func (p *PinningBypass) Hosts() []string {
+	now := time.Now()
+	p.mu.Lock()
+	hosts := make([]string, 0, len(p.hosts))
+	for host, expires := range p.hosts {
+		if expires.IsZero() || now.Before(expires) {
+			hosts = append(hosts, host)
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(hosts)
+	return hosts
+}
+
+// action returns the action applied to a CONNECT request to host: a plain
+// tunnel if host is recorded, todo otherwise. When host is an IP address,
+// the server name sent by the client is checked too.
+func (p *PinningBypass) action(todo *ConnectAction, host string, ctx *ProxyCtx) *ConnectAction {
+	if p == nil || (todo.Action != ConnectMitm && todo.Action != ConnectAutoMitm) {
+		return todo
+	}
+	if p.Contains(host) {
+		ctx.Logf("Tunneling %s, its clients reject the MITM certificates", host)
+		return OkConnect
+	}
+	if net.ParseIP(stripPort(host)) == nil {
+		return todo
+	}
+	withSNI := *todo
+	bypass := todo.Bypass
+	withSNI.Bypass = func(serverName string, ctx *ProxyCtx) bool {
+		if serverName != "" && p.Contains(serverName) {
+			return true
+		}
+		return bypass != nil && bypass(serverName, ctx)
+	}
+	return &withSNI
+}
+
+// connectionDone records the outcome of a MITM'd connection to host,
+// rejected if the client aborted the handshake because of the certificate.
+func (p *PinningBypass) connectionDone(host string, rejected bool) {
+	if p == nil || host == "" {
+		return
+	}
+	host = strings.ToLower(host)
+	now := time.Now()
+	p.mu.Lock()
+	if !rejected {
+		delete(p.failures, host)
+		p.mu.Unlock()
+		return
+	}
+	if p.failures == nil {
+		p.failures = make(map[string]pinningFailures)
+	}
+	f, ok := p.failures[host]
+	if !ok && len(p.failures) >= maxPinningFailures {
+		p.evictFailures(now)
+	}
+	if now.Sub(f.last) > failureTTL {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	p.failures[host] = f
+	recorded := f.count >= p.Threshold
+	p.mu.Unlock()
+	if recorded {
+		p.Add(host)
+	}
+}
+
+// evictFailures forgets the expired rejections, or the oldest one if none
+// expired.
+func (p *PinningBypass) evictFailures(now time.Time) {
+	var oldest string
+	for host, f := range p.failures {
+		if now.Sub(f.last) > failureTTL {
+			delete(p.failures, host)
+		} else if oldest == "" || f.last.Before(p.failures[oldest].last) {
+			oldest = host
+		}
+	}
+	if len(p.failures) >= maxPinningFailures {
+		delete(p.failures, oldest)
+	}
+}
+
+// isCertificateRejection tells whether err is a handshake aborted by the
+// client with an alert about the certificate.
+func isCertificateRejection(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	// The received alerts are of an unexported uint8 type
+	alert := reflect.ValueOf(opErr.Err)
+	if alert.Kind() != reflect.Uint8 {
+		return false
+	}
+	switch alert.Uint() {
+	case 42, // bad_certificate
+		43, // unsupported_certificate
+		44, // certificate_revoked
+		45, // certificate_expired
+		46, // certificate_unknown
+		48: // unknown_ca
+		return true
+	}
+	return false
+}
+
+// pinningHost returns the host of a MITM'd connection, as sent by the
+// client if possible.
+func pinningHost(hello *ClientHello, host string) string {
+	if hello != nil && hello.ServerName != "" {
+		return hello.ServerName
+	}
+	return stripPort(host)
+}
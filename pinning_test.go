@@ -0,0 +1,88 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinningBypass(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.PinningBypass = goproxy.NewPinningBypass()
+	proxy.PinningBypass.Threshold = 1
+
+	_, s := oneShotProxy(proxy)
+	defer s.Close()
+	// The client only trusts the certificate of the server
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		DisableKeepAlives: true,
+	}}
+	get := func() error {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	require.Error(t, get())
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"127.0.0.1"}, proxy.PinningBypass.Hosts())
+	}, time.Second, 10*time.Millisecond)
+
+	// The host is tunneled from then on
+	require.NoError(t, get())
+
+	proxy.PinningBypass.Remove("127.0.0.1")
+	assert.Empty(t, proxy.PinningBypass.Hosts())
+	require.Error(t, get())
+}
+
+func TestPinningBypassIgnoresAbortedConnections(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.PinningBypass = goproxy.NewPinningBypass()
+	proxy.PinningBypass.Threshold = 1
+
+	_, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	// The client accepts the certificate, then closes the connection
+	// without sending a request
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	host := strings.TrimPrefix(https.URL, "https://")
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "127.0.0.1"})
+	require.NoError(t, tlsConn.Handshake())
+	require.NoError(t, tlsConn.Close())
+
+	assert.Never(t, func() bool {
+		return len(proxy.PinningBypass.Hosts()) > 0
+	}, 100*time.Millisecond, 10*time.Millisecond)
+}
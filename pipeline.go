@@ -0,0 +1,178 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy/internal/http1parser"
+)
+
+// maxDiscardedBody is the size of the unread part of a request body that
+// the proxy consumes to keep a client connection open, like net/http does.
+const maxDiscardedBody = 256 << 10
+
+// clientRequestBody wraps the body of a request read from a MITM client
+// connection. Closing it consumes what is left of the body, so that the
+// next request pipelined by the client can be read.
+type clientRequestBody struct {
+	io.ReadCloser
+	expectContinue bool
+	read           atomic.Bool
+	once           sync.Once
+	reusable       bool
+}
+
+func newClientRequestBody(req *http.Request) *clientRequestBody {
+	return &clientRequestBody{
+		ReadCloser:     req.Body,
+		expectContinue: headerContains(req.Header, "Expect", "100-continue"),
+	}
+}
+
+func (b *clientRequestBody) Read(p []byte) (int, error) {
+	b.read.Store(true)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *clientRequestBody) Close() error {
+	b.once.Do(func() {
+		if b.expectContinue && !b.read.Load() {
+			// The client is still waiting for 100 Continue before
+			// sending the body, the connection can't be reused
+			return
+		}
+		_, err := io.CopyN(io.Discard, b.ReadCloser, maxDiscardedBody+1)
+		b.reusable = errors.Is(err, io.EOF)
+	})
+	if !b.reusable {
+		// Closing the underlying body would read it until the end,
+		// the connection will be closed instead
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// finish closes the body, reporting whether the client connection can be
+// used to read another request.
+func (b *clientRequestBody) finish() bool {
+	_ = b.Close()
+	return b.reusable
+}
+
+// defaultMitmIdleTimeout is how long the MITM client connections wait
+// for the next request when the server of the proxy has no timeouts.
+const defaultMitmIdleTimeout = 2 * time.Minute
+
+// errClientIdle is returned by requestQueue.next when the client didn't
+// send its next request within the idle timeout.
+var errClientIdle = errors.New("client connection idle")
+
+// mitmIdleTimeout returns how long the MITM client connection of the
+// CONNECT request r waits for the next request: the IdleTimeout of the
+// http.Server serving r, or its ReadTimeout, like net/http does.
+func mitmIdleTimeout(r *http.Request) time.Duration {
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+		if srv.IdleTimeout > 0 {
+			return srv.IdleTimeout
+		}
+		if srv.ReadTimeout > 0 {
+			return srv.ReadTimeout
+		}
+	}
+	return defaultMitmIdleTimeout
+}
+
+// requestQueue holds the requests read from a MITM client connection.
+// The next request is read while the response to the previous one is
+// written, so that the requests pipelined by the client are queued and
+// answered in order, whenever they arrive. Once the response is written,
+// the client has the idle timeout to send its next request.
+type requestQueue struct {
+	reader   *http1parser.RequestReader
+	conn     net.Conn
+	idle     time.Duration
+	requests chan queuedRequest
+
+	mu sync.Mutex
+	// received tells whether the pending request was read, waiting tells
+	// whether its reading is bounded by the idle timeout
+	received bool
+	waiting  bool
+}
+
+type queuedRequest struct {
+	req  *http.Request
+	body *clientRequestBody
+	err  error
+}
+
+func newRequestQueue(reader *http1parser.RequestReader, conn net.Conn, idle time.Duration) *requestQueue {
+	q := &requestQueue{
+		reader:   reader,
+		conn:     conn,
+		idle:     idle,
+		requests: make(chan queuedRequest, 1),
+	}
+	q.readNext()
+	return q
+}
+
+// readNext reads the next request of the client in the background. It
+// must be called once the body of the previous request was consumed, and
+// only when the connection is kept open.
+func (q *requestQueue) readNext() {
+	q.mu.Lock()
+	q.received, q.waiting = false, false
+	q.mu.Unlock()
+	go func() {
+		req, err := q.reader.ReadRequest()
+		q.mu.Lock()
+		q.received = true
+		if q.waiting {
+			_ = q.conn.SetReadDeadline(time.Time{})
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = errClientIdle
+			}
+		}
+		q.mu.Unlock()
+		var body *clientRequestBody
+		if err == nil {
+			body = newClientRequestBody(req)
+			req.Body = body
+		}
+		q.requests <- queuedRequest{req: req, body: body, err: err}
+	}()
+}
+
+// next returns the next request of the client, its body, or the error
+// that interrupted its reading, io.EOF when the client closed the
+// connection and errClientIdle when it was idle for too long.
+func (q *requestQueue) next() (*http.Request, *clientRequestBody, error) {
+	q.mu.Lock()
+	if !q.received && q.idle > 0 {
+		q.waiting = true
+		_ = q.conn.SetReadDeadline(time.Now().Add(q.idle))
+	}
+	q.mu.Unlock()
+	queued := <-q.requests
+	return queued.req, queued.body, queued.err
+}
+
+// delimitResponse makes resp chunked when the length of its body is
+// unknown, so that the client of a connection kept open finds its end.
+func delimitResponse(resp *http.Response) {
+	if resp.ContentLength >= 0 || len(resp.TransferEncoding) > 0 ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) ||
+		(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return
+	}
+	resp.TransferEncoding = []string{"chunked"}
+}
@@ -0,0 +1,181 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMitmPipelinedRequests(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length, the proxy must delimit the response itself
+		_, _ = io.WriteString(w, r.URL.Path)
+		w.(http.Flusher).Flush()
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/canned")).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			// The request body is never read
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "canned")
+		})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	backendURL, _ := url.Parse(backend.URL)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+backendURL.Host+" HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	// Send all the requests at once, before reading any response
+	_, err = io.WriteString(tlsConn,
+		"GET /first HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n"+
+			"POST /canned HTTP/1.1\r\nHost: "+backendURL.Host+"\r\nContent-Length: 4\r\n\r\nbody"+
+			"GET /last HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(tlsConn)
+	for _, want := range []string{"/first", "canned", "/last"} {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err, want)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, want)
+		resp.Body.Close()
+		assert.Equal(t, want, string(body))
+	}
+}
+
+func TestMitmRequestAfterResponse(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+		w.(http.Flusher).Flush()
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	backendURL, _ := url.Parse(backend.URL)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+backendURL.Host+" HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	reader := bufio.NewReader(tlsConn)
+	// Each request is sent once the previous response was read
+	for _, path := range []string{"/first", "/second", "/third"} {
+		_, err = io.WriteString(tlsConn, "GET "+path+" HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+		require.NoError(t, err, path)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err, path)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, path)
+		resp.Body.Close()
+		assert.Equal(t, path, string(body))
+		assert.False(t, resp.Close, path)
+	}
+}
+
+func TestMitmKeepAlive(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	connects := 0
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		connects++
+		return goproxy.MitmConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := client.Get(backend.URL + path)
+		require.NoError(t, err, path)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, path)
+		resp.Body.Close()
+		assert.Equal(t, path, string(body))
+		assert.False(t, resp.Close, path)
+	}
+	// The second request reused the MITM connection of the first one
+	assert.Equal(t, 1, connects)
+}
+
+func TestMitmIdleTimeout(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewUnstartedServer(proxy)
+	s.Config.IdleTimeout = 100 * time.Millisecond
+	s.Start()
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	backendURL, _ := url.Parse(backend.URL)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+backendURL.Host+" HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	reader := bufio.NewReader(tlsConn)
+	_, err = io.WriteString(tlsConn, "GET /first HTTP/1.1\r\nHost: "+backendURL.Host+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.False(t, resp.Close)
+
+	// The proxy closes the connection once it has been idle for too long
+	_ = tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,232 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PolicyAction is the action of a PolicyRule.
+type PolicyAction int
+
+const (
+	// PolicyAllow lets the request through, to the following handlers.
+	PolicyAllow PolicyAction = iota
+	// PolicyDeny rejects the request with 403 Forbidden.
+	PolicyDeny
+	// PolicyTunnel relays the CONNECT requests without MITM.
+	PolicyTunnel
+	// PolicyMitm MITMs the CONNECT requests, for their requests to be
+	// evaluated too.
+	PolicyMitm
+)
+
+// PolicyRule matches the destinations of the requests. The empty
+// conditions match any destination.
+type PolicyRule struct {
+	// Name identifies the rule, e.g. in the logs.
+	Name string
+	// Hosts are the matched host names, as in UpstreamRoute.Hosts: exact
+	// names, "*.example.com" or networks, "10.0.0.0/8".
+	Hosts []string
+	// HostRegexp matches the host names.
+	HostRegexp *regexp.Regexp
+	// Ports are the matched ports.
+	Ports []int
+	// PathPrefix and PathRegexp match the paths of the requests, cleaned
+	// and unescaped. PathPrefix matches the path and its sub-paths: "/admin"
+	// and "/admin/" match "/admin" and "/admin/users", not "/administrator".
+	// The rules with a path condition don't match the CONNECT requests.
+	PathPrefix string
+	PathRegexp *regexp.Regexp
+	// Windows, if set, restrict the rule to some periods of the week,
+	// e.g. the working hours.
+	Windows []TimeWindow
+	Action  PolicyAction
+}
+
+// TimeWindow is a period recurring every week, see PolicyRule.Windows:
+//
+//	goproxy.TimeWindow{
+//		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+//		Start: 9 * time.Hour,
+//		End:   17*time.Hour + 30*time.Minute,
+//	}
+type TimeWindow struct {
+	// Days are the days the window starts, every day if empty.
+	Days []time.Weekday
+	// Start and End are the times of the day the window starts and ends,
+	// since midnight. The windows ending before they start span midnight,
+	// the ones starting and ending at midnight last the whole day.
+	Start, End time.Duration
+	// Location is the time zone of the window, the one of the clock of the
+	// policy if nil.
+	Location *time.Location
+}
+
+// Contains tells whether t is in the window.
+func (w *TimeWindow) Contains(t time.Time) bool {
+	if w.Location != nil {
+		t = t.In(w.Location)
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	elapsed := t.Sub(midnight)
+	switch {
+	case w.Start == w.End:
+		return w.onDay(t.Weekday())
+	case w.Start < w.End:
+		return w.onDay(t.Weekday()) && elapsed >= w.Start && elapsed < w.End
+	}
+	// The window spans midnight
+	return (w.onDay(t.Weekday()) && elapsed >= w.Start) ||
+		(w.onDay((t.Weekday()+6)%7) && elapsed < w.End)
+}
+
+// onDay tells whether the window starts on day.
+func (w *TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// match tells whether the rule matches the destination host and port, and
+// the path if it isn't a CONNECT request, at now.
+func (r *PolicyRule) match(host string, port int, path string, connect bool, now time.Time) bool {
+	if len(r.Windows) > 0 {
+		in := false
+		for i := range r.Windows {
+			in = in || r.Windows[i].Contains(now)
+		}
+		if !in {
+			return false
+		}
+	}
+	if len(r.Hosts) > 0 && !matchHosts(r.Hosts, host) {
+		return false
+	}
+	if r.HostRegexp != nil && !r.HostRegexp.MatchString(host) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, p := range r.Ports {
+			matched = matched || p == port
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.PathPrefix != "" || r.PathRegexp != nil {
+		if connect {
+			return false
+		}
+		path = cleanPath(path)
+		if _, ok := hasPathPrefix(path, r.PathPrefix); !ok || (r.PathRegexp != nil && !r.PathRegexp.MatchString(path)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy allows or denies the destinations of the requests with its rules,
+// the same ones for the plain requests, the CONNECT requests and their
+// MITM'd requests, and the WebSocket upgrades. It's both a ReqHandler and
+// an HttpsHandler:
+//
+//	policy := &goproxy.Policy{Rules: []goproxy.PolicyRule{
+//		{Hosts: []string{"*.bank.example"}, Action: goproxy.PolicyTunnel},
+//		{Hosts: []string{"10.0.0.0/8"}, Action: goproxy.PolicyDeny},
+//		{Hosts: []string{"api.example.com"}, PathPrefix: "/admin/", Action: goproxy.PolicyDeny},
+//		{Hosts: []string{"api.example.com"}, Action: goproxy.PolicyMitm},
+//	}}
+//	proxy.OnRequest().Do(policy)
+//	proxy.OnRequest().HandleConnect(policy)
+//
+// The first rule matching a request applies, or Default if none does. The
+// path rules only apply to the CONNECT requests which are MITM'd, and the
+// rules with time windows only apply during them, e.g. to block some hosts
+// during the working hours.
+type Policy struct {
+	Rules   []PolicyRule
+	Default PolicyAction
+	// Clock returns the current time, for the time windows of the rules.
+	// It's time.Now by default.
+	Clock func() time.Time
+}
+
+// Evaluate returns the action of the policy for req, and the rule that
+// matched it, if any.
+func (p *Policy) Evaluate(req *http.Request) (PolicyAction, *PolicyRule) {
+	connect := req.Method == http.MethodConnect
+	host, port := req.URL.Host, ""
+	if connect && host == "" {
+		host = req.Host
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		portNumber = 80
+		if req.URL.Scheme == "https" || req.URL.Scheme == "wss" || connect {
+			portNumber = 443
+		}
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	now := time.Now()
+	if p.Clock != nil {
+		now = p.Clock()
+	}
+	for i := range p.Rules {
+		if p.Rules[i].match(host, portNumber, req.URL.Path, connect, now) {
+			return p.Rules[i].Action, &p.Rules[i]
+		}
+	}
+	return p.Default, nil
+}
+
+// denied returns the response to the request denied by rule.
+func (p *Policy) denied(req *http.Request, ctx *ProxyCtx, rule *PolicyRule) *http.Response {
+	if rule != nil && rule.Name != "" {
+		ctx.Logf("Request to %s denied by policy rule %s", req.URL.Host, rule.Name)
+		ctx.Audit(AuditEvent{Kind: AuditDenied, Rule: rule.Name, Reason: "destination denied by policy"})
+	} else {
+		ctx.Logf("Request to %s denied by policy", req.URL.Host)
+		ctx.Audit(AuditEvent{Kind: AuditDenied, Reason: "destination denied by policy"})
+	}
+	resp := NewResponse(req, ContentTypeText, http.StatusForbidden, "Destination blocked by policy")
+	return ctx.ApplyErrorPage(resp, "destination denied by policy")
+}
+
+// Handle denies the requests denied by the policy.
+func (p *Policy) Handle(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	if action, rule := p.Evaluate(req); action == PolicyDeny {
+		return req, p.denied(req, ctx, rule)
+	}
+	return req, nil
+}
+
+// HandleConnect denies, tunnels or MITMs the CONNECT requests as decided
+// by the policy, or lets the following handlers decide.
+func (p *Policy) HandleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	action, rule := p.Evaluate(ctx.Req)
+	switch action {
+	case PolicyDeny:
+		ctx.Resp = p.denied(ctx.Req, ctx, rule)
+		return RejectConnect, host
+	case PolicyTunnel:
+		return OkConnect, host
+	case PolicyMitm:
+		return MitmConnect, host
+	}
+	return nil, host
+}
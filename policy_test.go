@@ -0,0 +1,158 @@
+package goproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := &goproxy.Policy{
+		Rules: []goproxy.PolicyRule{
+			{Name: "admin", Hosts: []string{"api.example.com"}, PathPrefix: "/admin/", Action: goproxy.PolicyDeny},
+			{Name: "api", Hosts: []string{"api.example.com"}, Action: goproxy.PolicyMitm},
+			{Name: "bank", HostRegexp: regexp.MustCompile(`(^|\.)bank\.example$`), Action: goproxy.PolicyTunnel},
+			{Name: "internal", Hosts: []string{"10.0.0.0/8"}, Action: goproxy.PolicyDeny},
+			{Name: "smtp", Ports: []int{25}, Action: goproxy.PolicyDeny},
+			{Name: "scripts", PathRegexp: regexp.MustCompile(`\.js$`), Action: goproxy.PolicyDeny},
+		},
+		Default: goproxy.PolicyAllow,
+	}
+	for _, test := range []struct {
+		method string
+		url    string
+		action goproxy.PolicyAction
+		rule   string
+	}{
+		{http.MethodGet, "http://api.example.com/admin/users", goproxy.PolicyDeny, "admin"},
+		{http.MethodGet, "http://api.example.com/admin", goproxy.PolicyDeny, "admin"},
+		{http.MethodGet, "http://api.example.com/v1/../admin/users", goproxy.PolicyDeny, "admin"},
+		{http.MethodGet, "http://api.example.com//admin/users", goproxy.PolicyDeny, "admin"},
+		{http.MethodGet, "http://api.example.com/%61dmin/users", goproxy.PolicyDeny, "admin"},
+		{http.MethodGet, "http://api.example.com/administrator", goproxy.PolicyMitm, "api"},
+		{http.MethodGet, "https://API.example.com/v1", goproxy.PolicyMitm, "api"},
+		{http.MethodConnect, "//api.example.com:443", goproxy.PolicyMitm, "api"},
+		{http.MethodConnect, "//www.bank.example:443", goproxy.PolicyTunnel, "bank"},
+		{http.MethodGet, "ws://10.1.2.3/socket", goproxy.PolicyDeny, "internal"},
+		{http.MethodConnect, "//mail.example.com:25", goproxy.PolicyDeny, "smtp"},
+		{http.MethodGet, "http://mail.example.com:2525/", goproxy.PolicyAllow, ""},
+		{http.MethodGet, "http://cdn.example.com/app.js", goproxy.PolicyDeny, "scripts"},
+		// The path rules don't apply to the CONNECT requests
+		{http.MethodConnect, "//cdn.example.com:443", goproxy.PolicyAllow, ""},
+	} {
+		t.Run(test.method+" "+test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+			action, rule := policy.Evaluate(&http.Request{Method: test.method, URL: u, Host: u.Host})
+			assert.Equal(t, test.action, action)
+			if test.rule == "" {
+				assert.Nil(t, rule)
+			} else if assert.NotNil(t, rule) {
+				assert.Equal(t, test.rule, rule.Name)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		rules   []goproxy.PolicyRule
+		url     string
+		upgrade bool
+		body    string
+		mitm    bool
+	}{
+		{"http-denied", []goproxy.PolicyRule{{Hosts: []string{"127.0.0.0/8"}, Action: goproxy.PolicyDeny}}, srv.URL + "/bobo", false, "", false},
+		{"http-allowed", []goproxy.PolicyRule{{Hosts: []string{"localhost"}, Action: goproxy.PolicyDeny}}, srv.URL + "/bobo", false, "bobo", false},
+		{"websocket-denied", []goproxy.PolicyRule{{PathPrefix: "/ws", Action: goproxy.PolicyDeny}}, srv.URL + "/ws", true, "", false},
+		{"tunnel-denied", []goproxy.PolicyRule{{Hosts: []string{"127.0.0.1"}, Action: goproxy.PolicyDeny}}, https.URL + "/bobo", false, "", false},
+		{"tunnel", []goproxy.PolicyRule{{Hosts: []string{"127.0.0.1"}, Action: goproxy.PolicyTunnel}}, https.URL + "/bobo", false, "bobo", false},
+		{"mitm", []goproxy.PolicyRule{{Hosts: []string{"127.0.0.1"}, Action: goproxy.PolicyMitm}}, https.URL + "/bobo", false, "bobo", true},
+		{"mitm-path-denied", []goproxy.PolicyRule{
+			{Hosts: []string{"127.0.0.1"}, PathPrefix: "/bobo", Action: goproxy.PolicyDeny},
+			{Hosts: []string{"127.0.0.1"}, Action: goproxy.PolicyMitm},
+		}, https.URL + "/bobo", false, "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			policy := &goproxy.Policy{Rules: test.rules}
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().Do(policy)
+			proxy.OnRequest().HandleConnect(policy)
+			mitm := false
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				mitm = req.URL.Scheme == "https"
+				return req, nil
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			require.NoError(t, err)
+			if test.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			resp, err := client.Do(req)
+			if test.body == "" && err != nil {
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			if test.body == "" {
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.body, string(body))
+			assert.Equal(t, test.mitm, mitm)
+		})
+	}
+}
+
+func TestPolicyTimeWindows(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	var now time.Time
+	policy := &goproxy.Policy{
+		Rules: []goproxy.PolicyRule{
+			{Name: "work-hours", Hosts: []string{"social.example"}, Windows: []goproxy.TimeWindow{
+				{Days: weekdays, Start: 9 * time.Hour, End: 17 * time.Hour, Location: paris},
+			}, Action: goproxy.PolicyDeny},
+			{Name: "night", Hosts: []string{"games.example"}, Windows: []goproxy.TimeWindow{
+				{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour, Location: paris},
+			}, Action: goproxy.PolicyDeny},
+		},
+		Clock: func() time.Time { return now },
+	}
+	for _, test := range []struct {
+		host   string
+		time   time.Time
+		action goproxy.PolicyAction
+	}{
+		// Monday 2024-06-03, UTC+2 in Paris
+		{"social.example", time.Date(2024, 6, 3, 7, 0, 0, 0, time.UTC), goproxy.PolicyDeny},
+		{"social.example", time.Date(2024, 6, 3, 6, 59, 0, 0, time.UTC), goproxy.PolicyAllow},
+		{"social.example", time.Date(2024, 6, 3, 15, 0, 0, 0, time.UTC), goproxy.PolicyAllow},
+		{"social.example", time.Date(2024, 6, 8, 10, 0, 0, 0, paris), goproxy.PolicyAllow},
+		{"games.example", time.Date(2024, 6, 7, 23, 0, 0, 0, paris), goproxy.PolicyDeny},
+		{"games.example", time.Date(2024, 6, 8, 5, 0, 0, 0, paris), goproxy.PolicyDeny},
+		{"games.example", time.Date(2024, 6, 8, 23, 0, 0, 0, paris), goproxy.PolicyAllow},
+		{"games.example", time.Date(2024, 6, 7, 5, 0, 0, 0, paris), goproxy.PolicyAllow},
+	} {
+		now = test.time
+		action, _ := policy.Evaluate(&http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: "http", Host: test.host, Path: "/"}})
+		assert.Equal(t, test.action, action, "%s at %s", test.host, test.time)
+	}
+}
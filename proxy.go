@@ -1,12 +1,19 @@
 package goproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -23,7 +30,14 @@ type ProxyHttpServer struct {
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
 	httpsHandlers   []HttpsHandler
-	Tr              *http.Transport
+	infoHandlers    []InformationalResponseHandler
+	middlewares     []Middleware
+	// Tr sends the requests to the destinations. Its connection pool
+	// settings, such as MaxIdleConnsPerHost, MaxConnsPerHost and
+	// IdleConnTimeout, also apply to the copies of it made for the MITM'd
+	// requests, the upstream proxies or the DNS settings. ConnPools
+	// override them for some hosts.
+	Tr *http.Transport
 	// ConnectionErrHandler will be invoked to return a custom response
 	// to clients (written using conn parameter), when goproxy fails to connect
 	// to a target proxy.
@@ -51,6 +65,232 @@ type ProxyHttpServer struct {
 	// Accept-Encoding header. To disable this behavior, set
 	// Tr.DisableCompression to true.
 	KeepAcceptEncoding bool
+	// ExpectContinueHandler, if set, decides how MITM requests carrying an
+	// "Expect: 100-continue" header are handled. By default the proxy sends
+	// "100 Continue" to the client itself when the body is needed.
+	ExpectContinueHandler ExpectContinueHandler
+	// LenientResponseParsing, if true, makes the proxy tolerate common
+	// protocol violations in the HTTP/1.x responses of remote servers
+	// (missing reason phrase, bare LF line endings, invalid Content-Length...)
+	// instead of failing the request. The applied fixups are reported
+	// in ProxyCtx.ResponseFixups.
+	// Plain HTTP requests are then sent on dedicated connections, dialed
+	// like the CONNECT tunnels, without using Tr.
+	LenientResponseParsing bool
+	// TempDirRoot is the directory where the scratch directories returned
+	// by ProxyCtx.TempDir are created. If empty, os.TempDir is used.
+	TempDirRoot string
+	// CertKeyType is the key algorithm of the certificates generated by
+	// TLSConfigFromCA. By default the algorithm of the CA key is used.
+	CertKeyType CertKeyType
+	// ClientTLSRecords, if set, controls the TLS records written to the
+	// MITM'd clients.
+	ClientTLSRecords *TLSRecordOptions
+	// UpstreamTLSRecords, if set, controls the TLS records written on the
+	// TLS connections opened by the proxy itself (WebSockets, HTTP/2
+	// CONNECT...). See TLSRecordOptions.WrapConn for the requests sent
+	// through Tr.
+	UpstreamTLSRecords *TLSRecordOptions
+	// CASelector, if set, picks the CA signing the MITM certificate of each
+	// host in TLSConfigFromCA, so that different clients or environments
+	// can be served by different roots. Returning a nil certificate uses
+	// the CA given to TLSConfigFromCA.
+	CASelector CASelector
+	// FlowTracker, if set, links the exchanges of redirect chains and
+	// authentication dances under the same ProxyCtx.FlowID.
+	FlowTracker *FlowTracker
+	// KeyLogWriter, if set, receives the TLS master secrets of both the
+	// MITM'd client connections and the connections to the remote servers,
+	// in NSS key log format, so that captures can be decrypted (e.g. by
+	// Wireshark). It must be set before the proxy starts serving requests.
+	KeyLogWriter io.Writer
+	// WildcardCerts, if true, makes TLSConfigFromCA generate wildcard
+	// certificates (*.example.com for www.example.com), shared by the
+	// subdomains of a domain, instead of one certificate per host. When a
+	// client fails the handshake with a wildcard certificate, per-host
+	// certificates are used for that host from then on.
+	WildcardCerts bool
+	// UpstreamTLSHandshake, if set, replaces crypto/tls for the TLS
+	// handshakes with the remote servers, e.g. to impersonate the TLS
+	// fingerprint of a browser chosen by ProxyCtx.UpstreamTLSProfile. The
+	// HTTPS requests are then sent over HTTP/1.1, with a copy of Tr.
+	UpstreamTLSHandshake UpstreamTLSHandshake
+	// ClientCertificates maps hostnames to the client certificates presented
+	// to them (mutual TLS), see also ProxyCtx.ClientCertificate.
+	ClientCertificates map[string]*tls.Certificate
+	// FollowRedirects, if positive, makes the proxy follow up to this number
+	// of redirections itself, returning the final response to the client.
+	// The followed redirections are recorded in ProxyCtx.Redirects.
+	FollowRedirects int
+	// Retry, if set, makes the proxy retry the idempotent requests failing
+	// on the upstream leg, see RetryPolicy. The failed attempts are
+	// recorded in ProxyCtx.Retries.
+	Retry *RetryPolicy
+	// CircuitBreaker, if set, stops sending the exchanges to the
+	// destinations failing repeatedly, see CircuitBreaker.
+	CircuitBreaker *CircuitBreaker
+	// MitmClientAuth, if set, makes the proxy request a certificate from
+	// the MITM'd clients, and possibly verify it against MitmClientCAs.
+	// The certificates presented by the client are exposed in
+	// ProxyCtx.PeerCertificates.
+	MitmClientAuth tls.ClientAuthType
+	MitmClientCAs  *x509.CertPool
+	// RevocationResponder, if set, answers the OCSP and CRL requests for the
+	// certificates generated by TLSConfigFromCA, that point to it.
+	RevocationResponder *RevocationResponder
+	// MitmALPN, if set, chooses the application protocol negotiated with
+	// the MITM'd clients, and the protocols offered to the remote servers.
+	MitmALPN MitmALPN
+	// UpstreamSessionCache, if set, keeps the TLS sessions of the remote
+	// servers, so that the next connections to them resume the sessions
+	// instead of making full handshakes.
+	UpstreamSessionCache *SessionCache
+	// ClientTLSPolicy and UpstreamTLSPolicy, if set, restrict the TLS
+	// versions and cipher suites of the handshakes with the MITM'd clients
+	// and with the remote servers. TLSPolicyOverride, if set, returns the
+	// policies for a given host.
+	ClientTLSPolicy   *TLSPolicy
+	UpstreamTLSPolicy *TLSPolicy
+	TLSPolicyOverride TLSPolicyOverride
+	// PinningBypass, if set, tunnels the connections to the hosts whose
+	// clients reject the MITM certificates, e.g. because of certificate
+	// pinning, instead of breaking them.
+	PinningBypass *PinningBypass
+	// LeafProfile, if set, customizes the certificates generated by
+	// TLSConfigFromCA: validity window, key usages, SAN handling...
+	LeafProfile *LeafProfile
+	// TransparentDestination, if set, returns the original destination
+	// of the connections accepted by ServeTransparentTLS, instead of
+	// reading it from the socket.
+	TransparentDestination func(c net.Conn) (string, error)
+	// ECHPolicy, if set, decides what to do with the MITM'd connections
+	// whose clients offer Encrypted Client Hello, see ECHAction. They are
+	// intercepted without ECH otherwise.
+	ECHPolicy ECHPolicy
+	// OnTLSError, if set, is called for every failed TLS handshake, with
+	// the MITM'd clients or with the remote servers, e.g. to monitor the
+	// MITM compatibility problems.
+	OnTLSError func(e *TLSError, ctx *ProxyCtx)
+	// UpstreamPins, if set, checks the certificates of the remote servers
+	// against the public keys pinned for their hosts.
+	UpstreamPins *UpstreamPins
+	// SecurityHeaders, if set, strips or rewrites the HSTS and Expect-CT
+	// headers of the responses.
+	SecurityHeaders *SecurityHeaders
+	// TunnelThrottle, if set, limits the bandwidth of the CONNECT tunnels.
+	TunnelThrottle *TunnelThrottle
+	// ProxyTLSConfig holds the certificate presented by the proxy to the
+	// clients connecting to it over TLS, see ServeTLS.
+	ProxyTLSConfig *tls.Config
+	// OnTunnelOpen and OnTunnelClose, if set, are called when an opaque
+	// tunnel is opened and closed, with its destination, duration and the
+	// numbers of bytes relayed in each direction, see TunnelStats.
+	OnTunnelOpen  func(stats *TunnelStats, ctx *ProxyCtx)
+	OnTunnelClose func(stats *TunnelStats, ctx *ProxyCtx)
+	// TunnelIdleTimeout and TunnelMaxLifetime, if set, close the opaque
+	// tunnels without any data relayed for TunnelIdleTimeout, and the ones
+	// open for longer than TunnelMaxLifetime. They can be overridden by the
+	// CONNECT handlers, see ProxyCtx.TunnelIdleTimeout.
+	TunnelIdleTimeout time.Duration
+	TunnelMaxLifetime time.Duration
+	// Resolver, if set, resolves the host names of the destinations, e.g.
+	// with NewDoHResolver or NewDoTResolver, instead of the host resolver.
+	// NewDNSCache caches its lookups. ProxyCtx.Resolver overrides it for a
+	// given exchange. The host names sent through SOCKS5 upstream proxies
+	// aren't resolved by the proxy.
+	Resolver Resolver
+	// Hosts, if set, maps the hosts of the destinations to the addresses
+	// dialed for them, before any DNS resolution, e.g. to reach a staging
+	// backend under its public name. It can be changed at runtime.
+	// ProxyCtx.DNSOverrides take precedence.
+	Hosts *DialTargets
+	// AddressFamily selects the IP versions of the addresses dialed for the
+	// destinations, e.g. to test their dual-stack behavior. FallbackDelay
+	// is the Happy Eyeballs delay before the addresses of the other IP
+	// version are raced, 300ms if zero, never if negative. When any of
+	// them or DialPreferences is set, the proxy resolves the host names
+	// itself, with net.DefaultResolver if Resolver is nil.
+	AddressFamily AddressFamily
+	FallbackDelay time.Duration
+	// DialPreferences override AddressFamily and FallbackDelay for some
+	// hosts: the first preference matching the host of a destination is
+	// used.
+	DialPreferences []DialPreference
+	// SourceAddr, if set, binds the connections to the destinations and
+	// upstream proxies to a local address, on multi-homed hosts: an IP
+	// address, or the name of a network interface, whose address of the
+	// IP version of the destination is used. ProxyCtx.SourceAddr overrides
+	// it for a given exchange. It doesn't apply to the connections opened
+	// by Tr.DialContext, ProxyCtx.Dialer or the SOCKS5 upstream proxies.
+	SourceAddr string
+	// ConnPools override the connection pool settings of Tr for some
+	// hosts: the first pool matching the host of a request is used.
+	ConnPools []ConnPool
+	// TimeoutProfiles bound the exchanges with some hosts, e.g. tighter
+	// for fast APIs than for file downloads: the first profile matching
+	// the host of a destination is used. ProxyCtx.Timeouts overrides them.
+	TimeoutProfiles []TimeoutProfile
+	// DestinationGuard, if set, refuses the connections to the loopback,
+	// private and link-local addresses, for the deployments handling
+	// untrusted URLs, see DestinationGuard.
+	DestinationGuard *DestinationGuard
+	// ClientACL, if set, rejects the clients whose IP address isn't
+	// allowed, before any handler is called, see ClientACL.
+	ClientACL *ClientACL
+	// AuditSink, if set, receives the authentication and authorization
+	// decisions: the challenges, successes and failures of the
+	// authentication of the clients, and the requests denied by the
+	// policies, separately from the traffic logs. See ProxyCtx.Audit.
+	AuditSink AuditSink
+	// ErrorPages, if set, customizes the responses refusing the requests,
+	// e.g. the authentication challenges and the policy denials, by status
+	// code. See ErrorPage.
+	ErrorPages map[int]*ErrorPage
+	// BaseContext, if set, is the parent of the contexts of the exchanges,
+	// see ProxyCtx.Context. Cancelling it, e.g. when shutting the proxy
+	// down, cancels the exchanges in progress, their dials and handlers.
+	BaseContext context.Context
+	// Upstreams, if set, routes the traffic through a list of upstream
+	// proxies with failover, see UpstreamChain. It takes precedence over
+	// ConnectDial and the Proxy function of Tr, and shouldn't be combined
+	// with UseUpstreamProxy.
+	Upstreams *UpstreamChain
+	// SelectUpstream, if set, chooses the upstream proxy of every outbound
+	// connection: the CONNECT tunnels (req is then the CONNECT request),
+	// the plain and MITM'd requests, and the WebSocket upgrades. A nil URL
+	// connects directly, whatever the Proxy function of Tr, and an error
+	// fails the request. ProxyCtx.UpstreamProxy still takes precedence, and
+	// Upstreams is ignored.
+	SelectUpstream func(req *http.Request, ctx *ProxyCtx) (*url.URL, error)
+	// UpstreamAuth answers the 407 challenges of the upstream proxies. It
+	// defaults to BasicUpstreamAuth(nil), using the user info of their
+	// URLs.
+	UpstreamAuth UpstreamAuthenticator
+	// UpstreamHandshakes authenticate the connections to the upstream
+	// proxies offering their schemes, such as NTLM or Negotiate, in order
+	// of preference. They default to NTLMUpstreamAuth(nil), using the user
+	// info of the proxy URLs, and take precedence over UpstreamAuth.
+	UpstreamHandshakes []UpstreamHandshake
+
+	tlsOptionsOnce   sync.Once
+	wildcardRejected sync.Map
+	// upstreamAuthorizations are the Proxy-Authorization headers accepted
+	// by the upstream proxies, by host
+	upstreamAuthorizations sync.Map
+	// upstreamHandshakes are the UpstreamHandshakes accepted by the
+	// upstream proxies, by address
+	upstreamHandshakes sync.Map
+	// handshakeTransports are the copies of the transports tunneling
+	// through the proxies of upstreamHandshakes, see handshakeTransport
+	handshakeTransports transportCache
+	// upstreamTLSTransports are the copies of Tr making their handshakes
+	// with UpstreamTLSHandshake, see upstreamTLSTransport
+	upstreamTLSTransports sync.Map
+	// transports holds the copies of Tr used by the exchanges that can't
+	// share its connections, see ProxyCtx.transport
+	transports transportCache
+	readOnly   atomic.Bool
+	ca         atomic.Pointer[tls.Certificate]
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -69,6 +309,12 @@ func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
+	if proxy.FlowTracker != nil {
+		proxy.FlowTracker.request(req, ctx)
+	}
+	if proxy.ReadOnly() {
+		return proxy.observeRequest(req, ctx), nil
+	}
 	for _, h := range proxy.reqHandlers {
 		req, resp = h.Handle(req, ctx)
 		// non-nil resp means the handler decided to skip sending the request
@@ -82,9 +328,17 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
-		ctx.Resp = resp
-		resp = h.Handle(resp, ctx)
+	if proxy.ReadOnly() {
+		resp = proxy.observeResponse(resp, ctx)
+	} else {
+		proxy.rewriteSecurityHeaders(resp, ctx)
+		for _, h := range proxy.respHandlers {
+			ctx.Resp = resp
+			resp = h.Handle(resp, ctx)
+		}
+	}
+	if proxy.FlowTracker != nil {
+		proxy.FlowTracker.response(resp, ctx)
 	}
 	return
 }
@@ -135,7 +389,15 @@ func (fw flushWriter) Write(p []byte) (int, error) {
 
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodConnect {
+	proxy.tlsOptionsOnce.Do(proxy.applyUpstreamTLSOptions)
+	if proxy.ClientACL != nil && !proxy.ClientACL.admit(proxy, w, r) {
+		return
+	}
+	if IsConnectUDP(r) {
+		proxy.handleConnectUDP(w, r)
+	} else if r.Method == http.MethodConnect && r.ProtoMajor == 2 {
+		proxy.handleH2Connect(w, r)
+	} else if r.Method == http.MethodConnect {
 		proxy.handleHttps(w, r)
 	} else {
 		proxy.handleHttp(w, r)
@@ -151,6 +413,8 @@ func NewProxyHttpServer() *ProxyHttpServer {
 		}),
 		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
 	}
+	proxy.Tr.GetProxyConnectHeader = proxy.upstreamConnectHeader
+	proxy.Tr.OnProxyConnectResponse = proxy.upstreamConnectResponse
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 	return &proxy
 }
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -860,7 +865,9 @@ func TestProxyWithCertStorage(t *testing.T) {
 		t.Fatalf("Expected 1 cache miss, got %d", tcs.statMisses())
 	}
 
-	// Another round - this time the certificate can be loaded
+	// Another round - this time the certificate can be loaded. The MITM
+	// connection is kept open, the certificate is only needed by a new one.
+	tr.CloseIdleConnections()
 	if resp := string(getOrFail(t, https.URL+"/bobo", client)); resp != "bobo" {
 		t.Error("Wrong response when mitm", resp, "expected bobo")
 	}
@@ -1109,3 +1116,81 @@ func TestMITMRequestCancel(t *testing.T) {
 		assert.Fail(t, "request hasn't been cancelled")
 	}
 }
+
+func TestMitmCertKeyType(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertKeyType = goproxy.CertKeyECDSA
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyUrl, _ := url.Parse(s.URL)
+	var algorithm x509.PublicKeyAlgorithm
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(state tls.ConnectionState) error {
+				algorithm = state.PeerCertificates[0].PublicKeyAlgorithm
+				return nil
+			},
+		},
+		Proxy: http.ProxyURL(proxyUrl),
+	}
+	client := &http.Client{Transport: tr}
+	if resp := string(getOrFail(t, https.URL+"/bobo", client)); resp != "bobo" {
+		t.Error("Wrong response when mitm", resp, "expected bobo")
+	}
+	assert.Equal(t, x509.ECDSA, algorithm)
+}
+
+func newTestCA(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMitmCASelector(t *testing.T) {
+	testCA := newTestCA(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = goproxy.NewCertStorage(goproxy.NewLRUCertCache(10))
+	proxy.CASelector = func(host string, ctx *goproxy.ProxyCtx) (*tls.Certificate, error) {
+		if ctx.Req.Header.Get("X-Test-CA") != "" {
+			return testCA, nil
+		}
+		return nil, nil
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+
+	for _, ca := range []*tls.Certificate{&goproxy.GoproxyCa, testCA} {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Leaf)
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+			Proxy:           http.ProxyURL(proxyUrl),
+		}
+		if ca == testCA {
+			tr.ProxyConnectHeader = http.Header{"X-Test-CA": {"1"}}
+		}
+		client := &http.Client{Transport: tr}
+		if resp := string(getOrFail(t, https.URL+"/bobo", client)); resp != "bobo" {
+			t.Error("Wrong response when mitm", resp, "expected bobo")
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProxyProtocolTimeout bounds the reading of the PROXY protocol
+// headers when ProxyProtocolListener.HeaderTimeout isn't set.
+const defaultProxyProtocolTimeout = 10 * time.Second
+
+// proxyProtocolV1MaxLength is the maximum length of a PROXY protocol v1
+// header, CRLF included.
+const proxyProtocolV1MaxLength = 107
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyProtocolHeader = errors.New("missing PROXY protocol header")
+
+// ProxyProtocolHeader is the PROXY protocol header sent by a load balancer
+// at the beginning of a client connection.
+type ProxyProtocolHeader struct {
+	// Version is 1 for the text headers, and 2 for the binary ones.
+	Version int
+	// Source and Destination are the addresses of the client and of the
+	// proxy as seen by the load balancer. They're nil when the header
+	// doesn't carry TCP addresses, e.g. for the health checks of the load
+	// balancer.
+	Source, Destination net.Addr
+	// LoadBalancer is the address of the peer that sent the header.
+	LoadBalancer net.Addr
+}
+
+// ProxyProtocolListener wraps a listener placed behind load balancers
+// sending the PROXY protocol header, v1 or v2, at the beginning of the
+// connections. The RemoteAddr and LocalAddr of the connections it accepts
+// return the addresses of the header, so the requests and the logs of the
+// proxy show the real client addresses.
+//
+// The header is read on the first use of the connection, not by Accept.
+// The connections from the trusted load balancers without a valid header
+// fail, the connections from other peers are returned as they are.
+type ProxyProtocolListener struct {
+	net.Listener
+	// Trusted are the networks of the load balancers allowed to send the
+	// header. If it's empty, every peer must send it, e.g. when the proxy
+	// is only reachable by the load balancers.
+	Trusted []*net.IPNet
+	// HeaderTimeout bounds the reading of the header, 10 seconds if it
+	// isn't set.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener returns a ProxyProtocolListener accepting the
+// header from the load balancers whose addresses are in the trusted
+// networks, given in CIDR notation or as single IP addresses.
+func NewProxyProtocolListener(l net.Listener, trusted ...string) (*ProxyProtocolListener, error) {
+	pl := &ProxyProtocolListener{Listener: l}
+	for _, network := range trusted {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %q", network)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			pl.Trusted = append(pl.Trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		pl.Trusted = append(pl.Trusted, ipNet)
+	}
+	return pl, nil
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyProtocolTimeout
+	}
+	return &proxyProtocolConn{Conn: c, timeout: timeout}, nil
+}
+
+func (l *ProxyProtocolListener) trusted(addr net.Addr) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+	for _, network := range l.Trusted {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	header *ProxyProtocolHeader
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() error {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.header, c.err = readProxyProtocolHeader(c.reader)
+		if c.err != nil {
+			c.err = fmt.Errorf("reading the PROXY protocol header of %s: %w", c.Conn.RemoteAddr(), c.err)
+		} else {
+			c.header.LoadBalancer = c.Conn.RemoteAddr()
+		}
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header of any version.
+func readProxyProtocolHeader(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(signature, proxyProtocolV2Signature):
+		return readProxyProtocolV2(r)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyProtocolV1(r)
+	}
+	return nil, errNoProxyProtocolHeader
+}
+
+// readProxyProtocolV1 reads a header like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	if err != nil || len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	header := &ProxyProtocolHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	if header.Source, err = proxyProtocolV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if header.Destination, err = proxyProtocolV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func proxyProtocolV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header.
+func readProxyProtocolV2(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	header := &ProxyProtocolHeader{Version: 2}
+	switch fixed[12] & 0x0f {
+	case 0: // LOCAL, e.g. a health check
+		return header, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", fixed[12]&0x0f)
+	}
+	var ipLen int
+	switch fixed[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// UDP and UNIX sockets addresses aren't useful here, the TLVs
+		// are ignored
+		return header, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("truncated PROXY protocol v2 addresses")
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return header, nil
+}
+
+type proxyProtocolConnKey struct{}
+
+// ProxyProtocolConnContext can be used as the ConnContext of an
+// http.Server serving the proxy on a ProxyProtocolListener, to make the
+// headers of the connections available in ProxyCtx.ProxyProtocol. Serve
+// and ServeTLS use it.
+func ProxyProtocolConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	if pc, ok := c.(*proxyProtocolConn); ok {
+		// The header is read later, by the goroutine serving c
+		return context.WithValue(ctx, proxyProtocolConnKey{}, pc)
+	}
+	return ctx
+}
+
+// proxyProtocolHeader returns the PROXY protocol header of the connection
+// of r, or nil if there was none.
+func proxyProtocolHeader(r *http.Request) *ProxyProtocolHeader {
+	pc, ok := r.Context().Value(proxyProtocolConnKey{}).(*proxyProtocolConn)
+	if !ok || pc.readHeader() != nil {
+		return nil
+	}
+	return pc.header
+}
+
+// Serve accepts the clients connecting to l and serves their requests,
+// like http.Serve. If l is a ProxyProtocolListener, the headers of the
+// connections are available in ProxyCtx.ProxyProtocol.
+//
+// Serve always returns a non-nil error.
+func (proxy *ProxyHttpServer) Serve(l net.Listener) error {
+	srv := &http.Server{Handler: proxy, ConnContext: ProxyProtocolConnContext}
+	return srv.Serve(l)
+}
@@ -0,0 +1,104 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type proxyProtocolRequest struct {
+	remoteAddr string
+	header     *goproxy.ProxyProtocolHeader
+}
+
+func proxyProtocolProxy(t *testing.T, trusted ...string) (string, <-chan proxyProtocolRequest) {
+	t.Helper()
+	requests := make(chan proxyProtocolRequest, 1)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		requests <- proxyProtocolRequest{req.RemoteAddr, ctx.ProxyProtocol}
+		return req, nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	pl, err := goproxy.NewProxyProtocolListener(l, trusted...)
+	require.NoError(t, err)
+	go func() { _ = proxy.Serve(pl) }()
+	return l.Addr().String(), requests
+}
+
+// proxyProtocolGet sends a proxy request for srv prefixed by header, and
+// returns the response body.
+func proxyProtocolGet(t *testing.T, addr string, header []byte) (string, error) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write(append(header, "GET "+srv.URL+"/bobo HTTP/1.1\r\nHost: "+srv.Listener.Addr().String()+"\r\nConnection: close\r\n\r\n"...))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	addr, requests := proxyProtocolProxy(t, "127.0.0.1")
+	body, err := proxyProtocolGet(t, addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 8080\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", body)
+
+	r := <-requests
+	assert.Equal(t, "192.0.2.1:56324", r.remoteAddr)
+	require.NotNil(t, r.header)
+	assert.Equal(t, 1, r.header.Version)
+	assert.Equal(t, "198.51.100.1:8080", r.header.Destination.String())
+	assert.Contains(t, r.header.LoadBalancer.String(), "127.0.0.1:")
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	addr, requests := proxyProtocolProxy(t, "127.0.0.0/8")
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+	header = append(header, net.ParseIP("2001:db8::1")...)
+	header = append(header, net.ParseIP("2001:db8::2")...)
+	header = binary.BigEndian.AppendUint16(header, 56324)
+	header = binary.BigEndian.AppendUint16(header, 8080)
+	body, err := proxyProtocolGet(t, addr, header)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", body)
+
+	r := <-requests
+	assert.Equal(t, "[2001:db8::1]:56324", r.remoteAddr)
+	require.NotNil(t, r.header)
+	assert.Equal(t, 2, r.header.Version)
+	assert.Equal(t, "[2001:db8::2]:8080", r.header.Destination.String())
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	addr, requests := proxyProtocolProxy(t)
+	body, _ := proxyProtocolGet(t, addr, nil)
+	assert.NotEqual(t, "bobo", body)
+	assert.Empty(t, requests)
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	addr, requests := proxyProtocolProxy(t, "10.0.0.0/8")
+	body, err := proxyProtocolGet(t, addr, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", body)
+
+	r := <-requests
+	assert.Contains(t, r.remoteAddr, "127.0.0.1:")
+	assert.Nil(t, r.header)
+}
@@ -0,0 +1,40 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+var errNoProxyCertificate = errors.New("goproxy: ProxyTLSConfig has no certificate")
+
+// ServeTLS accepts the clients connecting to l over TLS, i.e. configured
+// with an https:// proxy URL, and serves their requests. The proxy presents
+// the certificate of ProxyTLSConfig, and negotiates HTTP/2 with the clients
+// supporting it, e.g. the browsers configured with a secure proxy, whose
+// CONNECT requests are then tunneled on HTTP/2 streams. The client
+// certificates requested by ProxyTLSConfig are available in the TLS field
+// of the requests, e.g. to authenticate the clients (mutual TLS) with the
+// CertificateScheme of ext/auth.
+//
+// ServeTLS always returns a non-nil error.
+func (proxy *ProxyHttpServer) ServeTLS(l net.Listener) error {
+	config := proxy.ProxyTLSConfig
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return errNoProxyCertificate
+	}
+	srv := &http.Server{Handler: proxy, TLSConfig: config.Clone(), ConnContext: ProxyProtocolConnContext}
+	// The certificate comes from TLSConfig
+	return srv.ServeTLS(l, "", "")
+}
+
+// ListenAndServeTLS listens on the TCP network address addr and calls
+// ServeTLS.
+func (proxy *ProxyHttpServer) ListenAndServeTLS(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return proxy.ServeTLS(l)
+}
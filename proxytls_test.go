@@ -0,0 +1,93 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func tlsProxy(t *testing.T, proxy *goproxy.ProxyHttpServer) string {
+	t.Helper()
+	proxy.ProxyTLSConfig = &tls.Config{Certificates: []tls.Certificate{goproxy.GoproxyCa}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = proxy.ServeTLS(l) }()
+	return l.Addr().String()
+}
+
+func TestServeTLS(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.ConnectDial = nil
+			if test.action != nil {
+				proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				}))
+			}
+			proxyURL := &url.URL{Scheme: "https", Host: tlsProxy(t, proxy)}
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, test.url+"/bobo", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "bobo", string(body))
+		})
+	}
+}
+
+func TestServeTLSHTTP2Connect(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	addr := tlsProxy(t, proxy)
+
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodConnect, "https://"+addr, pr)
+	require.NoError(t, err)
+	req.Host = srv.Listener.Addr().String()
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = io.WriteString(pw, "GET /bobo HTTP/1.1\r\nHost: "+req.Host+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	response, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(response), "bobo")
+	_ = pw.Close()
+}
+
+func TestServeTLSWithoutCertificate(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.Error(t, proxy.ServeTLS(l))
+}
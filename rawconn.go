@@ -0,0 +1,151 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// rawConnectionSniffTimeout is how long the first bytes sent by a MITM'd
+// client are awaited. A client that doesn't send anything is assumed to
+// wait for the server to speak first, as in SMTP.
+const rawConnectionSniffTimeout = 2 * time.Second
+
+// RawConnectionHandler handles the MITM'd TLS connections whose decrypted
+// traffic isn't HTTP, e.g. SMTP over TLS or custom binary protocols. It's
+// given the decrypted streams with the remote server and with the client,
+// and returns once it's done with them.
+type RawConnectionHandler interface {
+	HandleRawConnection(remote io.ReadWriter, client io.ReadWriter, ctx *ProxyCtx)
+}
+
+// A wrapper that would convert a function to a RawConnectionHandler interface type.
+type FuncRawConnectionHandler func(remote io.ReadWriter, client io.ReadWriter, ctx *ProxyCtx)
+
+// FuncRawConnectionHandler.HandleRawConnection(remote, client, ctx) <=> FuncRawConnectionHandler(remote, client, ctx).
+func (f FuncRawConnectionHandler) HandleRawConnection(remote io.ReadWriter, client io.ReadWriter, ctx *ProxyCtx) {
+	f(remote, client, ctx)
+}
+
+// RelayRawConnection is a RawConnectionHandler relaying the decrypted data
+// as is, in both directions:
+//
+//	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+//		ctx.RawConnectionHandler = goproxy.RelayRawConnection
+//		return goproxy.MitmConnect, host
+//	})
+var RelayRawConnection RawConnectionHandler = FuncRawConnectionHandler(func(remote io.ReadWriter, client io.ReadWriter, ctx *ProxyCtx) {
+	done := make(chan struct{})
+	go func() {
+		_ = copyOrWarn(ctx, remote, client)
+		if closer, ok := remote.(interface{ CloseWrite() error }); ok {
+			_ = closer.CloseWrite()
+		}
+		close(done)
+	}()
+	_ = copyOrWarn(ctx, client, remote)
+	if closer, ok := client.(interface{ CloseWrite() error }); ok {
+		_ = closer.CloseWrite()
+	}
+	<-done
+})
+
+// handleRawConnection hands the MITM'd client connection to host to the
+// RawConnectionHandler of ctx, if its traffic isn't HTTP, and reports
+// whether it did. reader is the buffered reader of client.
+func (proxy *ProxyHttpServer) handleRawConnection(ctx *ProxyCtx, client *tls.Conn, reader *bufio.Reader, host string) bool {
+	if ctx.RawConnectionHandler == nil || (!ctx.RawConnection && !isRawTraffic(client, reader)) {
+		return false
+	}
+	ctx.Logf("Handling non HTTP traffic to %s", host)
+
+	// The CONNECT request is over, its context is canceled
+	dialCtx := &ProxyCtx{
+		Req:        ctx.Req.WithContext(context.Background()),
+		Proxy:      proxy,
+		UserData:   ctx.UserData,
+		Dialer:     ctx.Dialer,
+		Resolver:   ctx.Resolver,
+		SourceAddr: ctx.SourceAddr,
+		Timeouts:   ctx.Timeouts,
+	}
+	target, err := proxy.connectDial(dialCtx, "tcp", host)
+	if err != nil {
+		ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+		return true
+	}
+	defer target.Close()
+	tlsConfig := tlsClientSkipVerify
+	if proxy.Tr != nil && proxy.Tr.TLSClientConfig != nil {
+		tlsConfig = proxy.Tr.TLSClientConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = nil
+	if protocol := client.ConnectionState().NegotiatedProtocol; protocol != "" {
+		tlsConfig.NextProtos = []string{protocol}
+	}
+	remote, err := proxy.initializeTLSconnection(dialCtx, target, tlsConfig, host)
+	if err != nil {
+		ctx.Warnf("Cannot handshake with %s: %s", host, err.Error())
+		return true
+	}
+	defer remote.Close()
+
+	ctx.RawConnectionHandler.HandleRawConnection(remote, &rawClientConn{Conn: client, r: reader}, ctx)
+	return true
+}
+
+// rawClientConn is a MITM'd client connection, with the data buffered
+// while sniffing its traffic.
+type rawClientConn struct {
+	*tls.Conn
+	r *bufio.Reader
+}
+
+func (c *rawClientConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// isRawTraffic reports whether the traffic of the client doesn't look
+// like HTTP, peeking its first bytes.
+func isRawTraffic(client *tls.Conn, reader *bufio.Reader) bool {
+	_ = client.SetReadDeadline(time.Now().Add(rawConnectionSniffTimeout))
+	_, err := reader.Peek(1)
+	_ = client.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// The server speaks first
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	return !looksLikeHTTP(buffered)
+}
+
+// maxMethodLength bounds the length of the HTTP methods recognized by
+// looksLikeHTTP.
+const maxMethodLength = 24
+
+// looksLikeHTTP reports whether b could be the start of an HTTP/1.x
+// request, or of the HTTP/2 preface.
+func looksLikeHTTP(b []byte) bool {
+	if line, _, found := bytes.Cut(b, []byte("\n")); found {
+		// A complete request line: METHOD target HTTP/x
+		fields := bytes.Fields(line)
+		return len(fields) == 3 && bytes.HasPrefix(fields[2], []byte("HTTP/")) && looksLikeHTTP(fields[0])
+	}
+	method, _, found := bytes.Cut(b, []byte(" "))
+	if len(method) == 0 || len(method) > maxMethodLength || !httpguts.ValidHeaderFieldName(string(method)) {
+		return false
+	}
+	return found || len(b) <= maxMethodLength
+}
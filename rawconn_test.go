@@ -0,0 +1,97 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineServer is a TLS server greeting its clients, then echoing the lines
+// they send, like a simplified SMTP server.
+func lineServer(t *testing.T) net.Listener {
+	t.Helper()
+	config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)("127.0.0.1", &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.WriteString(conn, "220 ready\r\n")
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = fmt.Fprintf(conn, "250 %s\r\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func connectMitm(t *testing.T, proxyAddr, host string) (*tls.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, client.Handshake())
+	return client, bufio.NewReader(client)
+}
+
+func TestRawConnectionHandler(t *testing.T) {
+	l := lineServer(t)
+	defer l.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.RawConnectionHandler = goproxy.RelayRawConnection
+		return goproxy.MitmConnect, host
+	})
+	_, s := oneShotProxy(proxy)
+	defer s.Close()
+	proxyAddr := strings.TrimPrefix(s.URL, "http://")
+
+	t.Run("client speaks first", func(t *testing.T) {
+		client, r := connectMitm(t, proxyAddr, l.Addr().String())
+		defer client.Close()
+		_, err := io.WriteString(client, "\x00binary\r\n")
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "220 ready\r\n", line)
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "250 \x00binary\r\n", line)
+	})
+
+	t.Run("server speaks first", func(t *testing.T) {
+		client, r := connectMitm(t, proxyAddr, l.Addr().String())
+		defer client.Close()
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "220 ready\r\n", line)
+		_, err = io.WriteString(client, "EHLO client\r\n")
+		require.NoError(t, err)
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "250 EHLO client\r\n", line)
+	})
+}
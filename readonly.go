@@ -0,0 +1,150 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// SetReadOnly enables or disables the read-only mode, in which the
+// handlers can observe the traffic but not modify it: they are still run,
+// so that the exchanges are logged and recorded, but the changes they make
+// to the requests and responses are discarded, as well as their canned
+// responses, and CONNECT requests can only be accepted or MITM'd.
+// It can be toggled while the proxy is running, to quickly rule out the
+// rewrites of the proxy when debugging.
+//
+// The bodies replaced or wrapped by the handlers are discarded too, the
+// original ones are forwarded. The handlers read a copy of the bodies,
+// the part they read being buffered to be forwarded.
+func (proxy *ProxyHttpServer) SetReadOnly(readOnly bool) {
+	proxy.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether the read-only mode is enabled.
+func (proxy *ProxyHttpServer) ReadOnly() bool {
+	return proxy.readOnly.Load()
+}
+
+// observeRequest runs the request handlers, discarding their changes.
+func (proxy *ProxyHttpServer) observeRequest(req *http.Request, ctx *ProxyCtx) *http.Request {
+	original := req.Clone(req.Context())
+	body := &observedBody{body: req.Body}
+	req.Body = body.copy()
+	roundTripper, dialer := ctx.RoundTripper, ctx.Dialer
+	clientCert, dnsOverrides := ctx.ClientCertificate, ctx.DNSOverrides
+
+	for _, h := range proxy.reqHandlers {
+		next, resp := h.Handle(req, ctx)
+		if resp != nil {
+			ctx.Logf("Read-only mode: ignoring handler response %v", resp.Status)
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+		}
+		if next != nil {
+			req = next
+		}
+	}
+
+	ctx.RoundTripper, ctx.Dialer = roundTripper, dialer
+	ctx.ClientCertificate, ctx.DNSOverrides = clientCert, dnsOverrides
+	ctx.abort = 0
+	original.Body = body.original()
+	ctx.Req = original
+	return original
+}
+
+// observeResponse runs the response handlers, discarding their changes.
+func (proxy *ProxyHttpServer) observeResponse(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	var original *http.Response
+	var body *observedBody
+	if resp != nil {
+		copied := *resp
+		copied.Header = resp.Header.Clone()
+		copied.Trailer = resp.Trailer.Clone()
+		original = &copied
+		body = &observedBody{body: resp.Body}
+		resp.Body = body.copy()
+	}
+
+	for _, h := range proxy.respHandlers {
+		ctx.Resp = resp
+		if next := h.Handle(resp, ctx); next != nil {
+			resp = next
+		}
+	}
+
+	ctx.abort = 0
+	if original != nil {
+		original.Body = body.original()
+	}
+	ctx.Resp = original
+	return original
+}
+
+// observedBody is the copy of a body read by the handlers in read-only
+// mode. What they read is buffered, so that the original body is still
+// forwarded whole.
+type observedBody struct {
+	mu     sync.Mutex
+	body   io.ReadCloser
+	read   bytes.Buffer
+	sealed bool
+}
+
+// copy returns the copy of the body read by the handlers.
+func (b *observedBody) copy() io.ReadCloser {
+	if b.body == nil || b.body == http.NoBody {
+		return b.body
+	}
+	return b
+}
+
+func (b *observedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sealed {
+		// The original body is being forwarded
+		return 0, io.EOF
+	}
+	n, err := b.body.Read(p)
+	b.read.Write(p[:n])
+	return n, err
+}
+
+// Close doesn't close the original body, which is still to be forwarded.
+func (b *observedBody) Close() error {
+	return nil
+}
+
+// original returns the original body, starting with the part read by
+// the handlers, which can't read their copy anymore.
+func (b *observedBody) original() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sealed = true
+	if b.read.Len() == 0 {
+		return b.body
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&b.read, b.body), b.body}
+}
+
+// observeConnect restricts the action of a CONNECT handler to the ones
+// that don't alter the traffic.
+func observeConnect(todo *ConnectAction, host, originalHost string, ctx *ProxyCtx) (*ConnectAction, string) {
+	switch todo.Action {
+	case ConnectAccept, ConnectMitm, ConnectHTTPMitm, ConnectAutoMitm:
+	default:
+		ctx.Logf("Read-only mode: accepting CONNECT instead of %v", todo.Action)
+		todo = OkConnect
+	}
+	if host != originalHost {
+		ctx.Logf("Read-only mode: ignoring CONNECT host rewrite to %s", host)
+	}
+	return todo, originalHost
+}
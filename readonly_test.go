@@ -0,0 +1,92 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	var requests, responses int32
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/canned")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "canned")
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		atomic.AddInt32(&requests, 1)
+		req.URL.Path = "/headers"
+		req.Header.Set("X-Rewritten", "1")
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		atomic.AddInt32(&responses, 1)
+		resp.Header.Set("X-Rewritten", "1")
+		return resp
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Contains(t, string(getOrFail(t, srv.URL+"/bobo", client)), "X-Rewritten")
+
+	proxy.SetReadOnly(true)
+	assert.True(t, proxy.ReadOnly())
+	for _, backend := range []string{srv.URL, https.URL} {
+		assert.Equal(t, "bobo", string(getOrFail(t, backend+"/bobo", client)))
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, backend+"/canned", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			assert.Empty(t, resp.Header.Get("X-Rewritten"))
+		}
+	}
+	// The handlers still observe the traffic
+	assert.Equal(t, int32(5), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&responses))
+
+	proxy.SetReadOnly(false)
+	assert.Equal(t, "canned", string(getOrFail(t, srv.URL+"/canned", client)))
+}
+
+func TestReadOnlyModeBodies(t *testing.T) {
+	var requestBody, responseBody string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		requestBody = string(body)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		responseBody = string(body)
+		return resp
+	})
+	proxy.SetReadOnly(true)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/query", strings.NewReader("result=echoed"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "echoed", string(body))
+	assert.Equal(t, "result=echoed", requestBody)
+	assert.Equal(t, "echoed", responseBody)
+}
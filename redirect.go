@@ -0,0 +1,98 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// RedirectHop is a redirection followed by the proxy.
+type RedirectHop struct {
+	// Method and URL are the ones of the redirected request.
+	Method string
+	URL    *url.URL
+	// StatusCode is the status of the redirection.
+	StatusCode int
+	// Location is the URL the request was redirected to.
+	Location *url.URL
+}
+
+// followRedirects sends req, following the redirections of the responses
+// up to the FollowRedirects limit.
+func (ctx *ProxyCtx) followRedirects(req *http.Request) (*http.Response, error) {
+	for hops := 0; ; hops++ {
+		resp, err := ctx.retryRoundTrip(req)
+		if err != nil || hops >= ctx.Proxy.FollowRedirects {
+			return resp, err
+		}
+		next := redirectRequest(req, resp)
+		if next == nil {
+			return resp, nil
+		}
+		ctx.Logf("Following redirection %d to %v", resp.StatusCode, next.URL)
+		ctx.Redirects = append(ctx.Redirects, RedirectHop{
+			Method:     req.Method,
+			URL:        req.URL,
+			StatusCode: resp.StatusCode,
+			Location:   next.URL,
+		})
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDiscardedBody))
+		resp.Body.Close()
+		req = next
+	}
+}
+
+// redirectRequest returns the request following the redirection resp, nil
+// if it can't be followed. It mimics the behavior of http.Client.
+func redirectRequest(req *http.Request, resp *http.Response) *http.Request {
+	var keepBody bool
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		keepBody = true
+	default:
+		return nil
+	}
+	header := resp.Header.Get("Location")
+	if header == "" {
+		return nil
+	}
+	location, err := req.URL.Parse(header)
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") {
+		return nil
+	}
+
+	next := req.Clone(req.Context())
+	next.URL = location
+	next.Host = ""
+	next.RequestURI = ""
+	if keepBody {
+		if req.Body != nil && req.Body != http.NoBody {
+			// The body has been sent already
+			if req.GetBody == nil {
+				return nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil
+			}
+			next.Body = body
+		}
+	} else {
+		if req.Method != http.MethodHead {
+			next.Method = http.MethodGet
+		}
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	if location.Hostname() != req.URL.Hostname() {
+		// Don't leak the credentials to other hosts
+		next.Header.Del("Authorization")
+		next.Header.Del("Www-Authenticate")
+		next.Header.Del("Cookie")
+	}
+	return next
+}
@@ -0,0 +1,74 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/middle", http.StatusFound)
+	})
+	mux.HandleFunc("/middle", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/end", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/end", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Method+" end")
+	})
+	backend := httptest.NewServer(mux)
+	defer backend.Close()
+
+	testCases := []struct {
+		name     string
+		max      int
+		status   int
+		body     string
+		redirect []string
+	}{
+		{"all hops", 5, http.StatusOK, "GET end", []string{"/start", "/middle"}},
+		{"limited", 1, http.StatusSeeOther, "", []string{"/start"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.FollowRedirects = tc.max
+			var redirects []goproxy.RedirectHop
+			proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				redirects = ctx.Redirects
+				return resp
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+			client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, backend.URL+"/start", strings.NewReader("data"))
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.status, resp.StatusCode)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, string(body))
+			}
+			paths := make([]string, len(redirects))
+			for i, hop := range redirects {
+				paths[i] = hop.URL.Path
+			}
+			assert.Equal(t, tc.redirect, paths)
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver resolves the host names of the destinations, see
+// ProxyHttpServer.Resolver. It's implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ResolveTo returns a ReqHandler making the proxy connect to ip for the
+// host of the matched requests, without changing their Host header or TLS
+// server name, e.g. to test a staging server under its public name:
+//
+//	proxy.OnRequest(goproxy.DstHostIs("www.example.com")).Do(goproxy.ResolveTo(net.ParseIP("10.0.0.5")))
+//
+// The override only applies to the current exchange, see
+// ProxyCtx.DNSOverrides.
+func ResolveTo(ip net.IP) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.DNSOverrides == nil {
+			ctx.DNSOverrides = make(map[string]net.IP)
+		}
+		ctx.DNSOverrides[req.URL.Hostname()] = ip
+		return req, nil
+	})
+}
+
+// resolveAddr returns the address to dial for addr, with its host replaced
+// by the IP address it's overridden to.
+func (ctx *ProxyCtx) resolveAddr(addr string) string {
+	if len(ctx.DNSOverrides) == 0 {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	for name, ip := range ctx.DNSOverrides {
+		if strings.EqualFold(name, host) && ip != nil {
+			return net.JoinHostPort(ip.String(), port)
+		}
+	}
+	return addr
+}
+
+// resolver returns the Resolver of the exchange of ctx, if any.
+func (proxy *ProxyHttpServer) resolver(ctx *ProxyCtx) Resolver {
+	if ctx != nil && ctx.Resolver != nil {
+		return ctx.Resolver
+	}
+	return proxy.Resolver
+}
+
+// dialResolved dials addr with dial, mapped by the proxy Hosts, and its
+// host name resolved by the Resolver of the exchange of ctx, if any: the
+// addresses are tried in order, or as selected by the address family
+// preferences of the proxy.
+func (proxy *ProxyHttpServer) dialResolved(
+	ctx *ProxyCtx,
+	c context.Context,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, addr string,
+) (net.Conn, error) {
+	if proxy.DestinationGuard != nil {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		dial = proxy.DestinationGuard.guard(host, dial)
+	}
+	if proxy.Hosts != nil {
+		network, addr, _ = proxy.Hosts.Lookup(network, addr)
+	}
+	resolver := proxy.resolver(ctx)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || strings.HasPrefix(network, "unix") {
+		return dial(c, network, addr)
+	}
+	family, delay, configured := proxy.dialPreference(host)
+	if ip := net.ParseIP(host); ip != nil {
+		if !configured {
+			return dial(c, network, addr)
+		}
+		if primaries, _ := sortAddressFamilies([]net.IP{ip}, family); len(primaries) == 0 {
+			return nil, errors.New("address family of " + host + " excluded")
+		}
+		return dial(c, network, addr)
+	}
+	if resolver == nil {
+		if !configured {
+			return dial(c, network, addr)
+		}
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(c, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	ips = filterAddressFamily(ips, network)
+	if !configured {
+		if ctx != nil {
+			ctx.ResolvedIPs = ips
+		}
+		if len(ips) == 0 {
+			return nil, errors.New("no address for " + host)
+		}
+		return dialSerial(c, dial, network, port, ips)
+	}
+	primaries, fallbacks := sortAddressFamilies(ips, family)
+	if ctx != nil {
+		ctx.ResolvedIPs = append(append([]net.IP(nil), primaries...), fallbacks...)
+	}
+	if len(primaries) == 0 {
+		return nil, errors.New("no address for " + host)
+	}
+	return dialHappyEyeballs(c, dial, network, port, primaries, fallbacks, delay)
+}
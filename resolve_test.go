@@ -0,0 +1,90 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveTo(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.DstHostIs("goproxy.invalid")).Do(goproxy.ResolveTo(net.ParseIP("127.0.0.1")))
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for _, backend := range []string{srv.URL, https.URL} {
+		u, _ := url.Parse(backend)
+		u.Host = net.JoinHostPort("goproxy.invalid", u.Port())
+		assert.Equal(t, "bobo", string(getOrFail(t, u.String()+"/bobo", client)))
+	}
+}
+
+// staticResolver resolves its host names to the loopback address.
+type staticResolver map[string]bool
+
+func (r staticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if !r[host] {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestProxyResolver(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend string
+		action  *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.Resolver = staticResolver{"backend.test": true}
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+			resolved := make(chan []net.IP, 1)
+			proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				resolved <- ctx.ResolvedIPs
+				return resp
+			})
+
+			u, err := url.Parse(test.backend)
+			require.NoError(t, err)
+			u.Host = net.JoinHostPort("backend.test", u.Port())
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, u.String()+"/bobo"))
+			if test.action != goproxy.OkConnect {
+				ips := <-resolved
+				require.Len(t, ips, 1)
+				assert.Equal(t, "127.0.0.1", ips[0].String())
+			}
+		})
+	}
+}
+
+func TestCtxResolver(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Resolver = staticResolver{}
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Resolver = staticResolver{"override.test": true}
+		return req, nil
+	})
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	u.Host = net.JoinHostPort("override.test", u.Port())
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, u.String()+"/bobo"))
+}
@@ -0,0 +1,150 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy makes the proxy retry the idempotent requests failing on the
+// upstream leg, see ProxyHttpServer.Retry.
+//
+//	proxy.Retry = &goproxy.RetryPolicy{NetworkErrors: true, StatusCodes: []int{502, 503, 504}}
+//
+// The requests whose body was sent already are only retried when it can
+// be sent again, see http.Request.GetBody.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request,
+	// including the first one, 3 if zero.
+	MaxAttempts int
+	// Methods are the retried methods, the idempotent methods of RFC 9110
+	// if nil: GET, HEAD, OPTIONS, TRACE, PUT and DELETE.
+	Methods []string
+	// StatusCodes are the statuses of the retried responses.
+	StatusCodes []int
+	// NetworkErrors retries the requests failing without a response, e.g.
+	// when the destination can't be reached.
+	NetworkErrors bool
+	// Backoff is the delay before the first retry, 100ms if zero, doubled
+	// for each next retry up to MaxBackoff, 5 seconds if zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// RetryAttempt is a failed attempt of a request retried by the proxy, see
+// ProxyCtx.Retries.
+type RetryAttempt struct {
+	// StatusCode is the status of the response of the attempt, 0 when it
+	// failed with Err.
+	StatusCode int
+	Err        error
+	// Delay is the time waited before the next attempt.
+	Delay time.Duration
+}
+
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+}
+
+func (p *RetryPolicy) retriesMethod(method string) bool {
+	methods := p.Methods
+	if methods == nil {
+		methods = idempotentMethods
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// retries tells whether the attempt answered resp, or failed with err,
+// is retried.
+func (p *RetryPolicy) retries(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return p.NetworkErrors && req.Context().Err() == nil
+	}
+	for _, code := range p.StatusCodes {
+		if code == resp.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay, maxDelay := p.Backoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	if maxDelay <= 0 {
+		maxDelay = 5 * time.Second
+	}
+	for ; retry > 0 && delay < maxDelay; retry-- {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// retryRoundTrip sends req, retrying it as configured by the Retry policy
+// of the proxy. The failed attempts are recorded in ctx.Retries.
+func (ctx *ProxyCtx) retryRoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx.Proxy == nil || ctx.Proxy.Retry == nil || !ctx.Proxy.Retry.retriesMethod(req.Method) {
+		return ctx.roundTrip(req)
+	}
+	policy := ctx.Proxy.Retry
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	var body *retryBody
+	if hasBody && req.GetBody == nil {
+		body = &retryBody{ReadCloser: req.Body}
+		req.Body = body
+		defer body.release()
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := ctx.roundTrip(req)
+		if attempt >= policy.maxAttempts() || !policy.retries(req, resp, err) || (body != nil && body.wasRead()) {
+			return resp, err
+		}
+		next := req
+		if hasBody && req.GetBody != nil {
+			b, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			next = req.Clone(req.Context())
+			next.Body = b
+		}
+
+		record := RetryAttempt{Err: err, Delay: policy.backoff(attempt - 1)}
+		if resp != nil {
+			record.StatusCode = resp.StatusCode
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDiscardedBody))
+			_ = resp.Body.Close()
+		}
+		ctx.Retries = append(ctx.Retries, record)
+		if err != nil {
+			ctx.Logf("Retrying %s %v in %v after error: %v", req.Method, req.URL, record.Delay, err)
+		} else {
+			ctx.Logf("Retrying %s %v in %v after status %d", req.Method, req.URL, record.Delay, record.StatusCode)
+		}
+		timer := time.NewTimer(record.Delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		req = next
+	}
+}
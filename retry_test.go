@@ -0,0 +1,98 @@
+package goproxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer returns a backend failing its first failures requests, by
+// answering 503 or by closing the connection, then answering "bobo" with
+// the request body.
+func flakyServer(t *testing.T, failures int32, closeConn bool) *httptest.Server {
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if requests.Add(1) <= failures {
+			if closeConn {
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err == nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(append([]byte("bobo"), body...))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		method    string
+		failures  int32
+		closeConn bool
+		status    int
+		body      string
+		retries   []int
+	}{
+		{"status", http.MethodGet, 2, false, http.StatusOK, "bobo", []int{503, 503}},
+		{"network-error", http.MethodGet, 1, true, http.StatusOK, "bobo", []int{0}},
+		// The body can't be sent again
+		{"put-body-sent", http.MethodPut, 1, false, http.StatusServiceUnavailable, "", nil},
+		{"post", http.MethodPost, 1, false, http.StatusServiceUnavailable, "", nil},
+		{"exhausted", http.MethodGet, 5, false, http.StatusServiceUnavailable, "", []int{503, 503}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend := flakyServer(t, test.failures, test.closeConn)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Retry = &goproxy.RetryPolicy{
+				StatusCodes:   []int{http.StatusServiceUnavailable},
+				NetworkErrors: true,
+				Backoff:       time.Millisecond,
+			}
+			retries := make(chan []goproxy.RetryAttempt, 1)
+			proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				retries <- ctx.Retries
+				return resp
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			var body io.Reader
+			if test.method != http.MethodGet {
+				body = strings.NewReader("-body")
+			}
+			req, err := http.NewRequest(test.method, backend.URL+"/bobo", body)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.status, resp.StatusCode)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.body, string(got))
+			}
+
+			attempts := <-retries
+			require.Len(t, attempts, len(test.retries))
+			for i, status := range test.retries {
+				assert.Equal(t, status, attempts[i].StatusCode)
+				assert.Equal(t, status == 0, attempts[i].Err != nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package goproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReverseRoute maps the requests for a host and path prefix to an
+// upstream server.
+type ReverseRoute struct {
+	// Host is the host the route applies to, without port, any host if
+	// empty.
+	Host string
+	// PathPrefix is the path the route applies to, with its sub-paths,
+	// "/" if empty: "/v1" and "/v1/" match "/v1" and "/v1/users", not
+	// "/v10". The paths of the requests are cleaned before matching.
+	PathPrefix string
+	// Upstream is the URL of the server the requests are sent to. Its path
+	// is prepended to the paths of the requests.
+	Upstream *url.URL
+	// StripPrefix removes PathPrefix from the paths of the requests.
+	StripPrefix bool
+	// Socket, if set, is the path of the Unix domain socket of the
+	// upstream server, e.g. a local daemon during development. The host
+	// of Upstream is then mapped to it in the proxy Hosts, Upstream
+	// defaulting to a made-up http URL.
+	Socket string
+}
+
+// ReverseRoutes makes the proxy a reverse proxy: it's a routing table,
+// used as the NonproxyHandler of the proxy, sending the requests made to
+// the proxy itself to upstream servers through the same handlers as the
+// proxied requests, WebSockets included:
+//
+//	routes := goproxy.NewReverseRoutes(proxy)
+//	if err := routes.Add("api.example.com/v1/", "http://10.0.0.5:8080"); err != nil {
+//		log.Fatal(err)
+//	}
+//	proxy.NonproxyHandler = routes
+//	proxy.OnResponse(goproxy.DstHostIs("10.0.0.5:8080")).DoFunc(...)
+//
+// The most specific route applies: the routes for a host are preferred to
+// the ones for any host, then the longest path prefix wins.
+type ReverseRoutes struct {
+	// NotFound handles the requests without route, a 404 error if nil.
+	NotFound http.Handler
+	// PreserveHost sends the Host header of the client to the upstream
+	// servers, instead of their own host.
+	PreserveHost bool
+
+	proxy  *ProxyHttpServer
+	mu     sync.RWMutex
+	routes []ReverseRoute
+}
+
+// NewReverseRoutes returns an empty routing table sending the requests
+// through proxy.
+func NewReverseRoutes(proxy *ProxyHttpServer) *ReverseRoutes {
+	return &ReverseRoutes{proxy: proxy}
+}
+
+// Add adds a route from a pattern, "host/path/prefix" or "/path/prefix"
+// for any host, to the upstream URL, or to the Unix domain socket of an
+// upstream server, as "unix:///run/app.sock".
+func (rt *ReverseRoutes) Add(pattern, upstream string) error {
+	host, path := pattern, "/"
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		host, path = pattern[:i], pattern[i:]
+	}
+	if socket, ok := strings.CutPrefix(upstream, "unix://"); ok {
+		if socket == "" {
+			return fmt.Errorf("upstream %q has no socket path", upstream)
+		}
+		rt.Handle(ReverseRoute{Host: host, PathPrefix: path, Socket: socket})
+		return nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("upstream %q must be an absolute URL", upstream)
+	}
+	rt.Handle(ReverseRoute{Host: host, PathPrefix: path, Upstream: u})
+	return nil
+}
+
+// Handle adds route to the table. It can be called while the proxy is
+// running, unless route has a Socket and the proxy Hosts is nil: the
+// table then sets it.
+func (rt *ReverseRoutes) Handle(route ReverseRoute) {
+	route.Host = strings.ToLower(route.Host)
+	if route.PathPrefix == "" {
+		route.PathPrefix = "/"
+	}
+	if route.Socket != "" {
+		if route.Upstream == nil {
+			sum := sha256.Sum256([]byte(route.Socket))
+			route.Upstream = &url.URL{Scheme: "http", Host: "unix-" + hex.EncodeToString(sum[:4]) + ".localhost"}
+		}
+		if rt.proxy.Hosts == nil {
+			rt.proxy.Hosts = NewDialTargets()
+		}
+		rt.proxy.Hosts.Set(route.Upstream.Hostname(), "unix://"+route.Socket)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = append(rt.routes, route)
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+}
+
+// Route returns the route of req, if any.
+func (rt *ReverseRoutes) Route(req *http.Request) (ReverseRoute, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	path := cleanPath(req.URL.Path)
+	for _, route := range rt.routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if _, ok := hasPathPrefix(path, route.PathPrefix); ok {
+			return route, true
+		}
+	}
+	return ReverseRoute{}, false
+}
+
+// ServeHTTP sends req to the upstream server of its route.
+func (rt *ReverseRoutes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route, ok := rt.Route(req)
+	if !ok {
+		if rt.NotFound != nil {
+			rt.NotFound.ServeHTTP(w, req)
+		} else {
+			http.NotFound(w, req)
+		}
+		return
+	}
+
+	path := cleanPath(req.URL.Path)
+	if route.StripPrefix {
+		rest, _ := hasPathPrefix(path, route.PathPrefix)
+		path = "/" + strings.TrimPrefix(rest, "/")
+	}
+	out := *req.URL
+	out.Scheme = route.Upstream.Scheme
+	out.Host = route.Upstream.Host
+	out.Path = singleJoiningSlash(route.Upstream.Path, path)
+	out.RawPath = ""
+	if route.Upstream.RawQuery != "" && req.URL.RawQuery != "" {
+		out.RawQuery = route.Upstream.RawQuery + "&" + req.URL.RawQuery
+	} else if route.Upstream.RawQuery != "" {
+		out.RawQuery = route.Upstream.RawQuery
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.URL = &out
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := outReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outReq.Header.Set("X-Forwarded-Host", req.Host)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	outReq.Header.Set("X-Forwarded-Proto", proto)
+	if !rt.PreserveHost {
+		outReq.Host = route.Upstream.Host
+	}
+	rt.proxy.ServeHTTP(w, outReq)
+}
+
+// cleanPath returns the canonical form of the unescaped path p, keeping
+// its trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// hasPathPrefix tells whether the cleaned path p is the path prefix or one
+// of its sub-paths, whether prefix ends with a slash or not, and returns
+// the rest of p.
+func hasPathPrefix(p, prefix string) (string, bool) {
+	base := strings.TrimSuffix(prefix, "/")
+	switch {
+	case base == "":
+		return p, true
+	case p == base:
+		return "", true
+	case strings.HasPrefix(p, base+"/"):
+		return p[len(base):], true
+	}
+	return "", false
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,111 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseRoutes(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.URL.RequestURI()+" "+r.Header.Get("X-Forwarded-Host"))
+		}))
+	}
+	api, web := upstream("api"), upstream("web")
+	defer api.Close()
+	defer web.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	routes := goproxy.NewReverseRoutes(proxy)
+	require.NoError(t, routes.Add("/", web.URL))
+	require.NoError(t, routes.Add("api.example.com/v1/", api.URL+"/internal"))
+	apiURL, err := url.Parse(api.URL)
+	require.NoError(t, err)
+	routes.Handle(goproxy.ReverseRoute{PathPrefix: "/static/", Upstream: apiURL, StripPrefix: true})
+	assert.Error(t, routes.Add("/", "not/absolute"))
+	proxy.NonproxyHandler = routes
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Intercepted", "1")
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	get := func(host, path string) (string, *http.Response) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, s.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp
+	}
+
+	body, resp := get("api.example.com", "/v1/users?id=1")
+	assert.Equal(t, "api /internal/v1/users?id=1 api.example.com", body)
+	assert.Equal(t, "1", resp.Header.Get("X-Intercepted"))
+	body, _ = get("www.example.com", "/v1/users")
+	assert.Equal(t, "web /v1/users www.example.com", body)
+	// The prefixes match whole path segments, of the cleaned paths
+	body, _ = get("api.example.com", "/v1")
+	assert.Equal(t, "api /internal/v1 api.example.com", body)
+	body, _ = get("api.example.com", "/v10/users")
+	assert.Equal(t, "web /v10/users api.example.com", body)
+	body, _ = get("api.example.com", "/static/../v1/users")
+	assert.Equal(t, "api /internal/v1/users api.example.com", body)
+	body, _ = get("www.example.com", "/static/app.js")
+	assert.Equal(t, "api /app.js www.example.com", body)
+}
+
+func TestReverseRoutesNotFound(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	routes := goproxy.NewReverseRoutes(proxy)
+	require.NoError(t, routes.Add("api.example.com/", "http://127.0.0.1:1"))
+	proxy.NonproxyHandler = routes
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "404"))
+}
+
+func TestReverseRoutesUnixSocket(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "app.sock"))
+	require.NoError(t, err)
+	backend := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "socket "+r.URL.RequestURI())
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	routes := goproxy.NewReverseRoutes(proxy)
+	require.NoError(t, routes.Add("/daemon/", "unix://"+l.Addr().String()))
+	assert.Error(t, routes.Add("/", "unix://"))
+	proxy.NonproxyHandler = routes
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/daemon/info")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "socket /daemon/info", string(body))
+}
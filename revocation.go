@@ -0,0 +1,421 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ocspPath = "/ocsp"
+	crlPath  = "/crl/"
+
+	ocspStatusSuccessful   = 0
+	ocspStatusMalformed    = 1
+	ocspStatusInternal     = 2
+	ocspStatusUnauthorized = 6
+
+	maxOCSPRequestSize = 16 << 10
+)
+
+var (
+	oidOCSPBasic         = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1              = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSHA256WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidEd25519           = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidCRLNumber         = asn1.ObjectIdentifier{2, 5, 29, 20}
+	errUnknownIssuer     = errors.New("unknown issuer")
+	errUnsupportedHashID = errors.New("unsupported hash algorithm")
+)
+
+// RevocationResponder answers the revocation checks (OCSP and CRL) of the
+// certificates generated for MITM, so that the clients hard-failing when
+// the revocation status can't be fetched still accept them.
+// When the proxy RevocationResponder is set, the generated certificates
+// point to BaseURL, that must be reachable by the clients, usually through
+// the proxy itself:
+//
+//	proxy.RevocationResponder = goproxy.NewRevocationResponder("http://revocation.goproxy.invalid")
+//
+// The requests to the host of BaseURL going through the proxy, or made
+// directly to the proxy on the path of BaseURL, are answered locally.
+// Every certificate is reported as good.
+type RevocationResponder struct {
+	// BaseURL is the URL prefix of the OCSP responder and of the CRLs.
+	BaseURL string
+	// Validity is how long the answers can be cached by the clients.
+	Validity time.Duration
+
+	mu  sync.RWMutex
+	cas map[string]*tls.Certificate
+}
+
+// NewRevocationResponder returns a RevocationResponder serving answers
+// valid for 24 hours under baseURL.
+func NewRevocationResponder(baseURL string) *RevocationResponder {
+	return &RevocationResponder{
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		Validity: 24 * time.Hour,
+		cas:      make(map[string]*tls.Certificate),
+	}
+}
+
+// register makes the responder answer for the certificates signed by ca,
+// and returns the OCSP and CRL URLs of these certificates.
+func (r *RevocationResponder) register(ca *tls.Certificate) (ocspURL, crlURL string, err error) {
+	caCert, err := parseCA(ca)
+	if err != nil {
+		return "", "", err
+	}
+	keyHash, err := issuerKeyHash(caCert, sha1.New)
+	if err != nil {
+		return "", "", err
+	}
+	id := hex.EncodeToString(keyHash)
+
+	r.mu.Lock()
+	if r.cas == nil {
+		r.cas = make(map[string]*tls.Certificate)
+	}
+	r.cas[id] = ca
+	r.mu.Unlock()
+	return r.BaseURL + ocspPath, r.BaseURL + crlPath + id + ".crl", nil
+}
+
+// handles reports whether req is a revocation check for the responder.
+func (r *RevocationResponder) handles(req *http.Request) bool {
+	base, err := url.Parse(r.BaseURL)
+	if err != nil {
+		return false
+	}
+	if req.URL.IsAbs() {
+		return strings.EqualFold(req.URL.Host, base.Host)
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, base.Path)
+	return ok && (path == ocspPath || strings.HasPrefix(path, ocspPath+"/") || strings.HasPrefix(path, crlPath))
+}
+
+// ServeHTTP answers the OCSP requests, sent with POST or GET, and the CRL
+// downloads.
+func (r *RevocationResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	base, _ := url.Parse(r.BaseURL)
+	path := strings.TrimPrefix(req.URL.Path, base.Path)
+
+	switch {
+	case strings.HasPrefix(path, crlPath):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, crlPath), ".crl")
+		r.mu.RLock()
+		ca := r.cas[id]
+		r.mu.RUnlock()
+		if ca == nil {
+			http.NotFound(w, req)
+			return
+		}
+		crl, err := r.createCRL(ca)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		_, _ = w.Write(crl)
+	case path == ocspPath || strings.HasPrefix(path, ocspPath+"/"):
+		var der []byte
+		var err error
+		if req.Method == http.MethodPost {
+			der, err = io.ReadAll(io.LimitReader(req.Body, maxOCSPRequestSize))
+		} else {
+			// The request is base64 encoded in the path, possibly URL escaped
+			encoded, _ := url.PathUnescape(strings.TrimPrefix(path, ocspPath+"/"))
+			der, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		resp := r.ocspResponse(der, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(resp)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspSingleRequest struct {
+	CertID     asn1.RawValue
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     asn1.RawValue
+	Good       asn1.Flag `asn1:"tag:0,optional"`
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	ResponderKeyHash []byte    `asn1:"explicit,tag:2"`
+	ProducedAt       time.Time `asn1:"generalized"`
+	Responses        []ocspSingleResponse
+}
+
+type signedData struct {
+	TBS                asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspResponse returns the DER encoded answer to the OCSP request der.
+func (r *RevocationResponder) ocspResponse(der []byte, err error) []byte {
+	var status asn1.Enumerated = ocspStatusMalformed
+	if err == nil {
+		var basic []byte
+		basic, err = r.basicOCSPResponse(der)
+		switch {
+		case err == nil:
+			resp, err := asn1.Marshal(ocspResponse{
+				Status:        ocspStatusSuccessful,
+				ResponseBytes: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic},
+			})
+			if err == nil {
+				return resp
+			}
+			status = ocspStatusInternal
+		case errors.Is(err, errUnknownIssuer):
+			status = ocspStatusUnauthorized
+		}
+	}
+	resp, _ := asn1.Marshal(ocspResponse{Status: status})
+	return resp
+}
+
+// basicOCSPResponse returns the signed BasicOCSPResponse reporting the
+// certificates of the OCSP request der as good.
+func (r *RevocationResponder) basicOCSPResponse(der []byte) ([]byte, error) {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, err
+	} else if len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return nil, errors.New("malformed OCSP request")
+	}
+
+	var ca *tls.Certificate
+	var caCert *x509.Certificate
+	now := time.Now().UTC().Truncate(time.Second)
+	data := ocspResponseData{ProducedAt: now}
+	for _, single := range req.TBSRequest.RequestList {
+		var id ocspCertID
+		if _, err := asn1.Unmarshal(single.CertID.FullBytes, &id); err != nil {
+			return nil, err
+		}
+		issuer, issuerCert, err := r.issuer(id)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil && ca != issuer {
+			return nil, errUnknownIssuer
+		}
+		ca, caCert = issuer, issuerCert
+		data.Responses = append(data.Responses, ocspSingleResponse{
+			CertID:     single.CertID,
+			Good:       true,
+			ThisUpdate: now,
+			NextUpdate: now.Add(r.Validity),
+		})
+	}
+	keyHash, err := issuerKeyHash(caCert, sha1.New)
+	if err != nil {
+		return nil, err
+	}
+	data.ResponderKeyHash = keyHash
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return signTBS(ca, tbs)
+}
+
+// issuer returns the registered CA matching the OCSP certificate ID.
+func (r *RevocationResponder) issuer(id ocspCertID) (*tls.Certificate, *x509.Certificate, error) {
+	var newHash func() hash.Hash
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		newHash = sha1.New
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		newHash = sha256.New
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA384):
+		newHash = sha512.New384
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA512):
+		newHash = sha512.New
+	default:
+		return nil, nil, errUnsupportedHashID
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, ca := range r.cas {
+		caCert, err := parseCA(ca)
+		if err != nil {
+			continue
+		}
+		keyHash, err := issuerKeyHash(caCert, newHash)
+		if err == nil && bytes.Equal(keyHash, id.IssuerKeyHash) {
+			return ca, caCert, nil
+		}
+	}
+	return nil, nil, errUnknownIssuer
+}
+
+type tbsCertList struct {
+	Version    int
+	Signature  pkix.AlgorithmIdentifier
+	Issuer     asn1.RawValue
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Extensions []pkix.Extension `asn1:"explicit,tag:0"`
+}
+
+// createCRL returns an empty CRL signed by ca. It's built by hand since
+// x509.CreateRevocationList requires the CRL signing key usage, that
+// most MITM CAs lack.
+func (r *RevocationResponder) createCRL(ca *tls.Certificate) ([]byte, error) {
+	caCert, err := parseCA(ca)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, _, err := signatureAlgorithm(ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	crlNumber, err := asn1.Marshal(big.NewInt(now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	tbs, err := asn1.Marshal(tbsCertList{
+		Version:    1, // v2
+		Signature:  algorithm,
+		Issuer:     asn1.RawValue{FullBytes: caCert.RawSubject},
+		ThisUpdate: now,
+		NextUpdate: now.Add(r.Validity),
+		Extensions: []pkix.Extension{{Id: oidCRLNumber, Value: crlNumber}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signTBS(ca, tbs)
+}
+
+// signTBS returns the DER encoded structure made of tbs, followed by its
+// signature by ca.
+func signTBS(ca *tls.Certificate, tbs []byte) ([]byte, error) {
+	algorithm, hashFunc, err := signatureAlgorithm(ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+	}
+	digest := tbs
+	if hashFunc != 0 {
+		h := hashFunc.New()
+		h.Write(tbs)
+		digest = h.Sum(nil)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, hashFunc)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(signedData{
+		TBS:                asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: algorithm,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+}
+
+// signatureAlgorithm returns the algorithm used to sign with key.
+func signatureAlgorithm(key crypto.PrivateKey) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case *ecdsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, 0, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// issuerKeyHash returns the hash of the public key of caCert, as used in
+// OCSP to identify issuers.
+func issuerKeyHash(caCert *x509.Certificate, newHash func() hash.Hash) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(caCert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	h := newHash()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+func parseCA(ca *tls.Certificate) (*x509.Certificate, error) {
+	if ca.Leaf != nil {
+		return ca.Leaf, nil
+	}
+	return x509.ParseCertificate(ca.Certificate[0])
+}
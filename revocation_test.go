@@ -0,0 +1,108 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type testOCSPRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID testCertID
+		}
+	}
+}
+
+type testBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type testOCSPResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+func TestRevocationResponder(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.RevocationResponder = goproxy.NewRevocationResponder("http://revocation.goproxy.invalid")
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)("www.example.com:443", &goproxy.ProxyCtx{Proxy: proxy})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	require.Len(t, leaf.OCSPServer, 1)
+	require.Len(t, leaf.CRLDistributionPoints, 1)
+	ca := goproxy.GoproxyCa.Leaf
+
+	// OCSP
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki)
+	require.NoError(t, err)
+	nameHash := sha1.Sum(ca.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	var ocspReq testOCSPRequest
+	ocspReq.TBSRequest.RequestList = append(ocspReq.TBSRequest.RequestList, struct{ CertID testCertID }{testCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   leaf.SerialNumber,
+	}})
+	der, err := asn1.Marshal(ocspReq)
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(der))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	var ocspResp testOCSPResponse
+	_, err = asn1.Unmarshal(body, &ocspResp)
+	require.NoError(t, err)
+	require.Equal(t, asn1.Enumerated(0), ocspResp.Status)
+	var basic testBasicResponse
+	_, err = asn1.Unmarshal(ocspResp.ResponseBytes.Response, &basic)
+	require.NoError(t, err)
+	assert.NoError(t, ca.CheckSignature(x509.SHA256WithRSA, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()))
+
+	// CRL
+	crlDER := getOrFail(t, leaf.CRLDistributionPoints[0], client)
+	crl, err := x509.ParseRevocationList(crlDER)
+	require.NoError(t, err)
+	assert.NoError(t, crl.CheckSignatureFrom(ca))
+	assert.Empty(t, crl.RevokedCertificateEntries)
+	assert.True(t, crl.NextUpdate.After(time.Now()))
+}
@@ -0,0 +1,145 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewDoTResolver returns a resolver sending its DNS queries over TLS (RFC
+// 7858) to server, a host:port address such as "1.1.1.1:853". config can
+// be nil, the server name is then the host of server.
+//
+//	proxy.Resolver = goproxy.NewDoTResolver("dns.quad9.net:853", nil)
+func NewDoTResolver(server string, config *tls.Config) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := tls.Dialer{Config: config}
+			return d.DialContext(ctx, "tcp", server)
+		},
+	}
+}
+
+// NewDoHResolver returns a resolver sending its DNS queries over HTTPS
+// (RFC 8484) to serverURL, such as "https://1.1.1.1/dns-query", with
+// client, http.DefaultClient if nil.
+//
+//	proxy.Resolver = goproxy.NewDoHResolver("https://1.1.1.1/dns-query", nil)
+func NewDoHResolver(serverURL string, client *http.Client) *net.Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: serverURL, client: client}, nil
+		},
+	}
+}
+
+// dohConn is the connection of the resolvers of NewDoHResolver. Like a
+// TCP connection, the queries written to it and the responses read from
+// it are prefixed with their length, each query being POSTed to the DoH
+// server.
+type dohConn struct {
+	ctx      context.Context
+	url      string
+	client   *http.Client
+	deadline time.Time
+
+	query    bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) exchange() error {
+	q := c.query.Bytes()
+	if len(q) < 2 || len(q) < 2+int(binary.BigEndian.Uint16(q)) {
+		return io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint16(q))
+	msg := append([]byte(nil), q[2:2+length]...)
+	c.query.Next(2 + length)
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DoH server %s: %s", c.url, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff+1))
+	if err != nil {
+		return err
+	}
+	if len(answer) > 0xffff {
+		return errors.New("DoH answer too large")
+	}
+	c.response.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+	c.response.Write(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr{}
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr{}
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
@@ -0,0 +1,107 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerDNS answers the A queries of example.test. with 192.0.2.10, and
+// the other queries of the name without records.
+func answerDNS(t *testing.T, query []byte) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+	q := msg.Questions[0]
+	switch {
+	case q.Name.String() != "example.test.":
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	case q.Type == dnsmessage.TypeA:
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+		}}
+	}
+	answer, err := msg.Pack()
+	require.NoError(t, err)
+	return answer
+}
+
+func TestDoHResolver(t *testing.T) {
+	var queries atomic.Int32
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answerDNS(t, query))
+	}))
+	defer s.Close()
+
+	r := goproxy.NewDoHResolver(s.URL+"/dns-query", s.Client())
+	addrs, err := r.LookupIPAddr(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "192.0.2.10", addrs[0].IP.String())
+	assert.Positive(t, queries.Load())
+
+	_, err = r.LookupIPAddr(context.Background(), "missing.test")
+	assert.Error(t, err)
+}
+
+func TestDoTResolver(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{goproxy.GoproxyCa}})
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(c, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					answer := answerDNS(t, query)
+					var framed bytes.Buffer
+					_ = binary.Write(&framed, binary.BigEndian, uint16(len(answer)))
+					framed.Write(answer)
+					if _, err := c.Write(framed.Bytes()); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	r := goproxy.NewDoTResolver(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	addrs, err := r.LookupIPAddr(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.True(t, addrs[0].IP.Equal(net.ParseIP("192.0.2.10")))
+}
@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRewrite is what is done with a response header: it's kept if
+// zero, removed if Strip is set, and replaced by Value otherwise.
+type HeaderRewrite struct {
+	Strip bool
+	Value string
+}
+
+func (r HeaderRewrite) apply(header http.Header, name string) {
+	switch {
+	case r.Strip:
+		header.Del(name)
+	case r.Value != "" && header.Get(name) != "":
+		header.Set(name, r.Value)
+	}
+}
+
+// SecurityHeaders rewrites the Strict-Transport-Security and Expect-CT
+// headers of the responses, which pin the hosts to HTTPS and to publicly
+// logged certificates, and often get in the way of the setups relying on
+// the proxy, e.g. to stop browsers from remembering HSTS:
+//
+//	proxy.SecurityHeaders = &goproxy.SecurityHeaders{
+//		HSTS:     goproxy.HeaderRewrite{Value: "max-age=0"},
+//		ExpectCT: goproxy.HeaderRewrite{Strip: true},
+//	}
+//
+// The original values of the headers are kept in ProxyCtx.SecurityHeaders.
+type SecurityHeaders struct {
+	HSTS     HeaderRewrite
+	ExpectCT HeaderRewrite
+	// Hosts maps hostnames to the settings used for their responses
+	// instead of these ones.
+	Hosts map[string]*SecurityHeaders
+}
+
+// forHost returns the settings of the responses of host.
+func (s *SecurityHeaders) forHost(host string) *SecurityHeaders {
+	if specific, ok := s.Hosts[strings.ToLower(host)]; ok && specific != nil {
+		return specific
+	}
+	return s
+}
+
+// rewriteSecurityHeaders applies the SecurityHeaders option to resp,
+// before the response handlers are run.
+func (proxy *ProxyHttpServer) rewriteSecurityHeaders(resp *http.Response, ctx *ProxyCtx) {
+	if proxy.SecurityHeaders == nil || resp == nil {
+		return
+	}
+	for _, name := range []string{"Strict-Transport-Security", "Expect-Ct"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			if ctx.SecurityHeaders == nil {
+				ctx.SecurityHeaders = make(http.Header)
+			}
+			ctx.SecurityHeaders[name] = append([]string(nil), values...)
+		}
+	}
+	host := ""
+	if resp.Request != nil {
+		host = resp.Request.URL.Hostname()
+	} else if ctx.Req != nil {
+		host = ctx.Req.URL.Hostname()
+	}
+	settings := proxy.SecurityHeaders.forHost(host)
+	settings.HSTS.apply(resp.Header, "Strict-Transport-Security")
+	settings.ExpectCT.apply(resp.Header, "Expect-Ct")
+}
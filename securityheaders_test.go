@@ -0,0 +1,59 @@
+package goproxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		w.Header().Set("Expect-CT", "max-age=86400, enforce")
+	}))
+	defer backend.Close()
+
+	for _, test := range []struct {
+		name     string
+		hosts    map[string]*goproxy.SecurityHeaders
+		hsts     string
+		expectCT string
+	}{
+		{"rewrite", map[string]*goproxy.SecurityHeaders{"other.example": {}}, "max-age=0", ""},
+		{"host override", map[string]*goproxy.SecurityHeaders{"127.0.0.1": {}}, "max-age=31536000; includeSubDomains", "max-age=86400, enforce"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			proxy.SecurityHeaders = &goproxy.SecurityHeaders{
+				HSTS:     goproxy.HeaderRewrite{Value: "max-age=0"},
+				ExpectCT: goproxy.HeaderRewrite{Strip: true},
+				Hosts:    test.hosts,
+			}
+			originals := make(chan http.Header, 1)
+			proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+				originals <- ctx.SecurityHeaders
+				return resp
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, backend.URL, nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, test.hsts, resp.Header.Get("Strict-Transport-Security"))
+			assert.Equal(t, test.expectCT, resp.Header.Get("Expect-CT"))
+			original := <-originals
+			assert.Equal(t, "max-age=31536000; includeSubDomains", original.Get("Strict-Transport-Security"))
+			assert.Equal(t, "max-age=86400, enforce", original.Get("Expect-CT"))
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package goproxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionCache is a tls.ClientSessionCache keeping the TLS session of the
+// capacity most recently used upstream hosts, the session keys being the
+// server names. It counts the session lookups, to tune its capacity:
+//
+//	cache := goproxy.NewSessionCache(1024)
+//	proxy.UpstreamSessionCache = cache
+//	...
+//	hits, misses := cache.Stats()
+type SessionCache struct {
+	capacity int
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	lru      list.List
+	hits     atomic.Int64
+	misses   atomic.Int64
+}
+
+type cachedSession struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+// NewSessionCache returns a SessionCache keeping the sessions of up to
+// capacity hosts, 64 if capacity isn't positive.
+func NewSessionCache(capacity int) *SessionCache {
+	if capacity <= 0 {
+		capacity = 64
+	}
+	return &SessionCache{capacity: capacity, sessions: make(map[string]*list.Element)}
+}
+
+// Get implements tls.ClientSessionCache.
+func (c *SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sessions[sessionKey]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedSession).state, true
+}
+
+// Put implements tls.ClientSessionCache, evicting the least recently used
+// session if the cache is full. A nil cs removes the session of
+// sessionKey.
+func (c *SessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.sessions[sessionKey]; ok {
+		if cs == nil {
+			c.lru.Remove(e)
+			delete(c.sessions, sessionKey)
+			return
+		}
+		e.Value.(*cachedSession).state = cs
+		c.lru.MoveToFront(e)
+		return
+	}
+	if cs == nil {
+		return
+	}
+	c.sessions[sessionKey] = c.lru.PushFront(&cachedSession{key: sessionKey, state: cs})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedSession)
+		delete(c.sessions, oldest.key)
+	}
+}
+
+// Stats returns the number of session lookups that found a session to
+// resume, and of the ones that didn't.
+func (c *SessionCache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
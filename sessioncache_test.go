@@ -0,0 +1,64 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamSessionCache(t *testing.T) {
+	cache := goproxy.NewSessionCache(4)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.UpstreamSessionCache = cache
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+		require.NoError(t, err)
+		// Close the upstream connection, so that the next request makes a
+		// new handshake
+		req.Close = true
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "bobo", string(body))
+	}
+
+	hits, misses := cache.Stats()
+	assert.Equal(t, int64(1), hits)
+	assert.Equal(t, int64(1), misses)
+}
+
+func TestSessionCacheEviction(t *testing.T) {
+	cache := goproxy.NewSessionCache(2)
+	sessions := map[string]*tls.ClientSessionState{"a": {}, "b": {}, "c": {}}
+	cache.Put("a", sessions["a"])
+	cache.Put("b", sessions["b"])
+	// a becomes the most recently used session, b is evicted
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+	cache.Put("c", sessions["c"])
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c"} {
+		session, ok := cache.Get(key)
+		assert.True(t, ok, key)
+		assert.Same(t, sessions[key], session, key)
+	}
+
+	cache.Put("a", nil)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,267 @@
+package goproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks4Version = 4
+	socks5Version = 5
+
+	socksCmdConnect = 1
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NotAllowed          = 2
+	socks5HostUnreachable     = 4
+	socks5CmdNotSupported     = 7
+	socks5AddrTypeUnsupported = 8
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation.
+const socksHandshakeTimeout = 30 * time.Second
+
+var errSOCKSCommand = errors.New("unsupported SOCKS command")
+
+// ServeSOCKS accepts the SOCKS5 and SOCKS4a clients connecting to l, and
+// serves their requests as if they had sent a CONNECT request for their
+// destination, so they go through the CONNECT handlers and are MITM'd or
+// tunneled like the HTTP proxy clients. The username and password of the
+// SOCKS5 clients are passed to the handlers in the Proxy-Authorization
+// header of the CONNECT request, as Basic credentials.
+//
+// Only the CONNECT command is supported. ServeSOCKS always returns a
+// non-nil error.
+func (proxy *ProxyHttpServer) ServeSOCKS(l net.Listener) error {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go proxy.handleSOCKS(c)
+	}
+}
+
+func (proxy *ProxyHttpServer) handleSOCKS(c net.Conn) {
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(c)
+	version, err := reader.ReadByte()
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	connectReq := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	var reply func(status int) []byte
+	switch version {
+	case socks5Version:
+		connectReq.URL.Host, err = socks5Handshake(reader, c, connectReq.Header)
+		reply = socks5Reply
+	case socks4Version:
+		connectReq.URL.Host, err = socks4Handshake(reader)
+		reply = socks4Reply
+	default:
+		err = fmt.Errorf("unsupported SOCKS version %d", version)
+	}
+	if err != nil {
+		proxy.Logger.Printf("WARN: SOCKS handshake with %s failed: %v", c.RemoteAddr(), err)
+		if errors.Is(err, errSOCKSCommand) && reply != nil {
+			_, _ = c.Write(reply(http.StatusMethodNotAllowed))
+		}
+		_ = c.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	connectReq.Host = connectReq.URL.Host
+
+	client := &peekedConn{Reader: reader, Conn: c}
+	proxy.ServeHTTP(&connectResponseWriter{Conn: client, reply: reply}, connectReq)
+}
+
+// socks5Handshake negotiates the authentication method with a SOCKS5
+// client, whose version byte has been read, and returns the destination
+// of its request. The credentials sent by the client are added to header.
+func socks5Handshake(r *bufio.Reader, w io.Writer, header http.Header) (string, error) {
+	methods, err := readSOCKSBytes(r)
+	if err != nil {
+		return "", err
+	}
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range methods {
+		if m == socksAuthPassword {
+			method = socksAuthPassword
+			break
+		}
+		if m == socksAuthNone {
+			method = socksAuthNone
+		}
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socksAuthNoAcceptable:
+		return "", errors.New("no acceptable SOCKS authentication method")
+	case socksAuthPassword:
+		if _, err := r.ReadByte(); err != nil { // subnegotiation version
+			return "", err
+		}
+		user, err := readSOCKSBytes(r)
+		if err != nil {
+			return "", err
+		}
+		password, err := readSOCKSBytes(r)
+		if err != nil {
+			return "", err
+		}
+		// The credentials are checked by the CONNECT handlers
+		if _, err := w.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(string(user) + ":" + string(password)))
+		header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(r, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		return "", errSOCKSCommand
+	}
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		domain, err := readSOCKSBytes(r)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_, _ = w.Write([]byte{socks5Version, socks5AddrTypeUnsupported, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks4Handshake returns the destination of the request of a SOCKS4 or
+// SOCKS4a client, whose version byte has been read.
+func socks4Handshake(r *bufio.Reader) (string, error) {
+	var request [7]byte
+	if _, err := io.ReadFull(r, request[:]); err != nil {
+		return "", err
+	}
+	// The user ID isn't used
+	if _, err := r.ReadString(0); err != nil {
+		return "", err
+	}
+	if request[0] != socksCmdConnect {
+		return "", errSOCKSCommand
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(request[1:3])))
+	ip := net.IP(request[3:7])
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a, the domain follows
+		domain, err := r.ReadString(0)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(domain[:len(domain)-1], port), nil
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// readSOCKSBytes reads a length-prefixed field.
+func readSOCKSBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// socks5Reply returns the SOCKS5 reply to a request given the status of
+// the response to its CONNECT request.
+func socks5Reply(status int) []byte {
+	code := byte(socks5GeneralFailure)
+	switch status {
+	case http.StatusOK:
+		code = socks5Succeeded
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		code = socks5NotAllowed
+	case http.StatusBadGateway:
+		code = socks5HostUnreachable
+	case http.StatusMethodNotAllowed:
+		code = socks5CmdNotSupported
+	}
+	return []byte{socks5Version, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+}
+
+// socks4Reply returns the SOCKS4 reply to a request given the status of
+// the response to its CONNECT request.
+func socks4Reply(status int) []byte {
+	code := byte(socks4Rejected)
+	if status == http.StatusOK {
+		code = socks4Granted
+	}
+	return []byte{0, code, 0, 0, 0, 0, 0, 0}
+}
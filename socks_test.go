@@ -0,0 +1,134 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	xproxy "golang.org/x/net/proxy"
+)
+
+func socksProxy(t *testing.T, proxy *goproxy.ProxyHttpServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = proxy.ServeSOCKS(l) }()
+	return l.Addr().String()
+}
+
+func socksClient(t *testing.T, addr string, auth *xproxy.Auth) *http.Client {
+	t.Helper()
+	dialer, err := xproxy.SOCKS5("tcp", addr, auth, xproxy.Direct)
+	require.NoError(t, err)
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       dialer.(xproxy.ContextDialer).DialContext,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func TestServeSOCKS5(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+		{"http", srv.URL, goproxy.OkConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.ConnectDial = nil
+			hosts := make(chan string, 1)
+			proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+				hosts <- host
+				return test.action, host
+			})
+			client := socksClient(t, socksProxy(t, proxy), nil)
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, test.url+"/bobo", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "bobo", string(body))
+			assert.Equal(t, req.URL.Host, <-hosts)
+		})
+	}
+}
+
+func TestServeSOCKS5Auth(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		user, password, ok := (&http.Request{Header: http.Header{
+			"Authorization": ctx.Req.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		if ok && user == "user" && password == "secret" {
+			return goproxy.OkConnect, host
+		}
+		return goproxy.RejectConnect, host
+	})
+	addr := socksProxy(t, proxy)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+	require.NoError(t, err)
+	resp, err := socksClient(t, addr, &xproxy.Auth{User: "user", Password: "secret"}).Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = socksClient(t, addr, &xproxy.Auth{User: "user", Password: "wrong"}).Do(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not allowed")
+}
+
+func TestServeSOCKS4a(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	hosts := make(chan string, 1)
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		hosts <- host
+		return goproxy.OkConnect, host
+	})
+	addr := socksProxy(t, proxy)
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	request := []byte{4, 1, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(request[2:4], uint16(portNumber))
+	request = append(request, "user\x00localhost\x00"...)
+	_, err = c.Write(request)
+	require.NoError(t, err)
+
+	var reply [8]byte
+	_, err = io.ReadFull(c, reply[:])
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x5a), reply[1])
+	assert.Equal(t, "localhost:"+port, <-hosts)
+
+	_, err = io.WriteString(c, "GET /bobo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	response, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Contains(t, string(response), "bobo")
+}
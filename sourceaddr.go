@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// sourceAddr returns the local address binding the connections of the
+// exchange of ctx, if any.
+func (proxy *ProxyHttpServer) sourceAddr(ctx *ProxyCtx) string {
+	if ctx != nil && ctx.SourceAddr != "" {
+		return ctx.SourceAddr
+	}
+	return proxy.SourceAddr
+}
+
+// sourceDialer returns a dialer binding its connections to source, an IP
+// address or the name of a network interface.
+func sourceDialer(source string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		ip, err := sourceIP(source, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		return d.DialContext(c, network, addr)
+	}
+}
+
+// sourceIP returns the local address of source, an IP address or the name
+// of a network interface, to dial addr on network: an address of the
+// interface with the IP version of addr, IPv4 for the host names.
+func sourceIP(source, network, addr string) (net.IP, error) {
+	if ip := net.ParseIP(source); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	wantIPv6 := strings.HasSuffix(network, "6")
+	if ip := net.ParseIP(host); ip != nil {
+		wantIPv6 = ip.To4() == nil
+	}
+	for _, a := range addrs {
+		var ip net.IP
+		switch a := a.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		if ip != nil && (ip.To4() == nil) == wantIPv6 && !ip.IsLinkLocalUnicast() {
+			return ip, nil
+		}
+	}
+	version := 4
+	if wantIPv6 {
+		version = 6
+	}
+	return nil, fmt.Errorf("no IPv%d address on interface %s", version, source)
+}
@@ -0,0 +1,110 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// remoteAddrServer returns a backend sending the hosts of the remote
+// addresses of its requests to the returned channel.
+func remoteAddrServer(t *testing.T, tls bool) (*httptest.Server, chan string) {
+	hosts := make(chan string, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		hosts <- host
+		_, _ = w.Write([]byte("bobo"))
+	})
+	var s *httptest.Server
+	if tls {
+		s = httptest.NewTLSServer(handler)
+	} else {
+		s = httptest.NewServer(handler)
+	}
+	t.Cleanup(s.Close)
+	return s, hosts
+}
+
+func TestSourceAddr(t *testing.T) {
+	if c, err := net.DialTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, srv.Listener.Addr().(*net.TCPAddr)); err != nil {
+		t.Skip("127.0.0.2 isn't a local address:", err)
+	} else {
+		_ = c.Close()
+	}
+	for _, test := range []struct {
+		name   string
+		tls    bool
+		action *goproxy.ConnectAction
+		ctx    bool
+	}{
+		{"http", false, nil, false},
+		{"http-ctx", false, nil, true},
+		{"tunnel", true, goproxy.OkConnect, false},
+		{"mitm", true, goproxy.MitmConnect, false},
+		{"mitm-ctx", true, goproxy.MitmConnect, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backend, hosts := remoteAddrServer(t, test.tls)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			if test.ctx {
+				proxy.SourceAddr = "127.0.0.3"
+			} else {
+				proxy.SourceAddr = "127.0.0.2"
+			}
+			setSource := func(ctx *goproxy.ProxyCtx) {
+				if test.ctx {
+					ctx.SourceAddr = "127.0.0.2"
+				}
+			}
+			if test.action == nil {
+				proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+					setSource(ctx)
+					return req, nil
+				})
+			} else {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					setSource(ctx)
+					return test.action, host
+				})
+			}
+
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, backend.URL+"/bobo"))
+			assert.Equal(t, "127.0.0.2", <-hosts)
+		})
+	}
+}
+
+func TestSourceAddrInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+	backend, hosts := remoteAddrServer(t, false)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SourceAddr = loopback
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, backend.URL+"/bobo"))
+	assert.Equal(t, "127.0.0.1", <-hosts)
+
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.SourceAddr = "goproxy-missing0"
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	resp, err := client.Get(backend.URL + "/bobo")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"os"
+	"sync"
+)
+
+// exchangeDir is the scratch directory of a single exchange. It's removed
+// when the exchange is done and all the holds have been released.
+type exchangeDir struct {
+	mu    sync.Mutex
+	root  string
+	path  string
+	err   error
+	holds int
+}
+
+func (d *exchangeDir) get() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.path == "" && d.err == nil {
+		d.path, d.err = os.MkdirTemp(d.root, "goproxy-")
+	}
+	return d.path, d.err
+}
+
+func (d *exchangeDir) hold() func() {
+	d.mu.Lock()
+	d.holds++
+	d.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(d.release)
+	}
+}
+
+func (d *exchangeDir) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.holds--
+	if d.holds == 0 && d.path != "" {
+		_ = os.RemoveAll(d.path)
+		d.path = ""
+	}
+}
+
+// TempDir returns a scratch directory dedicated to the current exchange,
+// for handlers that need to write artifacts (extracted files, transformed
+// bodies...). The directory is created on the first call, inside
+// ProxyHttpServer.TempDirRoot, and removed with its content once the
+// exchange is done and the holds returned by HoldTempDir are released.
+func (ctx *ProxyCtx) TempDir() (string, error) {
+	return ctx.exchangeDir().get()
+}
+
+// HoldTempDir delays the removal of the directory returned by TempDir
+// until release is called. It's meant for recorders that keep using the
+// exchange artifacts after the response has been sent to the client.
+//
+//	release := ctx.HoldTempDir()
+//	go func() {
+//		defer release()
+//		archive(dir)
+//	}()
+func (ctx *ProxyCtx) HoldTempDir() (release func()) {
+	return ctx.exchangeDir().hold()
+}
+
+func (ctx *ProxyCtx) exchangeDir() *exchangeDir {
+	if ctx.tempDir == nil {
+		root := ""
+		if ctx.Proxy != nil {
+			root = ctx.Proxy.TempDirRoot
+		}
+		ctx.tempDir = &exchangeDir{root: root, holds: 1}
+	}
+	return ctx.tempDir
+}
+
+// finishExchange releases the hold of the exchange on its scratch
+// directory. The context can then be reused for another exchange.
+func (ctx *ProxyCtx) finishExchange() {
+	if ctx.tempDir != nil {
+		ctx.tempDir.release()
+		ctx.tempDir = nil
+	}
+}
@@ -0,0 +1,62 @@
+package goproxy_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeTempDir(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.TempDirRoot = t.TempDir()
+
+	dirs := make(chan string, 2)
+	releases := make(chan func(), 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		dir, err := ctx.TempDir()
+		if err != nil {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		if again, _ := ctx.TempDir(); again != dir {
+			t.Error("TempDir returned different directories for the same exchange")
+		}
+		if err := os.WriteFile(filepath.Join(dir, "artifact"), []byte("data"), 0o600); err != nil {
+			t.Error(err)
+		}
+		if req.URL.Query().Get("hold") != "" {
+			releases <- ctx.HoldTempDir()
+		}
+		dirs <- dir
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	getOrFail(t, srv.URL+"/bobo", client)
+	dir := <-dirs
+	assert.True(t, filepath.IsAbs(dir))
+	assert.Equal(t, proxy.TempDirRoot, filepath.Dir(dir))
+	// Wait for the exchange to finish on the proxy side
+	s.CloseClientConnections()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(dir)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	getOrFail(t, srv.URL+"/bobo?hold=1", client)
+	held := <-dirs
+	release := <-releases
+	assert.NotEqual(t, dir, held)
+	time.Sleep(50 * time.Millisecond)
+	_, err := os.Stat(filepath.Join(held, "artifact"))
+	require.NoError(t, err, "held directory was removed")
+	release()
+	_, err = os.Stat(held)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,146 @@
+package goproxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimit is a byte rate limit, allowing bursts of Burst bytes,
+// BytesPerSecond if zero. A zero BytesPerSecond doesn't limit anything.
+type RateLimit struct {
+	BytesPerSecond int64
+	Burst          int64
+}
+
+// TunnelThrottle limits the bandwidth of the CONNECT tunnels, e.g. to
+// simulate a constrained link:
+//
+//	proxy.TunnelThrottle = &goproxy.TunnelThrottle{
+//		PerTunnel: goproxy.RateLimit{BytesPerSecond: 64 << 10},
+//		Global:    goproxy.RateLimit{BytesPerSecond: 1 << 20, Burst: 256 << 10},
+//	}
+//
+// It applies to the tunneled data: the opaque tunnels, and the WebSocket
+// and raw connections of the MITM'd ones.
+type TunnelThrottle struct {
+	// PerTunnel limits each direction of every tunnel.
+	PerTunnel RateLimit
+	// Global limits all the tunnels together, in both directions.
+	Global RateLimit
+
+	once   sync.Once
+	global *tokenBucket
+}
+
+// writer returns w limited by the throttle, for one direction of a tunnel.
+func (t *TunnelThrottle) writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	t.once.Do(func() {
+		t.global = newTokenBucket(t.Global)
+	})
+	tunnel := newTokenBucket(t.PerTunnel)
+	if tunnel == nil && t.global == nil {
+		return w
+	}
+	return &throttledWriter{w: w, buckets: []*tokenBucket{tunnel, t.global}}
+}
+
+// tunnelWriter returns dst, limited by the proxy TunnelThrottle, and
+// recording the activity of the tunnel when it has an idle timeout.
+func (ctx *ProxyCtx) tunnelWriter(dst io.Writer) io.Writer {
+	if ctx.Proxy != nil {
+		dst = ctx.Proxy.TunnelThrottle.writer(dst)
+	}
+	if ctx.tunnelActivity != nil {
+		dst = &activityWriter{w: dst, last: ctx.tunnelActivity}
+	}
+	return dst
+}
+
+// tokenBucket lets bytes through at a fixed rate, allowing bursts.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket enforcing limit, nil if it doesn't limit
+// anything.
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.BytesPerSecond
+	}
+	return &tokenBucket{
+		rate:   float64(limit.BytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens from the bucket, blocking until they're available.
+func (b *tokenBucket) wait(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	// The tokens are taken even if they're not available yet, the next
+	// callers wait for them too
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// maxChunk returns the largest write allowed at once by the bucket.
+func (b *tokenBucket) maxChunk(n int) int {
+	if b != nil && float64(n) > b.burst {
+		return int(b.burst)
+	}
+	return n
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := len(p)
+		for _, b := range t.buckets {
+			chunk = b.maxChunk(chunk)
+		}
+		for _, b := range t.buckets {
+			b.wait(chunk)
+		}
+		n, err := t.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
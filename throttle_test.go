@@ -0,0 +1,58 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelThrottle(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	received := make(chan int64, 1)
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		n, _ := io.Copy(io.Discard, c)
+		received <- n
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.TunnelThrottle = &goproxy.TunnelThrottle{
+		PerTunnel: goproxy.RateLimit{BytesPerSecond: 32 << 10, Burst: 8 << 10},
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	c, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	_, err = io.WriteString(c, "CONNECT "+backend.Addr().String()+" HTTP/1.1\r\nHost: "+backend.Addr().String()+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	start := time.Now()
+	_, err = c.Write(make([]byte, 24<<10))
+	require.NoError(t, err)
+	require.NoError(t, c.(*net.TCPConn).CloseWrite())
+	assert.Equal(t, int64(24<<10), <-received)
+	// The burst goes through at once, the rest at 32KB/s
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	c.Close()
+}
@@ -0,0 +1,131 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts bound the phases of the exchanges with a destination. The zero
+// durations don't bound anything, or keep the timeouts of the proxy Tr.
+type Timeouts struct {
+	// Dial bounds the connection to the destination, or to the upstream
+	// proxy, DNS resolution included.
+	Dial time.Duration
+	// TLSHandshake bounds the TLS handshake with the destination.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response headers, once the
+	// request is sent.
+	ResponseHeader time.Duration
+	// Total bounds the whole exchange, until the response body is read,
+	// retries and redirections included.
+	Total time.Duration
+}
+
+// TimeoutProfile applies Timeouts to some hosts, see
+// ProxyHttpServer.TimeoutProfiles.
+//
+//	proxy.TimeoutProfiles = []goproxy.TimeoutProfile{
+//		{Hosts: []string{"api.example.com"}, Timeouts: goproxy.Timeouts{ResponseHeader: 2 * time.Second, Total: 5 * time.Second}},
+//		{Hosts: []string{"downloads.example.com"}, Timeouts: goproxy.Timeouts{Dial: 10 * time.Second}},
+//	}
+type TimeoutProfile struct {
+	// Hosts are the matched host names, as in UpstreamRoute.Hosts.
+	Hosts []string
+	Timeouts
+}
+
+// hostTimeouts returns the Timeouts of the exchange of ctx with host: the ones
+// of its TimeoutProfile, overridden by the non-zero ones of ctx.Timeouts.
+func (ctx *ProxyCtx) hostTimeouts(host string) Timeouts {
+	var t Timeouts
+	if ctx.Proxy == nil {
+		return t
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for i := range ctx.Proxy.TimeoutProfiles {
+		if matchHosts(ctx.Proxy.TimeoutProfiles[i].Hosts, host) {
+			t = ctx.Proxy.TimeoutProfiles[i].Timeouts
+			break
+		}
+	}
+	if o := ctx.Timeouts; o != nil {
+		if o.Dial != 0 {
+			t.Dial = o.Dial
+		}
+		if o.TLSHandshake != 0 {
+			t.TLSHandshake = o.TLSHandshake
+		}
+		if o.ResponseHeader != 0 {
+			t.ResponseHeader = o.ResponseHeader
+		}
+		if o.Total != 0 {
+			t.Total = o.Total
+		}
+	}
+	return t
+}
+
+// transportTimeouts returns the timeouts applied by the transports, the
+// ones of t but Total.
+func (t Timeouts) transportTimeouts() Timeouts {
+	t.Total = 0
+	return t
+}
+
+// apply sets the timeouts of t on tr.
+func (t Timeouts) apply(tr *http.Transport) {
+	if t.TLSHandshake != 0 {
+		tr.TLSHandshakeTimeout = t.TLSHandshake
+	}
+	if t.ResponseHeader != 0 {
+		tr.ResponseHeaderTimeout = t.ResponseHeader
+	}
+	if t.Dial != 0 {
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		tr.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			c, cancel := context.WithTimeout(c, t.Dial)
+			defer cancel()
+			return dial(c, network, addr)
+		}
+	}
+}
+
+// sendWithTimeout sends req with send, bounded by the Total timeout of its
+// host: the response body is cut once it elapsed.
+func (ctx *ProxyCtx) sendWithTimeout(
+	req *http.Request,
+	send func(req *http.Request) (*http.Response, error),
+) (*http.Response, error) {
+	total := ctx.hostTimeouts(req.URL.Host).Total
+	if total <= 0 {
+		return send(req)
+	}
+	c, cancel := context.WithTimeout(req.Context(), total)
+	resp, err := send(req.WithContext(c))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the context of its request once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,94 @@
+package goproxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowServer returns a backend answering /headers after 200ms, and
+// stalling the body of /body for 200ms.
+func slowServer(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/headers" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("bo"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/body" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("bo"))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTimeoutProfiles(t *testing.T) {
+	backend := slowServer(t)
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name     string
+		host     string
+		path     string
+		ctx      *goproxy.Timeouts
+		complete bool
+	}{
+		{"response-header", "127.0.0.1", "/headers", nil, false},
+		{"other-host", "localhost", "/headers", nil, true},
+		{"ctx-override", "127.0.0.1", "/headers", &goproxy.Timeouts{ResponseHeader: time.Second, Total: time.Second}, true},
+		{"total", "127.0.0.1", "/body", nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.TimeoutProfiles = []goproxy.TimeoutProfile{{
+				Hosts:    []string{"127.0.0.0/8"},
+				Timeouts: goproxy.Timeouts{ResponseHeader: 50 * time.Millisecond, Total: 100 * time.Millisecond},
+			}}
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				ctx.Timeouts = test.ctx
+				return req, nil
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			resp, err := client.Get("http://" + net.JoinHostPort(test.host, u.Port()) + test.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if test.complete {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "bobo", string(body))
+			} else {
+				assert.NotEqual(t, "bobo", string(body))
+			}
+		})
+	}
+}
+
+func TestTimeoutsDial(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	proxy.TimeoutProfiles = []goproxy.TimeoutProfile{{Hosts: []string{"*"}, Timeouts: goproxy.Timeouts{Dial: 50 * time.Millisecond}}}
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	start := time.Now()
+	_, err := client.Get(https.URL + "/bobo")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,123 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings are the durations of the phases of an exchange with the remote
+// server, measured from the moment the request was sent to the
+// RoundTripper. The phases skipped by the exchange, e.g. DNS, Connect and
+// TLSHandshake for the requests sent on reused connections, are zero.
+type Timings struct {
+	Start time.Time
+	// DNS is the duration of the name resolution, Connect of the TCP
+	// connection and TLSHandshake of the TLS handshake.
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// TTFB is the time to the first byte of the response.
+	TTFB time.Duration
+	// Total is the time to the end of the response body. It's only set
+	// once the body has been read, or closed.
+	Total time.Duration
+	// ConnReused reports whether the request was sent on a connection
+	// kept from a previous exchange.
+	ConnReused bool
+}
+
+// timingsTrace records the Timings of an exchange from the client trace
+// events, which may be sent from the goroutines of the transport.
+type timingsTrace struct {
+	mu                                   sync.Mutex
+	timings                              Timings
+	dnsStart, connectStart, tlsStart     time.Time
+	dnsDone, connectDone, tlsDone, first time.Time
+}
+
+// traceTimings returns req with a client trace recording its Timings.
+func traceTimings(req *http.Request) (*http.Request, *timingsTrace) {
+	t := &timingsTrace{timings: Timings{Start: time.Now()}}
+	record := func(at *time.Time) {
+		t.mu.Lock()
+		if at.IsZero() {
+			*at = time.Now()
+		}
+		t.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.timings.ConnReused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { record(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { record(&t.dnsDone) },
+		ConnectStart:         func(string, string) { record(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { record(&t.connectDone) },
+		TLSHandshakeStart:    func() { record(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record(&t.tlsDone) },
+		GotFirstResponseByte: func() { record(&t.first) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// finish sets ctx.Timings once the response has been received, and
+// updates its Total when the body is done.
+func (t *timingsTrace) finish(ctx *ProxyCtx, resp *http.Response) {
+	t.mu.Lock()
+	timings := t.timings
+	timings.DNS = between(t.dnsStart, t.dnsDone)
+	timings.Connect = between(t.connectStart, t.connectDone)
+	timings.TLSHandshake = between(t.tlsStart, t.tlsDone)
+	timings.TTFB = between(timings.Start, t.first)
+	t.mu.Unlock()
+	if resp != nil && timings.TTFB == 0 {
+		// The RoundTripper didn't report the first byte
+		timings.TTFB = time.Since(timings.Start)
+	}
+	ctx.Timings = &timings
+
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		timings.Total = time.Since(timings.Start)
+		return
+	}
+	resp.Body = &timedBody{ReadCloser: resp.Body, timings: ctx.Timings}
+}
+
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// timedBody sets the Total of timings when the body is done.
+type timedBody struct {
+	io.ReadCloser
+	timings *Timings
+	once    sync.Once
+}
+
+func (b *timedBody) done() {
+	b.once.Do(func() {
+		b.timings.Total = time.Since(b.timings.Start)
+	})
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
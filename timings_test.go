@@ -0,0 +1,39 @@
+package goproxy_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimings(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	// Tr is shared, make sure that the first request opens a connection
+	proxy.Tr = &http.Transport{TLSClientConfig: proxy.Tr.TLSClientConfig}
+	timings := make(chan *goproxy.Timings, 2)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		timings <- ctx.Timings
+		return resp
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+		got := <-timings
+		require.NotNil(t, got)
+		assert.False(t, got.Start.IsZero())
+		assert.Equal(t, i > 0, got.ConnReused)
+		if i == 0 {
+			assert.Positive(t, got.Connect)
+			assert.Positive(t, got.TLSHandshake)
+		} else {
+			assert.Zero(t, got.TLSHandshake)
+		}
+		assert.Positive(t, got.TTFB)
+	}
+}
@@ -0,0 +1,87 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// TLSLeg is the side of a MITM'd connection a TLS handshake was made
+// with.
+type TLSLeg int
+
+const (
+	// TLSLegClient is the handshake between the client and the proxy.
+	TLSLegClient TLSLeg = iota
+	// TLSLegUpstream is the handshake between the proxy and the remote
+	// server.
+	TLSLegUpstream
+)
+
+func (l TLSLeg) String() string {
+	if l == TLSLegClient {
+		return "client"
+	}
+	return "upstream"
+}
+
+// TLSError is a failed TLS handshake, as passed to the OnTLSError callback.
+type TLSError struct {
+	// Host is the host, with port, the connection was made for.
+	Host string
+	Leg  TLSLeg
+	Err  error
+	// Start is when the handshake started, and Duration how long it took
+	// to fail.
+	Start    time.Time
+	Duration time.Duration
+	// ClientHello is the ClientHello of the client, if it was received.
+	ClientHello *ClientHello
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("%s TLS handshake for %s failed after %v: %v", e.Leg, e.Host, e.Duration, e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// tlsHandshakeFailed passes a failed handshake to the OnTLSError callback.
+func (proxy *ProxyHttpServer) tlsHandshakeFailed(ctx *ProxyCtx, host string, leg TLSLeg, err error, start time.Time, hello *ClientHello) {
+	if proxy.OnTLSError == nil {
+		return
+	}
+	proxy.OnTLSError(&TLSError{
+		Host:        host,
+		Leg:         leg,
+		Err:         err,
+		Start:       start,
+		Duration:    time.Since(start),
+		ClientHello: hello,
+	}, ctx)
+}
+
+// traceTLSErrors returns req with a client trace reporting the failed
+// upstream handshakes made by the RoundTripper.
+func (proxy *ProxyHttpServer) traceTLSErrors(req *http.Request, ctx *ProxyCtx) *http.Request {
+	if proxy.OnTLSError == nil {
+		return req
+	}
+	var start atomic.Pointer[time.Time]
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			now := time.Now()
+			start.Store(&now)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if started := start.Load(); err != nil && started != nil {
+				proxy.tlsHandshakeFailed(ctx, req.URL.Host, TLSLegUpstream, err, *started, ctx.ClientHello)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
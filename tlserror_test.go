@@ -0,0 +1,80 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnTLSErrorClient(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	tlsErrors := make(chan *goproxy.TLSError, 1)
+	proxy.OnTLSError = func(e *goproxy.TLSError, ctx *goproxy.ProxyCtx) {
+		tlsErrors <- e
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	// The client doesn't trust the MITM certificate
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()},
+	}}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.Error(t, err)
+
+	select {
+	case e := <-tlsErrors:
+		assert.Equal(t, goproxy.TLSLegClient, e.Leg)
+		assert.Equal(t, "example.com:443", e.Host)
+		assert.Error(t, e.Err)
+		require.NotNil(t, e.ClientHello)
+		assert.Equal(t, "example.com", e.ClientHello.ServerName)
+		assert.False(t, e.Start.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("OnTLSError wasn't called")
+	}
+}
+
+func TestOnTLSErrorUpstream(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	// The proxy doesn't trust the certificate of the server
+	proxy.Tr = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+	tlsErrors := make(chan *goproxy.TLSError, 1)
+	proxy.OnTLSError = func(e *goproxy.TLSError, ctx *goproxy.ProxyCtx) {
+		tlsErrors <- e
+	}
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+	require.NoError(t, err)
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	}
+
+	select {
+	case e := <-tlsErrors:
+		assert.Equal(t, goproxy.TLSLegUpstream, e.Leg)
+		assert.Equal(t, https.Listener.Addr().String(), e.Host)
+		var verifyErr *tls.CertificateVerificationError
+		assert.ErrorAs(t, e, &verifyErr)
+	case <-time.After(time.Second):
+		t.Fatal("OnTLSError wasn't called")
+	}
+}
@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy restricts the TLS versions and cipher suites of the handshakes
+// of one leg of the MITM'd connections. The zero values keep the settings
+// of the TLS configuration it applies to.
+type TLSPolicy struct {
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites are the TLS 1.0-1.2 cipher suites that can be
+	// negotiated, see tls.Config.CipherSuites.
+	CipherSuites []uint16
+}
+
+// TLSPolicyOverride returns the policies of the connections to host with
+// the client and with the remote server, nil to keep the proxy
+// ClientTLSPolicy or UpstreamTLSPolicy. It allows to reach legacy servers
+// while keeping the client leg modern:
+//
+//	proxy.TLSPolicyOverride = func(host string, ctx *goproxy.ProxyCtx) (client, upstream *goproxy.TLSPolicy) {
+//		if host == "legacy.example.com" {
+//			return nil, &goproxy.TLSPolicy{MinVersion: tls.VersionTLS10}
+//		}
+//		return nil, nil
+//	}
+//
+// The upstream connections are pooled by the values of the policies, so
+// a new policy can be returned by every call.
+type TLSPolicyOverride func(host string, ctx *ProxyCtx) (client, upstream *TLSPolicy)
+
+// apply returns config restricted by the policy.
+func (p *TLSPolicy) apply(config *tls.Config) *tls.Config {
+	if p == nil {
+		return config
+	}
+	config = config.Clone()
+	if p.MinVersion != 0 {
+		config.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		config.MaxVersion = p.MaxVersion
+	}
+	if p.CipherSuites != nil {
+		config.CipherSuites = p.CipherSuites
+	}
+	return config
+}
+
+// key returns the values of the policy, which identify the transports
+// sharing its connections.
+func (p *TLSPolicy) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%x-%x", p.MinVersion, p.MaxVersion)
+	if p.CipherSuites != nil {
+		b.WriteString(":")
+		for _, suite := range p.CipherSuites {
+			fmt.Fprintf(&b, "%x,", suite)
+		}
+	}
+	return b.String()
+}
+
+// clientTLSPolicy returns the policy of the handshakes with the clients
+// connecting to host.
+func (proxy *ProxyHttpServer) clientTLSPolicy(host string, ctx *ProxyCtx) *TLSPolicy {
+	if proxy.TLSPolicyOverride != nil {
+		if policy, _ := proxy.TLSPolicyOverride(host, ctx); policy != nil {
+			return policy
+		}
+	}
+	return proxy.ClientTLSPolicy
+}
+
+// upstreamTLSPolicy returns the policy of the handshakes with host, and
+// whether it's specific to host.
+func (proxy *ProxyHttpServer) upstreamTLSPolicy(host string, ctx *ProxyCtx) (*TLSPolicy, bool) {
+	if proxy.TLSPolicyOverride != nil {
+		if _, policy := proxy.TLSPolicyOverride(host, ctx); policy != nil {
+			return policy, true
+		}
+	}
+	return proxy.UpstreamTLSPolicy, false
+}
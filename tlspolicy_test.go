@@ -0,0 +1,97 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	legacy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "legacy")
+	}))
+	legacy.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	legacy.StartTLS()
+	defer legacy.Close()
+
+	modern := &goproxy.TLSPolicy{MinVersion: tls.VersionTLS13}
+	allowLegacy := &goproxy.TLSPolicy{MinVersion: tls.VersionTLS12}
+	var overridden atomic.Bool
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.ClientTLSPolicy = modern
+	proxy.UpstreamTLSPolicy = modern
+	proxy.TLSPolicyOverride = func(host string, ctx *goproxy.ProxyCtx) (*goproxy.TLSPolicy, *goproxy.TLSPolicy) {
+		if overridden.Load() {
+			return nil, allowLegacy
+		}
+		return nil, nil
+	}
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	get := func(client *http.Client) (int, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, legacy.URL, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// The upstream leg requires TLS 1.3 by default
+	_, err := get(client)
+	assert.Error(t, err)
+
+	overridden.Store(true)
+	status, err := get(client)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The client leg still requires TLS 1.3
+	tls12 := &http.Transport{
+		Proxy:           client.Transport.(*http.Transport).Proxy,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+	}
+	defer tls12.CloseIdleConnections()
+	_, err = get(&http.Client{Transport: tls12})
+	assert.Error(t, err)
+}
+
+func TestTLSPolicyPooledByValue(t *testing.T) {
+	var conns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "bobo")
+	}))
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.TLSPolicyOverride = func(host string, ctx *goproxy.ProxyCtx) (*goproxy.TLSPolicy, *goproxy.TLSPolicy) {
+		return nil, &goproxy.TLSPolicy{MinVersion: tls.VersionTLS12}
+	}
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "bobo", string(getOrFail(t, backend.URL, client)))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
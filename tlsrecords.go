@@ -0,0 +1,153 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeHandshake        = 22
+	recordHeaderLen            = 5
+)
+
+// TLSRecordOptions controls how the TLS records of a connection are written
+// on the wire. It's meant for research on the behavior of middleboxes, the
+// default behavior of crypto/tls is fine otherwise.
+//
+// Record padding can't be controlled, since crypto/tls doesn't expose it.
+type TLSRecordOptions struct {
+	// HandshakeRecordSize, if positive, splits the plaintext handshake
+	// records (e.g. the ClientHello) into records carrying at most this
+	// number of bytes.
+	HandshakeRecordSize int
+	// SegmentSize, if positive, splits every write on the connection
+	// into writes of at most this number of bytes, usually resulting in
+	// as many TCP segments.
+	SegmentSize int
+	// SegmentDelay is waited between two writes of a split write.
+	SegmentDelay time.Duration
+	// DisableDynamicRecordSizing makes crypto/tls send records of maximum
+	// size as soon as the connection is established, instead of starting
+	// with small records, see tls.Config.DynamicRecordSizingDisabled.
+	DisableDynamicRecordSizing bool
+}
+
+// WrapConn returns a connection applying the options to the TLS records
+// written on c. It must wrap the raw connection, before it's passed to
+// tls.Client or tls.Server. A nil TLSRecordOptions returns c.
+// For the requests sent through ProxyHttpServer.Tr, it can be used in
+// Tr.DialContext:
+//
+//	opts := &goproxy.TLSRecordOptions{HandshakeRecordSize: 16}
+//	proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+//		c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return opts.WrapConn(c), nil
+//	}
+func (o *TLSRecordOptions) WrapConn(c net.Conn) net.Conn {
+	if o == nil || (o.HandshakeRecordSize <= 0 && o.SegmentSize <= 0) {
+		return c
+	}
+	return &recordConn{Conn: c, opts: o}
+}
+
+// config returns the TLS configuration to use with the options.
+func (o *TLSRecordOptions) config(config *tls.Config) *tls.Config {
+	if o == nil || !o.DisableDynamicRecordSizing {
+		return config
+	}
+	config = config.Clone()
+	config.DynamicRecordSizingDisabled = true
+	return config
+}
+
+// recordConn rewrites the TLS records written by crypto/tls, that always
+// writes whole records at once.
+type recordConn struct {
+	net.Conn
+	opts *TLSRecordOptions
+
+	mu sync.Mutex
+	// encrypted is set once ChangeCipherSpec has been sent, the following
+	// handshake records can't be split anymore
+	encrypted bool
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := b
+	if c.opts.HandshakeRecordSize > 0 && !c.encrypted {
+		data = c.splitRecords(b)
+	}
+	if err := c.writeSegments(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// splitRecords splits the handshake records of b, b is returned unchanged
+// if it doesn't contain whole records.
+func (c *recordConn) splitRecords(b []byte) []byte {
+	size := c.opts.HandshakeRecordSize
+	var out []byte
+	for rest := b; len(rest) > 0; {
+		if len(rest) < recordHeaderLen {
+			return b
+		}
+		length := int(binary.BigEndian.Uint16(rest[3:5]))
+		if len(rest) < recordHeaderLen+length {
+			return b
+		}
+		header, payload := rest[:recordHeaderLen], rest[recordHeaderLen:recordHeaderLen+length]
+		rest = rest[recordHeaderLen+length:]
+
+		if header[0] != recordTypeHandshake || c.encrypted {
+			if header[0] == recordTypeChangeCipherSpec {
+				c.encrypted = true
+			}
+			out = append(out, header...)
+			out = append(out, payload...)
+			continue
+		}
+		for len(payload) > 0 {
+			n := size
+			if n > len(payload) {
+				n = len(payload)
+			}
+			out = append(out, header[0], header[1], header[2], byte(n>>8), byte(n))
+			out = append(out, payload[:n]...)
+			payload = payload[n:]
+		}
+	}
+	return out
+}
+
+func (c *recordConn) writeSegments(data []byte) error {
+	size := c.opts.SegmentSize
+	if size <= 0 {
+		_, err := c.Conn.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := c.Conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) > 0 && c.opts.SegmentDelay > 0 {
+			time.Sleep(c.opts.SegmentDelay)
+		}
+	}
+	return nil
+}
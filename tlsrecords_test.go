@@ -0,0 +1,63 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writesConn records the size of the writes made on the connection.
+type writesConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *writesConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestTLSRecordOptions(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	recorded := &writesConn{Conn: clientRaw}
+	opts := &goproxy.TLSRecordOptions{HandshakeRecordSize: 32, SegmentSize: 100}
+
+	cert, err := tls.X509KeyPair(goproxy.CA_CERT, goproxy.CA_KEY)
+	require.NoError(t, err)
+	server := tls.Server(serverRaw, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		defer server.Close()
+		_, _ = io.Copy(server, server)
+	}()
+
+	client := tls.Client(opts.WrapConn(recorded), &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	require.NoError(t, client.Handshake())
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	recorded.mu.Lock()
+	defer recorded.mu.Unlock()
+	var hello []byte
+	for _, w := range recorded.writes {
+		assert.LessOrEqual(t, len(w), 100)
+		hello = append(hello, w...)
+	}
+	// The ClientHello is split into records of 32 bytes
+	require.Greater(t, len(hello), 5)
+	assert.Equal(t, byte(22), hello[0])
+	assert.Equal(t, 32, int(hello[3])<<8|int(hello[4]))
+}
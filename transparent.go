@@ -0,0 +1,177 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ServeTransparentTLS accepts the TLS connections redirected to l by the
+// network, e.g. by an iptables REDIRECT or TPROXY rule, and serves them as
+// if the clients had sent a CONNECT request for the server name of their
+// ClientHello, so the connect handlers decide whether they are MITM'd or
+// tunneled. The connections are always dialed to their original
+// destination, see TransparentDestination.
+//
+// ServeTransparentTLS always returns a non-nil error.
+func (proxy *ProxyHttpServer) ServeTransparentTLS(l net.Listener) error {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go proxy.handleTransparentTLS(c)
+	}
+}
+
+func (proxy *ProxyHttpServer) handleTransparentTLS(c net.Conn) {
+	dst, err := proxy.transparentDestination(c)
+	if err != nil {
+		proxy.Logger.Printf("WARN: Cannot find the original destination of %s: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	dstHost, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		proxy.Logger.Printf("WARN: Invalid original destination %q: %v", dst, err)
+		_ = c.Close()
+		return
+	}
+	hello, replay, err := peekClientHello(c)
+	if err != nil || hello == nil {
+		proxy.Logger.Printf("WARN: Cannot read the ClientHello of %s: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	host := dstHost
+	if hello.ServerName != "" {
+		host = hello.ServerName
+	}
+	addr := net.JoinHostPort(host, port)
+	connectReq := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	ctx := context.WithValue(context.Background(), transparentDestinationKey{}, dst)
+	proxy.ServeHTTP(&connectResponseWriter{Conn: replay}, connectReq.WithContext(ctx))
+}
+
+func (proxy *ProxyHttpServer) transparentDestination(c net.Conn) (string, error) {
+	if proxy.TransparentDestination != nil {
+		return proxy.TransparentDestination(c)
+	}
+	if dst, ok := originalDestination(c); ok {
+		return dst, nil
+	}
+	// TPROXY'd sockets are bound to the original destination
+	return c.LocalAddr().String(), nil
+}
+
+type transparentDestinationKey struct{}
+
+// transparentOverrides returns the DNSOverrides making the exchanges of
+// the transparent connection r was made for dial its original
+// destination, or nil if r is a regular CONNECT request.
+func transparentOverrides(r *http.Request) map[string]net.IP {
+	dst, ok := r.Context().Value(transparentDestinationKey{}).(string)
+	if !ok {
+		return nil
+	}
+	dstHost, _, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(dstHost)
+	if ip == nil {
+		return nil
+	}
+	return map[string]net.IP{r.URL.Hostname(): ip}
+}
+
+// connectResponseWriter hijacks the connections of the CONNECT requests
+// made up by the proxy for the clients that never sent one, e.g. the
+// transparent ones. The response to the CONNECT request isn't written to
+// them, reply returns what is written instead given its status code.
+type connectResponseWriter struct {
+	net.Conn
+	reply     func(status int) []byte
+	responded bool
+}
+
+func (w *connectResponseWriter) Header() http.Header {
+	panic("Header() should not be called on this ResponseWriter")
+}
+
+func (w *connectResponseWriter) WriteHeader(int) {
+	panic("WriteHeader() should not be called on this ResponseWriter")
+}
+
+func (w *connectResponseWriter) Write(b []byte) (int, error) {
+	if w.responded {
+		return w.Conn.Write(b)
+	}
+	w.responded = true
+	status := http.StatusOK
+	// The responses made up by NewResponse have no protocol version.
+	isResponse := bytes.HasPrefix(b, []byte("HTTP/"))
+	if isResponse {
+		// "HTTP/x.y 200 ..."
+		if _, after, ok := bytes.Cut(b, []byte(" ")); ok && len(after) >= 3 {
+			if code, err := strconv.Atoi(string(after[:3])); err == nil {
+				status = code
+			}
+		}
+	}
+	if w.reply != nil {
+		if reply := w.reply(status); len(reply) > 0 {
+			if _, err := w.Conn.Write(reply); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if isResponse {
+		return len(b), nil
+	}
+	// A hijacking handler writing its own data
+	return w.Conn.Write(b)
+}
+
+// Close closes the connection, replying to the clients rejected without
+// a response.
+func (w *connectResponseWriter) Close() error {
+	if !w.responded {
+		w.responded = true
+		if w.reply != nil {
+			_, _ = w.Conn.Write(w.reply(http.StatusForbidden))
+		}
+	}
+	return w.Conn.Close()
+}
+
+func (w *connectResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w, bufio.NewReadWriter(bufio.NewReader(w), bufio.NewWriter(w)), nil
+}
@@ -0,0 +1,44 @@
+package goproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST, from
+// linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// originalDestination returns the destination of c before it was
+// redirected to the proxy by netfilter.
+func originalDestination(c net.Conn) (string, bool) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return "", false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+	var dst string
+	_ = raw.Control(func(fd uintptr) {
+		// The getsockopt helpers of the syscall package are only used for
+		// the size of the struct sockaddr_in and sockaddr_in6 they fill.
+		if mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			addr := mreq.Multiaddr
+			port := binary.BigEndian.Uint16(addr[2:4])
+			dst = net.JoinHostPort(net.IP(addr[4:8]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		if info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+			addr := info.Addr
+			// Port holds the bytes of the port in network order
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&addr.Port))[:])
+			dst = net.JoinHostPort(net.IP(addr.Addr[:]).String(), strconv.Itoa(int(port)))
+		}
+	})
+	return dst, dst != ""
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package goproxy
+
+import "net"
+
+func originalDestination(net.Conn) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,80 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func transparentClient(proxyAddr string, state *tls.ConnectionState) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			var d tls.Dialer
+			d.Config = &tls.Config{ServerName: host, InsecureSkipVerify: true}
+			c, err := d.DialContext(ctx, network, proxyAddr)
+			if err != nil {
+				return nil, err
+			}
+			*state = c.(*tls.Conn).ConnectionState()
+			return c, nil
+		},
+	}}
+}
+
+func TestServeTransparentTLS(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		action *goproxy.ConnectAction
+		mitm   bool
+	}{
+		{"mitm", goproxy.MitmConnect, true},
+		{"tunnel", goproxy.OkConnect, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.ConnectDial = nil
+			proxy.TransparentDestination = func(net.Conn) (string, error) {
+				return https.Listener.Addr().String(), nil
+			}
+			_, port, err := net.SplitHostPort(https.Listener.Addr().String())
+			require.NoError(t, err)
+			var connectHost string
+			proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+				connectHost = host
+				return test.action, host
+			})
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer l.Close()
+			go func() { _ = proxy.ServeTransparentTLS(l) }()
+
+			var state tls.ConnectionState
+			client := transparentClient(l.Addr().String(), &state)
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "https://transparent.example:"+port+"/bobo", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "bobo", string(body))
+			assert.Equal(t, "transparent.example:"+port, connectHost)
+			require.NotEmpty(t, state.PeerCertificates)
+			assert.Equal(t, test.mitm, state.PeerCertificates[0].VerifyHostname("transparent.example") == nil)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package goproxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// transportKey identifies the copies of Tr kept for the exchanges that
+// can't share its connections.
+type transportKey struct {
+	cert         any
+	dnsOverrides string
+	alpn         string
+	policy       string
+	pinnedIP     string
+	upstream     string
+	resolved     bool
+	source       string
+	pool         *ConnPool
+	timeouts     Timeouts
+}
+
+// maxCachedTransports bounds the number of copies of the transports kept
+// by a transportCache.
+const maxCachedTransports = 256
+
+// transportCache keeps the most recently used copies of the transports,
+// by the settings of their connections.
+type transportCache struct {
+	mu      sync.Mutex
+	entries map[any]*list.Element
+	order   *list.List
+}
+
+type transportCacheEntry struct {
+	key any
+	tr  *http.Transport
+}
+
+// get returns the transport of key, made by create if it isn't kept. The
+// least recently used transport is evicted, and its idle connections are
+// closed, when there are too many of them.
+func (c *transportCache) get(key any, create func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[any]*list.Element)
+		c.order = list.New()
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*transportCacheEntry).tr
+	}
+	tr := create()
+	c.entries[key] = c.order.PushFront(&transportCacheEntry{key: key, tr: tr})
+	for c.order.Len() > maxCachedTransports {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*transportCacheEntry)
+		delete(c.entries, entry.key)
+		entry.tr.CloseIdleConnections()
+	}
+	return tr
+}
+
+// directUpstream is the upstream key of the transports connecting directly
+// to the destinations, chosen by an UpstreamChain.
+const directUpstream = "DIRECT"
+
+// transport returns the transport sending req, see sharedTransport. The
+// connections opened by ctx.Dialer, or resolved by ctx.Resolver, aren't
+// shared: the exchange then uses its own copy of the transport, without
+// keep-alives. The SOCKS5 upstream proxies keep dialing through their own
+// dialer.
+func (ctx *ProxyCtx) transport(req *http.Request) *http.Transport {
+	tr := ctx.sharedTransport(req)
+	if (ctx.Dialer == nil && ctx.Resolver == nil) || ctx.socksUpstream() {
+		return tr
+	}
+	dial := tr.DialContext
+	if ctx.Dialer != nil {
+		dial = ctx.Dialer
+	} else if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr = tr.Clone()
+	tr.DisableKeepAlives = true
+	tr.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+		return ctx.Proxy.dialResolved(ctx, c, dial, network, ctx.resolveAddr(addr))
+	}
+	return tr
+}
+
+// socksUpstream tells whether the exchange of ctx goes through a SOCKS5
+// upstream proxy chosen for it.
+func (ctx *ProxyCtx) socksUpstream() bool {
+	upstream := ctx.UpstreamProxy
+	if ctx.upstreamChoice != nil {
+		upstream = ctx.upstreamChoice.proxy
+	}
+	return upstream != nil && isSOCKS5(upstream)
+}
+
+// sharedTransport returns the transport sending req: Tr, or a copy of it
+// when the connections of the exchange differ, because of a client
+// certificate, DNS overrides, the offered application protocols, a TLS
+// policy, the pins of an IP address, an upstream proxy, or the proxy
+// Resolver, Hosts and address family preferences, a source address, a
+// connection pool of ConnPools, or timeouts. The most recently used copies
+// are kept, so that their connections are reused by the exchanges with the
+// same settings.
+func (ctx *ProxyCtx) sharedTransport(req *http.Request) *http.Transport {
+	key, policy, upstream := ctx.transportKey(req)
+	if key == (transportKey{}) {
+		return ctx.Proxy.Tr
+	}
+	return ctx.Proxy.transports.get(key, func() *http.Transport {
+		return ctx.newSharedTransport(req, key, policy, upstream)
+	})
+}
+
+// newSharedTransport returns the copy of Tr sending the exchanges of key.
+func (ctx *ProxyCtx) newSharedTransport(req *http.Request, key transportKey, policy *TLSPolicy, upstream *url.URL) *http.Transport {
+	proxy := ctx.Proxy
+	tr := proxy.Tr.Clone()
+	if key.cert != nil {
+		config := tr.TLSClientConfig
+		if config == nil {
+			config = tlsClientSkipVerify
+		}
+		tr.TLSClientConfig = withClientCertificate(config, ctx.upstreamClientCertificate(req.URL.Hostname()))
+	}
+	if key.policy != "" {
+		config := tr.TLSClientConfig
+		if config == nil {
+			config = tlsClientSkipVerify
+		}
+		tr.TLSClientConfig = policy.apply(config)
+	}
+	if key.pinnedIP != "" {
+		config := tr.TLSClientConfig
+		if config == nil {
+			config = tlsClientSkipVerify
+		}
+		tr.TLSClientConfig = proxy.withUpstreamPins(config, key.pinnedIP)
+	}
+	if key.alpn != "" {
+		withUpstreamALPN(tr, ctx.UpstreamALPN)
+	}
+	switch key.upstream {
+	case "":
+	case directUpstream:
+		tr.Proxy = nil
+	default:
+		withUpstreamProxy(tr, upstream)
+	}
+	if key.pool != nil {
+		key.pool.apply(tr)
+	}
+	if key.source != "" {
+		tr.DialContext = sourceDialer(key.source)
+	}
+	if key.resolved {
+		// The exchanges are found in the contexts of the dials, see
+		// ProxyCtx.roundTrip
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		tr.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			ctx, _ := c.Value(proxyCtxKey{}).(*ProxyCtx)
+			return proxy.dialResolved(ctx, c, dial, network, addr)
+		}
+	}
+	if key.dnsOverrides != "" {
+		overrides := &ProxyCtx{DNSOverrides: make(map[string]net.IP, len(ctx.DNSOverrides))}
+		for host, ip := range ctx.DNSOverrides {
+			overrides.DNSOverrides[host] = ip
+		}
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		tr.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			return dial(c, network, overrides.resolveAddr(addr))
+		}
+	}
+	key.timeouts.apply(tr)
+	return tr
+}
+
+// transportKey returns the settings of the connections of the exchange
+// sending req, along with its specific TLS policy and upstream proxy.
+func (ctx *ProxyCtx) transportKey(req *http.Request) (key transportKey, policy *TLSPolicy, upstream *url.URL) {
+	proxy := ctx.Proxy
+	if req.URL.Scheme == "https" {
+		if cert := ctx.upstreamClientCertificate(req.URL.Hostname()); cert != nil {
+			key.cert = cert
+		}
+		key.alpn = strings.Join(ctx.UpstreamALPN, ",")
+		var specific bool
+		if policy, specific = proxy.upstreamTLSPolicy(req.URL.Hostname(), ctx); specific {
+			key.policy = policy.key()
+		}
+		if ip := net.ParseIP(req.URL.Hostname()); ip != nil && proxy.UpstreamPins.pinned(ip.String()) {
+			key.pinnedIP = ip.String()
+		}
+	}
+	key.dnsOverrides = ctx.dnsOverridesKey()
+	upstream = ctx.UpstreamProxy
+	if ctx.upstreamChoice != nil {
+		upstream = ctx.upstreamChoice.proxy
+		key.upstream = directUpstream
+	}
+	if upstream != nil {
+		key.upstream = upstream.String()
+	}
+	key.resolved = proxy.resolvesDials() && !ctx.socksUpstream()
+	if proxy.Tr.DialContext == nil && !ctx.socksUpstream() {
+		key.source = proxy.sourceAddr(ctx)
+	}
+	key.pool = proxy.connPool(req.URL.Hostname())
+	key.timeouts = ctx.hostTimeouts(req.URL.Host).transportTimeouts()
+	return key, policy, upstream
+}
+
+// dnsOverridesKey returns a canonical form of DNSOverrides.
+func (ctx *ProxyCtx) dnsOverridesKey() string {
+	if len(ctx.DNSOverrides) == 0 {
+		return ""
+	}
+	entries := make([]string, 0, len(ctx.DNSOverrides))
+	for host, ip := range ctx.DNSOverrides {
+		entries = append(entries, fmt.Sprintf("%s=%s", strings.ToLower(host), ip))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,33 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportCacheEviction(t *testing.T) {
+	var cache transportCache
+	var created int
+	get := func(key int) *http.Transport {
+		return cache.get(key, func() *http.Transport {
+			created++
+			return &http.Transport{}
+		})
+	}
+	first := get(0)
+	for key := 1; key < maxCachedTransports; key++ {
+		get(key)
+	}
+	// The first transport becomes the most recently used one, the second
+	// is evicted
+	assert.Same(t, first, get(0))
+	get(maxCachedTransports)
+	assert.Equal(t, maxCachedTransports+1, created)
+
+	assert.Same(t, first, get(0))
+	get(1)
+	assert.Equal(t, maxCachedTransports+2, created)
+	assert.Equal(t, maxCachedTransports, cache.order.Len())
+}
@@ -0,0 +1,157 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// tunnelBufferSize is the size of the buffers used to copy the tunneled
+// data, the same as io.Copy.
+const tunnelBufferSize = 32 << 10
+
+var tunnelBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, tunnelBufferSize)
+	return &buf
+}}
+
+// copyTunnel copies src to dst until EOF, like io.Copy, with the buffers
+// of a shared pool. When src is a raw socket, it only holds a buffer while
+// data is flowing: it waits for src to be readable through the runtime
+// network poller before taking a buffer, so that an idle tunnel doesn't
+// hold one buffer (or one splice(2) pipe, for io.Copy between TCP
+// connections) per direction. Each direction still blocks its goroutine
+// while the tunnel is idle. The wrappers of the proxy that don't change
+// the data are looked through.
+func copyTunnel(dst io.Writer, src io.Reader) (int64, error) {
+	dst, src = unwrapTunnelWriter(dst), unwrapTunnelReader(src)
+	srcConn, srcRaw := src.(syscall.Conn)
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		// Buffered connections (TLS...) may have data to return while
+		// the socket isn't readable
+		srcRaw = false
+	}
+
+	var raw syscall.RawConn
+	if srcRaw {
+		var err error
+		if raw, err = srcConn.SyscallConn(); err != nil {
+			raw = nil
+		}
+	}
+	if raw == nil || !canWaitReadable {
+		buf := tunnelBuffers.Get().(*[]byte)
+		defer tunnelBuffers.Put(buf)
+		return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+	}
+
+	var written int64
+	for {
+		if err := waitReadable(raw); err != nil {
+			return written, err
+		}
+		buf := tunnelBuffers.Get().(*[]byte)
+		nr, readErr := src.Read(*buf)
+		var writeErr error
+		if nr > 0 {
+			var nw int
+			nw, writeErr = dst.Write((*buf)[:nr])
+			written += int64(nw)
+			if writeErr == nil && nw != nr {
+				writeErr = io.ErrShortWrite
+			}
+		}
+		tunnelBuffers.Put(buf)
+		switch {
+		case writeErr != nil:
+			return written, writeErr
+		case errors.Is(readErr, io.EOF):
+			return written, nil
+		case readErr != nil:
+			return written, readErr
+		}
+	}
+}
+
+// notifyClose returns conn calling onClose once it's closed. The returned
+// connection can still be half-closed if conn can.
+func notifyClose(conn net.Conn, onClose func()) net.Conn {
+	c := &closeNotifyConn{Conn: conn, onClose: onClose}
+	if hc, ok := conn.(halfClosable); ok {
+		return &halfCloseNotifyConn{closeNotifyConn: c, half: hc}
+	}
+	return c
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
+
+type halfCloseNotifyConn struct {
+	*closeNotifyConn
+	half halfClosable
+}
+
+func (c *halfCloseNotifyConn) CloseWrite() error { return c.half.CloseWrite() }
+func (c *halfCloseNotifyConn) CloseRead() error  { return c.half.CloseRead() }
+
+// closeWriter is implemented by the connections that can be half-closed,
+// like *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+var errNoHalfClose = errors.New("connection can't be half-closed")
+
+// closeWrite shuts down the writing side of w, so that its peer reads EOF
+// while the other direction keeps flowing. It reports false if w can't be
+// half-closed.
+func closeWrite(w any) bool {
+	cw, ok := w.(closeWriter)
+	return ok && cw.CloseWrite() == nil
+}
+
+// unwrapTunnelWriter returns the connection wrapped by w, if writing to w
+// is writing to it.
+func unwrapTunnelWriter(w io.Writer) io.Writer {
+	for {
+		switch c := w.(type) {
+		case *closeNotifyConn:
+			w = c.Conn
+		case *halfCloseNotifyConn:
+			w = c.Conn
+		case *peekedConn:
+			// Only its reads are replayed
+			w = c.Conn
+		default:
+			return w
+		}
+	}
+}
+
+// unwrapTunnelReader returns the connection wrapped by r, if reading from
+// r is reading from it.
+func unwrapTunnelReader(r io.Reader) io.Reader {
+	for {
+		switch c := r.(type) {
+		case *closeNotifyConn:
+			r = c.Conn
+		case *halfCloseNotifyConn:
+			r = c.Conn
+		default:
+			return r
+		}
+	}
+}
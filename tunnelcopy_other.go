@@ -0,0 +1,11 @@
+//go:build !unix
+
+package goproxy
+
+import "syscall"
+
+const canWaitReadable = false
+
+func waitReadable(syscall.RawConn) error {
+	return nil
+}
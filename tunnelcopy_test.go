@@ -0,0 +1,129 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyTunnel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	payload := strings.Repeat("tunneled ", 10000)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Leave the tunnel idle between the writes
+		half := len(payload) / 2
+		_, _ = conn.Write([]byte(payload[:half]))
+		time.Sleep(50 * time.Millisecond)
+		_, _ = conn.Write([]byte(payload[half:]))
+	}()
+
+	src, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer src.Close()
+
+	var dst bytes.Buffer
+	n, err := copyTunnel(&dst, src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), n)
+	assert.Equal(t, payload, dst.String())
+}
+
+func TestCopyTunnelPipe(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		_, _ = server.Write([]byte("hello"))
+		server.Close()
+	}()
+
+	var dst bytes.Buffer
+	_, err := copyTunnel(&dst, client)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", dst.String())
+}
+
+func TestNotifyClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	var closed int
+	conn := notifyClose(c, func() { closed++ })
+	_, ok := conn.(halfClosable)
+	assert.True(t, ok, "TCP connections should stay half-closable")
+	require.NoError(t, conn.Close())
+	_ = conn.Close()
+	assert.Equal(t, 1, closed)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn = notifyClose(client, func() { closed++ })
+	_, ok = conn.(halfClosable)
+	assert.False(t, ok)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, 2, closed)
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			_, _ = io.Copy(io.Discard, c)
+			_ = c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.True(t, closeWrite(&peekedConn{Reader: c, Conn: c}))
+	client, server := net.Pipe()
+	defer server.Close()
+	assert.False(t, closeWrite(&peekedConn{Reader: client, Conn: client}))
+	assert.False(t, closeWrite(io.Discard))
+}
+
+func TestCopyTunnelUnwrap(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	wrapped := notifyClose(&peekedConn{Reader: strings.NewReader("peeked"), Conn: c}, func() {})
+	_, ok := unwrapTunnelWriter(wrapped).(*net.TCPConn)
+	assert.True(t, ok, "writes should reach the TCP connection")
+	// The peeked data must still be read
+	_, ok = unwrapTunnelReader(wrapped).(*peekedConn)
+	assert.True(t, ok, "reads should go through the replayed data")
+	_, ok = unwrapTunnelReader(notifyClose(c, func() {})).(*net.TCPConn)
+	assert.True(t, ok)
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package goproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+const canWaitReadable = true
+
+// waitReadable blocks until data (or EOF) can be read from raw, without
+// reading it.
+func waitReadable(raw syscall.RawConn) error {
+	err := raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			return false
+		}
+		// Any other error will be reported by the following Read
+		return true
+	})
+	return err
+}
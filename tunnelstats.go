@@ -0,0 +1,71 @@
+package goproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats describes an opaque tunnel relayed by the proxy: an accepted
+// CONNECT request, a TLS connection whose MITM is bypassed, or an HTTP/2
+// CONNECT stream. Its traffic can't be decrypted, but it can be measured.
+type TunnelStats struct {
+	// Host is the destination of the tunnel.
+	Host string
+	// Start is the time the tunnel was opened.
+	Start time.Time
+	// Duration is the lifetime of the tunnel, set once it's closed.
+	Duration time.Duration
+	// BytesSent and BytesReceived are the numbers of bytes sent by the
+	// client to the server, and by the server to the client. They're set
+	// once the tunnel is closed.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// tunnelTracker reports the lifecycle of a tunnel to the proxy
+// OnTunnelOpen and OnTunnelClose hooks.
+type tunnelTracker struct {
+	proxy *ProxyHttpServer
+	ctx   *ProxyCtx
+	stats TunnelStats
+
+	sent     atomic.Int64
+	received atomic.Int64
+	// pending is the number of directions of the tunnel still open
+	pending atomic.Int32
+}
+
+// openTunnel reports the opening of a tunnel to host, and returns its
+// tracker, or nil if the proxy has no tunnel hooks.
+func (proxy *ProxyHttpServer) openTunnel(ctx *ProxyCtx, host string) *tunnelTracker {
+	if proxy.OnTunnelOpen == nil && proxy.OnTunnelClose == nil {
+		return nil
+	}
+	t := &tunnelTracker{proxy: proxy, ctx: ctx, stats: TunnelStats{Host: host, Start: time.Now()}}
+	t.pending.Store(2)
+	if proxy.OnTunnelOpen != nil {
+		stats := t.stats
+		proxy.OnTunnelOpen(&stats, ctx)
+	}
+	return t
+}
+
+// done records the n bytes copied in one direction of the tunnel, that is
+// closed once both directions are done.
+func (t *tunnelTracker) done(n int64, fromClient bool) {
+	if t == nil {
+		return
+	}
+	if fromClient {
+		t.sent.Add(n)
+	} else {
+		t.received.Add(n)
+	}
+	if t.pending.Add(-1) != 0 || t.proxy.OnTunnelClose == nil {
+		return
+	}
+	t.stats.Duration = time.Since(t.stats.Start)
+	t.stats.BytesSent = t.sent.Load()
+	t.stats.BytesReceived = t.received.Load()
+	t.proxy.OnTunnelClose(&t.stats, t.ctx)
+}
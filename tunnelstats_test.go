@@ -0,0 +1,48 @@
+package goproxy_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelStats(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	opened := make(chan goproxy.TunnelStats, 1)
+	closed := make(chan goproxy.TunnelStats, 1)
+	proxy.OnTunnelOpen = func(stats *goproxy.TunnelStats, ctx *goproxy.ProxyCtx) { opened <- *stats }
+	proxy.OnTunnelClose = func(stats *goproxy.TunnelStats, ctx *goproxy.ProxyCtx) { closed <- *stats }
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, br := connectTunnel(t, s.URL, backend.Addr().String())
+	open := <-opened
+	assert.Equal(t, backend.Addr().String(), open.Host)
+	assert.False(t, open.Start.IsZero())
+
+	_, err := io.WriteString(c, "ping\n")
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+	require.NoError(t, c.Close())
+
+	select {
+	case stats := <-closed:
+		assert.Equal(t, backend.Addr().String(), stats.Host)
+		assert.Equal(t, int64(5), stats.BytesSent)
+		assert.Equal(t, int64(5), stats.BytesReceived)
+		assert.Positive(t, stats.Duration)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tunnel close wasn't reported")
+	}
+}
@@ -0,0 +1,114 @@
+package goproxy
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelTimeouts returns the idle timeout and the maximum lifetime of the
+// tunnel of ctx, zero when they don't apply.
+func (ctx *ProxyCtx) tunnelTimeouts() (idle, lifetime time.Duration) {
+	if ctx.Proxy != nil {
+		idle, lifetime = ctx.Proxy.TunnelIdleTimeout, ctx.Proxy.TunnelMaxLifetime
+	}
+	if ctx.TunnelIdleTimeout != 0 {
+		idle = ctx.TunnelIdleTimeout
+	}
+	if ctx.TunnelMaxLifetime != 0 {
+		lifetime = ctx.TunnelMaxLifetime
+	}
+	// Negative durations disable the proxy defaults
+	if idle < 0 {
+		idle = 0
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	return idle, lifetime
+}
+
+// tunnelWatch closes a tunnel once it has been idle for too long, or at
+// the end of its maximum lifetime.
+type tunnelWatch struct {
+	stop chan struct{}
+	// pending is the number of directions of the tunnel still open
+	pending atomic.Int32
+}
+
+// watchTunnel enforces the timeouts of the tunnel of ctx, closing conns
+// when they expire. The data written by the copies of the tunnel through
+// ctx.tunnelWriter counts as activity. It returns nil if the tunnel has no
+// timeouts.
+func (ctx *ProxyCtx) watchTunnel(host string, conns ...io.Closer) *tunnelWatch {
+	idle, lifetime := ctx.tunnelTimeouts()
+	if idle == 0 && lifetime == 0 {
+		return nil
+	}
+	start := time.Now()
+	last := &atomic.Int64{}
+	last.Store(start.UnixNano())
+	ctx.tunnelActivity = last
+
+	w := &tunnelWatch{stop: make(chan struct{})}
+	w.pending.Store(2)
+	go func() {
+		next := idle
+		if next == 0 || (lifetime > 0 && lifetime < next) {
+			next = lifetime
+		}
+		timer := time.NewTimer(next)
+		defer timer.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-timer.C:
+			}
+			now := time.Now()
+			next = 0
+			if lifetime > 0 {
+				if next = lifetime - now.Sub(start); next <= 0 {
+					ctx.Logf("Closing tunnel to %s at the end of its maximum lifetime", host)
+					break
+				}
+			}
+			if idle > 0 {
+				remaining := idle - now.Sub(time.Unix(0, last.Load()))
+				if remaining <= 0 {
+					ctx.Logf("Closing tunnel to %s idle for %v", host, idle)
+					next = 0
+					break
+				}
+				if next == 0 || remaining < next {
+					next = remaining
+				}
+			}
+			timer.Reset(next)
+		}
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	return w
+}
+
+// done records that one direction of the tunnel is done, the watch stops
+// once both are.
+func (w *tunnelWatch) done() {
+	if w != nil && w.pending.Add(-1) == 0 {
+		close(w.stop)
+	}
+}
+
+// activityWriter records the time of the writes to a tunnel.
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64
+}
+
+func (a *activityWriter) Write(p []byte) (int, error) {
+	n, err := a.w.Write(p)
+	a.last.Store(time.Now().UnixNano())
+	return n, err
+}
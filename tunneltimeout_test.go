@@ -0,0 +1,93 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireTunnelClosed waits for the proxy to close the tunnel c.
+func requireTunnelClosed(t *testing.T, c net.Conn, br *bufio.Reader, within time.Duration) {
+	t.Helper()
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(within)))
+	_, err := br.ReadString('\n')
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func pingTunnel(t *testing.T, c net.Conn, br *bufio.Reader) {
+	t.Helper()
+	_, err := io.WriteString(c, "ping\n")
+	require.NoError(t, err)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.TunnelIdleTimeout = 200 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, br := connectTunnel(t, s.URL, backend.Addr().String())
+	defer c.Close()
+	// The activity keeps the tunnel open
+	for i := 0; i < 5; i++ {
+		pingTunnel(t, c, br)
+		time.Sleep(100 * time.Millisecond)
+	}
+	requireTunnelClosed(t, c, br, 2*time.Second)
+}
+
+func TestTunnelMaxLifetime(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.TunnelIdleTimeout = time.Hour
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.TunnelMaxLifetime = 300 * time.Millisecond
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	start := time.Now()
+	c, br := connectTunnel(t, s.URL, backend.Addr().String())
+	defer c.Close()
+	pingTunnel(t, c, br)
+	requireTunnelClosed(t, c, br, 2*time.Second)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestTunnelTimeoutDisabled(t *testing.T) {
+	backend := echoServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	proxy.TunnelIdleTimeout = 50 * time.Millisecond
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.TunnelIdleTimeout = -1
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	c, br := connectTunnel(t, s.URL, backend.Addr().String())
+	defer c.Close()
+	time.Sleep(200 * time.Millisecond)
+	pingTunnel(t, c, br)
+}
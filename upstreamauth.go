@@ -0,0 +1,326 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamAuthenticator answers the authentication challenges of the
+// upstream proxies, so that their 407 Proxy Authentication Required
+// responses are retried with credentials instead of reaching the clients.
+// The schemes needing several exchanges on the same connection, such as
+// NTLM, aren't supported.
+type UpstreamAuthenticator interface {
+	// ProxyAuthorization returns the Proxy-Authorization header answering
+	// challenges, the Proxy-Authenticate headers of the response of the
+	// upstream proxy proxyURL to req, or an empty string when it can't
+	// answer them.
+	ProxyAuthorization(proxyURL *url.URL, challenges []string, req *http.Request) (string, error)
+}
+
+// UpstreamAuthenticatorFunc is a function implementing
+// UpstreamAuthenticator.
+type UpstreamAuthenticatorFunc func(proxyURL *url.URL, challenges []string, req *http.Request) (string, error)
+
+func (f UpstreamAuthenticatorFunc) ProxyAuthorization(proxyURL *url.URL, challenges []string, req *http.Request) (string, error) {
+	return f(proxyURL, challenges, req)
+}
+
+// BasicUpstreamAuth returns an UpstreamAuthenticator answering the Basic
+// challenges with the credentials returned by credentials for the proxy
+// and the realm of the challenge. The user info of the proxy URL is used
+// when credentials is nil or has none.
+func BasicUpstreamAuth(credentials func(proxyURL *url.URL, realm string) (user, password string, ok bool)) UpstreamAuthenticator {
+	return UpstreamAuthenticatorFunc(func(proxyURL *url.URL, challenges []string, req *http.Request) (string, error) {
+		for _, challenge := range challenges {
+			scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+			if !strings.EqualFold(scheme, "Basic") {
+				continue
+			}
+			var user, password string
+			ok := false
+			if credentials != nil {
+				user, password, ok = credentials(proxyURL, challengeParam(params, "realm"))
+			}
+			if !ok && proxyURL.User != nil {
+				user = proxyURL.User.Username()
+				password, _ = proxyURL.User.Password()
+				ok = true
+			}
+			if ok {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)), nil
+			}
+		}
+		return "", nil
+	})
+}
+
+// challengeParam returns the value of the parameter name of the
+// parameters of a challenge, e.g. the realm of `realm="corp", charset=UTF-8`.
+func challengeParam(params, name string) string {
+	for params != "" {
+		var param string
+		params = strings.TrimLeft(params, " ,")
+		key, rest, ok := strings.Cut(params, "=")
+		if !ok {
+			return ""
+		}
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				end = len(rest) - 1
+			}
+			param = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(rest[1:end])
+			params = rest[end+1:]
+		} else {
+			param, params, _ = strings.Cut(rest, ",")
+			param = strings.TrimSpace(param)
+		}
+		if strings.EqualFold(strings.TrimSpace(key), name) {
+			return param
+		}
+	}
+	return ""
+}
+
+func (proxy *ProxyHttpServer) upstreamAuthenticator() UpstreamAuthenticator {
+	if proxy.UpstreamAuth != nil {
+		return proxy.UpstreamAuth
+	}
+	return BasicUpstreamAuth(nil)
+}
+
+// answerUpstreamChallenge returns the Proxy-Authorization header answering
+// challenges, the Proxy-Authenticate headers of the 407 response of the
+// upstream proxy u to req, and remembers it to authenticate the next
+// requests sent to u upfront.
+func (proxy *ProxyHttpServer) answerUpstreamChallenge(u *url.URL, challenges []string, req *http.Request) (string, error) {
+	if len(challenges) == 0 {
+		return "", nil
+	}
+	authorization, err := proxy.upstreamAuthenticator().ProxyAuthorization(u, challenges, req)
+	if err != nil || authorization == "" {
+		return "", err
+	}
+	proxy.upstreamAuthorizations.Store(upstreamAuthKey(u), authorization)
+	return authorization, nil
+}
+
+// cachedUpstreamAuthorization returns the last Proxy-Authorization header
+// accepted by the upstream proxy u.
+func (proxy *ProxyHttpServer) cachedUpstreamAuthorization(u *url.URL) string {
+	if authorization, ok := proxy.upstreamAuthorizations.Load(upstreamAuthKey(u)); ok {
+		return authorization.(string)
+	}
+	return ""
+}
+
+// upstreamConnectHeader is the GetProxyConnectHeader of the transports,
+// authenticating their CONNECT requests upfront.
+func (proxy *ProxyHttpServer) upstreamConnectHeader(_ context.Context, proxyURL *url.URL, _ string) (http.Header, error) {
+	if authorization := proxy.cachedUpstreamAuthorization(proxyURL); authorization != "" {
+		return http.Header{"Proxy-Authorization": {authorization}}, nil
+	}
+	return nil, nil
+}
+
+// proxyAuthRequiredError is the error of the transports whose CONNECT
+// request was rejected with 407 Proxy Authentication Required, returned by
+// upstreamConnectResponse.
+type proxyAuthRequiredError struct {
+	connectReq *http.Request
+	challenges []string
+}
+
+func (e *proxyAuthRequiredError) Error() string {
+	return "upstream proxy: " + http.StatusText(http.StatusProxyAuthRequired)
+}
+
+// upstreamConnectResponse is the OnProxyConnectResponse of the transports,
+// failing their CONNECT requests rejected with 407 Proxy Authentication
+// Required with a proxyAuthRequiredError.
+func (proxy *ProxyHttpServer) upstreamConnectResponse(_ context.Context, _ *url.URL, connectReq *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	return &proxyAuthRequiredError{connectReq: connectReq, challenges: resp.Header.Values("Proxy-Authenticate")}
+}
+
+// connectThroughProxy opens a tunnel to addr through the upstream proxy u,
+// on a connection returned by dial, answering the authentication challenge
+// of the proxy on a new connection, authenticated by an UpstreamHandshake
+// if the proxy offers its scheme.
+func (proxy *ProxyHttpServer) connectThroughProxy(
+	u *url.URL,
+	addr string,
+	connectReqHandler func(req *http.Request),
+	dial func() (net.Conn, error),
+) (net.Conn, error) {
+	newConnectReq := func(authorization string) *http.Request {
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		setProxyAuthorization(connectReq, u)
+		if authorization != "" {
+			connectReq.Header.Set("Proxy-Authorization", authorization)
+		}
+		if connectReqHandler != nil {
+			connectReqHandler(connectReq)
+		}
+		return connectReq
+	}
+	if h := proxy.knownUpstreamHandshake(u); h != nil {
+		return proxy.connectWithHandshake(u, h, nil, newConnectReq(""), dial)
+	}
+
+	authorization := ""
+	if u.User == nil {
+		authorization = proxy.cachedUpstreamAuthorization(u)
+	}
+	for attempt := 0; ; attempt++ {
+		connectReq := newConnectReq(authorization)
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		_ = connectReq.Write(c)
+		// Read response.
+		// Okay to use and discard buffered reader here, because
+		// TLS server will not speak until spoken to.
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			_ = resp.Body.Close()
+			return c, nil
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired && attempt == 0 {
+			h, session, err := proxy.startUpstreamHandshake(u, resp.Header.Values("Proxy-Authenticate"))
+			if err != nil || session != nil {
+				_ = resp.Body.Close()
+				_ = c.Close()
+				if err != nil {
+					return nil, err
+				}
+				return proxy.connectWithHandshake(u, h, session, newConnectReq(""), dial)
+			}
+			answer, err := proxy.answerUpstreamChallenge(u, resp.Header.Values("Proxy-Authenticate"), connectReq)
+			if err != nil {
+				_ = resp.Body.Close()
+				_ = c.Close()
+				return nil, err
+			}
+			if answer != "" && answer != authorization {
+				_ = resp.Body.Close()
+				_ = c.Close()
+				authorization = answer
+				continue
+			}
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
+		_ = resp.Body.Close()
+		_ = c.Close()
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("proxy refused connection" + string(body))
+	}
+}
+
+// roundTripUpstreamAuth sends req with tr, answering the authentication
+// challenge of its upstream proxy, if any. The request is retried as long
+// as nothing of its body was read.
+func (ctx *ProxyCtx) roundTripUpstreamAuth(tr *http.Transport, req *http.Request) (*http.Response, error) {
+	if tr.Proxy == nil {
+		return tr.RoundTrip(req)
+	}
+	u, err := tr.Proxy(req)
+	if err != nil || u == nil || isSOCKS5(u) {
+		return tr.RoundTrip(req)
+	}
+	tunneled := req.URL.Scheme != "http" && req.URL.Scheme != "ws"
+	if h := ctx.Proxy.knownUpstreamHandshake(u); h != nil {
+		if tunneled {
+			return ctx.handshakeTransport(tr, req, u).RoundTrip(req)
+		}
+		return ctx.roundTripHandshake(u, h, nil, req)
+	}
+	if !tunneled && u.User == nil {
+		if authorization := ctx.Proxy.cachedUpstreamAuthorization(u); authorization != "" {
+			req = req.Clone(req.Context())
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+	}
+	var body *retryBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &retryBody{ReadCloser: req.Body}
+		req.Body = body
+		defer body.release()
+	}
+	resp, err := tr.RoundTrip(req)
+	if body != nil && body.wasRead() {
+		return resp, err
+	}
+
+	if tunneled {
+		// The transport fails when its CONNECT request is rejected, the
+		// answer to the challenge is then sent upfront by the transport.
+		var rejected *proxyAuthRequiredError
+		if err == nil || !errors.As(err, &rejected) {
+			return resp, err
+		}
+		h, session, handshakeErr := ctx.Proxy.startUpstreamHandshake(u, rejected.challenges)
+		if handshakeErr != nil {
+			return nil, err
+		}
+		if session != nil {
+			// The transport can't authenticate its own connections
+			ctx.Proxy.rememberUpstreamHandshake(u, h, true)
+			return ctx.handshakeTransport(tr, req, u).RoundTrip(req)
+		}
+		authorization, authErr := ctx.Proxy.answerUpstreamChallenge(u, rejected.challenges, rejected.connectReq)
+		if authErr != nil || authorization == "" || authorization == rejected.connectReq.Header.Get("Proxy-Authorization") {
+			return nil, err
+		}
+		return tr.RoundTrip(req)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	h, session, authErr := ctx.Proxy.startUpstreamHandshake(u, resp.Header.Values("Proxy-Authenticate"))
+	if authErr == nil && session != nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, _errorRespMaxLength))
+		_ = resp.Body.Close()
+		return ctx.roundTripHandshake(u, h, session, req)
+	}
+	authorization, authErr := ctx.Proxy.answerUpstreamChallenge(u, resp.Header.Values("Proxy-Authenticate"), req)
+	if authErr != nil || authorization == "" || authorization == req.Header.Get("Proxy-Authorization") {
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, _errorRespMaxLength))
+	_ = resp.Body.Close()
+	req = req.Clone(req.Context())
+	req.Header.Set("Proxy-Authorization", authorization)
+	return tr.RoundTrip(req)
+}
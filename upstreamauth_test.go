@@ -0,0 +1,124 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// authUpstreamProxy starts an HTTP proxy requiring the user:secret Basic
+// credentials, and returns its URL and its number of challenges.
+func authUpstreamProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	t.Helper()
+	upstream := goproxy.NewProxyHttpServer()
+	upstream.ConnectDial = nil
+	upstream.Tr.Proxy = nil
+	var challenges atomic.Int32
+	authorized := func(req *http.Request) bool {
+		user, password, ok := (&http.Request{Header: http.Header{
+			"Authorization": req.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		return ok && user == "user" && password == "secret"
+	}
+	challenge := func(req *http.Request) *http.Response {
+		challenges.Add(1)
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "authentication required")
+		resp.Header.Set("Proxy-Authenticate", `Basic realm="corp", charset="UTF-8"`)
+		return resp
+	}
+	upstream.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if !authorized(req) {
+			return req, challenge(req)
+		}
+		return req, nil
+	})
+	upstream.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if !authorized(ctx.Req) {
+			ctx.Resp = challenge(ctx.Req)
+			return goproxy.RejectConnect, host
+		}
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(upstream)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	return u, &challenges
+}
+
+func TestUpstreamAuthChallenge(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstream, challenges := authUpstreamProxy(t)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			realms := make(chan string, 10)
+			proxy.UpstreamAuth = goproxy.BasicUpstreamAuth(func(proxyURL *url.URL, realm string) (string, string, bool) {
+				realms <- realm
+				return "user", "secret", proxyURL.Host == upstream.Host
+			})
+			proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+				return upstream, nil
+			}
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			assert.Equal(t, "corp", <-realms)
+			assert.Equal(t, int32(1), challenges.Load())
+
+			// The accepted credentials are then sent upfront
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			assert.Equal(t, int32(1), challenges.Load())
+		})
+	}
+}
+
+func TestUpstreamAuthUserInfo(t *testing.T) {
+	upstream, challenges := authUpstreamProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	withCredentials := *upstream
+	withCredentials.User = url.UserPassword("user", "secret")
+	require.NoError(t, proxy.UseUpstreamProxy(&withCredentials))
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Equal(t, int32(0), challenges.Load())
+}
+
+func TestUpstreamAuthUnanswered(t *testing.T) {
+	upstream, challenges := authUpstreamProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+		return upstream, nil
+	}
+
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+	proxyURL, err := url.Parse(front.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, int32(1), challenges.Load())
+}
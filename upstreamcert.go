@@ -0,0 +1,114 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// oidSCTList is the X.509 extension embedding the signed certificate
+// timestamps in a certificate (RFC 6962 section 3.3).
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// UpstreamTLSInfo describes the TLS connection with the remote server of
+// an exchange, so that handlers can alert on certificate changes or apply
+// their own trust policies.
+type UpstreamTLSInfo struct {
+	// State is the state of the connection: negotiated version, cipher
+	// suite and application protocol, certificates, OCSP response...
+	State tls.ConnectionState
+	// Certificates is the chain presented by the server, leaf first.
+	Certificates []*x509.Certificate
+	// SCTs are the signed certificate timestamps of the leaf certificate,
+	// received in the handshake or embedded in the certificate.
+	SCTs [][]byte
+
+	verifyOnce     sync.Once
+	verify         func() ([][]*x509.Certificate, error)
+	verifiedChains [][]*x509.Certificate
+	verifyError    error
+}
+
+// VerifiedChains returns the chains verifying the server certificate for
+// the requested host, against the RootCAs of Tr or the system roots, even
+// when Tr skips the verification, or the error of the verification if it
+// failed. The chains are only built on the first call.
+func (info *UpstreamTLSInfo) VerifiedChains() ([][]*x509.Certificate, error) {
+	info.verifyOnce.Do(func() {
+		if info.verify != nil {
+			info.verifiedChains, info.verifyError = info.verify()
+		}
+	})
+	return info.verifiedChains, info.verifyError
+}
+
+// setUpstreamTLS records the TLS connection of resp in ctx.UpstreamTLS.
+func (ctx *ProxyCtx) setUpstreamTLS(req *http.Request, resp *http.Response) {
+	if resp == nil || resp.TLS == nil {
+		return
+	}
+	state := *resp.TLS
+	info := &UpstreamTLSInfo{
+		State:          state,
+		Certificates:   state.PeerCertificates,
+		SCTs:           append([][]byte(nil), state.SignedCertificateTimestamps...),
+		verifiedChains: state.VerifiedChains,
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		info.SCTs = append(info.SCTs, embeddedSCTs(leaf)...)
+		if info.verifiedChains == nil {
+			info.verify = ctx.verifyUpstream(req.URL.Hostname(), state.PeerCertificates)
+		}
+	}
+	ctx.UpstreamTLS = info
+}
+
+// verifyUpstream returns the verification of the certificate chain
+// presented by host, against the roots configured when it is called.
+func (ctx *ProxyCtx) verifyUpstream(host string, certs []*x509.Certificate) func() ([][]*x509.Certificate, error) {
+	opts := x509.VerifyOptions{
+		DNSName:     host,
+		CurrentTime: time.Now(),
+	}
+	if tr := ctx.Proxy.Tr; tr != nil && tr.TLSClientConfig != nil {
+		opts.Roots = tr.TLSClientConfig.RootCAs
+	}
+	return func() ([][]*x509.Certificate, error) {
+		opts.Intermediates = x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		return certs[0].Verify(opts)
+	}
+}
+
+// embeddedSCTs returns the signed certificate timestamps embedded in cert.
+func embeddedSCTs(cert *x509.Certificate) [][]byte {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		// An OCTET STRING wrapping a TLS-encoded list of
+		// length-prefixed SCTs
+		var list []byte
+		if _, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(list) < 2 {
+			return nil
+		}
+		list = list[2:]
+		var scts [][]byte
+		for len(list) >= 2 {
+			n := int(list[0])<<8 | int(list[1])
+			if len(list) < 2+n {
+				break
+			}
+			scts = append(scts, list[2:2+n])
+			list = list[2+n:]
+		}
+		return scts
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTLSInfo(t *testing.T) {
+	infos := make(chan *goproxy.UpstreamTLSInfo, 1)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		infos <- ctx.UpstreamTLS
+		return resp
+	})
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	// The test server isn't trusted by the system roots
+	getOrFail(t, https.URL+"/bobo", client)
+	info := <-infos
+	require.NotNil(t, info)
+	require.NotEmpty(t, info.Certificates)
+	assert.True(t, info.Certificates[0].Equal(https.Certificate()))
+	assert.NotZero(t, info.State.Version)
+	_, err := info.VerifiedChains()
+	assert.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, RootCAs: roots}
+	getOrFail(t, https.URL+"/bobo", client)
+	info = <-infos
+	require.NotNil(t, info)
+	chains, err := info.VerifiedChains()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, chains)
+
+	// Plain HTTP exchanges have no TLS information
+	getOrFail(t, srv.URL+"/bobo", client)
+	assert.Nil(t, <-infos)
+}
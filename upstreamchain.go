@@ -0,0 +1,342 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamChain routes the traffic through a prioritized list of upstream
+// proxies, failing over to the next one when a proxy can't be reached. The
+// failing proxies are skipped for RetryDelay, or until a health check
+// succeeds, unless all of them are failing.
+//
+//	chain := goproxy.NewUpstreamChain(primary, backup)
+//	chain.Routes = []goproxy.UpstreamRoute{{Hosts: []string{"*.corp.example"}, Proxies: []*url.URL{nil}}}
+//	go chain.RunHealthChecks(context.Background(), 30*time.Second)
+//	proxy.Upstreams = chain
+//
+// It's used for the CONNECT tunnels, the plain HTTP requests and the MITM'd
+// requests, unless a handler sets ProxyCtx.UpstreamProxy. The requests are
+// only retried with the next proxy while nothing of their body was sent.
+type UpstreamChain struct {
+	// Proxies are the upstream proxies, by decreasing priority: http,
+	// https, socks5 or socks5h URLs, or nil for a direct connection.
+	Proxies []*url.URL
+	// Routes override Proxies for some hosts: the first route matching the
+	// host of a request is used.
+	Routes []UpstreamRoute
+	// RetryDelay is how long a failing proxy is skipped, 30 seconds if
+	// zero.
+	RetryDelay time.Duration
+	// HealthCheckTimeout bounds the connections of the health checks, 5
+	// seconds if zero.
+	HealthCheckTimeout time.Duration
+
+	mu       sync.Mutex
+	failures map[string]time.Time
+}
+
+// UpstreamRoute selects the upstream proxies of some hosts.
+type UpstreamRoute struct {
+	// Hosts are the matched host names: "example.com", "*.example.com"
+	// for its subdomains, "10.0.0.0/8" for the IP addresses of a network,
+	// or "*" for all the hosts.
+	Hosts []string
+	// Proxies are the upstream proxies of the route, as in
+	// UpstreamChain.Proxies.
+	Proxies []*url.URL
+}
+
+// NewUpstreamChain returns an UpstreamChain trying the given proxies in
+// order.
+func NewUpstreamChain(proxies ...*url.URL) *UpstreamChain {
+	return &UpstreamChain{Proxies: proxies}
+}
+
+func (r *UpstreamRoute) match(host string) bool {
+	return matchHosts(r.Hosts, host)
+}
+
+// matchHosts tells whether host matches one of patterns, see
+// UpstreamRoute.Hosts.
+func matchHosts(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*" || pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case ip != nil && strings.Contains(pattern, "/"):
+			if _, network, err := net.ParseCIDR(pattern); err == nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// candidates returns the proxies to try for host: the healthy ones first,
+// by priority, then the failing ones.
+func (c *UpstreamChain) candidates(host string) []*url.URL {
+	proxies := c.Proxies
+	for i := range c.Routes {
+		if c.Routes[i].match(host) {
+			proxies = c.Routes[i].Proxies
+			break
+		}
+	}
+	now := time.Now()
+	healthy := make([]*url.URL, 0, len(proxies))
+	var failing []*url.URL
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range proxies {
+		if u != nil && now.Before(c.failures[u.String()]) {
+			failing = append(failing, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	return append(healthy, failing...)
+}
+
+// markFailed skips u for RetryDelay. The direct connections are never
+// skipped, their failures are the failures of the destinations.
+func (c *UpstreamChain) markFailed(u *url.URL) {
+	if u == nil {
+		return
+	}
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = 30 * time.Second
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures == nil {
+		c.failures = make(map[string]time.Time)
+	}
+	c.failures[u.String()] = time.Now().Add(delay)
+}
+
+func (c *UpstreamChain) markHealthy(u *url.URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.failures, u.String())
+}
+
+// Healthy tells whether the proxy u is currently used, i.e. it isn't
+// skipped after a failure.
+func (c *UpstreamChain) Healthy(u *url.URL) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !time.Now().Before(c.failures[u.String()])
+}
+
+// CheckHealth connects to every proxy of the chain, and skips the ones
+// that can't be reached, or restores the ones that can.
+func (c *UpstreamChain) CheckHealth(ctx context.Context) {
+	timeout := c.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, proxies := range c.allProxies() {
+		for _, u := range proxies {
+			if u == nil || seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+			wg.Add(1)
+			go func(u *url.URL) {
+				defer wg.Done()
+				checkCtx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				conn, err := (&net.Dialer{}).DialContext(checkCtx, "tcp", upstreamProxyAddr(u))
+				if err != nil {
+					c.markFailed(u)
+					return
+				}
+				_ = conn.Close()
+				c.markHealthy(u)
+			}(u)
+		}
+	}
+	wg.Wait()
+}
+
+func (c *UpstreamChain) allProxies() [][]*url.URL {
+	all := [][]*url.URL{c.Proxies}
+	for _, route := range c.Routes {
+		all = append(all, route.Proxies)
+	}
+	return all
+}
+
+// RunHealthChecks runs CheckHealth every interval, until ctx is done.
+func (c *UpstreamChain) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// upstreamProxyAddr returns the host:port of the upstream proxy u.
+func upstreamProxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	switch {
+	case u.Scheme == "https":
+		port = "443"
+	case isSOCKS5(u):
+		port = defaultSOCKSPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// isUpstreamFailure tells whether err is a failure to reach an upstream
+// proxy, or through it, rather than an error of the exchange.
+func isUpstreamFailure(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	return opErr.Op == "dial" || opErr.Op == "proxyconnect" || opErr.Op == "socks connect"
+}
+
+// dial opens a tunnel to addr through the first proxy of the chain that
+// can be reached.
+func (c *UpstreamChain) dial(ctx *ProxyCtx, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var lastErr error
+	for _, u := range c.candidates(host) {
+		var conn net.Conn
+		if u == nil {
+			conn, err = ctx.Proxy.dial(ctx, network, addr)
+		} else {
+			conn, err = ctx.Proxy.dialUpstreamProxy(ctx, u, network, addr)
+		}
+		if err == nil || !isUpstreamFailure(err) {
+			return conn, err
+		}
+		ctx.Warnf("Can't reach %s through %s: %v", addr, describeUpstream(u), err)
+		c.markFailed(u)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream proxy for " + addr)
+	}
+	return nil, lastErr
+}
+
+// roundTrip sends req through the first proxy of the chain that can be
+// reached. The request is retried as long as nothing of its body was read.
+func (c *UpstreamChain) roundTrip(ctx *ProxyCtx, req *http.Request) (*http.Response, error) {
+	var body *retryBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &retryBody{ReadCloser: req.Body}
+		req.Body = body
+		defer body.release()
+	}
+	var lastErr error
+	for _, u := range c.candidates(req.URL.Hostname()) {
+		ctx.upstreamChoice = &upstreamChoice{proxy: u}
+		resp, err := ctx.roundTripUpstreamAuth(ctx.transport(req), req)
+		ctx.upstreamChoice = nil
+		if err == nil || !isUpstreamFailure(err) {
+			return resp, err
+		}
+		ctx.Warnf("Can't reach %s through %s: %v", req.URL.Host, describeUpstream(u), err)
+		c.markFailed(u)
+		lastErr = err
+		if body != nil && body.wasRead() {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream proxy for " + req.URL.Host)
+	}
+	return nil, lastErr
+}
+
+// retryBody keeps a request body open across the attempts of a request,
+// the transport closing it on failures. It's closed for good once
+// released.
+type retryBody struct {
+	io.ReadCloser
+
+	mu             sync.Mutex
+	read           bool
+	closeRequested bool
+	released       bool
+}
+
+func (b *retryBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	b.read = true
+	b.mu.Unlock()
+	return b.ReadCloser.Read(p)
+}
+
+func (b *retryBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.released {
+		return b.ReadCloser.Close()
+	}
+	b.closeRequested = true
+	return nil
+}
+
+func (b *retryBody) wasRead() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.read
+}
+
+// release closes the body if the transport already did, and lets its
+// next Close through.
+func (b *retryBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.released = true
+	if b.closeRequested {
+		_ = b.ReadCloser.Close()
+	}
+}
+
+// upstreamChoice is the upstream proxy chosen by an UpstreamChain for an
+// attempt, nil for a direct connection.
+type upstreamChoice struct {
+	proxy *url.URL
+}
+
+func describeUpstream(u *url.URL) string {
+	if u == nil {
+		return "a direct connection"
+	}
+	return "upstream proxy " + u.Redacted()
+}
@@ -0,0 +1,159 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadProxy returns the URL of a proxy refusing the connections.
+func deadProxy(t *testing.T, scheme string) *url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return &url.URL{Scheme: scheme, Host: addr}
+}
+
+// upstreamHTTPProxy starts an HTTP proxy, and returns its URL and the
+// hosts of its requests.
+func upstreamHTTPProxy(t *testing.T) (*url.URL, chan string) {
+	t.Helper()
+	upstream := goproxy.NewProxyHttpServer()
+	upstream.ConnectDial = nil
+	upstream.Tr.Proxy = nil
+	hosts := make(chan string, 10)
+	upstream.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		hosts <- req.URL.Host
+		return req, nil
+	})
+	upstream.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		hosts <- host
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewServer(upstream)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	return u, hosts
+}
+
+func TestUpstreamChainFailover(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dead := deadProxy(t, "http")
+			live, hosts := upstreamHTTPProxy(t)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.Upstreams = goproxy.NewUpstreamChain(dead, live)
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			target, err := url.Parse(test.url)
+			require.NoError(t, err)
+			assert.Equal(t, target.Host, <-hosts)
+			assert.False(t, proxy.Upstreams.Healthy(dead))
+			assert.True(t, proxy.Upstreams.Healthy(live))
+		})
+	}
+}
+
+func TestUpstreamChainSOCKS5Failover(t *testing.T) {
+	addr, hosts := upstreamSOCKS5(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Upstreams = goproxy.NewUpstreamChain(
+		deadProxy(t, "socks5h"),
+		&url.URL{Scheme: "socks5h", User: url.UserPassword("user", "secret"), Host: addr},
+	)
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Equal(t, https.Listener.Addr().String(), <-hosts)
+}
+
+func TestUpstreamChainRetriesBody(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+	live, _ := upstreamHTTPProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Upstreams = goproxy.NewUpstreamChain(deadProxy(t, "http"), deadProxy(t, "http"), live)
+
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+	proxyURL, err := url.Parse(front.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, echo.URL, strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(body))
+}
+
+func TestUpstreamChainRoutes(t *testing.T) {
+	live, hosts := upstreamHTTPProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Upstreams = goproxy.NewUpstreamChain(live)
+	proxy.Upstreams.Routes = []goproxy.UpstreamRoute{
+		{Hosts: []string{"*.corp.example"}, Proxies: []*url.URL{deadProxy(t, "http")}},
+		{Hosts: []string{"127.0.0.0/8"}, Proxies: []*url.URL{nil}},
+	}
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	assert.Empty(t, hosts)
+}
+
+func TestUpstreamChainAllFailing(t *testing.T) {
+	dead := deadProxy(t, "http")
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Upstreams = goproxy.NewUpstreamChain(dead)
+
+	assert.NotEqual(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	assert.False(t, proxy.Upstreams.Healthy(dead))
+	// The failing proxies are still tried when there's no other choice
+	assert.NotEqual(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+}
+
+func TestUpstreamChainHealthCheck(t *testing.T) {
+	dead := deadProxy(t, "http")
+	live, _ := upstreamHTTPProxy(t)
+	chain := goproxy.NewUpstreamChain(dead, live)
+
+	chain.CheckHealth(context.Background())
+	assert.False(t, chain.Healthy(dead))
+	assert.True(t, chain.Healthy(live))
+
+	// A proxy back online is restored by the next check
+	l, err := net.Listen("tcp", dead.Host)
+	require.NoError(t, err)
+	defer l.Close()
+	chain.CheckHealth(context.Background())
+	assert.True(t, chain.Healthy(dead))
+}
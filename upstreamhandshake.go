@@ -0,0 +1,320 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamHandshake authenticates the connections to the upstream proxies
+// with a scheme exchanging several messages on the same connection, such
+// as NTLM or Negotiate.
+//
+// The proxy runs the handshake on the connections it opens itself: every
+// plain request sent through such a proxy gets its own authenticated
+// connection, and the CONNECT tunnels are authenticated before being
+// handed to the transports.
+type UpstreamHandshake interface {
+	// Scheme returns the authentication scheme, as named by the
+	// Proxy-Authenticate headers, e.g. "NTLM".
+	Scheme() string
+	// Start begins a handshake with the upstream proxy proxyURL, or
+	// returns a nil session when it has no credentials for it.
+	Start(proxyURL *url.URL) (UpstreamHandshakeSession, error)
+}
+
+// UpstreamHandshakeSession is the handshake of a connection.
+type UpstreamHandshakeSession interface {
+	// Next returns the token of the next Proxy-Authorization header, given
+	// the token of the last challenge of the proxy, nil at first. done
+	// tells whether the token completes the handshake: the body of a plain
+	// request is only sent with the last token.
+	Next(challenge []byte) (token []byte, done bool, err error)
+}
+
+type upstreamHandshake struct {
+	scheme string
+	start  func(proxyURL *url.URL) (UpstreamHandshakeSession, error)
+}
+
+func (h *upstreamHandshake) Scheme() string {
+	return h.scheme
+}
+
+func (h *upstreamHandshake) Start(proxyURL *url.URL) (UpstreamHandshakeSession, error) {
+	return h.start(proxyURL)
+}
+
+// NegotiateUpstreamAuth returns an UpstreamHandshake answering the
+// Negotiate challenges (SPNEGO, RFC 4559) with the sessions returned by
+// start, e.g. backed by a Kerberos library.
+func NegotiateUpstreamAuth(start func(proxyURL *url.URL) (UpstreamHandshakeSession, error)) UpstreamHandshake {
+	return &upstreamHandshake{scheme: "Negotiate", start: start}
+}
+
+// maxHandshakeRounds bounds the number of messages of a handshake.
+const maxHandshakeRounds = 5
+
+func (proxy *ProxyHttpServer) upstreamHandshakeList() []UpstreamHandshake {
+	if proxy.UpstreamHandshakes != nil {
+		return proxy.UpstreamHandshakes
+	}
+	return []UpstreamHandshake{NTLMUpstreamAuth(nil)}
+}
+
+// upstreamAuthKey identifies the upstream proxy u in the authentication
+// caches.
+func upstreamAuthKey(u *url.URL) string {
+	return strings.ToLower(upstreamProxyAddr(u))
+}
+
+// startUpstreamHandshake returns the first handshake answering one of
+// challenges, the Proxy-Authenticate headers of the upstream proxy u, and
+// its session, or a nil session when none can.
+func (proxy *ProxyHttpServer) startUpstreamHandshake(
+	u *url.URL,
+	challenges []string,
+) (UpstreamHandshake, UpstreamHandshakeSession, error) {
+	for _, h := range proxy.upstreamHandshakeList() {
+		offered := false
+		for _, challenge := range challenges {
+			scheme, _, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+			offered = offered || strings.EqualFold(scheme, h.Scheme())
+		}
+		if !offered {
+			continue
+		}
+		session, err := h.Start(u)
+		if err != nil || session != nil {
+			return h, session, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// knownUpstreamHandshake returns the handshake accepted by the upstream
+// proxy u, if any: its connections are then authenticated upfront.
+func (proxy *ProxyHttpServer) knownUpstreamHandshake(u *url.URL) UpstreamHandshake {
+	if h, ok := proxy.upstreamHandshakes.Load(upstreamAuthKey(u)); ok {
+		return h.(UpstreamHandshake)
+	}
+	return nil
+}
+
+// rememberUpstreamHandshake records whether the upstream proxy u accepted
+// the handshake h.
+func (proxy *ProxyHttpServer) rememberUpstreamHandshake(u *url.URL, h UpstreamHandshake, accepted bool) {
+	if accepted {
+		proxy.upstreamHandshakes.Store(upstreamAuthKey(u), h)
+	} else {
+		proxy.upstreamHandshakes.Delete(upstreamAuthKey(u))
+	}
+}
+
+// handshakeChallenge returns the token of the challenge of resp for the
+// given scheme, or nil.
+func handshakeChallenge(resp *http.Response, scheme string) []byte {
+	for _, challenge := range resp.Header.Values("Proxy-Authenticate") {
+		name, token, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if !strings.EqualFold(name, scheme) || strings.TrimSpace(token) == "" {
+			continue
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token)); err == nil {
+			return decoded
+		}
+	}
+	return nil
+}
+
+// runHandshake authenticates c, a connection to an upstream proxy, with
+// session, by sending req until the proxy stops challenging it. It returns
+// the response to the last request.
+func runHandshake(
+	c net.Conn,
+	br *bufio.Reader,
+	h UpstreamHandshake,
+	session UpstreamHandshakeSession,
+	req *http.Request,
+) (*http.Response, error) {
+	var challenge []byte
+	for round := 0; round < maxHandshakeRounds; round++ {
+		token, done, err := session.Next(challenge)
+		if err != nil {
+			return nil, err
+		}
+		out := req.Clone(req.Context())
+		out.Header.Set("Proxy-Authorization", h.Scheme()+" "+base64.StdEncoding.EncodeToString(token))
+		if !done && out.Body != nil && out.Body != http.NoBody {
+			// Like curl, the body is kept for the authenticated request
+			out.Body = nil
+			out.ContentLength = 0
+			out.TransferEncoding = nil
+		}
+		if req.Method == http.MethodConnect {
+			err = out.Write(c)
+		} else {
+			err = out.WriteProxy(c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(br, out)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || done {
+			return resp, nil
+		}
+		if challenge = handshakeChallenge(resp, h.Scheme()); challenge == nil {
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, _errorRespMaxLength))
+		_ = resp.Body.Close()
+		if resp.Close {
+			return nil, errors.New("upstream proxy closed the connection during the " + h.Scheme() + " handshake")
+		}
+	}
+	return nil, errors.New("too many messages in the " + h.Scheme() + " handshake of the upstream proxy")
+}
+
+// connectWithHandshake opens a tunnel through the upstream proxy u with
+// connectReq, on a new connection authenticated with h. session is nil
+// when the handshake isn't started yet.
+func (proxy *ProxyHttpServer) connectWithHandshake(
+	u *url.URL,
+	h UpstreamHandshake,
+	session UpstreamHandshakeSession,
+	connectReq *http.Request,
+	dial func() (net.Conn, error),
+) (net.Conn, error) {
+	if session == nil {
+		var err error
+		if session, err = h.Start(u); err != nil {
+			return nil, err
+		}
+		if session == nil {
+			return nil, errors.New("no " + h.Scheme() + " credentials for upstream proxy " + u.Redacted())
+		}
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	// The buffered reader is discarded once the tunnel is open, because
+	// TLS server will not speak until spoken to.
+	resp, err := runHandshake(c, bufio.NewReader(c), h, session, connectReq)
+	if err != nil {
+		proxy.rememberUpstreamHandshake(u, h, false)
+		_ = c.Close()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		_ = resp.Body.Close()
+		proxy.rememberUpstreamHandshake(u, h, true)
+		return c, nil
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		proxy.rememberUpstreamHandshake(u, h, false)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
+	_ = resp.Body.Close()
+	_ = c.Close()
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("proxy refused connection" + string(body))
+}
+
+// dialProxyConn opens a connection to the upstream proxy u itself,
+// speaking TLS to the https proxies.
+func (proxy *ProxyHttpServer) dialProxyConn(ctx *ProxyCtx, u *url.URL) (net.Conn, error) {
+	addr := upstreamProxyAddr(u)
+	c, err := proxy.dial(ctx, "tcp", addr)
+	if err != nil || u.Scheme != "https" {
+		return c, err
+	}
+	config := &tls.Config{}
+	if proxy.Tr.TLSClientConfig != nil {
+		config = proxy.Tr.TLSClientConfig
+	}
+	return proxy.initializeProxyTLSconnection(ctx, c, config, addr)
+}
+
+// roundTripHandshake sends the plain request req through the upstream
+// proxy u, on a new connection authenticated with h. session is nil when
+// the handshake isn't started yet.
+func (ctx *ProxyCtx) roundTripHandshake(
+	u *url.URL,
+	h UpstreamHandshake,
+	session UpstreamHandshakeSession,
+	req *http.Request,
+) (*http.Response, error) {
+	proxy := ctx.Proxy
+	if session == nil {
+		var err error
+		if session, err = h.Start(u); err != nil {
+			return nil, err
+		}
+		if session == nil {
+			return nil, errors.New("no " + h.Scheme() + " credentials for upstream proxy " + u.Redacted())
+		}
+	}
+	c, err := proxy.dialProxyConn(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := runHandshake(c, bufio.NewReader(c), h, session, req)
+	if err != nil {
+		proxy.rememberUpstreamHandshake(u, h, false)
+		_ = c.Close()
+		return nil, err
+	}
+	proxy.rememberUpstreamHandshake(u, h, resp.StatusCode != http.StatusProxyAuthRequired)
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: c}
+	return resp, nil
+}
+
+// handshakeTransportKey identifies a handshake transport by the settings
+// of the connections of its exchanges and its upstream proxy.
+type handshakeTransportKey struct {
+	transport transportKey
+	upstream  string
+}
+
+// handshakeTransport returns a copy of tr, the transport of req, opening
+// its tunnels through the upstream proxy u itself, authenticated with its
+// known handshake, rather than with the CONNECT requests of the transport.
+// The copies of the shared transports are kept, by the settings of their
+// connections.
+func (ctx *ProxyCtx) handshakeTransport(tr *http.Transport, req *http.Request, u *url.URL) *http.Transport {
+	proxy := ctx.Proxy
+	if ctx.Dialer != nil || ctx.Resolver != nil || ctx.SourceAddr != "" {
+		// tr is a copy of the shared transport for this exchange
+		clone := tr.Clone()
+		clone.Proxy = nil
+		clone.DialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return proxy.connectThroughProxy(u, addr, nil, func() (net.Conn, error) {
+				return proxy.dialProxyConn(ctx, u)
+			})
+		}
+		return clone
+	}
+	key, _, _ := ctx.transportKey(req)
+	return proxy.handshakeTransports.get(handshakeTransportKey{transport: key, upstream: u.String()}, func() *http.Transport {
+		clone := tr.Clone()
+		clone.Proxy = nil
+		clone.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			return proxy.connectThroughProxy(u, addr, nil, func() (net.Conn, error) {
+				return proxy.dialProxyConn(&ProxyCtx{Req: (&http.Request{}).WithContext(c), Proxy: proxy}, u)
+			})
+		}
+		return clone
+	})
+}
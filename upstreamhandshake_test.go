@@ -0,0 +1,224 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ntlmUpstreamProxy starts an HTTP proxy authenticating its connections
+// with NTLM, as CORP\user, and returns its URL and its number of
+// completed handshakes. The credentials aren't verified.
+func ntlmUpstreamProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var handshakes atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveNTLMProxyConn(c, &handshakes)
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, &handshakes
+}
+
+func serveNTLMProxyConn(c net.Conn, handshakes *atomic.Int32) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	negotiated, authenticated := false, false
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if !authenticated {
+			scheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+			msg, _ := base64.StdEncoding.DecodeString(token)
+			switch {
+			case scheme == "NTLM" && len(msg) >= 12 && msg[8] == 1:
+				// The body of the request is only sent once authenticated
+				if req.ContentLength != 0 {
+					return
+				}
+				negotiated = true
+				challenge := make([]byte, 48)
+				copy(challenge, "NTLMSSP\x00")
+				challenge[8] = 2
+				binary.LittleEndian.PutUint32(challenge[20:], 0x00808201)
+				_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(challenge)+"\r\n"+
+					"Content-Length: 0\r\n\r\n")
+				continue
+			case scheme == "NTLM" && negotiated && len(msg) >= 64 && msg[8] == 3 &&
+				ntlmString(msg, 28) == "CORP" && ntlmString(msg, 36) == "user":
+				authenticated = true
+				handshakes.Add(1)
+			default:
+				_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: NTLM\r\nProxy-Authenticate: Basic realm=\"corp\"\r\n"+
+					"Content-Length: 0\r\nConnection: close\r\n\r\n")
+				return
+			}
+		}
+		if req.Method == http.MethodConnect {
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			_, _ = io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+			go func() {
+				_, _ = io.Copy(target, br)
+			}()
+			_, _ = io.Copy(c, target)
+			return
+		}
+		req.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return
+		}
+		err = resp.Write(c)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ntlmString returns the UTF-16 string of the field at offset of msg.
+func ntlmString(msg []byte, offset int) string {
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start+length > len(msg) {
+		return ""
+	}
+	units := make([]uint16, length/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(msg[start+2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+// frontClient returns a client of proxy.
+func frontClient(t *testing.T, proxy *goproxy.ProxyHttpServer) *http.Client {
+	t.Helper()
+	front := httptest.NewServer(proxy)
+	t.Cleanup(front.Close)
+	proxyURL, err := url.Parse(front.URL)
+	require.NoError(t, err)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestUpstreamNTLM(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstream, handshakes := ntlmUpstreamProxy(t)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			proxy.UpstreamHandshakes = []goproxy.UpstreamHandshake{
+				goproxy.NTLMUpstreamAuth(func(proxyURL *url.URL) (string, string, string, bool) {
+					return "CORP", "user", "secret", true
+				}),
+			}
+			proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+				return upstream, nil
+			}
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			assert.Positive(t, handshakes.Load())
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+		})
+	}
+}
+
+func TestUpstreamNTLMUserInfo(t *testing.T) {
+	upstream, handshakes := ntlmUpstreamProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	withCredentials := *upstream
+	withCredentials.User = url.UserPassword(`CORP\user`, "secret")
+	require.NoError(t, proxy.UseUpstreamProxy(&withCredentials))
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	// Once the scheme of the proxy is known, the body of a request is
+	// only sent with the last message of the handshake
+	resp, err := frontClient(t, proxy).Post(srv.URL+"/bobo", "text/plain", bytes.NewBufferString("posted"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Equal(t, int32(3), handshakes.Load())
+}
+
+func TestUpstreamNTLMWithoutCredentials(t *testing.T) {
+	upstream, handshakes := ntlmUpstreamProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	require.NoError(t, proxy.UseUpstreamProxy(upstream))
+
+	resp, err := frontClient(t, proxy).Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, int32(0), handshakes.Load())
+}
+
+func TestUpstreamNTLMReusesTunnels(t *testing.T) {
+	upstream, handshakes := ntlmUpstreamProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	withCredentials := *upstream
+	withCredentials.User = url.UserPassword(`CORP\user`, "secret")
+	require.NoError(t, proxy.UseUpstreamProxy(&withCredentials))
+	client := frontClient(t, proxy)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	get := func() {
+		resp, err := client.Get(https.URL + "/bobo")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "bobo", string(body))
+	}
+	get()
+	authenticated := handshakes.Load()
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	// The authenticated tunnel of the first request is reused
+	assert.Equal(t, authenticated, handshakes.Load())
+}
@@ -0,0 +1,210 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PinAction is what the proxy does when the certificate of a remote server
+// doesn't match its pins.
+type PinAction int
+
+const (
+	// PinBlock fails the handshake, so the request isn't sent.
+	PinBlock PinAction = iota
+	// PinWarn logs the mismatch and goes on with the handshake.
+	PinWarn
+)
+
+// PinMismatchError is the error of the handshakes with a remote server
+// whose certificate doesn't match its pins.
+type PinMismatchError struct {
+	Host string
+	// Pins are the SPKI hashes of the certificate chain sent by the
+	// server, see SPKIHash.
+	Pins []string
+	// Err is the error of the verification callback of the host, if any.
+	Err error
+}
+
+func (e *PinMismatchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("certificate of %s rejected: %v", e.Host, e.Err)
+	}
+	return fmt.Sprintf("certificate of %s doesn't match its pins, got %s", e.Host, strings.Join(e.Pins, ", "))
+}
+
+func (e *PinMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// UpstreamPins checks the certificates of the remote servers against the
+// public keys expected for their hosts, to detect the interception of the
+// connections made by the proxy itself:
+//
+//	pins := goproxy.NewUpstreamPins()
+//	if err := pins.Pin("api.example.com", "sha256/YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg="); err != nil {
+//		log.Fatal(err)
+//	}
+//	proxy.UpstreamPins = pins
+//
+// The hosts without pins aren't checked.
+type UpstreamPins struct {
+	// Action is applied to the mismatches, PinBlock by default.
+	Action PinAction
+	// OnMismatch, if set, is called for every mismatch, whatever the
+	// action.
+	OnMismatch func(err *PinMismatchError, state tls.ConnectionState)
+
+	mu        sync.RWMutex
+	pins      map[string][][]byte
+	verifiers map[string]func(state tls.ConnectionState) error
+}
+
+// NewUpstreamPins returns an UpstreamPins without pins, blocking the
+// mismatches.
+func NewUpstreamPins() *UpstreamPins {
+	return &UpstreamPins{}
+}
+
+// SPKIHash returns the pin of cert: the base64 encoded SHA-256 hash of its
+// public key, prefixed by "sha256/".
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Pin adds the SPKI hashes expected for host, see SPKIHash. The "sha256/"
+// prefix is optional. The connections to host are accepted if any
+// certificate of the chain sent by the server matches any of its pins.
+func (p *UpstreamPins) Pin(host string, hashes ...string) error {
+	decoded := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "sha256/"))
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid SPKI hash %q", hash)
+		}
+		decoded = append(decoded, sum)
+	}
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pins == nil {
+		p.pins = make(map[string][][]byte)
+	}
+	p.pins[host] = append(p.pins[host], decoded...)
+	return nil
+}
+
+// Verify sets the callback checking the connections to host, instead of
+// or in addition to its pins. A non-nil error is a mismatch.
+func (p *UpstreamPins) Verify(host string, verify func(state tls.ConnectionState) error) {
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifiers == nil {
+		p.verifiers = make(map[string]func(tls.ConnectionState) error)
+	}
+	p.verifiers[host] = verify
+}
+
+// Remove removes the pins and the callback of host.
+func (p *UpstreamPins) Remove(host string) {
+	host = strings.ToLower(stripPort(host))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pins, host)
+	delete(p.verifiers, host)
+}
+
+// pinned reports whether host has pins or a callback.
+func (p *UpstreamPins) pinned(host string) bool {
+	if p == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.pins[host]) > 0 || p.verifiers[host] != nil
+}
+
+// check returns the mismatch of the connection to host described by state,
+// nil if it's accepted.
+func (p *UpstreamPins) check(host string, state tls.ConnectionState) *PinMismatchError {
+	host = strings.ToLower(host)
+	p.mu.RLock()
+	pins, verify := p.pins[host], p.verifiers[host]
+	p.mu.RUnlock()
+	if len(pins) == 0 && verify == nil {
+		return nil
+	}
+
+	if verify != nil {
+		if err := verify(state); err != nil {
+			return &PinMismatchError{Host: host, Pins: spkiHashes(state.PeerCertificates), Err: err}
+		}
+	}
+	if len(pins) == 0 {
+		return nil
+	}
+	for _, cert := range state.PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return &PinMismatchError{Host: host, Pins: spkiHashes(state.PeerCertificates)}
+}
+
+func spkiHashes(certs []*x509.Certificate) []string {
+	hashes := make([]string, len(certs))
+	for i, cert := range certs {
+		hashes[i] = SPKIHash(cert)
+	}
+	return hashes
+}
+
+// withUpstreamPins returns config checking the certificates of the remote
+// servers against UpstreamPins. The pins of host are checked, or the ones
+// of the server name sent by the client if host is empty: the IP addresses
+// aren't sent, so their connections need a config of their own.
+func (proxy *ProxyHttpServer) withUpstreamPins(config *tls.Config, host string) *tls.Config {
+	pins := proxy.UpstreamPins
+	if pins == nil {
+		return config
+	}
+	config = config.Clone()
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		name := host
+		if name == "" {
+			name = state.ServerName
+		}
+		mismatch := pins.check(name, state)
+		if mismatch == nil {
+			return nil
+		}
+		if pins.OnMismatch != nil {
+			pins.OnMismatch(mismatch, state)
+		}
+		if pins.Action == PinWarn {
+			proxy.Logger.Printf("WARN: %v", mismatch)
+			return nil
+		}
+		return mismatch
+	}
+	return config
+}
@@ -0,0 +1,80 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamPins(t *testing.T) {
+	goodPin := goproxy.SPKIHash(https.Certificate())
+	badSum := sha256.Sum256([]byte("other key"))
+	badPin := base64.StdEncoding.EncodeToString(badSum[:])
+
+	for _, test := range []struct {
+		name     string
+		pin      string
+		verify   func(tls.ConnectionState) error
+		action   goproxy.PinAction
+		ok       bool
+		mismatch bool
+	}{
+		{name: "match", pin: goodPin, ok: true},
+		{name: "block", pin: badPin, mismatch: true},
+		{name: "warn", pin: badPin, action: goproxy.PinWarn, ok: true, mismatch: true},
+		{name: "verify", verify: func(tls.ConnectionState) error { return errors.New("rejected") }, mismatch: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pins := goproxy.NewUpstreamPins()
+			pins.Action = test.action
+			if test.pin != "" {
+				require.NoError(t, pins.Pin("127.0.0.1", test.pin))
+			}
+			if test.verify != nil {
+				pins.Verify("127.0.0.1", test.verify)
+			}
+			mismatches := make(chan *goproxy.PinMismatchError, 1)
+			pins.OnMismatch = func(err *goproxy.PinMismatchError, state tls.ConnectionState) {
+				mismatches <- err
+			}
+
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+			proxy.UpstreamPins = pins
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, https.URL+"/bobo", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			ok := err == nil && resp.StatusCode == http.StatusOK
+			if err == nil {
+				resp.Body.Close()
+			}
+			assert.Equal(t, test.ok, ok)
+
+			select {
+			case mismatch := <-mismatches:
+				assert.True(t, test.mismatch, "unexpected mismatch %v", mismatch)
+				assert.Equal(t, "127.0.0.1", mismatch.Host)
+				assert.Contains(t, mismatch.Pins, goodPin)
+			default:
+				assert.False(t, test.mismatch, "mismatch not reported")
+			}
+		})
+	}
+}
+
+func TestUpstreamPinsInvalidHash(t *testing.T) {
+	pins := goproxy.NewUpstreamPins()
+	assert.Error(t, pins.Pin("example.com", "sha256/not base64"))
+	assert.Error(t, pins.Pin("example.com", base64.StdEncoding.EncodeToString([]byte("short"))))
+}
@@ -0,0 +1,147 @@
+package goproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// defaultSOCKSPort is the port of the SOCKS proxies whose URL has none.
+const defaultSOCKSPort = "1080"
+
+func isSOCKS5(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+// socks5Dialer returns a function dialing through the SOCKS5 proxy at u,
+// authenticating with the user info of u. Like curl, the host names are
+// resolved by the SOCKS proxy with the socks5h scheme, and locally with
+// socks5.
+func socks5Dialer(u *url.URL) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var auth *xproxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultSOCKSPort)
+	}
+	dialer, err := xproxy.SOCKS5("tcp", host, auth, xproxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(xproxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer without context support")
+	}
+	remoteDNS := u.Scheme == "socks5h"
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !remoteDNS {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil && net.ParseIP(host) == nil {
+				ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(ips[0].IP.String(), port)
+			}
+		}
+		return contextDialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// UseUpstreamProxy sends all the traffic of the proxy, the plain requests
+// as well as the CONNECT tunnels and the MITM'd requests, through the
+// upstream proxy at u. Its scheme is http, https, socks5 or socks5h, its
+// user info holds the credentials sent to the upstream proxy.
+// ProxyCtx.UpstreamProxy overrides it for a given request.
+func (proxy *ProxyHttpServer) UseUpstreamProxy(u *url.URL) error {
+	switch {
+	case isSOCKS5(u):
+		dial, err := socks5Dialer(u)
+		if err != nil {
+			return err
+		}
+		proxy.Tr.Proxy = nil
+		proxy.Tr.DialContext = dial
+	case u.Scheme == "http" || u.Scheme == "https":
+		proxy.Tr.Proxy = http.ProxyURL(u)
+		if proxy.Tr.GetProxyConnectHeader == nil {
+			proxy.Tr.GetProxyConnectHeader = proxy.upstreamConnectHeader
+		}
+		if proxy.Tr.OnProxyConnectResponse == nil {
+			proxy.Tr.OnProxyConnectResponse = proxy.upstreamConnectResponse
+		}
+	default:
+		return fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	proxy.ConnectDial = proxy.NewConnectDialToProxy(u.String())
+	proxy.ConnectDialWithReq = nil
+	return nil
+}
+
+// dialUpstreamProxy opens a tunnel to addr through the upstream proxy u.
+func (proxy *ProxyHttpServer) dialUpstreamProxy(ctx *ProxyCtx, u *url.URL, network, addr string) (net.Conn, error) {
+	if isSOCKS5(u) {
+		dial, err := socks5Dialer(u)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx.Req.Context(), network, addr)
+	}
+	dial := proxy.NewConnectDialToProxy(u.String())
+	if dial == nil {
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+	return dial(network, addr)
+}
+
+// withUpstreamProxy makes tr send its requests through the upstream proxy
+// at u.
+func withUpstreamProxy(tr *http.Transport, u *url.URL) {
+	if !isSOCKS5(u) {
+		tr.Proxy = http.ProxyURL(u)
+		return
+	}
+	dial, err := socks5Dialer(u)
+	if err != nil {
+		tr.DialContext = func(context.Context, string, string) (net.Conn, error) {
+			return nil, err
+		}
+		return
+	}
+	tr.Proxy = nil
+	tr.DialContext = dial
+}
+
+// setProxyAuthorization adds the credentials of the user info of the
+// upstream proxy u to the CONNECT request sent to it.
+func setProxyAuthorization(req *http.Request, u *url.URL) {
+	if u.User == nil {
+		return
+	}
+	password, _ := u.User.Password()
+	auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+	req.Header.Set("Proxy-Authorization", "Basic "+auth)
+}
+
+// roundTripSelectedUpstream sends req through the upstream proxy chosen
+// by SelectUpstream.
+func (proxy *ProxyHttpServer) roundTripSelectedUpstream(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	u, err := proxy.SelectUpstream(req, ctx)
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	ctx.upstreamChoice = &upstreamChoice{proxy: u}
+	defer func() { ctx.upstreamChoice = nil }()
+	return ctx.roundTripUpstreamAuth(ctx.transport(req), req)
+}
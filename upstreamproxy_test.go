@@ -0,0 +1,208 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamSOCKS5 starts a SOCKS5 proxy requiring the user:secret
+// credentials, and returns its address and the hosts it tunnels to.
+func upstreamSOCKS5(t *testing.T) (string, chan string) {
+	t.Helper()
+	upstream := goproxy.NewProxyHttpServer()
+	upstream.ConnectDial = nil
+	hosts := make(chan string, 10)
+	upstream.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		user, password, ok := (&http.Request{Header: http.Header{
+			"Authorization": ctx.Req.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			return goproxy.RejectConnect, host
+		}
+		hosts <- host
+		return goproxy.OkConnect, host
+	})
+	return socksProxy(t, upstream), hosts
+}
+
+func getThroughProxy(t *testing.T, proxy *goproxy.ProxyHttpServer, target string) string {
+	t.Helper()
+	front := httptest.NewServer(proxy)
+	t.Cleanup(front.Close)
+	proxyURL, err := url.Parse(front.URL)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestUseUpstreamProxySOCKS5(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		url    string
+		action *goproxy.ConnectAction
+	}{
+		{"http", srv.URL, nil},
+		{"tunnel", https.URL, goproxy.OkConnect},
+		{"mitm", https.URL, goproxy.MitmConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addr, hosts := upstreamSOCKS5(t)
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			require.NoError(t, proxy.UseUpstreamProxy(&url.URL{
+				Scheme: "socks5h",
+				User:   url.UserPassword("user", "secret"),
+				Host:   addr,
+			}))
+			if test.action != nil {
+				proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+					return test.action, host
+				})
+			}
+
+			assert.Equal(t, "bobo", getThroughProxy(t, proxy, test.url+"/bobo"))
+			target, err := url.Parse(test.url)
+			require.NoError(t, err)
+			assert.Equal(t, target.Host, <-hosts)
+		})
+	}
+}
+
+func TestUpstreamProxyPerRequest(t *testing.T) {
+	addr, hosts := upstreamSOCKS5(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = nil
+	upstream := &url.URL{Scheme: "socks5", User: url.UserPassword("user", "secret"), Host: addr}
+	proxy.OnRequest(goproxy.DstHostIs(srv.Listener.Addr().String())).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			ctx.UpstreamProxy = upstream
+			return req, nil
+		})
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	assert.Equal(t, srv.Listener.Addr().String(), <-hosts)
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Empty(t, hosts)
+}
+
+func TestUpstreamProxyRejectedCredentials(t *testing.T) {
+	addr, _ := upstreamSOCKS5(t)
+	proxy := goproxy.NewProxyHttpServer()
+	require.NoError(t, proxy.UseUpstreamProxy(&url.URL{
+		Scheme: "socks5h",
+		User:   url.UserPassword("user", "wrong"),
+		Host:   addr,
+	}))
+
+	assert.NotEqual(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+}
+
+func TestUseUpstreamProxyUnsupported(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	assert.Error(t, proxy.UseUpstreamProxy(&url.URL{Scheme: "ftp", Host: "localhost:21"}))
+}
+
+func TestSelectUpstream(t *testing.T) {
+	live, hosts := upstreamHTTPProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	selected := make(chan string, 10)
+	proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+		selected <- req.Method + " " + req.URL.Host
+		switch req.URL.Host {
+		case srv.Listener.Addr().String():
+			return live, nil
+		case https.Listener.Addr().String():
+			return nil, nil
+		}
+		return nil, errors.New("no upstream")
+	}
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, srv.URL+"/bobo"))
+	assert.Equal(t, "GET "+srv.Listener.Addr().String(), <-selected)
+	assert.Equal(t, srv.Listener.Addr().String(), <-hosts)
+
+	// Direct, despite the proxy of the environment
+	proxy.Tr.Proxy = func(*http.Request) (*url.URL, error) { return deadProxy(t, "http"), nil }
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Equal(t, "CONNECT "+https.Listener.Addr().String(), <-selected)
+
+	assert.NotEqual(t, "bobo", getThroughProxy(t, proxy, "http://unknown.invalid/bobo"))
+	assert.Empty(t, hosts)
+}
+
+func TestSelectUpstreamMITM(t *testing.T) {
+	live, hosts := upstreamHTTPProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+		return live, nil
+	}
+
+	assert.Equal(t, "bobo", getThroughProxy(t, proxy, https.URL+"/bobo"))
+	assert.Equal(t, https.Listener.Addr().String(), <-hosts)
+}
+
+func TestSelectUpstreamWebSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+	live, hosts := upstreamHTTPProxy(t)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SelectUpstream = func(req *http.Request, ctx *goproxy.ProxyCtx) (*url.URL, error) {
+		return live, nil
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+		backend.URL, backend.Listener.Addr())
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	assert.Equal(t, backend.Listener.Addr().String(), <-hosts)
+}
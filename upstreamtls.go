@@ -0,0 +1,96 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// UpstreamTLSHandshake performs the TLS handshake of conn, a connection to
+// a remote server, and returns the resulting connection. It allows to
+// replace crypto/tls, whose ClientHello is easily fingerprinted, with a
+// library impersonating browsers such as uTLS, see the ext/utls package.
+// The handshake should only depend on ctx.UpstreamTLSProfile, set by the
+// request handlers, since the connections are reused by the exchanges
+// with the same profile:
+//
+//	proxy.UpstreamTLSHandshake = func(ctx *goproxy.ProxyCtx, conn net.Conn, config *tls.Config) (net.Conn, error) {
+//		profile := utls.HelloChrome_Auto
+//		if ctx.UpstreamTLSProfile == "firefox" {
+//			profile = utls.HelloFirefox_Auto
+//		}
+//		uconn := utls.UClient(conn, &utls.Config{ServerName: config.ServerName, NextProtos: config.NextProtos}, profile)
+//		if err := uconn.HandshakeContext(ctx.Req.Context()); err != nil {
+//			return nil, err
+//		}
+//		return uconn, nil
+//	}
+//
+// config.NextProtos lists the application protocols the proxy can speak
+// on the connection: the negotiated protocol must be one of them, even if
+// the impersonated ClientHello advertises others.
+type UpstreamTLSHandshake func(ctx *ProxyCtx, conn net.Conn, config *tls.Config) (net.Conn, error)
+
+// proxyCtxKey is the request context key of the ProxyCtx of the requests
+// sent through the transports dialing with it: the one of
+// UpstreamTLSHandshake, and the ones resolving with the proxy Resolver or
+// Hosts.
+type proxyCtxKey struct{}
+
+// upstreamTLSTransportKey identifies the copies of Tr making their
+// handshakes with UpstreamTLSHandshake.
+type upstreamTLSTransportKey struct {
+	profile  string
+	upstream string
+}
+
+// upstreamTLSTransport returns a copy of Tr, with its TLS handshakes made
+// by UpstreamTLSHandshake, for the exchanges of ctx. The connections are
+// only shared by the exchanges with the same UpstreamTLSProfile and
+// UpstreamProxy. They're dialed with connectDial, through the upstream
+// proxies, and the handshakes are only made with the remote servers.
+func (proxy *ProxyHttpServer) upstreamTLSTransport(ctx *ProxyCtx) *http.Transport {
+	key := upstreamTLSTransportKey{profile: ctx.UpstreamTLSProfile}
+	if ctx.UpstreamProxy != nil {
+		key.upstream = ctx.UpstreamProxy.String()
+	}
+	if tr, ok := proxy.upstreamTLSTransports.Load(key); ok {
+		return tr.(*http.Transport)
+	}
+	tr := proxy.Tr.Clone()
+	// The tunnels through the upstream proxies are opened by connectDial
+	tr.Proxy = nil
+	tlsConfig := tlsClientSkipVerify
+	if tr.TLSClientConfig != nil {
+		tlsConfig = tr.TLSClientConfig
+	}
+	// Custom TLS connections can only be used for HTTP/1.x
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	tr.DialTLSContext = func(reqCtx context.Context, network, addr string) (net.Conn, error) {
+		ctx, ok := reqCtx.Value(proxyCtxKey{}).(*ProxyCtx)
+		if !ok {
+			ctx = &ProxyCtx{Req: (&http.Request{}).WithContext(reqCtx), Proxy: proxy}
+		}
+		conn, err := proxy.connectDial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := proxy.initializeTLSconnection(ctx, conn, tlsConfig, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	actual, _ := proxy.upstreamTLSTransports.LoadOrStore(key, tr)
+	return actual.(*http.Transport)
+}
+
+// roundTripUpstreamTLS sends an HTTPS request through the transport of
+// UpstreamTLSHandshake.
+func (proxy *ProxyHttpServer) roundTripUpstreamTLS(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	req = req.WithContext(context.WithValue(req.Context(), proxyCtxKey{}, ctx))
+	return proxy.upstreamTLSTransport(ctx).RoundTrip(req)
+}
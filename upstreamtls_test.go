@@ -0,0 +1,46 @@
+package goproxy_test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTLSHandshake(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.UpstreamTLSProfile = req.URL.Query().Get("profile")
+		return req, nil
+	})
+
+	var mu sync.Mutex
+	var profiles []string
+	proxy.UpstreamTLSHandshake = func(ctx *goproxy.ProxyCtx, conn net.Conn, config *tls.Config) (net.Conn, error) {
+		mu.Lock()
+		profiles = append(profiles, ctx.UpstreamTLSProfile)
+		mu.Unlock()
+		assert.Equal(t, []string{"http/1.1"}, config.NextProtos)
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx.Req.Context()); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	for _, profile := range []string{"chrome", "firefox", "chrome", "firefox"} {
+		assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo?profile="+profile, client)))
+	}
+
+	// The connections are only reused by the exchanges with the same profile
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"chrome", "firefox"}, profiles)
+}
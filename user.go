@@ -0,0 +1,57 @@
+package goproxy
+
+import "net/http"
+
+// User is the authenticated client of the proxy, see ProxyCtx.User.
+type User struct {
+	// Name identifies the user, e.g. the user name of its credentials.
+	Name string
+	// Groups are the groups the user belongs to, as known by the
+	// authenticator, for the policies applying to whole groups.
+	Groups []string
+	// Attributes are the other properties of the user provided by the
+	// authenticator, e.g. its e-mail address or its tenant.
+	Attributes map[string]string
+}
+
+// InGroup tells whether the user belongs to group.
+func (u *User) InGroup(group string) bool {
+	if u == nil {
+		return false
+	}
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// UserIs returns a ReqCondition testing whether the authenticated user of
+// the request is one of the given names.
+func UserIs(names ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		if ctx.User == nil {
+			return false
+		}
+		for _, name := range names {
+			if ctx.User.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// UserInGroup returns a ReqCondition testing whether the authenticated
+// user of the request belongs to one of the given groups.
+func UserInGroup(groups ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, group := range groups {
+			if ctx.User.InGroup(group) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,55 @@
+package goproxy_test
+
+import (
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserConditions(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend string
+		user    *goproxy.User
+		body    string
+	}{
+		{"http-admin", srv.URL, &goproxy.User{Name: "alice", Groups: []string{"admins"}}, "admin"},
+		{"mitm-admin", https.URL, &goproxy.User{Name: "alice", Groups: []string{"admins"}}, "admin"},
+		{"http-user", srv.URL, &goproxy.User{Name: "bob"}, "bob"},
+		{"mitm-anonymous", https.URL, nil, "bobo"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logs := &syncBuffer{}
+			proxy := goproxy.NewProxyHttpServer()
+			proxy.Logger = log.New(logs, "", 0)
+			proxy.Verbose = true
+			// The MITM'd requests get the user of their CONNECT request
+			proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+				ctx.User = test.user
+				return goproxy.MitmConnect, host
+			})
+			proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				if req.URL.Scheme == "http" {
+					ctx.User = test.user
+				}
+				return req, nil
+			})
+			proxy.OnRequest(goproxy.UserInGroup("admins")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "admin")
+			})
+			proxy.OnRequest(goproxy.UserIs("bob", "carol")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+				return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, ctx.User.Name)
+			})
+			client, s := oneShotProxy(proxy)
+			defer s.Close()
+
+			assert.Equal(t, test.body, string(getOrFail(t, test.backend+"/bobo", client)))
+			if test.user != nil {
+				assert.Contains(t, logs.String(), "] ["+test.user.Name+"] INFO: ")
+			}
+		})
+	}
+}
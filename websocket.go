@@ -103,13 +103,17 @@ func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, remoteConn io.ReadWr
 		return copyOrWarn(ctx, dst, src)
 	}
 
+	// The end of one direction is propagated to the other side, with a
+	// half-close if possible, so that both directions finish
 	go func() {
-		_ = copyFunc(remoteConn, proxyClient, WebSocketClientToServer)
+		err := copyFunc(remoteConn, proxyClient, WebSocketClientToServer)
+		endWebSocketDirection(remoteConn, err)
 		waitChan <- struct{}{}
 	}()
 
 	go func() {
-		_ = copyFunc(proxyClient, remoteConn, WebSocketServerToClient)
+		err := copyFunc(proxyClient, remoteConn, WebSocketServerToClient)
+		endWebSocketDirection(proxyClient, err)
 		waitChan <- struct{}{}
 	}()
 
@@ -117,3 +121,14 @@ func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, remoteConn io.ReadWr
 	<-waitChan
 	<-waitChan
 }
+
+// endWebSocketDirection signals the end of the data written to dst by a
+// WebSocket copy, half-closing dst if it can, and closing it otherwise.
+func endWebSocketDirection(dst io.Writer, err error) {
+	if err == nil && closeWrite(dst) {
+		return
+	}
+	if closer, ok := dst.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
@@ -0,0 +1,219 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// WebTransportHandler is called on the lifecycle events of a WebTransport
+// session (or any other HTTP/2 CONNECT stream) tunnelled by the proxy.
+type WebTransportHandler func(ctx *ProxyCtx)
+
+// IsWebTransport reports whether req is an extended CONNECT request
+// (RFC 8441 / RFC 9220) opening a WebTransport session.
+func IsWebTransport(req *http.Request) bool {
+	return req.Method == http.MethodConnect && req.Header.Get(":protocol") == "webtransport"
+}
+
+// handleH2Connect handles CONNECT requests received over HTTP/2.
+// HTTP/2 connections cannot be hijacked, so the stream itself is used as the
+// tunnel: the request body carries the client data and the response body
+// the server data.
+// Classic CONNECT requests are tunnelled to a TCP connection to the target,
+// extended CONNECT requests (e.g. WebTransport) are forwarded as extended
+// CONNECT requests over a new HTTP/2 connection to the target.
+// MITM isn't supported on these streams, every action other than
+// ConnectReject results in an opaque tunnel.
+func (proxy *ProxyHttpServer) handleH2Connect(w http.ResponseWriter, r *http.Request) {
+	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx.ProxyProtocol = proxyProtocolHeader(r)
+
+	todo, host := proxy.filterConnect(r.Host, ctx)
+	if ctx.TunnelCloseHandler != nil {
+		// The stream is closed when the handler returns
+		defer ctx.TunnelCloseHandler(ctx)
+	}
+	if todo.Action == ConnectReject {
+		if ctx.Resp != nil {
+			defer ctx.Resp.Body.Close()
+			copyHeaders(w.Header(), ctx.Resp.Header, proxy.KeepDestinationHeaders)
+			w.WriteHeader(ctx.Resp.StatusCode)
+			_, _ = io.Copy(w, ctx.Resp.Body)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if todo.Action != ConnectAccept {
+		ctx.Logf("Action %v not supported on HTTP/2 CONNECT streams, tunneling it", todo.Action)
+	}
+	if !hasPort.MatchString(host) {
+		host += ":443"
+	}
+
+	var remote io.ReadWriteCloser
+	if r.Header.Get(":protocol") != "" {
+		resp, pw, err := proxy.extendedConnect(ctx, r, host)
+		if err != nil {
+			ctx.Warnf("Cannot open extended CONNECT to %s: %v", host, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			defer resp.Body.Close()
+			_ = pw.Close()
+			copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			return
+		}
+		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+		remote = &streamConn{Reader: resp.Body, Writer: pw, closers: []io.Closer{pw, resp.Body}}
+	} else {
+		conn, err := proxy.connectDial(ctx, "tcp", host)
+		if err != nil {
+			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		remote = conn
+	}
+	defer remote.Close()
+
+	status := http.StatusOK
+	if ctx.ConnectResponse != nil {
+		copyHeaders(w.Header(), ctx.ConnectResponse.Header, proxy.KeepDestinationHeaders)
+		if ctx.ConnectResponse.StatusCode != 0 {
+			status = ctx.ConnectResponse.StatusCode
+		}
+	}
+	w.WriteHeader(status)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	ctx.Logf("Accepting HTTP/2 CONNECT to %s", host)
+
+	if ctx.WebTransportOpenHandler != nil {
+		ctx.WebTransportOpenHandler(ctx)
+	}
+	defer func() {
+		if ctx.WebTransportCloseHandler != nil {
+			ctx.WebTransportCloseHandler(ctx)
+		}
+	}()
+
+	tracker := proxy.openTunnel(ctx, host)
+	watch := ctx.watchTunnel(host, remote, r.Body)
+	waitChan := make(chan struct{}, 2)
+	go func() {
+		n, _ := copyTunnelOrWarn(ctx, remote, r.Body)
+		if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		tracker.done(n, true)
+		watch.done()
+		waitChan <- struct{}{}
+	}()
+	go func() {
+		n, _ := copyTunnelOrWarn(ctx, flushWriter{w: w}, remote)
+		tracker.done(n, false)
+		watch.done()
+		waitChan <- struct{}{}
+	}()
+	<-waitChan
+	// Either side is done, unblock the other one
+	_ = remote.Close()
+	_ = r.Body.Close()
+	<-waitChan
+}
+
+// extendedConnect forwards the extended CONNECT request r to host over a
+// new HTTP/2 connection, closed with the response body. The returned pipe
+// writer feeds the request stream.
+func (proxy *ProxyHttpServer) extendedConnect(
+	ctx *ProxyCtx,
+	r *http.Request,
+	host string,
+) (*http.Response, *io.PipeWriter, error) {
+	pr, pw := io.Pipe()
+	outReq, err := http.NewRequestWithContext(r.Context(), http.MethodConnect, "https://"+host+r.URL.RequestURI(), pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	outReq.Header = r.Header.Clone()
+	outReq.Host = r.Host
+	if !proxy.KeepHeader {
+		outReq.Header.Del("Proxy-Authorization")
+		outReq.Header.Del("Proxy-Connection")
+	}
+
+	var resp *http.Response
+	if ctx.RoundTripper != nil {
+		resp, err = ctx.RoundTripper.RoundTrip(outReq, ctx)
+	} else {
+		var tlsConfig *tls.Config
+		if proxy.Tr != nil && proxy.Tr.TLSClientConfig != nil {
+			tlsConfig = proxy.Tr.TLSClientConfig.Clone()
+		} else {
+			tlsConfig = &tls.Config{}
+		}
+		tr := &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(_ context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := proxy.connectDial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return proxy.initializeTLSconnection(ctx, conn, cfg, addr)
+			},
+		}
+		resp, err = tr.RoundTrip(outReq)
+		if err != nil {
+			tr.CloseIdleConnections()
+		} else {
+			resp.Body = &sessionBody{ReadCloser: resp.Body, tr: tr}
+		}
+	}
+	if err != nil {
+		_ = pw.Close()
+		return nil, nil, err
+	}
+	return resp, pw, nil
+}
+
+// sessionBody is the response body of an extended CONNECT request,
+// closing the connection of the session with it.
+type sessionBody struct {
+	io.ReadCloser
+	tr *http2.Transport
+}
+
+func (b *sessionBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.tr.CloseIdleConnections()
+	return err
+}
+
+// streamConn joins the two halves of an HTTP/2 stream.
+type streamConn struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (c *streamConn) CloseWrite() error {
+	return c.closers[0].Close()
+}
+
+func (c *streamConn) Close() error {
+	for _, closer := range c.closers {
+		_ = closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package goproxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestIsWebTransport(t *testing.T) {
+	req := &http.Request{Method: http.MethodConnect, Header: http.Header{}}
+	assert.False(t, goproxy.IsWebTransport(req))
+	req.Header.Set(":protocol", "webtransport")
+	assert.True(t, goproxy.IsWebTransport(req))
+	req.Method = http.MethodGet
+	assert.False(t, goproxy.IsWebTransport(req))
+}
+
+func TestHTTP2ConnectTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	opened := make(chan struct{}, 1)
+	closed := make(chan struct{}, 1)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.WebTransportOpenHandler = func(ctx *goproxy.ProxyCtx) { opened <- struct{}{} }
+		ctx.WebTransportCloseHandler = func(ctx *goproxy.ProxyCtx) { closed <- struct{}{} }
+		return goproxy.OkConnect, host
+	})
+	s := httptest.NewUnstartedServer(proxy)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodConnect, s.URL, pr)
+	require.NoError(t, err)
+	req.Host = echo.Addr().String()
+	req.URL.Host = s.Listener.Addr().String()
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	<-opened
+
+	_, err = pw.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	require.NoError(t, pw.Close())
+	<-closed
+}
+
+func TestHTTP2ConnectReject(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject)
+	s := httptest.NewUnstartedServer(proxy)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodConnect, s.URL, http.NoBody)
+	require.NoError(t, err)
+	req.Host = "example.com:443"
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,42 @@
+package goproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/elazarl/goproxy/internal/signer"
+	"golang.org/x/net/publicsuffix"
+)
+
+// wildcardCertHosts returns the names of the wildcard certificate covering
+// hostname, e.g. "example.com" and "*.example.com" for www.example.com,
+// when the WildcardCerts option is enabled and the clients of hostname
+// haven't rejected it.
+func (proxy *ProxyHttpServer) wildcardCertHosts(hostname string) ([]string, bool) {
+	if !proxy.WildcardCerts || net.ParseIP(hostname) != nil {
+		return nil, false
+	}
+	if _, rejected := proxy.wildcardRejected.Load(hostname); rejected {
+		return nil, false
+	}
+	_, parent, ok := strings.Cut(hostname, ".")
+	// A wildcard can't cover a top-level domain, or a public suffix such
+	// as co.uk
+	if !ok || !strings.Contains(parent, ".") {
+		return nil, false
+	}
+	if suffix, _ := publicsuffix.PublicSuffix(parent); suffix == parent {
+		return nil, false
+	}
+	return []string{parent, "*." + parent}, true
+}
+
+// wildcardHandshakeFailed makes the next certificates of hostname per-host
+// ones, after a client failed the handshake, which may be caused by the
+// wildcard certificate.
+func (proxy *ProxyHttpServer) wildcardHandshakeFailed(hostname string) {
+	hostname = signer.NormalizeHost(hostname)
+	if _, ok := proxy.wildcardCertHosts(hostname); ok {
+		proxy.wildcardRejected.Store(hostname, struct{}{})
+	}
+}
@@ -0,0 +1,91 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWildcardCerts(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.WildcardCerts = true
+	tlsConfig := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+
+	names := func(host string) []string {
+		config, err := tlsConfig(host, &goproxy.ProxyCtx{Proxy: proxy})
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		return leaf.DNSNames
+	}
+	assert.ElementsMatch(t, []string{"example.com", "*.example.com"}, names("www.example.com:443"))
+	assert.ElementsMatch(t, []string{"example.com", "*.example.com"}, names("cdn.example.com:443"))
+	assert.Equal(t, []string{"example.com"}, names("example.com:443"))
+	assert.Empty(t, names("127.0.0.1:443"))
+	assert.Equal(t, []string{"example.co.uk"}, names("example.co.uk:443"))
+	assert.ElementsMatch(t, []string{"example.co.uk", "*.example.co.uk"}, names("www.example.co.uk:443"))
+	assert.ElementsMatch(t, []string{"xn--bcher-kva.example", "*.xn--bcher-kva.example"}, names("WWW.Bücher.example:443"))
+}
+
+func TestWildcardCertsFallback(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.WildcardCerts = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+
+	// handshake connects to the proxy with a client rejecting wildcard
+	// certificates, and returns the names of the certificate it got
+	handshake := func() ([]string, error) {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var names []string
+		tlsConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				names = leaf.DNSNames
+				for _, name := range names {
+					if name[0] == '*' {
+						return errors.New("wildcard certificate")
+					}
+				}
+				return nil
+			},
+		})
+		return names, tlsConn.Handshake()
+	}
+
+	names, err := handshake()
+	require.Error(t, err)
+	assert.Contains(t, names, "*.example.com")
+
+	// The proxy notices the failed handshake asynchronously
+	assert.Eventually(t, func() bool {
+		names, err := handshake()
+		return err == nil && assert.Equal(t, []string{"www.example.com"}, names)
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,22 +1,23 @@
 // Taken from $GOROOT/src/pkg/net/http/chunked
 // needed to write https responses to client.
-package goproxy
+package wire
 
 import (
 	"io"
+	"net/http/httputil"
 	"strconv"
 )
 
-// newChunkedWriter returns a new chunkedWriter that translates writes into HTTP
+// NewChunkedWriter returns a new chunkedWriter that translates writes into HTTP
 // "chunked" format before writing them to w. Closing the returned chunkedWriter
 // sends the final 0-length chunk that marks the end of the stream.
 //
-// newChunkedWriter is not needed by normal applications. The http
+// NewChunkedWriter is not needed by normal applications. The http
 // package adds chunking automatically if handlers don't set a
-// Content-Length header. Using newChunkedWriter inside a handler
+// Content-Length header. Using NewChunkedWriter inside a handler
 // would result in double chunking or chunking with a Content-Length
 // length, both of which are wrong.
-func newChunkedWriter(w io.Writer) io.WriteCloser {
+func NewChunkedWriter(w io.Writer) io.WriteCloser {
 	return &chunkedWriter{w}
 }
 
@@ -55,3 +56,10 @@ func (cw *chunkedWriter) Close() error {
 	_, err := io.WriteString(cw.Wire, "0\r\n")
 	return err
 }
+
+// NewChunkedReader returns a reader decoding the HTTP "chunked" format read
+// from r, returning io.EOF at the final 0-length chunk. The trailer isn't
+// consumed.
+func NewChunkedReader(r io.Reader) io.Reader {
+	return httputil.NewChunkedReader(r)
+}
@@ -0,0 +1,55 @@
+package wire_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := wire.NewChunkedWriter(&buf)
+	_, err := io.WriteString(w, "hello ")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "world")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	buf.WriteString("\r\n")
+	assert.Equal(t, "6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n", buf.String())
+
+	data, err := io.ReadAll(wire.NewChunkedReader(&buf))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
+
+func FuzzChunkedReader(f *testing.F) {
+	f.Add([]byte("6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n"))
+	f.Add([]byte("ffffffffffffffff\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = io.Copy(io.Discard, wire.NewChunkedReader(bytes.NewReader(data)))
+	})
+}
+
+func FuzzReadLenientResponse(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	f.Add("http/1.1  200\nTransfer-Encoding: chunked\n\n5\r\nhello\r\n0\r\n\r\n")
+	f.Add("HTTP/1.0 204\r\nContent-Length: x\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp, err := wire.ReadLenientResponse(bufio.NewReader(strings.NewReader(data)), req, func(wire.Fixup) {})
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	})
+}
@@ -0,0 +1,58 @@
+// Package wire exposes the HTTP/1.x, chunked and WebSocket parsing and
+// serialization primitives used by the proxy, for tools and fuzzers that
+// need to handle the same protocol plumbing.
+package wire
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/textproto"
+
+	"github.com/elazarl/goproxy/internal/http1parser"
+)
+
+// RequestReader reads the HTTP/1.x requests sent on a connection,
+// optionally keeping the original case of the header names.
+type RequestReader = http1parser.RequestReader
+
+// NewRequestReader returns a RequestReader reading from conn. If
+// preventCanonicalization is true, the header names of the requests are
+// kept as sent instead of being canonicalized.
+func NewRequestReader(preventCanonicalization bool, conn io.Reader) *RequestReader {
+	return http1parser.NewRequestReader(preventCanonicalization, conn)
+}
+
+// ExtractHeaderNames returns the header names of the HTTP/1.x message read
+// from r, in their original case, the start line excluded.
+func ExtractHeaderNames(r *textproto.Reader) ([]string, error) {
+	return http1parser.Http1ExtractHeaders(r)
+}
+
+// ErrBadProto is returned by ExtractHeaderNames for malformed headers.
+var ErrBadProto = http1parser.ErrBadProto
+
+// Fixup is a set of protocol violations tolerated by ReadLenientResponse.
+type Fixup = http1parser.Fixup
+
+// The protocol violations tolerated by ReadLenientResponse.
+const (
+	FixupMissingReason        = http1parser.FixupMissingReason
+	FixupBareLF               = http1parser.FixupBareLF
+	FixupMalformedStatusLine  = http1parser.FixupMalformedStatusLine
+	FixupMalformedHeader      = http1parser.FixupMalformedHeader
+	FixupInvalidContentLength = http1parser.FixupInvalidContentLength
+	FixupTruncatedBody        = http1parser.FixupTruncatedBody
+)
+
+// ErrMalformedResponse is returned by ReadLenientResponse for responses
+// that can't be fixed.
+var ErrMalformedResponse = http1parser.ErrMalformedResponse
+
+// ReadLenientResponse reads an HTTP/1.x response from r like
+// http.ReadResponse, but tolerates common violations of the protocol.
+// onFixup is called with the violations that have been fixed, possibly
+// while the body is read.
+func ReadLenientResponse(r *bufio.Reader, req *http.Request, onFixup func(Fixup)) (*http.Response, error) {
+	return http1parser.ReadLenientResponse(r, req, onFixup)
+}
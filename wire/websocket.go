@@ -0,0 +1,209 @@
+package wire
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WebSocket frame opcodes (RFC 6455 section 5.2).
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// websocketGUID is appended to the handshake key to compute the accept
+// value.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrNotWebSocketHandshake = errors.New("not a WebSocket handshake")
+	ErrFrameTooLarge         = errors.New("WebSocket frame too large")
+	ErrInvalidFrame          = errors.New("invalid WebSocket frame")
+)
+
+// WebSocketHandshake is the opening handshake request of a WebSocket
+// connection.
+type WebSocketHandshake struct {
+	// Key is the Sec-WebSocket-Key of the client.
+	Key string
+	// Version is the Sec-WebSocket-Version of the client.
+	Version string
+	// Protocols are the subprotocols requested by the client.
+	Protocols []string
+	// Extensions are the extensions requested by the client, with their
+	// parameters.
+	Extensions []string
+}
+
+// ParseWebSocketHandshake returns the handshake of req, a WebSocket
+// opening handshake request, ErrNotWebSocketHandshake otherwise.
+func ParseWebSocketHandshake(req *http.Request) (*WebSocketHandshake, error) {
+	if req.Method != http.MethodGet ||
+		!headerHasToken(req.Header, "Connection", "upgrade") ||
+		!headerHasToken(req.Header, "Upgrade", "websocket") {
+		return nil, ErrNotWebSocketHandshake
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Key %q", ErrNotWebSocketHandshake, key)
+	}
+	return &WebSocketHandshake{
+		Key:        key,
+		Version:    req.Header.Get("Sec-WebSocket-Version"),
+		Protocols:  headerTokens(req.Header, "Sec-WebSocket-Protocol"),
+		Extensions: headerTokens(req.Header, "Sec-WebSocket-Extensions"),
+	}, nil
+}
+
+// WebSocketAccept returns the Sec-WebSocket-Accept value answering key.
+func WebSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, t := range headerTokens(header, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Frame is a WebSocket frame.
+type Frame struct {
+	Fin    bool
+	RSV    byte // RSV1, RSV2 and RSV3 bits, in the 3 low bits
+	Opcode byte
+	Masked bool
+	Mask   [4]byte
+	// Payload is the unmasked payload of the frame.
+	Payload []byte
+}
+
+// ReadFrame reads a frame from r, unmasking its payload. The frames whose
+// payload is larger than maxPayload are rejected with ErrFrameTooLarge.
+func ReadFrame(r io.Reader, maxPayload int64) (*Frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	f := &Frame{
+		Fin:    header[0]&0x80 != 0,
+		RSV:    header[0] >> 4 & 0x7,
+		Opcode: header[0] & 0x0f,
+		Masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, ErrInvalidFrame
+		}
+	}
+	if f.Opcode >= OpClose && (length > 125 || !f.Fin) {
+		// Control frames can't be fragmented nor have long payloads
+		return nil, ErrInvalidFrame
+	}
+	if length > uint64(maxPayload) {
+		return nil, ErrFrameTooLarge
+	}
+
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.Mask[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if f.Masked {
+		maskBytes(f.Mask, f.Payload)
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w, masking its payload if f.Masked is true. The
+// payload of f isn't modified.
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf := make([]byte, 0, 14+len(f.Payload))
+	first := f.RSV&0x7<<4 | f.Opcode&0x0f
+	if f.Fin {
+		first |= 0x80
+	}
+	buf = append(buf, first)
+
+	var mask byte
+	if f.Masked {
+		mask = 0x80
+	}
+	switch length := len(f.Payload); {
+	case length <= 125:
+		buf = append(buf, mask|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, mask|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, mask|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if f.Masked {
+		buf = append(buf, f.Mask[:]...)
+		start := len(buf)
+		buf = append(buf, f.Payload...)
+		maskBytes(f.Mask, buf[start:])
+	} else {
+		buf = append(buf, f.Payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package wire_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebSocketHandshake(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat, superchat")
+
+	handshake, err := wire.ParseWebSocketHandshake(req)
+	require.NoError(t, err)
+	assert.Equal(t, "13", handshake.Version)
+	assert.Equal(t, []string{"chat", "superchat"}, handshake.Protocols)
+	// Example of RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wire.WebSocketAccept(handshake.Key))
+
+	req.Header.Del("Upgrade")
+	_, err = wire.ParseWebSocketHandshake(req)
+	assert.ErrorIs(t, err, wire.ErrNotWebSocketHandshake)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 70000} {
+		frame := &wire.Frame{
+			Fin:     true,
+			Opcode:  wire.OpBinary,
+			Payload: bytes.Repeat([]byte{'x'}, size),
+		}
+		if size%2 == 0 {
+			frame.Masked = true
+			frame.Mask = [4]byte{1, 2, 3, 4}
+		}
+		var buf bytes.Buffer
+		require.NoError(t, wire.WriteFrame(&buf, frame))
+		read, err := wire.ReadFrame(&buf, 1<<20)
+		require.NoError(t, err)
+		assert.Equal(t, frame, read, "payload of %d bytes", size)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, wire.WriteFrame(&buf, &wire.Frame{Fin: true, Opcode: wire.OpText, Payload: make([]byte, 200)}))
+	_, err := wire.ReadFrame(&buf, 100)
+	assert.ErrorIs(t, err, wire.ErrFrameTooLarge)
+}
+
+func FuzzReadFrame(f *testing.F) {
+	var buf bytes.Buffer
+	_ = wire.WriteFrame(&buf, &wire.Frame{Fin: true, Opcode: wire.OpText, Masked: true, Payload: []byte("hello")})
+	f.Add(buf.Bytes())
+	f.Add([]byte{0x89, 0x7e, 0x00, 0x80})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := wire.ReadFrame(bytes.NewReader(data), 1<<16)
+		if err != nil {
+			return
+		}
+		// A frame that was read must be written back identically, up to
+		// the length encoding
+		var out bytes.Buffer
+		if err := wire.WriteFrame(&out, frame); err != nil {
+			t.Fatal(err)
+		}
+		again, err := wire.ReadFrame(&out, 1<<16)
+		if err != nil && !errors.Is(err, wire.ErrInvalidFrame) {
+			t.Fatal(err)
+		}
+		if err == nil && !bytes.Equal(again.Payload, frame.Payload) {
+			t.Fatalf("payload changed: %q != %q", again.Payload, frame.Payload)
+		}
+	})
+}